@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ArchiveOptions configures Proxy.Archive
+type ArchiveOptions struct {
+	// Dir is the directory the bundle is written to, it is created if it does not exist
+	Dir string
+	// Concurrency is the maximum number of assets fetched in parallel, defaults to 4
+	Concurrency int
+}
+
+// ArchiveManifest describes an archived page and the assets that were (or could not be) saved with it
+// It is written as manifest.json next to the archived page
+type ArchiveManifest struct {
+	Page      string          `json:"page"`
+	File      string          `json:"file"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Assets    []ArchivedAsset `json:"assets"`
+}
+
+// ArchivedAsset is a single asset of an archived page
+// if the asset could not be fetched, Error is set and the page keeps linking to the original URL
+type ArchivedAsset struct {
+	Url   string `json:"url"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// archiveFile is the name of the archived page inside the bundle directory
+const archiveFile = "index.html"
+
+// Archive fetches the page at path of the target with the given prefix and saves it together with its
+// same-target images, stylesheets and scripts as a self-contained bundle in opts.Dir.
+// The links of the saved page are rewritten to point at the saved assets relative to the page.
+// Assets that cannot be fetched are recorded in the manifest instead of failing the whole archive.
+func (p *Proxy) Archive(ctx context.Context, prefix, pagePath string, opts ArchiveOptions) (ArchiveManifest, error) {
+	p.mu.RLock()
+	target, ok := p.targets[p.routeKey(prefix)]
+	p.mu.RUnlock()
+	if !ok {
+		return ArchiveManifest{}, fmt.Errorf("no target with prefix %s", prefix)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	pageUrl, err := url.Parse(JoinURL(target.BaseUrl, pagePath))
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error parsing page URL: %w", err)
+	}
+	page, _, err := p.fetchUpstream(ctx, target, pageUrl)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error fetching page: %w", err)
+	}
+	document, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error parsing HTML content: %w", err)
+	}
+
+	// collect all assets that live on the target
+	type assetRef struct {
+		element *goquery.Selection
+		attr    string
+		url     *url.URL
+	}
+	refs := make([]assetRef, 0)
+	assets := make(map[string]*ArchivedAsset)
+	document.Find("img[src], link[rel=stylesheet][href], script[src]").Each(func(index int, element *goquery.Selection) {
+		for _, attr := range []string{"href", "src"} {
+			val, exists := element.Attr(attr)
+			if !exists {
+				continue
+			}
+			assetUrl, ok := archiveRef(target, pageUrl, val)
+			if !ok {
+				continue
+			}
+			refs = append(refs, assetRef{element: element, attr: attr, url: assetUrl})
+			if _, ok := assets[assetUrl.String()]; !ok {
+				assets[assetUrl.String()] = &ArchivedAsset{Url: assetUrl.String(), File: archivePath(assetUrl)}
+			}
+		}
+	})
+
+	// fetch the assets with bounded concurrency
+	err = os.MkdirAll(opts.Dir, 0o755)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error creating archive directory: %w", err)
+	}
+	// the assets referenced by the stylesheets are fetched in further rounds, until no new ones turn up
+	var mu sync.Mutex
+	stylesheets := make(map[string][]byte)
+	pending := make([]*ArchivedAsset, 0, len(assets))
+	for _, asset := range assets {
+		pending = append(pending, asset)
+	}
+	for len(pending) > 0 {
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, opts.Concurrency)
+		for _, asset := range pending {
+			asset := asset
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }()
+
+				css, err := p.archiveAsset(ctx, target, opts.Dir, asset)
+				if err != nil {
+					asset.Error = err.Error()
+					asset.File = ""
+					return
+				}
+				if css != nil {
+					mu.Lock()
+					stylesheets[asset.Url] = css
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		next := make([]*ArchivedAsset, 0)
+		for _, asset := range pending {
+			css, ok := stylesheets[asset.Url]
+			if !ok {
+				continue
+			}
+			cssUrl, _ := url.Parse(asset.Url)
+			rewriteCssUrls(string(css), func(ref string) (string, bool) {
+				refUrl, ok := archiveRef(target, cssUrl, ref)
+				if ok && assets[refUrl.String()] == nil {
+					assets[refUrl.String()] = &ArchivedAsset{Url: refUrl.String(), File: archivePath(refUrl)}
+					next = append(next, assets[refUrl.String()])
+				}
+				return "", false
+			})
+		}
+		pending = next
+	}
+
+	// point the stylesheets at the saved assets relative to their own location
+	for cssUrl, css := range stylesheets {
+		asset := assets[cssUrl]
+		base, _ := url.Parse(cssUrl)
+		rewritten := rewriteCssUrls(string(css), func(ref string) (string, bool) {
+			refUrl, ok := archiveRef(target, base, ref)
+			if !ok {
+				return "", false
+			}
+			return archiveLink(asset.File, assets[refUrl.String()]), true
+		})
+		if err := writeArchiveFile(opts.Dir, asset.File, []byte(rewritten)); err != nil {
+			asset.Error = err.Error()
+			asset.File = ""
+		}
+	}
+
+	// point the page at the saved assets
+	for _, ref := range refs {
+		asset := assets[ref.url.String()]
+		if asset.Error != "" {
+			ref.element.SetAttr(ref.attr, asset.Url)
+			continue
+		}
+		ref.element.SetAttr(ref.attr, asset.File)
+	}
+	newPage, err := document.Html()
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error getting modified HTML content: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(opts.Dir, archiveFile), []byte(newPage), 0o644)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error writing page: %w", err)
+	}
+
+	manifest := ArchiveManifest{
+		Page:      pageUrl.String(),
+		File:      archiveFile,
+		CreatedAt: time.Now(),
+		Assets:    make([]ArchivedAsset, 0, len(assets)),
+	}
+	for _, ref := range refs {
+		if asset, ok := assets[ref.url.String()]; ok {
+			manifest.Assets = append(manifest.Assets, *asset)
+			delete(assets, ref.url.String())
+		}
+	}
+	// the assets of the stylesheets follow the ones of the page
+	remaining := make([]string, 0, len(assets))
+	for assetUrl := range assets {
+		remaining = append(remaining, assetUrl)
+	}
+	slices.Sort(remaining)
+	for _, assetUrl := range remaining {
+		manifest.Assets = append(manifest.Assets, *assets[assetUrl])
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error encoding manifest: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(opts.Dir, "manifest.json"), manifestData, 0o644)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// archiveAsset fetches the asset and saves it in the bundle
+// stylesheets are returned instead, they are saved once the assets they reference are saved
+func (p *Proxy) archiveAsset(ctx context.Context, target Target, dir string, asset *ArchivedAsset) ([]byte, error) {
+	assetUrl, err := url.Parse(asset.Url)
+	if err != nil {
+		return nil, err
+	}
+	body, contentType, err := p.fetchUpstream(ctx, target, assetUrl)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/css" {
+		return body, nil
+	}
+	return nil, writeArchiveFile(dir, asset.File, body)
+}
+
+func writeArchiveFile(dir, file string, data []byte) error {
+	file = filepath.Join(dir, filepath.FromSlash(file))
+	err := os.MkdirAll(filepath.Dir(file), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o644)
+}
+
+// archiveRef returns the absolute URL of a reference of the page or a stylesheet if it points at the target
+func archiveRef(target Target, base *url.URL, ref string) (*url.URL, bool) {
+	if strings.HasPrefix(ref, "data:") {
+		return nil, false
+	}
+	refUrl, err := base.Parse(ref)
+	if err != nil || !TargetMatches(target, refUrl.String()) {
+		return nil, false
+	}
+	refUrl.Fragment = ""
+	return refUrl, true
+}
+
+// archiveLink returns the link from the file of the bundle to the asset, the original URL if it was not saved
+func archiveLink(from string, asset *ArchivedAsset) string {
+	if asset.Error != "" {
+		return asset.Url
+	}
+	link, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(asset.File))
+	if err != nil {
+		return asset.Url
+	}
+	return filepath.ToSlash(link)
+}
+
+// archivePath maps an asset URL to its (slash separated) location inside the bundle
+func archivePath(u *url.URL) string {
+	file := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if file == "" || strings.HasSuffix(u.Path, "/") {
+		file = path.Join(file, "index")
+	}
+	// assets that differ by their query only get files of their own, e.g. img.php?id=1 is saved as img.<hash>.php
+	if u.RawQuery != "" {
+		sum := sha256.Sum256([]byte(u.RawQuery))
+		ext := path.Ext(file)
+		file = fmt.Sprintf("%s.%x%s", strings.TrimSuffix(file, ext), sum[:4], ext)
+	}
+	if file == archiveFile || file == "manifest.json" {
+		file = path.Join("assets", file)
+	}
+	return file
+}
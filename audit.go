@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// mutationsHeader returns the MutationReport of a response if WithMutationAudit is used
+const mutationsHeader = "X-Proxy-Mutations"
+
+// maxMutationsHeaderLength truncates the report in the mutations header, the logged report is complete
+const maxMutationsHeaderLength = 4096
+
+// WithMutationAudit records for every request what the proxy changed in the response: the rewritten URLs
+// with a sample, the hits of the RewriteRules, the added, removed and changed headers and the body sizes.
+// The MutationReport is logged with the completed request and returned as JSON in the X-Proxy-Mutations
+// response header, truncated to 4 KiB. Without the option nothing is recorded.
+func WithMutationAudit() ProxyOption {
+	return func(p *Proxy) { p.mutationAudit = true }
+}
+
+// MutationReport summarizes what the proxy changed in a response, see WithMutationAudit
+type MutationReport struct {
+	// Rewrites are the rewritten values by where they were found, e.g. "a[href]", "css" or "json"
+	Rewrites map[string]*RewriteCount `json:"rewrites,omitempty"`
+	// Rules are the number of values changed by the RewriteRules of the target by their Selector
+	Rules          map[string]int `json:"rules,omitempty"`
+	HeadersAdded   []string       `json:"headersAdded,omitempty"`
+	HeadersRemoved []string       `json:"headersRemoved,omitempty"`
+	HeadersChanged []string       `json:"headersChanged,omitempty"`
+	// Redactions is the number of values masked by the RedactionRules of the target
+	Redactions int `json:"redactions,omitempty"`
+	// UpstreamBytes and RewrittenBytes are the decompressed sizes of the body before and after rewriting
+	UpstreamBytes  int `json:"upstreamBytes,omitempty"`
+	RewrittenBytes int `json:"rewrittenBytes,omitempty"`
+	// CompressedBytes is the size of the rewritten body after compressing it again, 0 if it is not compressed
+	CompressedBytes int `json:"compressedBytes,omitempty"`
+}
+
+// RewriteCount is the number of rewritten values of a kind and the first of them
+type RewriteCount struct {
+	Count  int    `json:"count"`
+	Sample string `json:"sample"`
+}
+
+// mutationAudit collects the MutationReport of a request, all methods are no-ops on nil
+type mutationAudit struct {
+	mu     sync.Mutex
+	report MutationReport
+}
+
+// newMutationAudit returns nil if the audit is disabled, so recording costs nothing
+func (p *Proxy) newMutationAudit() *mutationAudit {
+	if !p.mutationAudit {
+		return nil
+	}
+	return &mutationAudit{}
+}
+
+// rewrites wraps rewriteUrl to record the values it changes as kind
+func (a *mutationAudit) rewrites(kind string, rewriteUrl func(string) (string, bool)) func(string) (string, bool) {
+	if a == nil {
+		return rewriteUrl
+	}
+	return func(val string) (string, bool) {
+		newVal, ok := rewriteUrl(val)
+		if ok && newVal != val {
+			a.rewrite(kind, val, newVal)
+		}
+		return newVal, ok
+	}
+}
+
+// replacements wraps replace to record the texts it changes as kind
+func (a *mutationAudit) replacements(kind string, replace func(string) string) func(string) string {
+	if a == nil {
+		return replace
+	}
+	return func(val string) string {
+		newVal := replace(val)
+		if newVal != val {
+			a.rewrite(kind, val, newVal)
+		}
+		return newVal
+	}
+}
+
+func (a *mutationAudit) rewrite(kind, val, newVal string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.report.Rewrites == nil {
+		a.report.Rewrites = make(map[string]*RewriteCount)
+	}
+	count, ok := a.report.Rewrites[kind]
+	if !ok {
+		count = &RewriteCount{Sample: truncate(val, 100) + " -> " + truncate(newVal, 100)}
+		a.report.Rewrites[kind] = count
+	}
+	count.Count++
+}
+
+func (a *mutationAudit) rule(selector string, hits int) {
+	if a == nil || hits == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.report.Rules == nil {
+		a.report.Rules = make(map[string]int)
+	}
+	a.report.Rules[selector] += hits
+}
+
+func (a *mutationAudit) redactions(count int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.report.Redactions += count
+}
+
+func (a *mutationAudit) bodySizes(upstream, rewritten, compressed int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.report.UpstreamBytes, a.report.RewrittenBytes, a.report.CompressedBytes = upstream, rewritten, compressed
+}
+
+// finish records the header changes between the upstream and the client response and sets the mutations header
+// it has to be called right before the header is written
+func (a *mutationAudit) finish(upstream, header http.Header) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, values := range header {
+		upstreamValues, ok := upstream[name]
+		if !ok {
+			a.report.HeadersAdded = append(a.report.HeadersAdded, name)
+		} else if !slices.Equal(values, upstreamValues) {
+			a.report.HeadersChanged = append(a.report.HeadersChanged, name)
+		}
+	}
+	for name := range upstream {
+		if _, ok := header[name]; !ok {
+			a.report.HeadersRemoved = append(a.report.HeadersRemoved, name)
+		}
+	}
+	sort.Strings(a.report.HeadersAdded)
+	sort.Strings(a.report.HeadersChanged)
+	sort.Strings(a.report.HeadersRemoved)
+
+	encoded, err := json.Marshal(a.report)
+	if err != nil {
+		return
+	}
+	header.Set(mutationsHeader, truncate(string(encoded), maxMutationsHeaderLength))
+}
+
+// snapshot returns a copy of the collected report
+func (a *mutationAudit) snapshot() MutationReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.report
+}
+
+// truncate shortens s to at most limit bytes without splitting a rune, marking the cut with "..."
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	cut := limit - 3
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
+
+// countingReader counts the bytes read from the body of a response
+type countingReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += n
+	return n, err
+}
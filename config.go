@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProxyConfig is the file representation of the targets of a proxy, see NewProxyFromFile
+type ProxyConfig struct {
+	Targets []TargetConfig `json:"targets" yaml:"targets"`
+}
+
+// TargetConfig mirrors Target without its function fields
+type TargetConfig struct {
+	BaseUrl               string              `json:"baseUrl" yaml:"baseUrl"`
+	Prefix                string              `json:"prefix" yaml:"prefix"`
+	Host                  string              `json:"host" yaml:"host"`
+	RewritePrefix         string              `json:"rewritePrefix" yaml:"rewritePrefix"`
+	Default               bool                `json:"default" yaml:"default"`
+	AddQueryParams        map[string]string   `json:"addQueryParams" yaml:"addQueryParams"`
+	StripQueryParams      []string            `json:"stripQueryParams" yaml:"stripQueryParams"`
+	RemoveRequestHeaders  []string            `json:"removeRequestHeaders" yaml:"removeRequestHeaders"`
+	AddRequestHeaders     map[string]string   `json:"addRequestHeaders" yaml:"addRequestHeaders"`
+	RewriteInlineScripts  bool                `json:"rewriteInlineScripts" yaml:"rewriteInlineScripts"`
+	StripSetCookie        bool                `json:"stripSetCookie" yaml:"stripSetCookie"`
+	StripSetCookiePaths   []string            `json:"stripSetCookiePaths" yaml:"stripSetCookiePaths"`
+	InlineAssets          *InlineAssets       `json:"inlineAssets" yaml:"inlineAssets"`
+	LazyLoadAttributes    []string            `json:"lazyLoadAttributes" yaml:"lazyLoadAttributes"`
+	LoginCompat           *LoginCompat        `json:"loginCompat" yaml:"loginCompat"`
+	RewriteCookies        bool                `json:"rewriteCookies" yaml:"rewriteCookies"`
+	RewriteExclusions     *RewriteExclusions  `json:"rewriteExclusions" yaml:"rewriteExclusions"`
+	RewriteRedirects      bool                `json:"rewriteRedirects" yaml:"rewriteRedirects"`
+	FollowRedirects       *RedirectPolicy     `json:"followRedirects" yaml:"followRedirects"`
+	RewriteJSON           bool                `json:"rewriteJson" yaml:"rewriteJson"`
+	DisableRewrite        bool                `json:"disableRewrite" yaml:"disableRewrite"`
+	RemoveResponseHeaders []string            `json:"removeResponseHeaders" yaml:"removeResponseHeaders"`
+	AddResponseHeaders    map[string]string   `json:"addResponseHeaders" yaml:"addResponseHeaders"`
+	HeaderProfile         string              `json:"headerProfile" yaml:"headerProfile"`
+	OpenAPI               *OpenAPI            `json:"openApi" yaml:"openApi"`
+	Redactions            []RedactionRule     `json:"redactions" yaml:"redactions"`
+	DialPolicy            DialPolicy          `json:"dialPolicy" yaml:"dialPolicy"`
+	Timeout               time.Duration       `json:"timeout" yaml:"timeout"`
+	DisableWriteTimeout   bool                `json:"disableWriteTimeout" yaml:"disableWriteTimeout"`
+	FanOut                []FanOutDestination `json:"fanOut" yaml:"fanOut"`
+	FanOutResponse        FanOutResponse      `json:"fanOutResponse" yaml:"fanOutResponse"`
+}
+
+func (c TargetConfig) target() Target {
+	return Target{
+		BaseUrl:               c.BaseUrl,
+		Prefix:                c.Prefix,
+		Host:                  c.Host,
+		RewritePrefix:         c.RewritePrefix,
+		Default:               c.Default,
+		AddQueryParams:        c.AddQueryParams,
+		StripQueryParams:      c.StripQueryParams,
+		RemoveRequestHeaders:  c.RemoveRequestHeaders,
+		AddRequestHeaders:     c.AddRequestHeaders,
+		RewriteInlineScripts:  c.RewriteInlineScripts,
+		StripSetCookie:        c.StripSetCookie,
+		StripSetCookiePaths:   c.StripSetCookiePaths,
+		InlineAssets:          c.InlineAssets,
+		LazyLoadAttributes:    c.LazyLoadAttributes,
+		LoginCompat:           c.LoginCompat,
+		RewriteCookies:        c.RewriteCookies,
+		RewriteExclusions:     c.RewriteExclusions,
+		RewriteRedirects:      c.RewriteRedirects,
+		FollowRedirects:       c.FollowRedirects,
+		RewriteJSON:           c.RewriteJSON,
+		DisableRewrite:        c.DisableRewrite,
+		RemoveResponseHeaders: c.RemoveResponseHeaders,
+		AddResponseHeaders:    c.AddResponseHeaders,
+		HeaderProfile:         c.HeaderProfile,
+		OpenAPI:               c.OpenAPI,
+		Redactions:            c.Redactions,
+		DialPolicy:            c.DialPolicy,
+		Timeout:               c.Timeout,
+		DisableWriteTimeout:   c.DisableWriteTimeout,
+		FanOut:                c.FanOut,
+		FanOutResponse:        c.FanOutResponse,
+	}
+}
+
+// WithConfigWatcher makes a proxy created by NewProxyFromFile check its config file in the given interval
+// and reload it with ReloadConfig whenever its modification time changes
+func WithConfigWatcher(interval time.Duration) ProxyOption {
+	return func(p *Proxy) { p.configWatchInterval = interval }
+}
+
+// NewProxyFromFile creates a proxy with the targets of the given YAML or JSON config file
+// Files ending with .json are parsed as JSON, everything else as YAML.
+func NewProxyFromFile(path string, opts ...ProxyOption) (*Proxy, error) {
+	p, err := NewProxy(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.ReloadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.configWatchInterval > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopConfigWatcher = cancel
+		go p.watchConfig(ctx, path, info.ModTime())
+	}
+
+	return p, nil
+}
+
+// ReloadConfig replaces all targets of the proxy with the targets of the given config file
+// The targets are swapped atomically, a running server keeps its listener.
+// If the config is invalid, the current targets stay in place.
+func (p *Proxy) ReloadConfig(path string) error {
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[string]Target, len(config.Targets))
+	errs := make([]error, 0)
+	for _, targetConfig := range config.Targets {
+		target, err := p.prepareTarget(targetConfig.target())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := validateRoute(targets, target); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		targets[target.route()] = target
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = targets
+	if p.governors != nil {
+		governors := make(map[string]*rateLimitGovernor, len(targets))
+		for prefix := range targets {
+			governor, ok := p.governors[prefix]
+			if !ok {
+				governor = newRateLimitGovernor(p.governorMaxWait)
+			}
+			governors[prefix] = governor
+		}
+		p.governors = governors
+	}
+	p.mux = p.buildMux()
+	return nil
+}
+
+func (p *Proxy) watchConfig(ctx context.Context, path string, lastModified time.Time) {
+	ticker := time.NewTicker(p.configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			p.logger.Warn("Error checking config file", "path", path, "err", err)
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		err = p.ReloadConfig(path)
+		if err != nil {
+			p.logger.Warn("Error reloading config file", "path", path, "err", err)
+			continue
+		}
+		p.logger.Info("Reloaded config file", "path", path)
+	}
+}
+
+func loadConfig(path string) (ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ProxyConfig{}, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var config ProxyConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return ProxyConfig{}, fmt.Errorf("error parsing config file: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// relaxCookies drops the Secure flag and downgrades SameSite=None to SameSite=Lax of all Set-Cookie headers,
+// because browsers reject such cookies if they are served over plain HTTP
+func relaxCookies(header http.Header) {
+	rewriteCookieAttributes(header, func(attr, name, value string) (string, bool) {
+		switch {
+		case strings.EqualFold(name, "Secure"):
+			return "", false
+		case strings.EqualFold(name, "SameSite") && strings.EqualFold(value, "None"):
+			return "SameSite=Lax", true
+		}
+		return attr, true
+	})
+}
+
+// rewriteCookies rewrites the Domain and Path attributes of all Set-Cookie headers to the proxy.
+// The Domain is replaced with the proxy host and the prefix is prepended to the Path,
+// so the cookie is sent with the requests to the target through the proxy.
+// Browsers do not accept IP addresses as Domain, so for them the cookie becomes a host-only cookie.
+func rewriteCookies(header http.Header, publicBase, prefix string) {
+	base, err := url.Parse(publicBase)
+	if err != nil {
+		return
+	}
+	if base.Path != "" {
+		prefix = JoinURL(base.Path, prefix)
+	}
+	host := base.Hostname()
+	rewriteCookieAttributes(header, func(attr, name, value string) (string, bool) {
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			if net.ParseIP(host) != nil {
+				return "", false
+			}
+			return "Domain=" + host, true
+		case strings.EqualFold(name, "Path"):
+			return "Path=" + JoinURL(prefix, value), true
+		}
+		return attr, true
+	})
+}
+
+// rewriteCookieAttributes calls rewrite for every attribute of all Set-Cookie headers and replaces the attribute
+// with the result, or drops it if rewrite returns false. attr is the trimmed attribute, name and value its trimmed parts.
+func rewriteCookieAttributes(header http.Header, rewrite func(attr, name, value string) (string, bool)) {
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts := strings.Split(cookie, ";")
+		newParts := make([]string, 0, len(parts))
+		newParts = append(newParts, strings.TrimSpace(parts[0]))
+		for _, part := range parts[1:] {
+			attr := strings.TrimSpace(part)
+			name, value, _ := strings.Cut(attr, "=")
+			if attr, ok := rewrite(attr, strings.TrimSpace(name), strings.TrimSpace(value)); ok {
+				newParts = append(newParts, attr)
+			}
+		}
+		rewritten = append(rewritten, strings.Join(newParts, "; "))
+	}
+	header["Set-Cookie"] = rewritten
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// DialPolicy decides which address families of an upstream host are dialed and in which order
+type DialPolicy string
+
+const (
+	// Auto dials like net/http does, IPv6 and IPv4 addresses race each other
+	Auto DialPolicy = ""
+	// IPv4Only dials the IPv4 addresses of the host only
+	IPv4Only DialPolicy = "ipv4-only"
+	// IPv6Only dials the IPv6 addresses of the host only
+	IPv6Only DialPolicy = "ipv6-only"
+	// PreferIPv4 dials the IPv4 addresses of the host before its IPv6 addresses, e.g. for hosts with broken AAAA records
+	PreferIPv4 DialPolicy = "prefer-ipv4"
+)
+
+// WithDialPolicy sets the DialPolicy of the connections to the upstreams, Target.DialPolicy overrides it per target
+// It requires the transport to be an *http.Transport, whose dialer is used to dial the resolved addresses.
+func WithDialPolicy(policy DialPolicy) ProxyOption {
+	return func(p *Proxy) { p.dialPolicy = policy }
+}
+
+// PolicyDialer resolves a host and dials its addresses in the families and order of the policy one after another
+// A host without addresses of the allowed families fails with a *net.DNSError, so it is classified as DNSFailure.
+// IP addresses are dialed as they are, the policy applies to resolved hosts.
+type PolicyDialer struct {
+	Policy DialPolicy
+	// LookupNetIP resolves the host, defaults to net.DefaultResolver.LookupNetIP
+	LookupNetIP func(ctx context.Context, network, host string) ([]netip.Addr, error)
+	// DialContext dials a resolved address, defaults to a net.Dialer
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial dials the address like net.Dialer.DialContext, following the policy
+func (d *PolicyDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dial := d.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		dial = dialer.DialContext
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dial(ctx, network, addr)
+	}
+
+	lookup := d.LookupNetIP
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupNetIP
+	}
+	addrs, err := lookup(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = d.Policy.order(addrs)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("no address allowed by dial policy %s", d.Policy), Name: host, IsNotFound: true}
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// order returns the addresses the policy allows in the order they are dialed
+func (p DialPolicy) order(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	switch p {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv4:
+		return append(v4, v6...)
+	}
+	return addrs
+}
+
+func (p DialPolicy) valid() bool {
+	switch p {
+	case Auto, IPv4Only, IPv6Only, PreferIPv4:
+		return true
+	}
+	return false
+}
+
+// withDialPolicy returns a copy of the transport dialing with the policy, Auto returns the transport as it is
+func withDialPolicy(transport http.RoundTripper, policy DialPolicy) (http.RoundTripper, error) {
+	if policy == Auto {
+		return transport, nil
+	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("dial policies require an *http.Transport, got %T", transport)
+	}
+	clone := httpTransport.Clone()
+	dialer := &PolicyDialer{Policy: policy, DialContext: clone.DialContext}
+	clone.DialContext = dialer.Dial
+	return clone, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WithDrainTimeout sets how long Shutdown waits for requests that are still being forwarded
+// after the server stopped accepting connections, independent of the context passed to Shutdown.
+// The upstream requests still running afterwards are cancelled, their clients get a 502 or a closed connection.
+func WithDrainTimeout(timeout time.Duration) ProxyOption {
+	return func(p *Proxy) { p.drainTimeout = timeout }
+}
+
+// WithDrainHook adds a hook that Shutdown calls before it stops accepting connections,
+// e.g. to make PreRequest hooks stop starting new work
+func WithDrainHook(hook func()) ProxyOption {
+	return func(p *Proxy) { p.drainHooks = append(p.drainHooks, hook) }
+}
+
+// InFlight returns the number of requests that are currently forwarded
+func (p *Proxy) InFlight() int {
+	return int(p.inFlightCount.Load())
+}
+
+// trackRequest counts a forwarded request until the returned function is called
+func (p *Proxy) trackRequest() func() {
+	p.idleMu.Lock()
+	if p.inFlightCount.Add(1) == 1 {
+		p.idle = make(chan struct{})
+	}
+	p.idleMu.Unlock()
+	return func() {
+		p.idleMu.Lock()
+		defer p.idleMu.Unlock()
+		if p.inFlightCount.Add(-1) == 0 {
+			close(p.idle)
+		}
+	}
+}
+
+// abortable returns a copy of the upstream request that is cancelled if Shutdown gives up draining
+// the returned function releases the request, call it once the response is copied
+func (p *Proxy) abortable(req *http.Request) (*http.Request, context.CancelFunc) {
+	p.mu.RLock()
+	abort := p.abort
+	p.mu.RUnlock()
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(abort, cancel)
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
+}
+
+// drain waits until all in flight requests are finished or ctx is done, then it cancels the remaining ones
+func (p *Proxy) drain(ctx context.Context) error {
+	// requests may still start meanwhile, e.g. the deliveries of fan-out targets, so instead of a WaitGroup
+	// the channel closed once no request is left is awaited
+	p.idleMu.Lock()
+	idle := p.idle
+	if p.inFlightCount.Load() == 0 {
+		idle = nil
+	}
+	p.idleMu.Unlock()
+	if idle == nil {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		p.mu.RLock()
+		abortRequests := p.abortRequests
+		p.mu.RUnlock()
+		abortRequests()
+		return fmt.Errorf("error draining %d in flight requests: %w", p.InFlight(), ctx.Err())
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity is how serious a Finding is
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Finding is a single result of a dry run
+type Finding struct {
+	// Target is the prefix of the target the finding is about, empty for the proxy itself
+	// For targets with a Host it is the Host followed by the prefix.
+	Target   string   `json:"target,omitempty"`
+	Severity Severity `json:"severity"`
+	// Check is the name of the check, one of "config", "listen", "dns", "connect", "tls" and "http"
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// Report lists the findings of a dry run
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// HasErrors reports whether one of the findings is an error
+func (r Report) HasErrors() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ForTarget returns the findings of the target with the given prefix
+func (r Report) ForTarget(prefix string) []Finding {
+	findings := make([]Finding, 0)
+	for _, finding := range r.Findings {
+		if finding.Target == prefix {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+func (r *Report) add(target string, severity Severity, check, message string) {
+	r.Findings = append(r.Findings, Finding{Target: target, Severity: severity, Check: check, Message: message})
+}
+
+// ErrDryRunFailed is returned by DryRun if the report contains errors
+var ErrDryRunFailed = errors.New("dry run found errors")
+
+// defaultProbeTimeout is how long a dry run waits for each upstream
+const defaultProbeTimeout = 5 * time.Second
+
+type dryRunOptions struct {
+	probe        bool
+	probeTimeout time.Duration
+}
+
+type DryRunOption func(*dryRunOptions)
+
+// WithoutProbes only checks the configuration and the listen address, the upstreams are not contacted
+func WithoutProbes() DryRunOption {
+	return func(o *dryRunOptions) { o.probe = false }
+}
+
+// WithProbeTimeout sets how long the dry run waits for each upstream, defaults to 5 seconds
+func WithProbeTimeout(timeout time.Duration) DryRunOption {
+	return func(o *dryRunOptions) { o.probeTimeout = timeout }
+}
+
+// DryRun checks the proxy without serving: the targets are validated again,
+// the listen address has to be bindable and the upstream of every target is probed
+// by resolving its host and sending a HEAD request through the configured transport.
+// The returned error is ErrDryRunFailed if the report contains errors.
+func (p *Proxy) DryRun(ctx context.Context, opts ...DryRunOption) (Report, error) {
+	options := dryRunOptions{probe: true, probeTimeout: defaultProbeTimeout}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var report Report
+	p.dryRun(ctx, &report, options)
+	if report.HasErrors() {
+		return report, ErrDryRunFailed
+	}
+	return report, nil
+}
+
+// DryRunFile checks a configuration file like DryRun, without failing at the first invalid target
+// Duplicate prefixes and invalid targets are reported, the remaining targets are probed.
+func DryRunFile(ctx context.Context, path string, proxyOpts []ProxyOption, opts ...DryRunOption) (Report, error) {
+	options := dryRunOptions{probe: true, probeTimeout: defaultProbeTimeout}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var report Report
+	p, err := NewProxy(proxyOpts...)
+	if err != nil {
+		report.add("", SeverityError, "config", err.Error())
+		return report, ErrDryRunFailed
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		report.add("", SeverityError, "config", err.Error())
+		return report, ErrDryRunFailed
+	}
+
+	for _, targetConfig := range config.Targets {
+		target, err := p.prepareTarget(targetConfig.target())
+		if err != nil {
+			report.add(targetConfig.Host+targetConfig.Prefix, SeverityError, "config", err.Error())
+			continue
+		}
+		if err := validateRoute(p.targets, target); err != nil {
+			report.add(target.route(), SeverityError, "config", err.Error())
+			continue
+		}
+		p.targets[target.route()] = target
+	}
+
+	p.dryRun(ctx, &report, options)
+	if report.HasErrors() {
+		return report, ErrDryRunFailed
+	}
+	return report, nil
+}
+
+func (p *Proxy) dryRun(ctx context.Context, report *Report, options dryRunOptions) {
+	addr := p.listenAddr()
+	listener, err := net.Listen("tcp", addr.Host)
+	if err != nil {
+		report.add("", SeverityError, "listen", fmt.Sprintf("cannot listen on %s: %s", addr.Host, err))
+	} else {
+		listener.Close()
+	}
+
+	p.mu.RLock()
+	targets := make([]Target, 0, len(p.targets))
+	for _, target := range p.targets {
+		targets = append(targets, target)
+	}
+	p.mu.RUnlock()
+
+	for _, target := range targets {
+		if err := validateTarget(target); err != nil {
+			report.add(target.route(), SeverityError, "config", err.Error())
+		}
+	}
+	if !options.probe {
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		target := target
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, options.probeTimeout)
+			defer cancel()
+			findings := p.probeUpstream(probeCtx, target)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Findings = append(report.Findings, findings...)
+		}()
+	}
+	wg.Wait()
+}
+
+// probeUpstream resolves the host of the target and sends a HEAD request to its BaseUrl
+func (p *Proxy) probeUpstream(ctx context.Context, target Target) []Finding {
+	finding := func(severity Severity, check, message string) []Finding {
+		return []Finding{{Target: target.route(), Severity: severity, Check: check, Message: message}}
+	}
+	if len(target.FanOut) > 0 {
+		var findings []Finding
+		for _, destination := range target.FanOut {
+			findings = append(findings, p.probeUpstream(ctx, target.destinationTarget(destination))...)
+		}
+		return findings
+	}
+
+	targetUrl, err := url.Parse(target.BaseUrl)
+	if err != nil || targetUrl.Host == "" {
+		return finding(SeverityError, "config", "BaseUrl has no host")
+	}
+	if net.ParseIP(targetUrl.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, targetUrl.Hostname()); err != nil {
+			return finding(SeverityError, "dns", fmt.Sprintf("cannot resolve %s: %s", targetUrl.Hostname(), err))
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.BaseUrl, nil)
+	if err != nil {
+		return finding(SeverityError, "config", err.Error())
+	}
+	resp, err := p.upstreamTransport(target).RoundTrip(req)
+	if err != nil {
+		return finding(SeverityError, probeErrorCheck(err), err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return finding(SeverityWarning, "http", fmt.Sprintf("upstream answered with %s", resp.Status))
+	}
+	return finding(SeverityInfo, "http", fmt.Sprintf("upstream answered with %s", resp.Status))
+}
+
+// probeErrorCheck classifies the error of a probe request as "tls", "connect" or "http" failure
+func probeErrorCheck(err error) string {
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) {
+		return "tls"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connect"
+	}
+	if strings.Contains(err.Error(), "tls:") {
+		return "tls"
+	}
+	return "http"
+}
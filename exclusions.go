@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// regexpPatternPrefix marks a RewriteExclusions pattern as regular expression instead of a glob
+const regexpPatternPrefix = "regexp:"
+
+// RewriteExclusions keeps URLs out of the rewriting that must reach the origin directly,
+// e.g. download links to a CDN or OAuth authorize URLs.
+// They apply to HTML attributes, stylesheets, inline styles and the Location header alike.
+type RewriteExclusions struct {
+	// Patterns are matched against the absolute URL, resolved against the URL of the page it is found on.
+	// A pattern is a glob whose * matches any characters, including slashes, e.g. "https://cdn.example.com/*",
+	// or a regular expression if prefixed with "regexp:", e.g. "regexp:^https://[^/]+/oauth/authorize".
+	Patterns []string `json:"patterns" yaml:"patterns"`
+	// Selectors are goquery selectors of HTML elements that are not rewritten at all
+	Selectors []string `json:"selectors" yaml:"selectors"`
+	// NoReferrer adds rel="noreferrer" to excluded links, so the origin does not see the proxy URLs
+	NoReferrer bool `json:"noReferrer" yaml:"noReferrer"`
+}
+
+// compilePattern translates a pattern of RewriteExclusions to a regular expression
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pattern, regexpPatternPrefix); ok {
+		return regexp.Compile(expr)
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.Compile("^" + expr + "$")
+}
+
+// compileExclusions compiles the patterns of the exclusions, nil if there are none
+func compileExclusions(exclusions *RewriteExclusions) ([]*regexp.Regexp, error) {
+	if exclusions == nil || len(exclusions.Patterns) == 0 {
+		return nil, nil
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(exclusions.Patterns))
+	for _, pattern := range exclusions.Patterns {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, compiled)
+	}
+	return patterns, nil
+}
+
+// isExcluded reports whether the URL, found on the page at base, matches one of the exclusion patterns
+func (t Target) isExcluded(base *url.URL, val string) bool {
+	if len(t.exclusionPatterns) == 0 {
+		return false
+	}
+
+	ref, err := url.Parse(strings.TrimSpace(val))
+	if err != nil {
+		return false
+	}
+	absolute := base.ResolveReference(ref).String()
+	for _, pattern := range t.exclusionPatterns {
+		if pattern.MatchString(absolute) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter removes the elements matching one of the exclusion selectors from the selection
+func (e *RewriteExclusions) filter(selection *goquery.Selection) *goquery.Selection {
+	if e == nil {
+		return selection
+	}
+	for _, selector := range e.Selectors {
+		selection = selection.Not(selector)
+	}
+	return selection
+}
+
+// addNoReferrer adds rel="noreferrer" to the links that are excluded from rewriting
+// it has to run before the links are rewritten, while their URLs still point at the origin
+func (t Target) addNoReferrer(document *goquery.Document, base *url.URL) {
+	if t.RewriteExclusions == nil || !t.RewriteExclusions.NoReferrer {
+		return
+	}
+
+	links := document.Find("a[href], area[href]")
+	included := t.RewriteExclusions.filter(links)
+	links.Each(func(index int, element *goquery.Selection) {
+		href, _ := element.Attr("href")
+		if included.IsSelection(element) && !t.isExcluded(base, href) {
+			return
+		}
+
+		rel, _ := element.Attr("rel")
+		for _, token := range strings.Fields(rel) {
+			if strings.EqualFold(token, "noreferrer") {
+				return
+			}
+		}
+		element.SetAttr("rel", strings.TrimSpace(rel+" noreferrer"))
+	})
+}
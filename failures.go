@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass tells why a request could not be forwarded to the upstream, each class needs a different fix
+type ErrorClass string
+
+const (
+	// DNSFailure means the host of the upstream could not be resolved
+	DNSFailure ErrorClass = "dns_failure"
+	// ConnectionRefused means nothing listens on the address of the upstream
+	ConnectionRefused ErrorClass = "connection_refused"
+	// TLSVerification means the certificate of the upstream is not trusted or does not match its host
+	TLSVerification ErrorClass = "tls_verification"
+	// ProxyAuth means the SOCKS5 or HTTP proxy in front of the upstream rejected the credentials
+	ProxyAuth ErrorClass = "proxy_auth"
+	// Timeout means the upstream did not answer in time
+	Timeout ErrorClass = "timeout"
+	// Other is any other error
+	Other ErrorClass = "other"
+)
+
+// UpstreamError is the error of a request that could not be forwarded to the upstream
+// Custom transports can return it to set the class of their errors explicitly
+type UpstreamError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError returns the ErrorClass of an error of forwarding a request, it unwraps url.Error, net.OpError and
+// the errors of crypto/x509 and crypto/tls. Errors of custom transports are classified as long as they wrap these,
+// the SOCKS5 and proxy errors which are only strings are matched by their messages.
+func ClassifyError(err error) ErrorClass {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.Class
+	}
+
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var verificationErr *tls.CertificateVerificationError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return Timeout
+		}
+		return DNSFailure
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		errors.As(err, &verificationErr):
+		return TLSVerification
+	case isProxyAuthError(err):
+		return ProxyAuth
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(err.Error(), "connection refused"):
+		return ConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return Timeout
+	}
+	return Other
+}
+
+// isProxyAuthError reports if the error is a rejected authentication of golang.org/x/net/proxy or of net/http's proxy
+func isProxyAuthError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "username/password authentication failed") ||
+		strings.Contains(msg, "no acceptable authentication methods") ||
+		strings.Contains(msg, "Proxy Authentication Required")
+}
+
+// upstreamErrorMessages are the messages of the responses to requests that could not be forwarded
+var upstreamErrorMessages = map[ErrorClass]string{
+	DNSFailure:        "Error forwarding request: upstream host not found",
+	ConnectionRefused: "Error forwarding request: upstream refused the connection",
+	TLSVerification:   "Error forwarding request: upstream certificate not trusted",
+	ProxyAuth:         "Error forwarding request: proxy authentication failed",
+	Timeout:           "Error forwarding request: upstream timed out",
+	Other:             "Error forwarding request",
+}
+
+type upstreamErrorKey struct{}
+
+// OnUpstreamError returns a copy of the request which calls fn with the ErrorClass if it cannot be forwarded,
+// to be used in a PreRequest hook. The PostRequest hooks of a failed request only see a nil response.
+func OnUpstreamError(req *http.Request, fn func(ErrorClass)) *http.Request {
+	callbacks, _ := req.Context().Value(upstreamErrorKey{}).([]func(ErrorClass))
+	callbacks = append(slices.Clip(callbacks), fn)
+	return req.WithContext(context.WithValue(req.Context(), upstreamErrorKey{}, callbacks))
+}
+
+// reportUpstreamError calls the callbacks of OnUpstreamError of the request
+func reportUpstreamError(req *http.Request, class ErrorClass) {
+	callbacks, _ := req.Context().Value(upstreamErrorKey{}).([]func(ErrorClass))
+	for _, fn := range callbacks {
+		fn(class)
+	}
+}
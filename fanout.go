@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DeliveryPolicy decides whether the response of a fan-out target depends on a FanOutDestination
+type DeliveryPolicy string
+
+const (
+	// BestEffort delivers in the background, failures are logged and counted only. It is the default.
+	BestEffort DeliveryPolicy = "best-effort"
+	// MustSucceed fails the request with 502 unless the destination answers with a 2xx status
+	MustSucceed DeliveryPolicy = "must-succeed"
+)
+
+// FanOutResponse decides how a fan-out target answers the client
+type FanOutResponse string
+
+const (
+	// RespondPrimary answers with the response of the primary destination once it and the MustSucceed
+	// destinations answered. It is the default.
+	RespondPrimary FanOutResponse = "primary"
+	// RespondAccepted answers 202 Accepted once the MustSucceed destinations succeeded,
+	// the BestEffort deliveries continue in the background
+	RespondAccepted FanOutResponse = "accepted"
+)
+
+const (
+	defaultFanOutTimeout = 30 * time.Second
+	// fanOutRetryBackoff is the wait before the first retry of a delivery, it grows linearly with each attempt
+	fanOutRetryBackoff = 100 * time.Millisecond
+)
+
+// FanOutDestination is one of the upstreams a fan-out target forwards every request to, see Target.FanOut
+type FanOutDestination struct {
+	// Name identifies the destination in logs, metrics and stats, defaults to BaseUrl
+	Name string `json:"name" yaml:"name"`
+	// BaseUrl is the absolute URL of the destination, the path is built like the one of Target.BaseUrl
+	BaseUrl string `json:"baseUrl" yaml:"baseUrl"`
+	// RemoveRequestHeaders and AddRequestHeaders apply after the ones of the target
+	RemoveRequestHeaders []string          `json:"removeRequestHeaders" yaml:"removeRequestHeaders"`
+	AddRequestHeaders    map[string]string `json:"addRequestHeaders" yaml:"addRequestHeaders"`
+	// Policy decides whether the response waits for the destination, defaults to BestEffort
+	Policy DeliveryPolicy `json:"policy" yaml:"policy"`
+	// Primary marks the destination whose response is passed on with RespondPrimary, defaults to the first one
+	Primary bool `json:"primary" yaml:"primary"`
+	// Timeout limits each attempt including reading the response, defaults to 30 seconds
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// Retries is the number of additional attempts after errors and 5xx responses
+	Retries int `json:"retries" yaml:"retries"`
+}
+
+func (d FanOutDestination) name() string {
+	if d.Name == "" {
+		return d.BaseUrl
+	}
+	return d.Name
+}
+
+func (d FanOutDestination) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return defaultFanOutTimeout
+	}
+	return d.Timeout
+}
+
+func (d FanOutDestination) mustSucceed() bool {
+	return d.Policy == MustSucceed
+}
+
+// FanOutDelivery is the outcome of delivering a request to a FanOutDestination, see Target.OnDelivery
+type FanOutDelivery struct {
+	RequestID   string
+	Target      string
+	Destination string
+	// Status is the status of the last response, 0 if there was none
+	Status   int
+	Attempts int
+	Duration time.Duration
+	// Err is the error of the last attempt, nil if it got a response
+	Err error
+}
+
+// Succeeded reports whether the destination answered with a 2xx status
+func (d FanOutDelivery) Succeeded() bool {
+	return d.Err == nil && d.Status >= 200 && d.Status < 300
+}
+
+// primaryDestination returns the index of the destination whose response is passed on
+func (t Target) primaryDestination() int {
+	for i, destination := range t.FanOut {
+		if destination.Primary {
+			return i
+		}
+	}
+	return 0
+}
+
+// awaits reports whether the response of the target waits for the destination with the given index
+func (t Target) awaits(i int) bool {
+	return t.FanOut[i].mustSucceed() || (t.FanOutResponse != RespondAccepted && i == t.primaryDestination())
+}
+
+// destinationTarget returns the target the requests to the destination are built with
+func (t Target) destinationTarget(destination FanOutDestination) Target {
+	t.BaseUrl = destination.BaseUrl
+	t.FanOut = nil
+	t.RemoveRequestHeaders = append(slices.Clip(t.RemoveRequestHeaders), destination.RemoveRequestHeaders...)
+	t.AddRequestHeaders = maps.Clone(t.AddRequestHeaders)
+	if t.AddRequestHeaders == nil {
+		t.AddRequestHeaders = make(map[string]string, len(destination.AddRequestHeaders))
+	}
+	// the headers removed by the destination are not added back by the target
+	maps.DeleteFunc(t.AddRequestHeaders, func(name, _ string) bool {
+		return slices.ContainsFunc(destination.RemoveRequestHeaders, func(removed string) bool {
+			return http.CanonicalHeaderKey(removed) == http.CanonicalHeaderKey(name)
+		})
+	})
+	maps.Copy(t.AddRequestHeaders, destination.AddRequestHeaders)
+	return t
+}
+
+// fanOutResult is a delivery and the response of its last attempt, whose body is open only for the primary destination
+type fanOutResult struct {
+	resp     *http.Response
+	delivery FanOutDelivery
+}
+
+// fanOut forwards the request to all destinations of the target concurrently and answers as Target.FanOutResponse says
+func (p *Proxy) fanOut(w http.ResponseWriter, r *http.Request, target *Target, recorder *statusRecorder, logger *slog.Logger) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("Error reading request body", "err", err)
+		http.Error(w, "Error constructing new request", http.StatusBadGateway)
+		return
+	}
+	// the deliveries in the background outlive the request
+	r = r.Clone(context.WithoutCancel(r.Context()))
+
+	primary := target.primaryDestination()
+	respondPrimary := target.FanOutResponse != RespondAccepted
+	waiting := make(map[int]chan fanOutResult)
+	for i, destination := range target.FanOut {
+		destination := destination
+		keepBody := respondPrimary && i == primary
+		if !target.awaits(i) {
+			// the deliveries in the background are drained by Shutdown like any other request
+			done := p.trackRequest()
+			go func() {
+				defer done()
+				result := p.deliver(r, body, target, destination, false)
+				p.reportDelivery(target, result.delivery, logger)
+			}()
+			continue
+		}
+		results := make(chan fanOutResult, 1)
+		waiting[i] = results
+		go func() { results <- p.deliver(r, body, target, destination, keepBody) }()
+	}
+
+	var failed []string
+	var primaryResult fanOutResult
+	for i, results := range waiting {
+		result := <-results
+		p.reportDelivery(target, result.delivery, logger)
+		if respondPrimary && i == primary {
+			primaryResult = result
+			continue
+		}
+		if !result.delivery.Succeeded() {
+			failed = append(failed, result.delivery.Destination)
+		}
+	}
+	if primaryResult.resp != nil {
+		defer primaryResult.resp.Body.Close()
+	}
+
+	switch {
+	case len(failed) > 0:
+		slices.Sort(failed)
+		logger.Warn("Fan-out deliveries failed", "destinations", failed)
+		http.Error(w, fmt.Sprintf("Error forwarding request: delivery to %s failed", strings.Join(failed, ", ")), http.StatusBadGateway)
+	case !respondPrimary:
+		w.WriteHeader(http.StatusAccepted)
+	case primaryResult.delivery.Err != nil:
+		recorder.errorClass = ClassifyError(primaryResult.delivery.Err)
+		http.Error(w, upstreamErrorMessages[recorder.errorClass], http.StatusBadGateway)
+	default:
+		destinationTarget := target.destinationTarget(target.FanOut[primary])
+		err = p.copyResponse(r, primaryResult.resp, w, destinationTarget, nil)
+		if err != nil {
+			logger.Error("Error copying response", "err", err)
+			http.Error(w, "Error copying response", http.StatusBadGateway)
+		}
+	}
+}
+
+// deliver sends the request to the destination, retrying after errors and 5xx responses
+// the body of the returned response is closed unless keepBody is set
+func (p *Proxy) deliver(r *http.Request, body []byte, target *Target, destination FanOutDestination, keepBody bool) fanOutResult {
+	info, _ := RequestInfoFromContext(r.Context())
+	delivery := FanOutDelivery{RequestID: info.RequestID, Target: target.Prefix, Destination: destination.name()}
+	destinationTarget := target.destinationTarget(destination)
+	client := &http.Client{Transport: p.upstreamTransport(*target), Timeout: destination.timeout()}
+	start := time.Now()
+
+	var resp *http.Response
+	for {
+		delivery.Attempts++
+		original := r.Clone(r.Context())
+		original.Body = io.NopCloser(bytes.NewReader(body))
+		req, err := buildRequest(original, destinationTarget, p.trustedProxies)
+		if err != nil {
+			delivery.Err = err
+			break
+		}
+		req.Header.Set("X-Request-ID", info.RequestID)
+		req, cancel := p.abortable(req)
+		resp, err = client.Do(req)
+		delivery.Status, delivery.Err = 0, err
+		retry := delivery.Attempts <= destination.Retries
+		if err == nil {
+			delivery.Status = resp.StatusCode
+			if keepBody && (resp.StatusCode < http.StatusInternalServerError || !retry) {
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+				break
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			resp = nil
+		}
+		cancel()
+		if (err == nil && delivery.Status < http.StatusInternalServerError) || !retry ||
+			!p.waitRetry(time.Duration(delivery.Attempts)*fanOutRetryBackoff) {
+			break
+		}
+	}
+	delivery.Duration = time.Since(start)
+	return fanOutResult{resp: resp, delivery: delivery}
+}
+
+// waitRetry waits before the next attempt of a delivery, it returns false if Shutdown gave up draining meanwhile
+func (p *Proxy) waitRetry(backoff time.Duration) bool {
+	p.mu.RLock()
+	abort := p.abort
+	p.mu.RUnlock()
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-abort.Done():
+		return false
+	}
+}
+
+// reportDelivery logs and counts the outcome of a delivery and passes it to Target.OnDelivery
+func (p *Proxy) reportDelivery(target *Target, delivery FanOutDelivery, logger *slog.Logger) {
+	attrs := []any{"destination", delivery.Destination, "status", delivery.Status, "attempts", delivery.Attempts,
+		"latency", delivery.Duration}
+	if delivery.Succeeded() {
+		logger.Info("Fan-out delivery completed", attrs...)
+	} else {
+		logger.Warn("Fan-out delivery failed", append(attrs, "err", delivery.Err)...)
+	}
+	if p.metrics != nil {
+		p.metrics.observeDelivery(target.route(), delivery)
+	}
+	if target.OnDelivery != nil {
+		target.OnDelivery(delivery)
+	}
+}
+
+// cancelOnClose cancels the request of a response once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
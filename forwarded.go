@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithTrustedProxies declares the proxies in front of this one, as CIDRs like "10.0.0.0/8" or single IPs.
+// Only requests from these proxies may bring their own X-Forwarded-For and X-Real-IP headers
+// and set the scheme of rewritten URLs with X-Forwarded-Proto,
+// the headers of all other clients are dropped so they cannot spoof their IP.
+// Without trusted proxies the X-Forwarded-For chain of every client is kept and extended.
+func WithTrustedProxies(cidrs ...string) ProxyOption {
+	return func(p *Proxy) { p.trustedProxyCidrs = append(p.trustedProxyCidrs, cidrs...) }
+}
+
+// parseTrustedProxy parses a CIDR or single IP of WithTrustedProxies
+func parseTrustedProxy(cidr string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(cidr); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the IP of the peer the request came from, which is a proxy in front of this one or the client
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedProto returns the scheme of X-Forwarded-Proto if a trusted proxy sent the request, otherwise ""
+// a proxy terminating TLS in front of this one forwards HTTPS requests as plain HTTP
+func forwardedProto(r *http.Request, trustedProxies []netip.Prefix) string {
+	addr, ok := remoteAddr(r)
+	if !ok || !isTrustedProxy(addr, trustedProxies) {
+		return ""
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto != "http" && proto != "https" {
+		return ""
+	}
+	return proto
+}
+
+// setForwardedHeaders appends the IP of the client to the X-Forwarded-For chain of the upstream request
+// and sets X-Real-IP to the client IP if no trusted proxy set it already
+func setForwardedHeaders(originalReq, newReq *http.Request, trustedProxies []netip.Prefix) {
+	clientAddr, ok := remoteAddr(originalReq)
+	if !ok {
+		return
+	}
+
+	if len(trustedProxies) > 0 && !isTrustedProxy(clientAddr, trustedProxies) {
+		newReq.Header.Del("X-Forwarded-For")
+		newReq.Header.Del("X-Real-IP")
+	}
+
+	chain := make([]string, 0)
+	for _, value := range newReq.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	chain = append(chain, clientAddr.String())
+	newReq.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+
+	if newReq.Header.Get("X-Real-IP") == "" {
+		newReq.Header.Set("X-Real-IP", realClientIp(chain, trustedProxies))
+	}
+}
+
+// realClientIp returns the last IP of the chain that is not a trusted proxy
+// the chain is only trustworthy up to there, everything before may be made up by the client
+func realClientIp(chain []string, trustedProxies []netip.Prefix) string {
+	for i := len(chain) - 1; i > 0; i-- {
+		addr, err := netip.ParseAddr(chain[i])
+		if err != nil || !isTrustedProxy(addr.Unmap(), trustedProxies) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
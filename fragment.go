@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// fragmentContexts are the parents HTML fragments starting with one of these elements are parsed in,
+// in the body they would be dropped, e.g. the rows of a table returned by an HTMX endpoint
+var fragmentContexts = map[atom.Atom]atom.Atom{
+	atom.Tr:       atom.Tbody,
+	atom.Td:       atom.Tr,
+	atom.Th:       atom.Tr,
+	atom.Thead:    atom.Table,
+	atom.Tbody:    atom.Table,
+	atom.Tfoot:    atom.Table,
+	atom.Caption:  atom.Table,
+	atom.Colgroup: atom.Table,
+	atom.Col:      atom.Colgroup,
+	atom.Option:   atom.Select,
+	atom.Optgroup: atom.Select,
+}
+
+// parseHtml parses a document or, if it has neither a doctype nor an html, head or body element, a fragment.
+// Fragments are returned as the children of a document node, so rendering it adds no wrapper elements.
+func parseHtml(body []byte) (*html.Node, error) {
+	first, fragment := inspectHtml(body)
+	if !fragment {
+		return html.Parse(bytes.NewReader(body))
+	}
+
+	context := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	if parent, ok := fragmentContexts[first]; ok {
+		context = &html.Node{Type: html.ElementNode, Data: parent.String(), DataAtom: parent}
+	}
+	nodes, err := html.ParseFragment(bytes.NewReader(body), context)
+	if err != nil {
+		return nil, err
+	}
+	root := &html.Node{Type: html.DocumentNode}
+	for _, node := range nodes {
+		root.AppendChild(node)
+	}
+	return root, nil
+}
+
+// inspectHtml returns the first element of the HTML and whether it is a fragment
+func inspectHtml(body []byte) (first atom.Atom, fragment bool) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return first, true
+		case html.DoctypeToken:
+			return first, false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			switch tag {
+			case atom.Html, atom.Head, atom.Body:
+				return first, false
+			}
+			if first == 0 {
+				first = tag
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitState is a snapshot of what the upstream of a target told us about its rate limit
+type RateLimitState struct {
+	// Limit is the request quota of the current window, -1 if unknown
+	Limit int `json:"limit"`
+	// Remaining is the number of requests left in the current window, -1 if unknown
+	Remaining int `json:"remaining"`
+	// Reset is the time the current window ends, zero if unknown
+	Reset time.Time `json:"reset"`
+}
+
+// errRateLimited is returned by the governor if a request would have to wait longer than allowed
+type errRateLimited struct {
+	retryAfter time.Duration
+}
+
+func (e *errRateLimited) Error() string {
+	return fmt.Sprintf("upstream rate limit exhausted, resets in %s", e.retryAfter)
+}
+
+// rateLimitGovernor keeps track of the rate limit signals an upstream sends with its responses
+// and holds back requests to that upstream until the limit is reset.
+// It is shared by all concurrent requests to the same target.
+type rateLimitGovernor struct {
+	mu sync.Mutex
+	// maxWait is the longest a request is delayed, if the reset is further away the request is shed
+	maxWait time.Duration
+	state   RateLimitState
+
+	now func() time.Time
+}
+
+func newRateLimitGovernor(maxWait time.Duration) *rateLimitGovernor {
+	return &rateLimitGovernor{
+		maxWait: maxWait,
+		state:   RateLimitState{Limit: -1, Remaining: -1},
+		now:     time.Now,
+	}
+}
+
+// wait blocks until the upstream allows another request and takes one request from the allowance
+func (g *rateLimitGovernor) wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		now := g.now()
+		if !g.state.Reset.IsZero() && !now.Before(g.state.Reset) {
+			// the window is over, we do not know anything about the next one
+			g.state = RateLimitState{Limit: g.state.Limit, Remaining: -1}
+		}
+		if g.state.Remaining != 0 || g.state.Reset.IsZero() {
+			if g.state.Remaining > 0 {
+				g.state.Remaining--
+			}
+			g.mu.Unlock()
+			return nil
+		}
+		delay := g.state.Reset.Sub(now)
+		g.mu.Unlock()
+
+		if delay > g.maxWait {
+			return &errRateLimited{retryAfter: delay}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// observe updates the governor with the rate limit headers of an upstream response
+func (g *rateLimitGovernor) observe(resp *http.Response) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+
+	if limit, ok := parseRateLimitInt(resp.Header, "RateLimit-Limit", "X-RateLimit-Limit"); ok {
+		g.state.Limit = limit
+	}
+	if remaining, ok := parseRateLimitInt(resp.Header, "RateLimit-Remaining", "X-RateLimit-Remaining"); ok {
+		g.state.Remaining = remaining
+	}
+	if reset, ok := parseRateLimitReset(resp.Header, now); ok {
+		g.state.Reset = reset
+	}
+
+	// an explicit Retry-After on a rejected request overrules everything else
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			g.state.Remaining = 0
+			g.state.Reset = retryAfter
+		}
+	}
+}
+
+func (g *rateLimitGovernor) snapshot() RateLimitState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.state
+}
+
+func parseRateLimitInt(header http.Header, keys ...string) (int, bool) {
+	for _, key := range keys {
+		value := strings.TrimSpace(header.Get(key))
+		if value == "" {
+			continue
+		}
+		// the IETF draft allows a policy suffix like "100, 100;w=60"
+		value, _, _ = strings.Cut(value, ",")
+		value, _, _ = strings.Cut(value, ";")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err == nil && n >= 0 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// parseRateLimitReset reads the reset time from RateLimit-Reset (delta seconds) or X-RateLimit-Reset,
+// which is a unix timestamp for most APIs (e.g. GitHub), but delta seconds for others
+func parseRateLimitReset(header http.Header, now time.Time) (time.Time, bool) {
+	if seconds, ok := parseRateLimitInt(header, "RateLimit-Reset"); ok {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if seconds, ok := parseRateLimitInt(header, "X-RateLimit-Reset"); ok {
+		// anything bigger than a year of seconds is considered a unix timestamp
+		if seconds > 365*24*60*60 {
+			return time.Unix(int64(seconds), 0), true
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+// parseRetryAfter parses the Retry-After header which is either delta seconds or a HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotListening is returned by ListenerFile, Handoff and Shutdown if ListenAndServe has not started listening yet
+var ErrNotListening = errors.New("proxy is not listening")
+
+// WithListenerFile makes ListenAndServe serve on the listening socket of f instead of listening on the port,
+// e.g. the socket of ListenerFile passed on by the previous process for a restart without downtime.
+// The proxy closes f once it adopted the socket.
+func WithListenerFile(f *os.File) ProxyOption {
+	return func(p *Proxy) { p.listenerFile = f }
+}
+
+// ListenerFile returns a duplicate of the listening socket, to be passed on to a new process with WithListenerFile.
+// Both processes accept connections on the socket until the old one calls Shutdown, which stops accepting,
+// drains the requests in flight and leaves the socket open for the new process.
+func (p *Proxy) ListenerFile() (*os.File, error) {
+	p.mu.RLock()
+	listener := p.listener
+	p.mu.RUnlock()
+	if listener == nil {
+		return nil, ErrNotListening
+	}
+	fileListener, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T has no file", listener)
+	}
+	return fileListener.File()
+}
+
+// listen creates the listener of ListenAndServe, adopting the socket of WithListenerFile if set
+func (p *Proxy) listen() (net.Listener, error) {
+	if p.listenerFile == nil {
+		return net.Listen("tcp", p.listenAddr().Host)
+	}
+	defer p.listenerFile.Close()
+	return net.FileListener(p.listenerFile)
+}
+
+// Handoff stops accepting connections, so the process that adopted the socket of ListenerFile gets all new ones,
+// and shuts down like Shutdown once every connection accepted so far sent its first request.
+// Shutdown alone would close connections whose request arrives after it started, failing their requests.
+func (p *Proxy) Handoff(ctx context.Context) error {
+	p.mu.RLock()
+	listener, served := p.listener, p.served
+	p.mu.RUnlock()
+	if listener == nil {
+		return ErrNotListening
+	}
+
+	p.handingOff.Store(true)
+	if err := listener.Close(); err != nil {
+		return fmt.Errorf("error closing listener: %w", err)
+	}
+	// once Serve returned, every accepted connection is tracked
+	select {
+	case <-served:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := p.newConns.wait(ctx); err != nil {
+		return err
+	}
+	return p.Shutdown(ctx)
+}
+
+// connTracker tracks the connections of the server that did not send their first request yet
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// track is the http.Server.ConnState hook, a connection leaves StateNew with its first request or when it is closed
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state != http.StateNew {
+		delete(t.conns, conn)
+		return
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+}
+
+// wait polls until all tracked connections sent their first request or were closed
+func (t *connTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		pending := len(t.conns)
+		t.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for %d new connections: %w", pending, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders only apply to a single connection and are not forwarded by proxies, see RFC 7230 section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// stripHopByHopHeaders removes the hop-by-hop headers and the headers listed in the Connection header
+func stripHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// HeaderRule changes a header of the responses of a target before they are sent to the client
+type HeaderRule struct {
+	// Name is the name of the header
+	Name string
+	// Remove deletes the header
+	Remove bool
+	// Value replaces all values of the header, ignored if empty
+	Value string
+	// Edit rewrites every value of the header, values it returns empty are removed
+	Edit func(value string) string
+}
+
+func (r HeaderRule) apply(h http.Header) {
+	if r.Remove {
+		h.Del(r.Name)
+		return
+	}
+	if r.Value != "" {
+		h.Set(r.Name, r.Value)
+	}
+	if r.Edit == nil {
+		return
+	}
+	values := h.Values(r.Name)
+	h.Del(r.Name)
+	for _, value := range values {
+		if value = r.Edit(value); value != "" {
+			h.Add(r.Name, value)
+		}
+	}
+}
+
+// The built-in header profiles of Target.HeaderProfile
+const (
+	// HeaderProfileIframeEmbed allows embedding the target in frames of any site:
+	// it removes X-Frame-Options and the frame-ancestors directive of Content-Security-Policy
+	// and Content-Security-Policy-Report-Only
+	HeaderProfileIframeEmbed = "iframe-embed"
+	// HeaderProfileApiCorsOpen allows cross-origin requests from anywhere: it sets
+	// Access-Control-Allow-Origin to *, Access-Control-Allow-Methods to all common methods,
+	// Access-Control-Allow-Headers and Access-Control-Expose-Headers to * and Access-Control-Max-Age to a day
+	HeaderProfileApiCorsOpen = "api-cors-open"
+	// HeaderProfilePrivacy removes the headers that track clients or reveal the upstream software:
+	// Set-Cookie, ETag, Server, X-Powered-By, X-AspNet-Version, X-AspNetMvc-Version, X-Generator and Via
+	HeaderProfilePrivacy = "privacy"
+	// HeaderProfilePassthroughStrict sends the upstream headers without the CORS headers the proxy adds otherwise,
+	// CORS preflights are forwarded to the upstream as well instead of being answered by the proxy
+	HeaderProfilePassthroughStrict = "passthrough-strict"
+)
+
+// headerProfile is a named set of header rules
+type headerProfile struct {
+	rules []HeaderRule
+	// omitCorsHeaders stops the proxy from adding its CORS headers and answering preflights itself
+	omitCorsHeaders bool
+}
+
+var headerProfiles = map[string]headerProfile{
+	HeaderProfileIframeEmbed: {rules: []HeaderRule{
+		{Name: "X-Frame-Options", Remove: true},
+		{Name: "Content-Security-Policy", Edit: removeFrameAncestors},
+		{Name: "Content-Security-Policy-Report-Only", Edit: removeFrameAncestors},
+	}},
+	HeaderProfileApiCorsOpen: {rules: []HeaderRule{
+		{Name: "Access-Control-Allow-Origin", Value: "*"},
+		{Name: "Access-Control-Allow-Methods", Value: "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+		{Name: "Access-Control-Allow-Headers", Value: "*"},
+		{Name: "Access-Control-Expose-Headers", Value: "*"},
+		{Name: "Access-Control-Max-Age", Value: "86400"},
+	}},
+	HeaderProfilePrivacy: {rules: []HeaderRule{
+		{Name: "Set-Cookie", Remove: true},
+		{Name: "ETag", Remove: true},
+		{Name: "Server", Remove: true},
+		{Name: "X-Powered-By", Remove: true},
+		{Name: "X-AspNet-Version", Remove: true},
+		{Name: "X-AspNetMvc-Version", Remove: true},
+		{Name: "X-Generator", Remove: true},
+		{Name: "Via", Remove: true},
+	}},
+	HeaderProfilePassthroughStrict: {omitCorsHeaders: true},
+}
+
+// removeFrameAncestors removes the frame-ancestors directive from a Content-Security-Policy
+func removeFrameAncestors(policy string) string {
+	directives := make([]string, 0)
+	for _, directive := range strings.Split(policy, ";") {
+		directive = strings.TrimSpace(directive)
+		name, _, _ := strings.Cut(directive, " ")
+		if directive == "" || strings.EqualFold(name, "frame-ancestors") {
+			continue
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, "; ")
+}
+
+// addsCorsHeaders reports whether the proxy adds its CORS headers to the responses of the target
+func (t Target) addsCorsHeaders() bool {
+	return !headerProfiles[t.HeaderProfile].omitCorsHeaders
+}
+
+// applyHeaderRules applies the rules of the header profile of the target and its explicit rules, in that order
+func (t Target) applyHeaderRules(h http.Header) {
+	for _, rule := range headerProfiles[t.HeaderProfile].rules {
+		rule.apply(h)
+	}
+	for _, rule := range t.ResponseHeaderRules {
+		rule.apply(h)
+	}
+}
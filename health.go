@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithReadyzCheck serves /readyz, which checks the upstream of every target with a HEAD request to its BaseUrl
+// An upstream is healthy if it answers with a status below 500 within the given timeout.
+// /readyz responds with 200 if all upstreams are healthy and 503 otherwise.
+func WithReadyzCheck(timeout time.Duration) ProxyOption {
+	return func(p *Proxy) { p.readyzTimeout = timeout }
+}
+
+type readyzResponse struct {
+	Targets map[string]bool `json:"targets"`
+}
+
+func (p *Proxy) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), p.readyzTimeout)
+	defer cancel()
+
+	p.mu.RLock()
+	targets := make(map[string]Target, len(p.targets))
+	for prefix, target := range p.targets {
+		targets[prefix] = target
+	}
+	p.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := readyzResponse{Targets: make(map[string]bool, len(targets))}
+	for prefix, target := range targets {
+		prefix, target := prefix, target
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := p.checkUpstream(ctx, target)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Targets[prefix] = healthy
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, healthy := range result.Targets {
+		if !healthy {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (p *Proxy) checkUpstream(ctx context.Context, target Target) bool {
+	// a fan-out target is ready if the destinations its responses wait for are
+	if len(target.FanOut) > 0 {
+		for i, destination := range target.FanOut {
+			if target.awaits(i) && !p.checkUpstream(ctx, target.destinationTarget(destination)) {
+				return false
+			}
+		}
+		return true
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.BaseUrl, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.upstreamTransport(target).RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
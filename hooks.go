@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Priorities of the hooks added by this module, user hooks default to HookPriorityDefault.
+// PreRequest hooks run in ascending priority, PostRequest hooks in descending priority,
+// so the hook that sees the request first sees the response last, like middleware.
+// Hooks with the same priority run in the order they were added, and in reverse order for PostRequest.
+const (
+	// HookPriorityInstrumentation hooks measure the whole upstream round trip including all other hooks
+	HookPriorityInstrumentation = -200
+	// HookPriorityAuth hooks add credentials before the user hooks see the request
+	HookPriorityAuth    = -100
+	HookPriorityDefault = 0
+)
+
+// HookOption configures a hook added with Target.AddPreRequest or Target.AddPostRequest
+type HookOption func(*hookOptions)
+
+type hookOptions struct {
+	priority int
+}
+
+// WithHookPriority sets the priority of the hook, defaults to HookPriorityDefault
+func WithHookPriority(priority int) HookOption {
+	return func(o *hookOptions) { o.priority = priority }
+}
+
+type hook[F any] struct {
+	fn       F
+	priority int
+}
+
+// addHook returns a new slice with the hook inserted after all hooks with a lower or the same priority
+// the slice is copied, so copies of a Target do not share their hooks
+func addHook[F any](hooks []hook[F], fn F, opts []HookOption) []hook[F] {
+	options := hookOptions{priority: HookPriorityDefault}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	result := make([]hook[F], len(hooks), len(hooks)+1)
+	copy(result, hooks)
+	result = append(result, hook[F]{fn: fn, priority: options.priority})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].priority < result[j].priority })
+	return result
+}
+
+// AddPreRequest adds a hook manipulating the upstream request, see the HookPriority constants for the order
+// A hook returning nil keeps the request it was given.
+func (t *Target) AddPreRequest(fn func(*http.Request) *http.Request, opts ...HookOption) {
+	t.preHooks = addHook(t.preHooks, fn, opts)
+}
+
+// AddPostRequest adds a hook manipulating the upstream response, see the HookPriority constants for the order
+// If the request failed, every hook is called with a nil response and its returned value is ignored.
+// A hook returning nil for a response keeps the response it was given.
+func (t *Target) AddPostRequest(fn func(*http.Response) *http.Response, opts ...HookOption) {
+	t.postHooks = addHook(t.postHooks, fn, opts)
+}
+
+// runPreRequest runs the PreRequest hooks of the target on the request
+// the PreRequest field runs at HookPriorityDefault after the hooks added with the same priority
+func (t Target) runPreRequest(req *http.Request) *http.Request {
+	hooks := t.preHooks
+	if t.PreRequest != nil {
+		hooks = addHook(hooks, t.PreRequest, nil)
+	}
+	for _, h := range hooks {
+		if newReq := h.fn(req); newReq != nil {
+			req = newReq
+		}
+	}
+	return req
+}
+
+// runPostRequest runs the PostRequest hooks of the target on the response in reverse order
+func (t Target) runPostRequest(resp *http.Response) *http.Response {
+	hooks := t.postHooks
+	if t.PostRequest != nil {
+		hooks = addHook(hooks, t.PostRequest, nil)
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		newResp := hooks[i].fn(resp)
+		if resp != nil && newResp != nil {
+			resp = newResp
+		}
+	}
+	return resp
+}
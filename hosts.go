@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route is the key of the target in the proxy, its Prefix or for host targets its Host followed by its Prefix
+func (t Target) route() string {
+	return t.Host + t.Prefix
+}
+
+// servesRoot reports whether the target has a host of its own, so its paths are the paths of the proxy
+// root relative URLs of such a target need no rewriting, only absolute ones
+func (t Target) servesRoot() bool {
+	return t.Host != "" && t.Prefix == "/"
+}
+
+// hostMatches reports whether the hostname matches the Host of a target, an exact name or a wildcard like "*.localhost"
+// a wildcard matches one or more labels, but not the bare domain
+func hostMatches(pattern, hostname string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return len(hostname) > len(suffix) && strings.HasSuffix(hostname, suffix)
+	}
+	return pattern == hostname
+}
+
+// isValidHostPattern reports whether the Host of a target is a hostname or a wildcard like "*.localhost"
+func isValidHostPattern(pattern string) bool {
+	pattern = strings.TrimPrefix(pattern, "*.")
+	if pattern == "" || strings.ContainsAny(pattern, "*:/ ") {
+		return false
+	}
+	for _, label := range strings.Split(pattern, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHostname returns the lowercase Host header of the request without its port
+func requestHostname(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+// router dispatches a request to the targets of its Host header and falls back to the targets without a Host
+type router struct {
+	hosts    []hostRoute
+	prefixes *http.ServeMux
+	// notFound handles the requests no target matches, the mux responds with a plain text 404 if it is nil
+	notFound http.Handler
+}
+
+// hostRoute holds the targets of a Host
+type hostRoute struct {
+	host string
+	mux  *http.ServeMux
+}
+
+func newRouter() *router {
+	return &router{prefixes: http.NewServeMux()}
+}
+
+// handle registers the handler of the target at the mux of its Host, or at the prefix mux if it has none
+func (rt *router) handle(target Target, handler http.Handler) {
+	if target.Host == "" {
+		handlePrefix(rt.prefixes, target.Prefix, handler)
+		if target.Default && target.Prefix != "/" {
+			rt.prefixes.Handle("/", handler)
+		}
+		return
+	}
+	for _, route := range rt.hosts {
+		if route.host == target.Host {
+			handlePrefix(route.mux, target.Prefix, handler)
+			return
+		}
+	}
+	mux := http.NewServeMux()
+	handlePrefix(mux, target.Prefix, handler)
+	rt.hosts = append(rt.hosts, hostRoute{host: target.Host, mux: mux})
+
+	// exact hosts win over wildcards, more specific wildcards over less specific ones
+	sort.SliceStable(rt.hosts, func(i, j int) bool {
+		iWildcard, jWildcard := strings.HasPrefix(rt.hosts[i].host, "*"), strings.HasPrefix(rt.hosts[j].host, "*")
+		if iWildcard != jWildcard {
+			return jWildcard
+		}
+		return len(rt.hosts[i].host) > len(rt.hosts[j].host)
+	})
+}
+
+// handlePrefix registers the handler for the subtree of the prefix and for the prefix without its trailing slash,
+// which the mux would redirect otherwise
+func handlePrefix(mux *http.ServeMux, prefix string, handler http.Handler) {
+	mux.Handle(prefix, handler)
+	if bare := strings.TrimSuffix(prefix, "/"); bare != "" {
+		mux.Handle(bare, handler)
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(rt.hosts) > 0 {
+		hostname := requestHostname(r)
+		for _, route := range rt.hosts {
+			if !hostMatches(route.host, hostname) {
+				continue
+			}
+			if handler, pattern := route.mux.Handler(r); pattern != "" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+	if _, pattern := rt.prefixes.Handler(r); pattern == "" && rt.notFound != nil {
+		rt.notFound.ServeHTTP(w, r)
+		return
+	}
+	rt.prefixes.ServeHTTP(w, r)
+}
+
+// hostBase returns publicBase with its host replaced by the Host of the target, the port is kept
+// it returns false for wildcard hosts, which cannot be linked to
+func hostBase(publicBase string, target Target) (string, bool) {
+	if strings.HasPrefix(target.Host, "*") {
+		return "", false
+	}
+	scheme, host, _ := strings.Cut(publicBase, "://")
+	host, _, _ = strings.Cut(host, "/")
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return scheme + "://" + net.JoinHostPort(target.Host, port), true
+	}
+	return scheme + "://" + target.Host, true
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// WithIndexPage serves a page at / listing the prefix, BaseUrl and link of every target,
+// as HTML for browsers and as JSON for clients accepting only application/json.
+// A target without Host at the prefix / or a Default target would shadow the page, adding one fails.
+func WithIndexPage() ProxyOption {
+	return func(p *Proxy) { p.indexPage = true }
+}
+
+type indexEntry struct {
+	Prefix  string `json:"prefix"`
+	Host    string `json:"host,omitempty"`
+	BaseUrl string `json:"baseUrl"`
+	// URL is the public URL of the target, empty for wildcard hosts
+	URL string `json:"url,omitempty"`
+}
+
+type indexResponse struct {
+	Targets []indexEntry `json:"targets"`
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Proxy targets</title></head>
+<body>
+<h1>Proxy targets</h1>
+<table>
+<tr><th>Prefix</th><th>Upstream</th></tr>
+{{- range .Targets}}
+<tr><td>{{if .URL}}<a href="{{.URL}}">{{.Host}}{{.Prefix}}</a>{{else}}{{.Host}}{{.Prefix}}{{end}}</td><td>{{.BaseUrl}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// indexHandler returns the handler of the index page, other paths are passed to notFound, p.mu has to be held
+func (p *Proxy) indexHandler(notFound http.Handler) http.Handler {
+	targets := make([]Target, 0, len(p.targets))
+	for _, target := range p.targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].route() < targets[j].route() })
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+
+		result := indexResponse{Targets: make([]indexEntry, 0, len(targets))}
+		for _, target := range targets {
+			entry := indexEntry{Prefix: target.Prefix, Host: target.Host, BaseUrl: target.BaseUrl}
+			publicBase, ok := p.publicBase(r, target), true
+			if target.Host != "" {
+				publicBase, ok = hostBase(publicBase, target)
+			}
+			if ok {
+				entry.URL = publicBase + target.Prefix
+			}
+			result.Targets = append(result.Targets, entry)
+		}
+
+		accept := r.Header.Get("Accept")
+		if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		indexTemplate.Execute(w, result)
+	})
+}
+
+// validateIndexPage rejects targets that would shadow the index page
+func (p *Proxy) validateIndexPage(target Target) error {
+	if !p.indexPage || target.Host != "" || (target.Prefix != "/" && !target.Default) {
+		return nil
+	}
+	return &ValidationError{
+		Field:   "Target.Prefix",
+		Value:   target.Prefix,
+		Rule:    "excluded_with",
+		Message: "the index page of WithIndexPage is served at /, a target at / or a default target would shadow it",
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/FrauElster/proxy/internal"
+)
+
+// version and commit identify the build, set them with
+// -ldflags "-X github.com/FrauElster/proxy.version=v1.2.3 -X github.com/FrauElster/proxy.commit=abc123"
+var (
+	version string
+	commit  string
+)
+
+// modulePath is the path of this module in the build info of the binary
+const modulePath = "github.com/FrauElster/proxy"
+
+// infoPath serves the Info of the proxy if WithInfoEndpoint is used, it takes precedence over the targets
+const infoPath = "/_proxy/info"
+
+// BuildInfo identifies the build of the proxy
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+}
+
+// Version returns the version set with -ldflags, the module version of the proxy from the build info
+// or "(devel)" if it is unknown
+func Version() string {
+	return GetBuildInfo().Version
+}
+
+// GetBuildInfo returns the version and commit set with -ldflags, falling back to the build info of the binary
+func GetBuildInfo() BuildInfo {
+	result := BuildInfo{Version: version, Commit: commit, GoVersion: runtime.Version(), GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if result.Version == "" {
+			result.Version = "(devel)"
+		}
+		return result
+	}
+
+	if result.Version == "" {
+		result.Version = moduleVersion(info)
+	}
+	if result.Commit == "" && info.Main.Path == modulePath {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				result.Commit = setting.Value
+			}
+		}
+	}
+	return result
+}
+
+// moduleVersion returns the version of this module in the build info, it is the main module or a dependency
+func moduleVersion(info *debug.BuildInfo) string {
+	module := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			module = dep
+		}
+	}
+	if module.Replace != nil && module.Replace.Version != "" {
+		return module.Replace.Version
+	}
+	if module.Path != modulePath || module.Version == "" {
+		return "(devel)"
+	}
+	return module.Version
+}
+
+// Info describes a running proxy instance, see WithInfoEndpoint
+type Info struct {
+	BuildInfo
+	ListenAddresses []string `json:"listenAddresses"`
+	Targets         int      `json:"targets"`
+	// Features are the optional features by the name of their option without "With", e.g. "ssl" or "mutationAudit"
+	Features map[string]bool `json:"features"`
+}
+
+// WithInfoEndpoint serves the Info of the proxy as JSON at /_proxy/info to requests with the header
+// "Authorization: Bearer <adminToken>". The path is never forwarded to a target.
+func WithInfoEndpoint(adminToken string) ProxyOption {
+	return func(p *Proxy) {
+		p.infoEndpoint = true
+		p.adminToken = adminToken
+	}
+}
+
+// Info returns the current Info of the proxy, it is updated when targets change and the proxy starts listening
+func (p *Proxy) Info() Info {
+	if info := p.info.Load(); info != nil {
+		return *info
+	}
+	return Info{}
+}
+
+// updateInfo takes a snapshot of the configuration for Info, so serving it takes no locks, p.mu has to be held
+func (p *Proxy) updateInfo() {
+	info := Info{
+		BuildInfo:       GetBuildInfo(),
+		ListenAddresses: []string{},
+		Targets:         len(p.targets),
+		Features: map[string]bool{
+			"ssl":                p.cert != nil,
+			"backendClientCert":  p.backendClientCert != nil,
+			"customTransport":    p.transport != http.DefaultTransport,
+			"prometheusMetrics":  p.metricsRegistry != nil,
+			"tracing":            p.tracer != nil,
+			"rateLimitGovernor":  p.governors != nil,
+			"preflightCache":     p.preflightCache != nil,
+			"mutationAudit":      p.mutationAudit,
+			"crossTargetRewrite": p.crossTargetRewrite,
+			"streamingResponse":  p.streamResponses,
+			"readyzCheck":        p.readyzTimeout > 0,
+			"indexPage":          p.indexPage,
+			"infoEndpoint":       p.infoEndpoint,
+			"dialPolicy":         p.dialPolicy != Auto,
+		},
+	}
+	if p.addr != nil {
+		info.ListenAddresses = append(info.ListenAddresses, p.addr.String())
+	}
+	p.info.Store(&info)
+}
+
+// enabledFeatures returns the names of the enabled features of the info, sorted
+func (i Info) enabledFeatures() []string {
+	features := make([]string, 0, len(i.Features))
+	for name, enabled := range i.Features {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// MapStats are the occupancy and evictions of a bounded in-memory map of the proxy
+type MapStats = internal.MapStats
+
+// MapStats returns the stats of the in-memory maps growing with the clients, by name, e.g. "preflightCache"
+// Maps of options that are not used are missing.
+func (p *Proxy) MapStats() map[string]MapStats {
+	stats := make(map[string]MapStats)
+	if p.preflightCache != nil {
+		stats["preflightCache"] = p.preflightCache.entries.Stats()
+	}
+	return stats
+}
+
+func (p *Proxy) handleInfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(p.Info())
+}
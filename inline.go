@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// InlineAssets configures the embedding of small same-target assets into rewritten HTML as data: URIs
+// Images (img[src]) and stylesheets (link[rel=stylesheet]) are fetched through the proxy's transport.
+// If an asset is too big, exceeds the budget or cannot be fetched, its URL is rewritten as usual.
+type InlineAssets struct {
+	// MaxAssetSize is the maximum size in bytes of a single inlined asset
+	MaxAssetSize int `json:"maxAssetSize" yaml:"maxAssetSize"`
+	// MaxTotalSize is the maximum size in bytes of all assets inlined into a single page
+	MaxTotalSize int `json:"maxTotalSize" yaml:"maxTotalSize"`
+	// MaxDepth is how many levels of url() references inside inlined stylesheets are inlined as well
+	// 0 only inlines the stylesheets themselves
+	MaxDepth int `json:"maxDepth" yaml:"maxDepth"`
+}
+
+// assetInliner inlines the assets of a single page and keeps track of its budget
+type assetInliner struct {
+	p          *Proxy
+	target     Target
+	publicBase string
+	ctx        context.Context
+	budget     int
+}
+
+func newAssetInliner(p *Proxy, target Target, publicBase string, ctx context.Context) *assetInliner {
+	return &assetInliner{p: p, target: target, publicBase: publicBase, ctx: ctx, budget: target.InlineAssets.MaxTotalSize}
+}
+
+// inlineDocument replaces the URLs of all qualifying assets of the document with data: URIs
+// pageUrl is the upstream URL of the document, relative asset URLs are resolved against it
+func (i *assetInliner) inlineDocument(document *goquery.Document, pageUrl *url.URL) {
+	document.Find("img[src], link[rel=stylesheet][href]").Each(func(index int, element *goquery.Selection) {
+		attr := "src"
+		if goquery.NodeName(element) == "link" {
+			attr = "href"
+		}
+		val, _ := element.Attr(attr)
+		if dataUri, ok := i.inline(val, pageUrl, 0); ok {
+			element.SetAttr(attr, dataUri)
+		}
+	})
+}
+
+// inline fetches the asset val refers to and returns it as data: URI
+// it returns false if the asset does not qualify for inlining
+func (i *assetInliner) inline(val string, base *url.URL, depth int) (string, bool) {
+	assetUrl, ok := i.resolve(val, base)
+	if !ok {
+		return "", false
+	}
+
+	body, contentType, err := i.p.fetchUpstream(i.ctx, i.target, assetUrl)
+	if err != nil || len(body) > i.target.InlineAssets.MaxAssetSize || len(body) > i.budget {
+		return "", false
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	// the references of an inlined stylesheet can not be resolved relative to a data: URI anymore
+	if mediaType == "text/css" {
+		// the nested assets are charged while rewriting, so together they stay within the budget,
+		// afterwards only the stylesheet embedding them is charged, or nothing if it turns out too big
+		budget := i.budget
+		css := rewriteCssUrls(string(body), func(ref string) (string, bool) {
+			if depth < i.target.InlineAssets.MaxDepth {
+				if dataUri, ok := i.inline(ref, assetUrl, depth+1); ok {
+					return dataUri, true
+				}
+			}
+			return i.absolute(ref, assetUrl)
+		})
+		body = []byte(css)
+		i.budget = budget
+		if len(body) > i.target.InlineAssets.MaxAssetSize || len(body) > i.budget {
+			return "", false
+		}
+	}
+
+	i.budget -= len(body)
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(body), true
+}
+
+// resolve returns the absolute URL of val if it points at the target
+func (i *assetInliner) resolve(val string, base *url.URL) (*url.URL, bool) {
+	if strings.HasPrefix(val, "data:") {
+		return nil, false
+	}
+	assetUrl, err := base.Parse(val)
+	if err != nil || !TargetMatches(i.target, assetUrl.String()) {
+		return nil, false
+	}
+	assetUrl.Fragment = ""
+	return assetUrl, true
+}
+
+// absolute turns a reference of an inlined stylesheet into a URL that works without the stylesheet's location
+func (i *assetInliner) absolute(ref string, base *url.URL) (string, bool) {
+	refUrl, err := base.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	if !TargetMatches(i.target, refUrl.String()) {
+		return refUrl.String(), true
+	}
+	return i.p.rewriteUrl(refUrl.String(), i.target, i.publicBase)
+}
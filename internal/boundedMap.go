@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MapStats are the occupancy and evictions of a BoundedMap, so operators can size its limits
+type MapStats struct {
+	Entries    int    `json:"entries"`
+	MaxEntries int    `json:"maxEntries"`
+	Evictions  uint64 `json:"evictions"`
+}
+
+// BoundedMap is a map safe for concurrent use with a maximum number of entries and a maximum age of its entries.
+// Entries expire ttl after they were last set, updated or acquired. If the map is full, the least recently used
+// entry is evicted. Entries pinned with Acquire are neither evicted nor expired until they are released.
+type BoundedMap[K comparable, V any] struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[K]*list.Element
+	// lru holds the entries, the most recently used one at the front
+	lru       *list.List
+	evictions uint64
+
+	// Now returns the current time, it can be replaced in tests
+	Now func() time.Time
+}
+
+type boundedEntry[K comparable, V any] struct {
+	key   K
+	value V
+	used  time.Time
+	pins  int
+}
+
+// NewBoundedMap returns a map with up to maxEntries entries, which expire after ttl
+// maxEntries or ttl of 0 disables the limit
+func NewBoundedMap[K comparable, V any](maxEntries int, ttl time.Duration) *BoundedMap[K, V] {
+	return &BoundedMap[K, V]{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[K]*list.Element),
+		lru:        list.New(),
+		Now:        time.Now,
+	}
+}
+
+// Get returns the value of the key, it does not count as use
+func (m *BoundedMap[K, V]) Get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entry(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set sets the value of the key
+func (m *BoundedMap[K, V]) Set(key K, value V) {
+	m.Update(key, func(V, bool) V { return value })
+}
+
+// Update sets the value of the key to the result of fn, which gets the current value and whether there is one
+// fn is called with the map locked, so concurrent updates of the same key do not get lost
+func (m *BoundedMap[K, V]) Update(key K, fn func(value V, ok bool) V) V {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entry(key)
+	if !ok {
+		var zero V
+		entry = m.insert(key, fn(zero, false))
+	} else {
+		entry.value = fn(entry.value, true)
+	}
+	m.touch(entry)
+	return entry.value
+}
+
+// Acquire returns the value of the key, creating it with create if there is none, and pins it until release is called
+// A pinned entry is never evicted, so state like a queue or a session is not replaced while it is in use.
+func (m *BoundedMap[K, V]) Acquire(key K, create func() V) (value V, release func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entry(key)
+	if !ok {
+		entry = m.insert(key, create())
+	}
+	m.touch(entry)
+	entry.pins++
+
+	var once sync.Once
+	return entry.value, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			entry.pins--
+			// the entry was kept beyond the limits while it was pinned
+			m.evict()
+		})
+	}
+}
+
+// Delete removes the key
+func (m *BoundedMap[K, V]) Delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+}
+
+// Stats returns the number of entries and how many were evicted or expired so far
+func (m *BoundedMap[K, V]) Stats() MapStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evict()
+	return MapStats{Entries: len(m.entries), MaxEntries: m.maxEntries, Evictions: m.evictions}
+}
+
+// entry returns the entry of the key unless it expired, expired entries are removed, m.mu has to be held
+func (m *BoundedMap[K, V]) entry(key K) (*boundedEntry[K, V], bool) {
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*boundedEntry[K, V])
+	if m.expired(entry) {
+		m.remove(element)
+		m.evictions++
+		return nil, false
+	}
+	return entry, true
+}
+
+// insert adds a new entry and evicts entries beyond the limits, m.mu has to be held
+func (m *BoundedMap[K, V]) insert(key K, value V) *boundedEntry[K, V] {
+	entry := &boundedEntry[K, V]{key: key, value: value, used: m.Now()}
+	// the new entry is pinned while evicting, so it is not evicted itself
+	entry.pins++
+	m.entries[key] = m.lru.PushFront(entry)
+	m.evict()
+	entry.pins--
+	return entry
+}
+
+// touch marks the entry as most recently used, m.mu has to be held
+func (m *BoundedMap[K, V]) touch(entry *boundedEntry[K, V]) {
+	entry.used = m.Now()
+	m.lru.MoveToFront(m.entries[entry.key])
+}
+
+// evict removes the expired entries and the least recently used ones beyond maxEntries, pinned entries are kept
+// the list is ordered by the last use, so it stops at the first entry that is neither expired nor beyond the limit
+// m.mu has to be held
+func (m *BoundedMap[K, V]) evict() {
+	var prev *list.Element
+	for element := m.lru.Back(); element != nil; element = prev {
+		prev = element.Prev()
+		entry := element.Value.(*boundedEntry[K, V])
+		if entry.pins > 0 {
+			continue
+		}
+		overfull := m.maxEntries > 0 && len(m.entries) > m.maxEntries
+		if !overfull && !m.expired(entry) {
+			return
+		}
+		m.remove(element)
+		m.evictions++
+	}
+}
+
+func (m *BoundedMap[K, V]) expired(entry *boundedEntry[K, V]) bool {
+	return entry.pins == 0 && m.ttl > 0 && !m.Now().Before(entry.used.Add(m.ttl))
+}
+
+func (m *BoundedMap[K, V]) remove(element *list.Element) {
+	m.lru.Remove(element)
+	delete(m.entries, element.Value.(*boundedEntry[K, V]).key)
+}
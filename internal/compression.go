@@ -74,12 +74,18 @@ func DecompressResponse(res *http.Response) (err error) {
 	return nil
 }
 
-func CompressBody(body []byte, encoding SupportedCompression) ([]byte, error) {
+// CompressBody compresses the body with the given encoding
+// gzipLevel is only used for Gzip, see gzip.NewWriterLevel
+func CompressBody(body []byte, encoding SupportedCompression, gzipLevel int) ([]byte, error) {
 	var writer io.WriteCloser
 	var compressedBodyBuffer bytes.Buffer
 	switch encoding {
 	case Gzip:
-		writer = gzip.NewWriter(&compressedBodyBuffer)
+		gzipWriter, err := gzip.NewWriterLevel(&compressedBodyBuffer, gzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		writer = gzipWriter
 	case Deflate:
 		flateWriter, err := flate.NewWriter(&compressedBodyBuffer, flate.BestCompression)
 		if err != nil {
@@ -1,16 +1,18 @@
 package internal
 
-import "strings"
+import (
+	"crypto/rand"
+	"fmt"
+)
 
-func JoinUrl(elements ...string) string {
-	for idx, element := range elements {
-		if idx > 0 {
-			element = strings.TrimPrefix(element, "/")
-		}
-		if idx < len(elements)-1 {
-			element = strings.TrimSuffix(element, "/")
-		}
-		elements[idx] = element
+// NewRequestId returns a random (version 4) UUID
+func NewRequestId() string {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		panic(fmt.Sprintf("error reading random bytes: %s", err))
 	}
-	return strings.Join(elements, "/")
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
 }
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger sets the logger used for the request logs of the proxy, defaults to slog.Default()
+// Without WithLogger and WithLogLevel the completion of requests is logged at slog.LevelDebug instead of slog.LevelInfo,
+// so embedding the proxy does not add a line per request to the default logger.
+func WithLogger(logger *slog.Logger) ProxyOption {
+	return func(p *Proxy) { p.logger = logger }
+}
+
+// WithLogLevel sets the minimum level of the request logs on top of the level of the logger's handler
+// slog.LevelDebug logs the start of every request, slog.LevelInfo its completion,
+// slog.LevelWarn recoverable errors (e.g. unreachable upstreams) and slog.LevelError fatal ones
+func WithLogLevel(level slog.Level) ProxyOption {
+	return func(p *Proxy) { p.logLevel = level }
+}
+
+// levelHandler drops all records below level before passing them to the wrapped handler
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
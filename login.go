@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LoginCompat makes form based login flows with CSRF protection work through the proxy.
+// For requests to one of Paths it
+//   - translates the Origin and Referer headers from the proxy back to the upstream, so origin checks pass
+//   - keeps the Set-Cookie headers even if StripSetCookie or StripSetCookiePaths match,
+//     only their Domain attribute is dropped so the browser scopes them to the proxy host
+//   - passes upstream redirects on to the client with their Location translated to the proxy,
+//     instead of following them inside the proxy, so the cookies set by the redirect reach the browser
+//
+// WithRelaxedCookies still applies to the cookies of the login paths.
+type LoginCompat struct {
+	// Paths are the upstream paths (i.e. without Prefix) of the login flow, matched by prefix
+	Paths []string `json:"paths" yaml:"paths"`
+}
+
+// isLoginPath reports whether the given upstream path is part of the login flow of the target
+func (t Target) isLoginPath(path string) bool {
+	if t.LoginCompat == nil {
+		return false
+	}
+	for _, loginPath := range t.LoginCompat.Paths {
+		if strings.HasPrefix(path, loginPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateLoginHeaders rewrites the Origin and Referer headers of the upstream request
+// from the proxy at publicBase the browser sent them for to the upstream host
+func translateLoginHeaders(newReq *http.Request, target Target, publicBase string) {
+	targetUrl, err := url.Parse(target.BaseUrl)
+	if err != nil {
+		return
+	}
+	proxyUrl, err := url.Parse(publicBase)
+	if err != nil {
+		return
+	}
+
+	if origin := newReq.Header.Get("Origin"); origin != "" {
+		if originUrl, err := url.Parse(origin); err == nil && originUrl.Host == proxyUrl.Host {
+			newReq.Header.Set("Origin", targetUrl.Scheme+"://"+targetUrl.Host)
+		}
+	}
+	if referer := newReq.Header.Get("Referer"); referer != "" {
+		if refererUrl, err := url.Parse(referer); err == nil && refererUrl.Host == proxyUrl.Host {
+			// the prefix of the target follows the base path of the proxy
+			refererUrl.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(refererUrl.Path, proxyUrl.Path), "/")
+			refererUrl.RawPath = ""
+			if originReferer, err := ToOriginURL(target, refererUrl.String()); err == nil {
+				newReq.Header.Set("Referer", originReferer)
+			}
+		}
+	}
+}
+
+// dropCookieDomains removes the Domain attribute of all Set-Cookie headers,
+// the upstream domain would make the browser reject the cookies served by the proxy
+func dropCookieDomains(header http.Header) {
+	rewriteCookieAttributes(header, func(attr, name, _ string) (string, bool) {
+		return attr, !strings.EqualFold(name, "Domain")
+	})
+}
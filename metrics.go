@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// WithPrometheusMetrics registers request metrics of the proxy at the given registry
+// If the registry is also a prometheus.Gatherer, MetricsHandler serves its metrics, otherwise the default gatherer is used
+func WithPrometheusMetrics(registry prometheus.Registerer) ProxyOption {
+	return func(p *Proxy) { p.metricsRegistry = registry }
+}
+
+type proxyMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	active   *prometheus.GaugeVec
+	errors   *prometheus.CounterVec
+	fanOut   *prometheus.CounterVec
+	gatherer prometheus.Gatherer
+}
+
+func newProxyMetrics(registry prometheus.Registerer) (*proxyMetrics, error) {
+	m := &proxyMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Total number of proxied requests.",
+		}, []string{"target", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_request_duration_seconds",
+			Help:    "Duration of proxied requests in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_active_requests",
+			Help: "Number of requests currently being proxied.",
+		}, []string{"target"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_upstream_errors_total",
+			Help: "Total number of requests that could not be forwarded, by the class of the error.",
+		}, []string{"target", "class"}),
+		fanOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_fanout_deliveries_total",
+			Help: "Total number of deliveries to the destinations of fan-out targets, by their outcome.",
+		}, []string{"target", "destination", "outcome"}),
+		gatherer: prometheus.DefaultGatherer,
+	}
+	if gatherer, ok := registry.(prometheus.Gatherer); ok {
+		m.gatherer = gatherer
+	}
+
+	for _, collector := range []prometheus.Collector{m.requests, m.duration, m.active, m.errors, m.fanOut} {
+		err := registry.Register(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// instrument starts tracking a request to the given target
+// it returns a function to call once the request is done
+func (m *proxyMetrics) instrument(target string, recorder *statusRecorder, r *http.Request) func() {
+	m.active.WithLabelValues(target).Inc()
+	start := time.Now()
+
+	return func() {
+		m.active.WithLabelValues(target).Dec()
+		m.duration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(target, r.Method, strconv.Itoa(recorder.status)).Inc()
+		if recorder.errorClass != "" {
+			m.errors.WithLabelValues(target, string(recorder.errorClass)).Inc()
+		}
+	}
+}
+
+// observeDelivery counts a delivery to a destination of a fan-out target
+func (m *proxyMetrics) observeDelivery(target string, delivery FanOutDelivery) {
+	outcome := "failed"
+	if delivery.Succeeded() {
+		outcome = "delivered"
+	}
+	m.fanOut.WithLabelValues(target, delivery.Destination, outcome).Inc()
+}
+
+// MetricsHandler returns a handler serving the Prometheus metrics of the proxy
+// If WithPrometheusMetrics is not used, the handler responds with 404
+func (p *Proxy) MetricsHandler() http.Handler {
+	if p.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(p.metrics.gatherer, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/FrauElster/proxy/internal"
+)
+
+// WithMiddleware wraps the handler of the proxy with standard net/http middleware, the first one is the outermost.
+// It runs before the routing, so it sees every request including the ones no target matches, see Target.Middleware
+// for middleware of a single target. Middleware wrapping the ResponseWriter should implement
+// Unwrap() http.ResponseWriter, so streamed responses can still be flushed through it.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) ProxyOption {
+	return func(p *Proxy) { p.middleware = append(p.middleware, mw...) }
+}
+
+// RequestInfo describes a request routed to a target, it is in the context of the requests passed to Target.Middleware
+type RequestInfo struct {
+	// RequestID is the X-Request-ID of the request or a generated one, it is sent to the upstream and logged
+	RequestID string
+	// Target is the Prefix of the target the request is routed to
+	Target string
+	// Host is the Host of the target, empty for targets without one
+	Host string
+}
+
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo of a request routed to a target
+// The second return value is false outside of Target.Middleware, e.g. in WithMiddleware.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// chainMiddleware wraps the handler with the middleware, the first one is the outermost
+func chainMiddleware(handler http.Handler, mw []func(http.Handler) http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// targetHandler returns the handler of a target: it establishes the RequestInfo, runs Target.Middleware
+// and forwards the request
+func (p *Proxy) targetHandler(target *Target) http.Handler {
+	handler := chainMiddleware(p.forwardRequest(target), target.Middleware)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-ID")
+		if requestId == "" {
+			requestId = internal.NewRequestId()
+		}
+		info := RequestInfo{RequestID: requestId, Target: target.Prefix, Host: target.Host}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	})
+}
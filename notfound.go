@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// WithNotFoundHandler replaces the handler of requests no target matches, which responds with a JSON body by default
+func WithNotFoundHandler(handler http.Handler) ProxyOption {
+	return func(p *Proxy) { p.notFoundHandler = handler }
+}
+
+// WithoutPrefixListing keeps the default not found response from listing the prefixes of the targets,
+// so a production proxy does not reveal its routes
+func WithoutPrefixListing() ProxyOption {
+	return func(p *Proxy) { p.hidePrefixes = true }
+}
+
+type notFoundResponse struct {
+	Error string `json:"error"`
+	Path  string `json:"path"`
+	// Prefixes are the routes of the targets, Host followed by Prefix for host targets
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// notFound returns the handler of requests no target matches, p.mu has to be held
+func (p *Proxy) notFound() http.Handler {
+	if p.notFoundHandler != nil {
+		return p.notFoundHandler
+	}
+
+	var prefixes []string
+	if !p.hidePrefixes {
+		prefixes = make([]string, 0, len(p.targets))
+		for route := range p.targets {
+			prefixes = append(prefixes, route)
+		}
+		sort.Strings(prefixes)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(notFoundResponse{Error: "no target matches the path", Path: r.URL.Path, Prefixes: prefixes})
+	})
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI rewrites the server URLs of OpenAPI and Swagger documents of the target to the proxy,
+// so "Try it out" of Swagger UI or Redoc sends its requests through the proxy as well.
+// Documents are detected by their openapi or swagger key in JSON and YAML responses.
+// For OpenAPI 3 the servers[].url entries on the document, path and operation level are rewritten,
+// for Swagger 2 the host, basePath and schemes of the document if host is the target or not set.
+// JSON documents are kept byte for byte apart from the rewritten values, YAML documents are re-encoded.
+type OpenAPI struct {
+	// SpecPaths are the upstream paths of documents served with a content type other than JSON or YAML
+	SpecPaths []string `json:"specPaths" yaml:"specPaths"`
+}
+
+// isOpenAPICandidate reports whether the response of the target may be an OpenAPI document
+func (t Target) isOpenAPICandidate(resp *http.Response) bool {
+	if t.OpenAPI == nil {
+		return false
+	}
+	if resp.Request != nil {
+		for _, specPath := range t.OpenAPI.SpecPaths {
+			if resp.Request.URL.Path == specPath {
+				return true
+			}
+		}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return isJsonContentType(contentType) || isYamlContentType(contentType)
+}
+
+// isYamlContentType reports whether the content type is one of the YAML types or a +yaml type
+func isYamlContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+yaml")
+}
+
+// openAPIEdit is a changed scalar of an OpenAPI document
+type openAPIEdit struct {
+	node  *yaml.Node
+	value string
+}
+
+// rewriteOpenAPI rewrites the server URLs of the OpenAPI document with rewriteUrl
+// publicUrl is the URL of the target's prefix on the proxy. It returns false if the body is no OpenAPI document.
+func rewriteOpenAPI(body []byte, target Target, publicUrl *url.URL, rewriteUrl func(string) (string, bool)) ([]byte, bool) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(body, &document); err != nil || len(document.Content) == 0 {
+		return body, false
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return body, false
+	}
+
+	edits := make([]openAPIEdit, 0)
+	editServers := func(mapping *yaml.Node) {
+		servers := mappingValue(mapping, "servers")
+		if servers == nil || servers.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, server := range servers.Content {
+			serverUrl := mappingValue(server, "url")
+			if serverUrl == nil || serverUrl.Kind != yaml.ScalarNode {
+				continue
+			}
+			if newUrl, ok := rewriteUrl(serverUrl.Value); ok {
+				edits = append(edits, openAPIEdit{node: serverUrl, value: newUrl})
+			}
+		}
+	}
+
+	var insertBasePath string
+	switch {
+	case mappingValue(root, "openapi") != nil:
+		editServers(root)
+		if paths := mappingValue(root, "paths"); paths != nil && paths.Kind == yaml.MappingNode {
+			for i := 1; i < len(paths.Content); i += 2 {
+				pathItem := paths.Content[i]
+				editServers(pathItem)
+				for j := 1; j < len(pathItem.Content); j += 2 {
+					editServers(pathItem.Content[j])
+				}
+			}
+		}
+	case mappingValue(root, "swagger") != nil:
+		targetUrl, err := url.Parse(target.BaseUrl)
+		if err != nil {
+			return body, true
+		}
+		host := mappingValue(root, "host")
+		if host != nil && !strings.EqualFold(host.Value, targetUrl.Host) {
+			// the API is not served by the target
+			return body, true
+		}
+		if host != nil {
+			edits = append(edits, openAPIEdit{node: host, value: publicUrl.Host})
+		}
+		if schemes := mappingValue(root, "schemes"); schemes != nil && host != nil {
+			for _, scheme := range schemes.Content {
+				edits = append(edits, openAPIEdit{node: scheme, value: publicUrl.Scheme})
+			}
+		}
+		basePath := mappingValue(root, "basePath")
+		if basePath == nil {
+			insertBasePath = publicUrl.Path
+		} else {
+			edits = append(edits, openAPIEdit{node: basePath, value: JoinURL(publicUrl.Path, basePath.Value)})
+		}
+	default:
+		return body, false
+	}
+
+	if len(edits) == 0 && insertBasePath == "" {
+		return body, true
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		rewritten, err := editJsonDocument(body, root, edits, insertBasePath)
+		if err != nil {
+			return body, true
+		}
+		return rewritten, true
+	}
+
+	for _, edit := range edits {
+		edit.node.Value = edit.value
+	}
+	if insertBasePath != "" {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "basePath"},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: insertBasePath},
+		)
+	}
+	var result bytes.Buffer
+	encoder := yaml.NewEncoder(&result)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return body, true
+	}
+	return result.Bytes(), true
+}
+
+// mappingValue returns the value of the key in a YAML mapping, nil if there is no such key
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// editJsonDocument replaces the string values of the edits in the JSON document and leaves all other bytes as they are
+// the positions of the nodes are taken from the YAML parser, which reads JSON as well
+func editJsonDocument(body []byte, root *yaml.Node, edits []openAPIEdit, insertBasePath string) ([]byte, error) {
+	lineStarts := []int{0}
+	for i, c := range body {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	// offset converts the 1-based line and rune column of a node to a byte offset
+	offset := func(node *yaml.Node) (int, error) {
+		if node.Line < 1 || node.Line > len(lineStarts) {
+			return 0, fmt.Errorf("invalid line %d", node.Line)
+		}
+		pos := lineStarts[node.Line-1]
+		for col := 1; col < node.Column; col++ {
+			if pos >= len(body) {
+				return 0, fmt.Errorf("invalid column %d", node.Column)
+			}
+			_, size := utf8.DecodeRune(body[pos:])
+			pos += size
+		}
+		return pos, nil
+	}
+
+	type replacement struct {
+		start, end int
+		value      []byte
+	}
+	replacements := make([]replacement, 0, len(edits)+1)
+	for _, edit := range edits {
+		start, err := offset(edit.node)
+		if err != nil {
+			return nil, err
+		}
+		if body[start] != '"' {
+			return nil, fmt.Errorf("expected string at line %d column %d", edit.node.Line, edit.node.Column)
+		}
+		end := start + 1
+		for ; end < len(body) && body[end] != '"'; end++ {
+			if body[end] == '\\' {
+				end++
+			}
+		}
+		value, err := marshalJsonString(edit.value)
+		if err != nil {
+			return nil, err
+		}
+		replacements = append(replacements, replacement{start: start, end: end + 1, value: value})
+	}
+	if insertBasePath != "" {
+		start, err := offset(root)
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalJsonString(insertBasePath)
+		if err != nil {
+			return nil, err
+		}
+		insertion := append(append([]byte(`"basePath": `), value...), ',')
+		replacements = append(replacements, replacement{start: start + 1, end: start + 1, value: insertion})
+	}
+
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].start < replacements[j].start })
+	var result bytes.Buffer
+	last := 0
+	for _, r := range replacements {
+		result.Write(body[last:r.start])
+		result.Write(r.value)
+		last = r.end
+	}
+	result.Write(body[last:])
+	return result.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FrauElster/proxy/internal"
+)
+
+// WithPreflightCache answers repeated CORS preflight requests from memory for the given ttl
+// instead of forwarding every one of them to the upstream.
+// Preflights are considered equal if they ask for the same path, origin, method and headers.
+// The responses announce the ttl with Access-Control-Max-Age, so browsers cache them as well.
+func WithPreflightCache(ttl time.Duration) ProxyOption {
+	return func(p *Proxy) { p.preflightCache = newPreflightCache(ttl) }
+}
+
+type preflightKey struct {
+	path    string
+	origin  string
+	method  string
+	headers string
+}
+
+// maxPreflightEntries bounds the preflight cache, as every origin and path of the clients adds an entry
+const maxPreflightEntries = 10000
+
+// preflightCache remembers the preflight requests that were forwarded successfully
+type preflightCache struct {
+	ttl     time.Duration
+	entries *internal.BoundedMap[preflightKey, struct{}]
+}
+
+func newPreflightCache(ttl time.Duration) *preflightCache {
+	return &preflightCache{
+		ttl:     ttl,
+		entries: internal.NewBoundedMap[preflightKey, struct{}](maxPreflightEntries, ttl),
+	}
+}
+
+// isPreflight reports whether the request is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func newPreflightKey(r *http.Request) preflightKey {
+	return preflightKey{
+		path:    r.URL.Path,
+		origin:  r.Header.Get("Origin"),
+		method:  r.Header.Get("Access-Control-Request-Method"),
+		headers: r.Header.Get("Access-Control-Request-Headers"),
+	}
+}
+
+// hit reports whether an equal preflight was forwarded within the ttl
+func (c *preflightCache) hit(key preflightKey) bool {
+	_, ok := c.entries.Get(key)
+	return ok
+}
+
+func (c *preflightCache) store(key preflightKey) {
+	c.entries.Set(key, struct{}{})
+}
+
+// writePreflightResponse answers a preflight request with the CORS headers of the proxy
+func (p *Proxy) writePreflightResponse(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if p.preflightCache != nil {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.preflightCache.ttl.Seconds())))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -2,28 +2,188 @@ package proxy
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/FrauElster/proxy/internal"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Target struct {
+	// BaseUrl is the absolute URL of the upstream, including scheme and host
 	BaseUrl string
-	Prefix  string
+	// Prefix is the path the target is served at, e.g. "/github/". A missing leading or trailing slash is added.
+	// If prefixes are nested like "/api/" and "/api/v2/", the longest prefix matching the request path wins.
+	Prefix string
+	// Host routes the requests with this Host header to the target, an exact name like "github.localhost"
+	// or a wildcard like "*.github.localhost". Requests are matched against the targets with a Host first
+	// and fall back to the targets without one. With the default Prefix "/" the paths of the target are
+	// the paths of the proxy, so only absolute URLs have to be rewritten.
+	Host string
+	// RewritePrefix replaces Prefix in the path of forwarded requests instead of just stripping it,
+	// e.g. with Prefix "/api/" and RewritePrefix "/v2/" a request to /api/users is forwarded to /v2/users
+	RewritePrefix string
+	// AddQueryParams are set on the query of every forwarded request, they win over parameters of the client
+	AddQueryParams map[string]string
+	// StripQueryParams are removed from the query of forwarded requests
+	StripQueryParams []string
+	// RemoveRequestHeaders are removed from forwarded requests, e.g. to hide headers of the client from the upstream
+	RemoveRequestHeaders []string
+	// AddRequestHeaders are set on forwarded requests after RemoveRequestHeaders, replacing headers of the client
+	// PreRequest hooks run afterwards and see them.
+	AddRequestHeaders map[string]string
+	// Default forwards all requests that match no other target to this target with their path as it is,
+	// e.g. API calls of a script computing root relative paths. Only one target without Host can be the default.
+	Default bool
+	// PathTransform rewrites the path of forwarded requests after Prefix and RewritePrefix were applied
+	// it gets and returns a path starting with a slash
+	PathTransform func(string) string
 	// PreRequest can be used to manipulate the http.Request
+	// it runs like a hook added last with AddPreRequest at HookPriorityDefault
 	PreRequest func(*http.Request) *http.Request
 	// PostRequest can be used to manipulate the http.Response
 	// if the request failed, *http.Response will be nil and the returned value will be ignored
+	// it runs like a hook added last with AddPostRequest at HookPriorityDefault
 	PostRequest func(*http.Response) *http.Response
+	// RewriteInlineScripts replaces the absolute URLs of the target inside inline <script> blocks with their proxy URLs
+	// this is a plain text search, not a JavaScript parser, so it is opt-in to avoid false positives
+	RewriteInlineScripts bool
+	// StripSetCookie removes all Set-Cookie headers from upstream responses
+	StripSetCookie bool
+	// StripSetCookiePaths removes Set-Cookie headers from upstream responses to paths starting with one of the given paths
+	// the paths are matched against the upstream path, i.e. without Prefix
+	StripSetCookiePaths []string
+	// InlineAssets embeds small images and stylesheets of the target as data: URIs into rewritten HTML
+	InlineAssets *InlineAssets
+	// LazyLoadAttributes are the attributes used by lazy loading scripts that are rewritten like src
+	// attributes ending with "srcset" are rewritten like srcset, defaults to data-src and data-srcset
+	LazyLoadAttributes []string
+	// LoginCompat keeps form based logins with CSRF protection working, see LoginCompat
+	LoginCompat *LoginCompat
+	// RewriteRules are applied to HTML responses in addition to the built-in rewriting
+	RewriteRules []RewriteRule
+	// RewriteCookies scopes the cookies set by the upstream to the proxy, see rewriteCookie
+	RewriteCookies bool
+	// RewriteExclusions keeps the matching URLs pointing at their origin
+	RewriteExclusions *RewriteExclusions
+	// RewriteRedirects passes redirects of the upstream on to the client instead of following them
+	// with their Location header pointing through the proxy
+	RewriteRedirects bool
+	// FollowRedirects makes the proxy follow redirects to the host of the target itself, see RedirectPolicy.
+	// Without it, the proxy follows all redirects silently, as net/http does.
+	FollowRedirects *RedirectPolicy
+	// RewriteJSON replaces the absolute URLs of the target with their proxy URLs in the string values of JSON responses,
+	// e.g. pagination or HAL links. Object keys, numbers and the formatting are kept as they are.
+	RewriteJSON bool
+	// OpenAPI rewrites the server URLs of API specs to the proxy, see OpenAPI
+	OpenAPI *OpenAPI
+	// DisableRewrite passes HTML and CSS responses through byte for byte, like any other content type
+	// The body is not decompressed either, only the headers are still processed.
+	DisableRewrite bool
+	// RemoveResponseHeaders are removed from the upstream responses, e.g. X-Powered-By
+	// they apply after PostRequest, so headers added by PostRequest hooks are removed as well
+	RemoveResponseHeaders []string
+	// AddResponseHeaders are set on the responses after RemoveResponseHeaders, replacing upstream headers
+	// The CORS headers of the proxy, HeaderProfile and ResponseHeaderRules are applied afterwards.
+	AddResponseHeaders map[string]string
+	// HeaderProfile is the name of a built-in set of header rules, e.g. HeaderProfileIframeEmbed
+	HeaderProfile string
+	// ResponseHeaderRules change the response headers after the HeaderProfile, so they win over it
+	ResponseHeaderRules []HeaderRule
+	// Redactions mask sensitive content of the responses, see RedactionRule
+	Redactions []RedactionRule
+	// ClientCert is presented to the upstream if it asks for a client certificate, it takes precedence over WithBackendClientCert
+	ClientCert *tls.Certificate
+	// DialPolicy overrides the DialPolicy of WithDialPolicy for the target, Auto keeps the one of the proxy
+	DialPolicy DialPolicy
+	// Timeout limits the exchange with the upstream including reading a buffered body, exceeding it answers 504.
+	// Streamed responses like event streams or bodies passed through are not limited once their headers arrived.
+	Timeout time.Duration
+	// DisableWriteTimeout exempts the responses of the target from ServerTimeouts.WriteTimeout, e.g. for long downloads
+	DisableWriteTimeout bool
+	// FanOut forwards every request to all of the destinations instead of BaseUrl, which is optional then.
+	// The body is buffered once and delivered concurrently, PreRequest and PostRequest hooks do not run.
+	FanOut []FanOutDestination
+	// FanOutResponse decides how a FanOut target answers, defaults to RespondPrimary
+	FanOutResponse FanOutResponse
+	// OnDelivery is called with the outcome of every delivery to a FanOut destination
+	OnDelivery func(FanOutDelivery)
+	// Middleware wraps the forwarding of the requests routed to the target, the first one is the outermost.
+	// It runs after WithMiddleware and sees the RequestInfo of the request, see RequestInfoFromContext.
+	Middleware []func(http.Handler) http.Handler
+
+	// transport is the transport configured with ClientCert, nil to use the proxy's transport
+	transport http.RoundTripper
+	// exclusionPatterns are the compiled RewriteExclusions.Patterns
+	exclusionPatterns []*regexp.Regexp
+	// redactionPatterns are the compiled Patterns of each of the Redactions
+	redactionPatterns [][]*regexp.Regexp
+	// preHooks and postHooks are added with AddPreRequest and AddPostRequest, sorted by priority
+	preHooks  []hook[func(*http.Request) *http.Request]
+	postHooks []hook[func(*http.Response) *http.Response]
+}
+
+// defaultLazyLoadAttributes are rewritten if Target.LazyLoadAttributes is not set
+var defaultLazyLoadAttributes = []string{"data-src", "data-srcset"}
+
+// lazyLoadAttributes returns the lazy loading attributes rewritten for the target
+func (t Target) lazyLoadAttributes() []string {
+	if t.LazyLoadAttributes == nil {
+		return defaultLazyLoadAttributes
+	}
+	return t.LazyLoadAttributes
+}
+
+// rewritesBody reports whether the response is rewritten for the target
+// all other responses are passed through as they are
+func (t Target) rewritesBody(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	if t.redacts(contentType) {
+		return true
+	}
+	if t.DisableRewrite {
+		return false
+	}
+	if t.RewriteJSON && isJsonContentType(contentType) {
+		return true
+	}
+	if t.isOpenAPICandidate(resp) {
+		return true
+	}
+	return strings.Contains(contentType, "text/html") || strings.Contains(contentType, "text/css")
+}
+
+// stripsSetCookie reports whether Set-Cookie headers of the response to the given upstream path are removed
+func (t Target) stripsSetCookie(path string) bool {
+	if t.StripSetCookie {
+		return true
+	}
+	for _, stripPath := range t.StripSetCookiePaths {
+		if strings.HasPrefix(path, stripPath) {
+			return true
+		}
+	}
+	return false
 }
 
 type ProxyOption func(*Proxy)
@@ -34,6 +194,27 @@ func WithSsl(cert tls.Certificate) ProxyOption {
 	return func(p *Proxy) { p.cert = &cert }
 }
 
+// WithGeneratedSsl enables SSL like WithSsl with certificates generated by GenerateSslCerts when the proxy is created
+func WithGeneratedSsl(caOrganisation string, opts ...CertOption) ProxyOption {
+	return func(p *Proxy) {
+		p.loadCert = func() (tls.Certificate, error) { return GenerateSslCerts(caOrganisation, opts...) }
+	}
+}
+
+// WithSslFromFiles enables SSL like WithSsl with the PEM encoded certificate and key files
+// NewProxy fails if the files cannot be loaded
+func WithSslFromFiles(certFile, keyFile string) ProxyOption {
+	return func(p *Proxy) {
+		p.loadCert = func() (tls.Certificate, error) { return tls.LoadX509KeyPair(certFile, keyFile) }
+	}
+}
+
+// WithBackendClientCert presents the certificate to upstreams that ask for a client certificate (mTLS)
+// The transport has to be an *http.Transport, it is cloned and not modified.
+func WithBackendClientCert(cert tls.Certificate) ProxyOption {
+	return func(p *Proxy) { p.backendClientCert = &cert }
+}
+
 // WithTransport sets the transport used by the proxy server
 func WithTransport(transport http.RoundTripper) ProxyOption {
 	return func(p *Proxy) { p.transport = transport }
@@ -43,136 +224,872 @@ func WithPort(port int) ProxyOption {
 	return func(p *Proxy) { p.port = port }
 }
 
+// WithRateLimitGovernor makes the proxy respect the rate limit headers of the upstreams
+// (RateLimit-*, X-RateLimit-* and Retry-After). Once an upstream signals its allowance is used up,
+// all following requests to that target are held back until the limit resets.
+// If the reset is further away than maxWait, requests are answered with 503 instead.
+func WithRateLimitGovernor(maxWait time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.governorMaxWait = maxWait
+		p.governors = make(map[string]*rateLimitGovernor)
+	}
+}
+
+// WithGzipLevel sets the compression level used when gzip responses are compressed again after rewriting
+// e.g. gzip.BestSpeed for time-sensitive responses or gzip.BestCompression for storage-bound assets
+// defaults to gzip.DefaultCompression
+func WithGzipLevel(level int) ProxyOption {
+	return func(p *Proxy) { p.gzipLevel = level }
+}
+
+// WithRelaxedCookies drops the Secure flag and downgrades SameSite=None to Lax on upstream cookies,
+// so sessions of HTTPS upstreams keep working if the proxy itself serves plain HTTP.
+// This weakens the cookie security. It only applies to requests the client sent over plain HTTP,
+// judged by the connection, X-Forwarded-Proto of a trusted proxy and the scheme of WithPublicURL.
+func WithRelaxedCookies() ProxyOption {
+	return func(p *Proxy) { p.relaxCookies = true }
+}
+
+// WithCrossTargetRewrite rewrites absolute URLs pointing at any registered target to the prefix of that target,
+// not only those of the target the response came from
+func WithCrossTargetRewrite() ProxyOption {
+	return func(p *Proxy) { p.crossTargetRewrite = true }
+}
+
+// WithMaxResponseHeaders rejects upstream responses with more than n header lines with 502 Bad Gateway
+// to protect the proxy from upstreams flooding it with headers, 0 disables the limit
+func WithMaxResponseHeaders(n int) ProxyOption {
+	return func(p *Proxy) { p.maxResponseHeaders = n }
+}
+
+// WithStreamingResponse passes chunked responses and responses with a Content-Length above minSizeBytes on
+// as they arrive instead of buffering them for rewriting, e.g. large HTML or JSON exports.
+// Such responses are not rewritten. PostRequest hooks still run, as they get the response before its body is read.
+// Responses of targets with Redactions are always buffered, so nothing sensitive is streamed unmasked.
+func WithStreamingResponse(minSizeBytes int64) ProxyOption {
+	return func(p *Proxy) {
+		p.streamResponses = true
+		p.streamingMinSize = minSizeBytes
+	}
+}
+
+// WithPublicURL sets the URL clients reach the proxy at, e.g. "https://example.com/proxy" behind a reverse proxy
+// Rewritten links, redirects and cookies point there. By default they use the scheme and Host of each request.
+func WithPublicURL(u string) ProxyOption {
+	return func(p *Proxy) { p.publicUrl = u }
+}
+
 type Proxy struct {
+	// mu guards targets, governors and mux, which are swapped when the configuration is reloaded
+	mu        sync.RWMutex
 	targets   map[string]Target
+	mux       *router
 	transport http.RoundTripper
-	server    *http.Server
-	port      int
+	// server is the server of ListenAndServe guarded by mu, nil before it started listening
+	server *http.Server
+	// shuttingDown is set by the first Shutdown of server guarded by mu, so repeated calls return immediately
+	shuttingDown bool
+	// listener is the listener of ListenAndServe guarded by mu, nil before it started listening
+	listener     net.Listener
+	listenerFile *os.File
+	// ready is closed once the first listener is bound, see Ready
+	ready     chan struct{}
+	readyOnce sync.Once
+	// served is closed when Serve of ListenAndServe returned, newConns and handingOff are used by Handoff
+	served     chan struct{}
+	newConns   connTracker
+	handingOff atomic.Bool
+	port       int
+	// handler dispatches to the current mux, it is shared by the server and ServeHTTP
+	handler http.Handler
 
-	addr *url.URL
-	cert *tls.Certificate
+	addr     *url.URL
+	cert     *tls.Certificate
+	loadCert func() (tls.Certificate, error)
+
+	backendClientCert *tls.Certificate
+	publicUrl         string
+	dialPolicy        DialPolicy
+
+	// trustedProxies may set X-Forwarded-For, parsed from trustedProxyCidrs by NewProxy
+	trustedProxyCidrs []string
+	trustedProxies    []netip.Prefix
+
+	relaxCookies       bool
+	mutationAudit      bool
+	crossTargetRewrite bool
+	gzipLevel          int
+	readyzTimeout      time.Duration
+	maxResponseHeaders int
+	notFoundHandler    http.Handler
+	hidePrefixes       bool
+	indexPage          bool
+	infoEndpoint       bool
+	adminToken         string
+	// info is the snapshot served by the info endpoint, see updateInfo
+	info atomic.Pointer[Info]
+	// streamingMinSize is the body size from which responses are streamed without rewriting, see WithStreamingResponse
+	streamResponses  bool
+	streamingMinSize int64
+
+	metricsRegistry prometheus.Registerer
+	metrics         *proxyMetrics
+	tracer          trace.Tracer
+
+	logger   *slog.Logger
+	logLevel slog.Leveler
+	// completedLevel is the level of the completion of a request, Info only if WithLogger or WithLogLevel is used
+	completedLevel slog.Level
+
+	// governors hold the per target rate limit state, nil if WithRateLimitGovernor is not used
+	governors       map[string]*rateLimitGovernor
+	governorMaxWait time.Duration
+
+	// preflightCache answers repeated CORS preflights, nil if WithPreflightCache is not used
+	preflightCache *preflightCache
+
+	// inFlightCount counts the requests that are currently forwarded, Shutdown waits for them
+	inFlightCount atomic.Int64
+	// idle is closed once inFlightCount drops to zero and replaced by the next request, idleMu guards both
+	idle         chan struct{}
+	idleMu       sync.Mutex
+	drainTimeout time.Duration
+	timeouts     ServerTimeouts
+	drainHooks   []func()
+	// abort is cancelled when Shutdown gives up draining, it cancels the upstream requests, guarded by mu
+	abort         context.Context
+	abortRequests context.CancelFunc
+	gracePeriod   time.Duration
+
+	// middleware wraps handler, see WithMiddleware
+	middleware []func(http.Handler) http.Handler
+
+	// configWatchInterval is the interval the config file of NewProxyFromFile is checked for changes
+	configWatchInterval time.Duration
+	stopConfigWatcher   context.CancelFunc
 }
 
 func NewProxy(opts ...ProxyOption) (*Proxy, error) {
 	p := &Proxy{
+		ready:     make(chan struct{}),
 		targets:   make(map[string]Target),
 		transport: http.DefaultTransport,
+		gzipLevel: gzip.DefaultCompression,
 	}
+	p.abort, p.abortRequests = context.WithCancel(context.Background())
 	for _, opt := range opts {
 		opt(p)
 	}
 
+	err := validateProxy(p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.completedLevel = slog.LevelDebug
+	if p.logger != nil || p.logLevel != nil {
+		p.completedLevel = slog.LevelInfo
+	}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+	if p.logLevel != nil {
+		p.logger = slog.New(&levelHandler{level: p.logLevel, handler: p.logger.Handler()})
+	}
+
+	for _, cidr := range p.trustedProxyCidrs {
+		prefix, err := parseTrustedProxy(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing trusted proxy: %w", err)
+		}
+		p.trustedProxies = append(p.trustedProxies, prefix)
+	}
+
+	if p.backendClientCert != nil {
+		p.transport, err = withClientCert(p.transport, *p.backendClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring backend client certificate: %w", err)
+		}
+	}
+	p.transport, err = withDialPolicy(p.transport, p.dialPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring dial policy: %w", err)
+	}
+
+	if p.loadCert != nil {
+		cert, err := p.loadCert()
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificates: %w", err)
+		}
+		p.cert = &cert
+	}
+
+	p.mux = p.buildMux()
+	p.handler = chainMiddleware(http.HandlerFunc(p.serveHTTP), p.middleware)
+
 	p.addr = &url.URL{Scheme: "http", Host: fmt.Sprintf("0.0.0.0:%d", p.port)}
 
 	if p.cert != nil {
 		p.addr.Scheme = "https"
 	}
 
+	if p.metricsRegistry != nil {
+		metrics, err := newProxyMetrics(p.metricsRegistry)
+		if err != nil {
+			return nil, fmt.Errorf("error registering metrics: %w", err)
+		}
+		p.metrics = metrics
+	}
+	p.updateInfo()
+
 	return p, nil
 }
 
 func (p *Proxy) AddTarget(target Target) error {
-	if !strings.HasPrefix(target.Prefix, "/") {
-		target.Prefix = "/" + target.Prefix
+	target, err := p.prepareTarget(target)
+	if err != nil {
+		return err
 	}
 
-	_, err := url.Parse(target.BaseUrl)
-	if err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := validateRoute(p.targets, target); err != nil {
 		return err
 	}
+	p.targets[target.route()] = target
+	if p.governors != nil {
+		p.governors[target.route()] = newRateLimitGovernor(p.governorMaxWait)
+	}
+	p.mux = p.buildMux()
+	return nil
+}
+
+// ErrUnknownTarget is returned by RemoveTarget if no target is registered at the prefix
+var ErrUnknownTarget = errors.New("no target registered at prefix")
 
-	p.targets[target.Prefix] = target
+// RemoveTarget unregisters the target at the prefix, later requests to it are answered with 404
+// Targets with a Host are removed by their Host followed by their Prefix, e.g. "github.localhost/".
+// Requests already forwarded to the target are completed.
+func (p *Proxy) RemoveTarget(prefix string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix = p.routeKey(prefix)
+	if _, ok := p.targets[prefix]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTarget, prefix)
+	}
+	delete(p.targets, prefix)
+	delete(p.governors, prefix)
+	p.mux = p.buildMux()
 	return nil
 }
 
+// routeKey returns the key of p.targets for a prefix given with or without leading and trailing slash, p.mu has to be held
+func (p *Proxy) routeKey(route string) string {
+	if _, ok := p.targets[route]; ok {
+		return route
+	}
+	return normalizePrefix(route)
+}
+
+// normalizePrefix returns the prefix with a leading and a trailing slash, e.g. "/api/" for "api"
+func normalizePrefix(prefix string) string {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// prepareTarget normalizes and validates a target before it is registered
+func (p *Proxy) prepareTarget(target Target) (Target, error) {
+	// a blank prefix is rejected by validateTarget, except for host targets, which serve the whole host by default
+	if strings.TrimSpace(target.Prefix) != "" {
+		target.Prefix = normalizePrefix(target.Prefix)
+	} else if target.Host != "" {
+		target.Prefix = "/"
+	}
+	target.Host = strings.ToLower(target.Host)
+
+	err := errors.Join(validateTarget(target), p.validateIndexPage(target), p.validateBuiltinRoutes(target))
+	if err != nil {
+		return Target{}, err
+	}
+
+	if target.ClientCert != nil {
+		target.transport, err = withClientCert(p.transport, *target.ClientCert)
+		if err != nil {
+			return Target{}, fmt.Errorf("error configuring client certificate of target %s: %w", target.Prefix, err)
+		}
+	}
+	if target.DialPolicy != Auto {
+		target.transport, err = withDialPolicy(p.upstreamTransport(target), target.DialPolicy)
+		if err != nil {
+			return Target{}, fmt.Errorf("error configuring dial policy of target %s: %w", target.Prefix, err)
+		}
+	}
+	target.exclusionPatterns, err = compileExclusions(target.RewriteExclusions)
+	if err != nil {
+		return Target{}, fmt.Errorf("error compiling rewrite exclusions of target %s: %w", target.Prefix, err)
+	}
+	target.redactionPatterns, err = compileRedactions(target.Redactions)
+	if err != nil {
+		return Target{}, fmt.Errorf("error compiling redactions of target %s: %w", target.Prefix, err)
+	}
+	return target, nil
+}
+
+// upstreamTransport returns the transport used for requests to the target
+func (p *Proxy) upstreamTransport(target Target) http.RoundTripper {
+	if target.transport != nil {
+		return target.transport
+	}
+	return p.transport
+}
+
+// RateLimitState returns the rate limit the upstream of the target with the given prefix last reported
+// The second return value is false if there is no such target or WithRateLimitGovernor is not used
+func (p *Proxy) RateLimitState(prefix string) (RateLimitState, bool) {
+	p.mu.RLock()
+	governor, ok := p.governors[p.routeKey(prefix)]
+	p.mu.RUnlock()
+	if !ok {
+		return RateLimitState{}, false
+	}
+	return governor.snapshot(), true
+}
+
 // ListenAndServe starts the proxy server
 // It blocks until the server is shut down
 // If the proxy server was started with WithSsl, it will use http.ListenAndServeTLS instead of http.ListenAndServe
-func (p *Proxy) ListenAndServe() (err error) {
+func (p *Proxy) ListenAndServe() error {
 	// start listener (so we can get the actual port, even if it was chosen by the OS)
-	listener, err := net.Listen("tcp", p.addr.Host)
+	listener, err := p.listen()
 	if err != nil {
 		return fmt.Errorf("error starting listener: %w", err)
 	}
-	defer listener.Close()
-	p.addr.Host = listener.Addr().String()
+	return p.Serve(listener)
+}
 
-	// build server
-	mux := http.NewServeMux()
-	for path, target := range p.targets {
-		target := target
-		mux.HandleFunc(path, p.forwardRequest(&target))
+// ServeTLS is like Serve, but serves TLS with the certificate and key files instead of the certificate of WithSsl
+func (p *Proxy) ServeTLS(listener net.Listener, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("error loading certificates: %w", err)
 	}
-	p.server = &http.Server{
-		Addr:    p.addr.Host,
-		Handler: mux,
+	p.cert = &cert
+	return p.Serve(listener)
+}
+
+// Serve serves the proxy on a listener owned by the caller, e.g. one of systemd socket activation
+// or a netutil.LimitListener. Addr returns the address of the listener afterwards.
+// Like ListenAndServe it serves TLS if WithSsl is used, it closes the listener when it returns.
+func (p *Proxy) Serve(listener net.Listener) error {
+	return p.serve(p.newServer(listener), listener)
+}
+
+// newServer makes the listener the listener of the proxy and creates the server serving it
+func (p *Proxy) newServer(listener net.Listener) *http.Server {
+	// replace instead of modify the address, Addr and the rewriters read it concurrently
+	addr := p.listenAddr()
+	addr.Host = listener.Addr().String()
+	if p.cert != nil {
+		addr.Scheme = "https"
+	}
+	timeouts := p.timeouts.withDefaults()
+	server := &http.Server{
+		Addr:              addr.Host,
+		Handler:           p.handler,
+		ConnState:         p.newConns.track,
+		ReadHeaderTimeout: timeouts.ReadHeaderTimeout,
+		ReadTimeout:       timeouts.ReadTimeout,
+		IdleTimeout:       timeouts.IdleTimeout,
 	}
+	p.mu.Lock()
+	p.addr = &addr
+	p.listener = listener
+	p.server = server
+	p.shuttingDown = false
+	if p.abort.Err() != nil {
+		p.abort, p.abortRequests = context.WithCancel(context.Background())
+	}
+	p.served = make(chan struct{})
+	p.updateInfo()
+	p.mu.Unlock()
+	p.readyOnce.Do(func() { close(p.ready) })
+	return server
+}
+
+// serve serves the listener with the server of newServer until it is shut down
+func (p *Proxy) serve(server *http.Server, listener net.Listener) (err error) {
+	defer listener.Close()
+	p.mu.RLock()
+	served := p.served
+	p.mu.RUnlock()
+	defer close(served)
+
+	info := p.Info()
+	p.logger.Info("Proxy listening", "addr", p.Addr(), "version", info.Version, "commit", info.Commit, "go", info.GoVersion,
+		"os", info.GOOS, "arch", info.GOARCH, "targets", info.Targets, "features", info.enabledFeatures())
+
+	defer func() {
+		// the listener was closed by Handoff, the server is about to shut down
+		if p.handingOff.Load() && errors.Is(err, net.ErrClosed) {
+			err = http.ErrServerClosed
+		}
+	}()
 
 	// start server
 	if p.cert == nil {
-		return p.server.Serve(listener)
+		return server.Serve(listener)
 	}
 
 	// start TLS server
-	p.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*p.cert}}
-	return p.server.ServeTLS(listener, "", "")
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*p.cert}}
+	return server.ServeTLS(listener, "", "")
+}
+
+// buildMux registers all targets at a new router, p.mu has to be held
+func (p *Proxy) buildMux() *router {
+	mux := newRouter()
+	for _, target := range p.targets {
+		target := target
+		mux.handle(target, p.targetHandler(&target))
+	}
+	if p.readyzTimeout > 0 {
+		mux.prefixes.HandleFunc("/readyz", p.handleReadyz)
+	}
+	if p.infoEndpoint {
+		mux.prefixes.HandleFunc(infoPath, p.handleInfo)
+	}
+	mux.notFound = p.notFound()
+	if p.indexPage {
+		mux.prefixes.Handle("/", p.indexHandler(mux.notFound))
+	}
+	p.updateInfo()
+	return mux
+}
+
+// Handler returns the handler forwarding the requests to the targets, e.g. to mount the proxy in another server
+// Targets added later are served by it as well. If it is mounted with http.StripPrefix, the stripped path is part
+// of the rewritten URLs, unless WithPublicURL is used. ListenAndServe serves the same handler.
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// ServeHTTP implements http.Handler, so the proxy can be used without ListenAndServe
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// serveHTTP dispatches the request to the current router
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	mux := p.mux
+	p.mu.RUnlock()
+	mux.ServeHTTP(w, r)
 }
 
+// Shutdown calls the hooks of WithDrainHook, stops the server from accepting new connections and waits for the
+// requests that are still forwarded. If WithDrainTimeout is used, the requests are drained for up to the drain timeout
+// even if ctx is done before. When giving up, the upstream requests still running are cancelled and an error is returned.
+// It returns ErrNotListening if the proxy never listened, calls after the first one return nil immediately.
 func (p *Proxy) Shutdown(ctx context.Context) error {
-	return p.server.Shutdown(ctx)
+	if p.stopConfigWatcher != nil {
+		p.stopConfigWatcher()
+	}
+	p.mu.Lock()
+	server, shuttingDown := p.server, p.shuttingDown
+	p.shuttingDown = true
+	p.mu.Unlock()
+	if server == nil {
+		return ErrNotListening
+	}
+	if shuttingDown {
+		return nil
+	}
+	for _, hook := range p.drainHooks {
+		hook()
+	}
+	err := server.Shutdown(ctx)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	drainCtx := ctx
+	if p.drainTimeout > 0 {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithTimeout(context.Background(), p.drainTimeout)
+		defer cancel()
+	}
+	return p.drain(drainCtx)
+}
+
+// Ready returns a channel that is closed once the proxy listens, e.g. by ListenAndServe, Serve or Run.
+// Afterwards Addr returns the address of the listener including a port chosen by the OS.
+// It is never closed if the proxy fails to listen, so wait for it together with the error of ListenAndServe.
+func (p *Proxy) Ready() <-chan struct{} {
+	return p.ready
 }
 
+// Addr returns the URL the proxy listens on, wait for Ready before, as the port is unknown until then
 func (p *Proxy) Addr() string {
-	return p.addr.String()
+	addr := p.listenAddr()
+	return addr.String()
+}
+
+// publicBase returns the URL the client reached the proxy at, without trailing slash
+// For targets with a Host it is the host of the request, as the public URL only applies to the prefix targets.
+func (p *Proxy) publicBase(r *http.Request, target Target) string {
+	if p.publicUrl != "" && target.Host == "" {
+		return strings.TrimSuffix(p.publicUrl, "/")
+	}
+	if r.Host == "" {
+		addr := p.listenAddr()
+		return addr.String()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := forwardedProto(r, p.trustedProxies); proto != "" {
+		scheme = proto
+	}
+	if publicUrl, err := url.Parse(p.publicUrl); err == nil && publicUrl.Scheme != "" {
+		scheme = publicUrl.Scheme
+	}
+	return scheme + "://" + r.Host + mountPath(r)
+}
+
+// mountPath returns the path the proxy is mounted at in another server, e.g. "/proxy" for http.StripPrefix("/proxy", p)
+// StripPrefix shortens URL.Path but keeps RequestURI, so the mount path is the part of RequestURI in front of URL.Path
+func mountPath(r *http.Request) string {
+	if r.RequestURI == "" {
+		return ""
+	}
+	requestUrl, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return ""
+	}
+	mount, ok := strings.CutSuffix(requestUrl.Path, r.URL.Path)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(mount, "/")
+}
+
+// listenAddr returns a copy of the address the proxy listens on
+func (p *Proxy) listenAddr() url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return *p.addr
 }
 
 func (p *Proxy) forwardRequest(target *Target) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		newReq, err := buildRequest(r, *target)
+		done := p.trackRequest()
+		defer done()
+		p.setWriteDeadline(w, target)
+
+		start := time.Now()
+		info, _ := RequestInfoFromContext(r.Context())
+		requestId := info.RequestID
+		logger := p.logger.With("request_id", requestId)
+		logger.Debug("Forwarding request", "method", r.Method, "path", r.URL.Path, "target", target.Prefix)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = recorder
+		audit := p.newMutationAudit()
+		defer func() {
+			attrs := []any{"status", recorder.status, "latency", time.Since(start), "bytes", recorder.bytes}
+			if recorder.errorClass != "" {
+				attrs = append(attrs, "error_class", recorder.errorClass)
+			}
+			if audit != nil {
+				attrs = append(attrs, "mutations", audit.snapshot())
+			}
+			logger.Log(r.Context(), p.completedLevel, "Request completed", attrs...)
+		}()
+		if p.metrics != nil {
+			done := p.metrics.instrument(target.route(), recorder, r)
+			defer done()
+		}
+		if p.tracer != nil {
+			var end func()
+			r, end = p.startSpan(target, recorder, r)
+			defer end()
+		}
+
+		if len(target.FanOut) > 0 {
+			p.fanOut(w, r, target, recorder, logger)
+			return
+		}
+
+		// answer repeated preflights without asking the upstream again
+		if p.preflightCache != nil && isPreflight(r) && target.addsCorsHeaders() && p.preflightCache.hit(newPreflightKey(r)) {
+			logger.Debug("Serving cached preflight")
+			p.writePreflightResponse(w)
+			return
+		}
+
+		newReq, err := buildRequest(r, *target, p.trustedProxies)
 		if err != nil {
-			slog.Warn("Error constructing new request", "err", err)
+			logger.Error("Error constructing new request", "err", err)
 			http.Error(w, "Error constructing new request", http.StatusBadGateway)
 			return
 		}
+		newReq.Header.Set("X-Request-ID", requestId)
+		loginPath := target.isLoginPath(newReq.URL.Path)
+		if loginPath {
+			translateLoginHeaders(newReq, *target, p.publicBase(r, *target))
+		}
+		p.injectSpan(r.Context(), newReq)
+
+		// hold back the request if the upstream told us to slow down
+		p.mu.RLock()
+		governor := p.governors[target.route()]
+		p.mu.RUnlock()
+		if governor != nil {
+			err = governor.wait(r.Context())
+			var rateLimitErr *errRateLimited
+			if errors.As(err, &rateLimitErr) {
+				logger.Warn("Shedding request due to upstream rate limit", "target", target.Prefix, "err", err)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.retryAfter.Seconds()))))
+				http.Error(w, "Upstream rate limit exhausted", http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				logger.Warn("Error waiting for upstream rate limit", "err", err)
+				http.Error(w, "Error waiting for upstream rate limit", http.StatusBadGateway)
+				return
+			}
+		}
 
 		// Send the new request
-		if target.PreRequest != nil {
-			newReq = target.PreRequest(newReq)
+		newReq, cancel := p.abortable(newReq)
+		defer cancel()
+		newReq, stopTimeout := target.withTimeout(newReq)
+		defer stopTimeout()
+		newReq = target.runPreRequest(newReq)
+		client := &http.Client{Transport: p.upstreamTransport(*target)}
+		var redirects *redirectFollower
+		if loginPath || target.RewriteRedirects {
+			// the client has to see the redirect, to store the cookies set with it or to follow it through the proxy
+			client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		} else if target.FollowRedirects != nil {
+			redirects = &redirectFollower{policy: *target.FollowRedirects}
+			client.CheckRedirect = redirects.checkRedirect
 		}
-		client := &http.Client{Transport: p.transport}
 		resp, err := client.Do(newReq)
-		if target.PostRequest != nil {
-			resp = target.PostRequest(resp)
+		if err != nil && !isRedirectLimit(err) {
+			recorder.errorClass = ClassifyError(err)
+			if timedOut(newReq) {
+				recorder.errorClass = Timeout
+			}
+			reportUpstreamError(newReq, recorder.errorClass)
+		}
+		if governor != nil && resp != nil {
+			governor.observe(resp)
+		}
+		resp = target.runPostRequest(resp)
+		if isRedirectLimit(err) {
+			logger.Warn("Upstream redirects not followed", "err", err)
+			http.Error(w, "Upstream redirect loop or too many redirects", http.StatusLoopDetected)
+			return
 		}
 		if err != nil {
-			slog.Warn("Error forwarding request", "err", err)
-			http.Error(w, "Error forwarding request", http.StatusBadGateway)
+			logger.Warn("Error forwarding request", "err", err, "error_class", recorder.errorClass)
+			status := http.StatusBadGateway
+			if timedOut(newReq) {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(w, upstreamErrorMessages[recorder.errorClass], status)
 			return
 		}
+		// the timeout covers reading the body only if it is buffered, streams last as long as they need
+		if !p.buffersBody(resp, *target) {
+			stopTimeout()
+		}
+		if p.maxResponseHeaders > 0 {
+			if count := countHeaders(resp.Header); count > p.maxResponseHeaders {
+				resp.Body.Close()
+				logger.Warn("Upstream response has too many headers", "count", count, "max", p.maxResponseHeaders)
+				http.Error(w, "Upstream response has too many headers", http.StatusBadGateway)
+				return
+			}
+		}
 
 		// If it's an OPTIONS request (a preflight CORS request), respond with OK
-		if r.Method == http.MethodOptions {
-			// Add CORS headers
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-			w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodOptions && target.addsCorsHeaders() {
+			resp.Body.Close()
+			if p.preflightCache != nil && isPreflight(r) {
+				p.preflightCache.store(newPreflightKey(r))
+			}
+			p.writePreflightResponse(w)
 			return
 		}
 
-		err = p.copyResponse(resp, w, *target)
+		if redirects != nil && len(redirects.hops) > 0 {
+			w.Header().Set(redirectsHeader, redirects.header())
+		}
+		err = p.copyResponse(r, resp, w, *target, audit)
+		if err != nil && timedOut(newReq) {
+			recorder.errorClass = Timeout
+			logger.Warn("Upstream response timed out", "err", err, "error_class", recorder.errorClass)
+			http.Error(w, upstreamErrorMessages[recorder.errorClass], http.StatusGatewayTimeout)
+			return
+		}
 		if err != nil {
-			slog.Warn("Error copying response", "err", err)
+			logger.Error("Error copying response", "err", err)
 			http.Error(w, "Error copying response", http.StatusBadGateway)
 			return
 		}
 	}
 }
 
-func (p *Proxy) copyResponse(resp *http.Response, w http.ResponseWriter, target Target) error {
+// buffersBody reports whether copyResponse reads the whole body of the response before writing it
+func (p *Proxy) buffersBody(resp *http.Response, target Target) bool {
+	return !isEventStream(resp) && target.rewritesBody(resp) && !p.streamsBody(resp, target)
+}
+
+// streamsBody reports whether the body of the response is too large to be buffered for rewriting, see WithStreamingResponse
+func (p *Proxy) streamsBody(resp *http.Response, target Target) bool {
+	if !p.streamResponses || target.redacts(resp.Header.Get("Content-Type")) {
+		return false
+	}
+	return slices.Contains(resp.TransferEncoding, "chunked") || resp.ContentLength > p.streamingMinSize
+}
+
+// isEventStream reports whether the response is a stream of Server-Sent Events
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// streamBody copies the body to w and flushes after every read, until the body ends or ctx is done
+func streamBody(ctx context.Context, w http.ResponseWriter, body io.ReadCloser) error {
+	// a read blocks until the upstream sends the next event, closing the body unblocks it once the client is gone
+	stop := context.AfterFunc(ctx, func() { body.Close() })
+	defer stop()
+
+	controller := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return nil // the client is gone
+			}
+			if flushErr := controller.Flush(); flushErr != nil && !errors.Is(flushErr, http.ErrNotSupported) {
+				return nil
+			}
+		}
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error streaming response body: %w", err)
+		}
+	}
+}
+
+// countHeaders returns the number of header lines, a header with multiple values counts once per value
+func countHeaders(header http.Header) int {
+	count := 0
+	for _, values := range header {
+		count += len(values)
+	}
+	return count
+}
+
+// isRedirect reports whether the status code redirects the client to the Location header
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// bodyAllowed reports whether a response with the status code may carry a body, 1xx, 204 and 304 responses never do
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// rewriteLocation points the Location header of a redirect to the upstream back to the proxy
+func (p *Proxy) rewriteLocation(header http.Header, resp *http.Response, target Target, publicBase string) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+	pageUrl, _ := url.Parse(target.BaseUrl)
+	if resp.Request != nil {
+		pageUrl = resp.Request.URL
+	}
+	if target.isExcluded(pageUrl, location) {
+		return
+	}
+	if newLocation, ok := p.rewriteUrl(location, target, publicBase); ok {
+		header.Set("Location", newLocation)
+	}
+}
+
+func (p *Proxy) copyResponse(r *http.Request, resp *http.Response, w http.ResponseWriter, target Target, audit *mutationAudit) error {
+	publicBase := p.publicBase(r, target)
+	var upstreamHeader http.Header
+	if audit != nil {
+		upstreamHeader = resp.Header.Clone()
+	}
+
 	// Copy the headers from the target server to the original response writer
-	copyHeaders(resp, w)
+	copyHeaders(resp, w, target)
+	// the body might be rewritten or recompressed, so the upstream length is not reliable anymore
+	rewriteBody := target.rewritesBody(resp) && !p.streamsBody(resp, target)
+	if rewriteBody {
+		w.Header().Del("Content-Length")
+	}
+	loginPath := resp.Request != nil && target.isLoginPath(resp.Request.URL.Path)
+	if loginPath {
+		dropCookieDomains(w.Header())
+	}
+	if loginPath || ((target.RewriteRedirects || target.FollowRedirects != nil) && isRedirect(resp.StatusCode)) {
+		p.rewriteLocation(w.Header(), resp, target, publicBase)
+	}
+	if target.RewriteCookies {
+		rewriteCookies(w.Header(), publicBase, target.Prefix)
+	}
+	// the client may reach the proxy over HTTPS without its certificate, e.g. through a load balancer
+	if p.relaxCookies && strings.HasPrefix(publicBase, "http://") {
+		relaxCookies(w.Header())
+	}
+
+	// event streams never end, so every chunk is passed on as soon as it arrives instead of buffering the body
+	if isEventStream(resp) {
+		defer resp.Body.Close()
+		clearWriteDeadline(w)
+		w.Header().Del("Content-Length")
+		audit.finish(upstreamHeader, w.Header())
+		w.WriteHeader(resp.StatusCode)
+		return streamBody(r.Context(), w, resp.Body)
+	}
+
+	// pass the upstream bytes through untouched, still encoded and with their Content-Length,
+	// so clients can show the progress of large downloads
+	if !rewriteBody {
+		defer resp.Body.Close()
+		audit.finish(upstreamHeader, w.Header())
+		w.WriteHeader(resp.StatusCode)
+		if err := p.liftWriteDeadline(w, target); err != nil {
+			return fmt.Errorf("error writing response headers: %w", err)
+		}
+		_, err := io.Copy(w, resp.Body)
+		if err != nil {
+			return fmt.Errorf("error copying response body: %w", err)
+		}
+		return nil
+	}
 
 	// we have to decompress the response before we can copy the body
 	encoding := resp.Header.Get("Content-Encoding")
@@ -183,43 +1100,167 @@ func (p *Proxy) copyResponse(resp *http.Response, w http.ResponseWriter, target
 		}
 	}
 	defer resp.Body.Close()
+	var upstreamBody *countingReader
+	if audit != nil {
+		upstreamBody = &countingReader{ReadCloser: resp.Body}
+		resp.Body = upstreamBody
+	}
 
 	// Copy the body from the target server to the original response writer
-	newBody, err := p.copyBody(resp, target)
+	var newBody []byte
+	var err error
+	if target.DisableRewrite {
+		// the body is only read for the redactions
+		newBody, err = io.ReadAll(resp.Body)
+	} else {
+		newBody, err = p.copyBody(resp, target, publicBase, audit)
+	}
 	if err != nil {
 		return fmt.Errorf("error copying response body: %w", err)
 	}
+	if len(target.Redactions) > 0 {
+		var redactions int
+		newBody, redactions = target.redact(resp.Header.Get("Content-Type"), newBody)
+		audit.redactions(redactions)
+	}
+	rewrittenLength := len(newBody)
 
 	// compress the response again
 	if encoding != "" {
-		newBody, err = internal.CompressBody(newBody, internal.SupportedCompression(encoding))
+		newBody, err = internal.CompressBody(newBody, internal.SupportedCompression(encoding), p.gzipLevel)
 		if err != nil {
 			return fmt.Errorf("error compressing response body: %w", err)
 		}
 		w.Header().Set("Content-Encoding", encoding)
 	}
 
+	// the body is buffered anyway, so its length is known, HEAD responses and some statuses have no body to measure
+	if r.Method != http.MethodHead && bodyAllowed(resp.StatusCode) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(newBody)))
+	}
+	if audit != nil {
+		compressedLength := 0
+		if encoding != "" {
+			compressedLength = len(newBody)
+		}
+		audit.bodySizes(upstreamBody.n, rewrittenLength, compressedLength)
+		audit.finish(upstreamHeader, w.Header())
+	}
 	w.WriteHeader(resp.StatusCode)
 	w.Write([]byte(newBody))
 	return nil
 }
 
-func copyHeaders(resp *http.Response, w http.ResponseWriter) {
-	for name, values := range resp.Header {
+func copyHeaders(resp *http.Response, w http.ResponseWriter, target Target) {
+	stripSetCookie := resp.Request != nil && target.stripsSetCookie(resp.Request.URL.Path) && !target.isLoginPath(resp.Request.URL.Path)
+	header := resp.Header.Clone()
+	stripHopByHopHeaders(header)
+	for name, values := range header {
+		if stripSetCookie && http.CanonicalHeaderKey(name) == "Set-Cookie" {
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
+	for _, name := range target.RemoveResponseHeaders {
+		w.Header().Del(name)
+	}
+	for name, value := range target.AddResponseHeaders {
+		w.Header().Set(name, value)
+	}
 
 	// Add CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if target.addsCorsHeaders() {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	}
+	target.applyHeaderRules(w.Header())
+}
+
+// statusRecorder remembers the status code and the number of bytes written to the underlying ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+	// errorClass is the class of the error forwarding the request, empty if it was forwarded
+	errorClass ErrorClass
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
 }
 
-func (p *Proxy) copyBody(resp *http.Response, target Target) ([]byte, error) {
+// Unwrap gives http.ResponseController access to the underlying ResponseWriter, e.g. to flush it
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (p *Proxy) copyBody(resp *http.Response, target Target, publicBase string, audit *mutationAudit) ([]byte, error) {
+	contentType := resp.Header.Get("Content-Type")
+	pageUrl, _ := url.Parse(target.BaseUrl)
+	if resp.Request != nil {
+		pageUrl = resp.Request.URL
+	}
+	rewriteUrl := func(val string) (string, bool) {
+		if target.isExcluded(pageUrl, val) {
+			return val, false
+		}
+		return p.rewriteUrl(val, target, publicBase)
+	}
+	proxyBase, err := url.Parse(publicBase)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public base URL: %w", err)
+	}
+	proxyBase.Path = JoinURL(proxyBase.Path, target.Prefix)
+
+	// rewrite the server URLs of API specs, other JSON and YAML documents are handled below
+	if target.isOpenAPICandidate(resp) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading (decompressed) response body")
+		}
+		if rewritten, ok := rewriteOpenAPI(body, target, proxyBase, audit.rewrites("openapi", rewriteUrl)); ok {
+			return rewritten, nil
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// rewrite the absolute URLs in the string values of JSON documents
+	if target.RewriteJSON && isJsonContentType(contentType) {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading (decompressed) response body")
+		}
+		return rewriteJsonStrings(body, audit.replacements("json", func(val string) string {
+			return replaceTargetUrls(val, target, rewriteUrl)
+		})), nil
+	}
+
+	// rewrite the url() and @import references of stylesheets
+	if strings.Contains(contentType, "text/css") {
+		css, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading (decompressed) response body")
+		}
+		return []byte(rewriteCssUrls(string(css), audit.rewrites("css", rewriteUrl))), nil
+	}
+
 	// if not HTML just copy the body
-	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+	if !strings.Contains(contentType, "text/html") {
 		return io.ReadAll(resp.Body)
 	}
 
@@ -228,26 +1269,85 @@ func (p *Proxy) copyBody(resp *http.Response, target Target) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading (decompressed) response body")
 	}
-	document, err := goquery.NewDocumentFromReader(bytes.NewReader(originalBody))
+	// fragments fetched by scripts are rewritten without adding html, head and body elements around them
+	root, err := parseHtml(originalBody)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing HTML content")
 	}
+	document := goquery.NewDocumentFromNode(root)
+	// find skips the elements excluded from rewriting
+	find := func(selector string) *goquery.Selection {
+		return target.RewriteExclusions.filter(document.Find(selector))
+	}
+	target.addNoReferrer(document, pageUrl)
 
-	// Replace all links and script tags with the proxy URL
-	document.Find("a[href], img[src], link[href], script[src]").Each(func(index int, element *goquery.Selection) {
-		for _, attr := range []string{"href", "src"} {
-			if val, exists := element.Attr(attr); exists {
-				isDynamic := strings.HasPrefix(val, "/")
-				isOnOriginalHost := strings.HasPrefix(val, target.BaseUrl)
+	// Inline small assets before the remaining URLs are rewritten
+	if target.InlineAssets != nil && resp.Request != nil {
+		inliner := newAssetInliner(p, target, publicBase, resp.Request.Context())
+		inliner.inlineDocument(document, resp.Request.URL)
+	}
 
-				url := p.addr
-				url.Path = internal.JoinUrl(target.Prefix, strings.TrimPrefix(val, target.BaseUrl))
-				if isDynamic || isOnOriginalHost {
-					element.SetAttr(attr, url.String())
-				}
+	// Replace all links, embedded resources and form targets with the proxy URL
+	for _, urlAttr := range urlAttributes {
+		selector := urlAttr.element + "[" + urlAttr.attr + "]"
+		rewriteAttr := audit.rewrites(selector, rewriteUrl)
+		find(selector).Each(func(index int, element *goquery.Selection) {
+			val, _ := element.Attr(urlAttr.attr)
+			if newVal, ok := rewriteAttr(val); ok {
+				element.SetAttr(urlAttr.attr, newVal)
 			}
+		})
+	}
+
+	// Replace the URL of meta refreshes
+	find("meta[http-equiv][content]").Each(func(index int, element *goquery.Selection) {
+		if httpEquiv, _ := element.Attr("http-equiv"); !strings.EqualFold(httpEquiv, "refresh") {
+			return
 		}
+		content, _ := element.Attr("content")
+		element.SetAttr("content", rewriteMetaRefresh(content, audit.rewrites("meta[http-equiv=refresh]", rewriteUrl)))
+	})
+
+	// Replace the candidates of responsive images
+	find("img[srcset], source[srcset]").Each(func(index int, element *goquery.Selection) {
+		srcset, _ := element.Attr("srcset")
+		element.SetAttr("srcset", rewriteSrcset(srcset, audit.rewrites("[srcset]", rewriteUrl)))
+	})
+
+	// Replace the URLs of lazy loaded elements
+	for _, attr := range target.lazyLoadAttributes() {
+		rewriteAttr := audit.rewrites("["+attr+"]", rewriteUrl)
+		find("[" + attr + "]").Each(func(index int, element *goquery.Selection) {
+			val, _ := element.Attr(attr)
+			if strings.HasSuffix(attr, "srcset") {
+				element.SetAttr(attr, rewriteSrcset(val, rewriteAttr))
+				return
+			}
+			if newVal, ok := rewriteAttr(val); ok {
+				element.SetAttr(attr, newVal)
+			}
+		})
+	}
+
+	// Replace the URLs in inline styles
+	find("[style]").Each(func(index int, element *goquery.Selection) {
+		style, _ := element.Attr("style")
+		element.SetAttr("style", rewriteCssUrls(style, audit.rewrites("[style]", rewriteUrl)))
 	})
+	replaceText(find("style"), func(css string) string { return rewriteCssUrls(css, audit.rewrites("style", rewriteUrl)) })
+
+	// Replace the URLs of the target in inline scripts
+	replaceUrls := func(text string) string {
+		return replaceTargetUrls(text, target, rewriteUrl)
+	}
+	if target.RewriteInlineScripts {
+		replaceText(find("script:not([src])"), audit.replacements("script", replaceUrls))
+	}
+
+	// Apply the rules of the target on top of the built-in ones
+	for _, rule := range target.RewriteRules {
+		audit.rule(rule.Selector, rule.apply(find, proxyBase, rewriteUrl, replaceUrls))
+	}
 
 	// parse back to HTML
 	newBody, err := document.Html()
@@ -258,7 +1358,37 @@ func (p *Proxy) copyBody(resp *http.Response, target Target) ([]byte, error) {
 	return []byte(newBody), nil
 }
 
-func buildRequest(originalReq *http.Request, target Target) (*http.Request, error) {
+// fetchUpstream requests the given URL of the target through the proxy's transport and the target's hooks
+// it returns the decompressed body and its content type
+func (p *Proxy) fetchUpstream(ctx context.Context, target Target, u *url.URL) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = target.runPreRequest(req)
+	client := &http.Client{Transport: p.upstreamTransport(target)}
+	resp, err := client.Do(req)
+	resp = target.runPostRequest(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	err = internal.DecompressResponse(resp)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decompressing response body: %w", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+func buildRequest(originalReq *http.Request, target Target, trustedProxies []netip.Prefix) (*http.Request, error) {
 	// Create a new URL from the base URL of the target server and the path from the original request
 	targetAsUrl, err := url.Parse(target.BaseUrl)
 	if err != nil {
@@ -267,7 +1397,28 @@ func buildRequest(originalReq *http.Request, target Target) (*http.Request, erro
 	newURL := *originalReq.URL
 	newURL.Scheme = targetAsUrl.Scheme
 	newURL.Host = targetAsUrl.Host
-	newURL.Path = strings.TrimPrefix(newURL.Path, target.Prefix)
+	if newURL.Path == strings.TrimSuffix(target.Prefix, "/") {
+		// the prefix without trailing slash is the root of the target
+		newURL.Path = ""
+	} else {
+		newURL.Path = strings.TrimPrefix(newURL.Path, target.Prefix)
+	}
+	if target.RewritePrefix != "" {
+		newURL.Path = JoinURL(target.RewritePrefix, newURL.Path)
+	}
+	if target.PathTransform != nil {
+		newURL.Path = target.PathTransform("/" + strings.TrimPrefix(newURL.Path, "/"))
+	}
+	if len(target.AddQueryParams) > 0 || len(target.StripQueryParams) > 0 {
+		query := newURL.Query()
+		for _, name := range target.StripQueryParams {
+			query.Del(name)
+		}
+		for name, value := range target.AddQueryParams {
+			query.Set(name, value)
+		}
+		newURL.RawQuery = query.Encode()
+	}
 
 	// Create a new request with the original method, the new URL, and the original body
 	bodyBytes, err := io.ReadAll(originalReq.Body)
@@ -278,6 +1429,8 @@ func buildRequest(originalReq *http.Request, target Target) (*http.Request, erro
 	if err != nil {
 		return nil, fmt.Errorf("error creating new request")
 	}
+	// the body is sent again if a 307 or 308 redirect is followed
+	newReq.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(bodyBytes)), nil }
 
 	// Copy the original headers to the new request
 	for name, values := range originalReq.Header {
@@ -285,6 +1438,14 @@ func buildRequest(originalReq *http.Request, target Target) (*http.Request, erro
 			newReq.Header.Add(name, value)
 		}
 	}
+	stripHopByHopHeaders(newReq.Header)
+	setForwardedHeaders(originalReq, newReq, trustedProxies)
+	for _, name := range target.RemoveRequestHeaders {
+		newReq.Header.Del(name)
+	}
+	for name, value := range target.AddRequestHeaders {
+		newReq.Header.Set(name, value)
+	}
 
 	newReq.Close = true
 	return newReq, nil
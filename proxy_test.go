@@ -1,13 +1,41 @@
 package proxy_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	goProxy "golang.org/x/net/proxy"
 
@@ -15,8 +43,15 @@ import (
 	"github.com/FrauElster/proxy/internal"
 	"github.com/FrauElster/proxy/stats"
 	"github.com/FrauElster/proxy/stealth"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/armon/go-socks5"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gopkg.in/yaml.v3"
 )
 
 var GithubTarget = proxy.Target{BaseUrl: "https://github.com", Prefix: "/github/"}
@@ -24,17 +59,17 @@ var WikipediaTarget = proxy.Target{BaseUrl: "https://wikipedia.org", Prefix: "/w
 
 func TestProxy(t *testing.T) {
 	t.Run("Check if the response body is the same", func(t *testing.T) {
-		proxy, err := proxy.NewProxy()
+		p, err := proxy.NewProxy()
 		require.NoError(t, err)
-		err = proxy.AddTarget(GithubTarget)
+		err = p.AddTarget(GithubTarget)
 		require.NoError(t, err)
-		startProxy(t, proxy)
-		defer stopServer(t, proxy)
+		startProxy(t, p)
+		defer stopServer(t, p)
 
 		originalUrl := "https://github.com/FrauElster"
 		originalBody := getBody(t, originalUrl)
 
-		proxyUrl := internal.JoinUrl(proxy.Addr(), GithubTarget.Prefix, "FrauElster")
+		proxyUrl := proxy.JoinURL(p.Addr(), GithubTarget.Prefix, "FrauElster")
 		proxyBody := getBody(t, proxyUrl)
 
 		// due to rewritten URLs the body is not the same
@@ -42,17 +77,17 @@ func TestProxy(t *testing.T) {
 	})
 
 	t.Run("check with SOCKS5 proxy", func(t *testing.T) {
-		proxy, err := proxy.NewProxy(proxy.WithTransport(mustSocksTransport(t)))
+		p, err := proxy.NewProxy(proxy.WithTransport(mustSocksTransport(t)))
 		require.NoError(t, err)
-		err = proxy.AddTarget(GithubTarget)
+		err = p.AddTarget(GithubTarget)
 		require.NoError(t, err)
-		startProxy(t, proxy)
-		defer stopServer(t, proxy)
+		startProxy(t, p)
+		defer stopServer(t, p)
 
 		originalUrl := "https://github.com/FrauElster"
 		originalBody := getBody(t, originalUrl)
 
-		proxyUrl := internal.JoinUrl(proxy.Addr(), GithubTarget.Prefix, "FrauElster")
+		proxyUrl := proxy.JoinURL(p.Addr(), GithubTarget.Prefix, "FrauElster")
 		proxyBody := getBody(t, proxyUrl)
 
 		// due to rewritten URLs the body is not the same
@@ -60,6 +95,4957 @@ func TestProxy(t *testing.T) {
 	})
 }
 
+func TestRateLimitGovernor(t *testing.T) {
+	t.Run("delays requests until the rate limit resets", func(t *testing.T) {
+		var requestCount atomic.Int32
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestCount.Add(1) == 1 {
+				w.Header().Set("X-RateLimit-Limit", "1")
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("RateLimit-Reset", "1")
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer upstream.Close()
+
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/limited/"}
+		p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRateLimitGovernor(5*time.Second))
+
+		require.Equal(t, "ok", getBody(t, proxy.JoinURL(proxyUrl, target.Prefix)))
+		state, ok := p.RateLimitState(target.Prefix)
+		require.True(t, ok)
+		require.Equal(t, 1, state.Limit)
+		require.Equal(t, 0, state.Remaining)
+
+		// the allowance is used up, so the next request has to wait for the reset
+		start := time.Now()
+		require.Equal(t, "ok", getBody(t, proxy.JoinURL(proxyUrl, target.Prefix)))
+		require.GreaterOrEqual(t, time.Since(start), 800*time.Millisecond)
+
+		// after the reset requests pass immediately again
+		start = time.Now()
+		require.Equal(t, "ok", getBody(t, proxy.JoinURL(proxyUrl, target.Prefix)))
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("respects Retry-After of 429 responses", func(t *testing.T) {
+		var requestCount atomic.Int32
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestCount.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer upstream.Close()
+
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/limited/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRateLimitGovernor(5*time.Second))
+
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+		// concurrent follow-up requests all wait for the reset
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("expected status 200, got %d", res.StatusCode)
+				}
+				if time.Since(start) < 800*time.Millisecond {
+					t.Errorf("request was not delayed until the reset")
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("sheds requests if the reset is too far away", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer upstream.Close()
+
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/limited/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRateLimitGovernor(time.Second))
+
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+		res, err = http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		require.NotEmpty(t, res.Header.Get("Retry-After"))
+	})
+}
+
+func TestInlineScriptRewriting(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><script>fetch("%s/api").then(r => r.json())</script></body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	t.Run("rewrites the base URL inside inline scripts", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/scripts/", RewriteInlineScripts: true}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		body := getBody(t, proxy.JoinURL(proxyUrl, target.Prefix))
+		require.Contains(t, body, fmt.Sprintf(`fetch("%s/api")`, proxy.JoinURL(proxyUrl, "scripts")))
+		require.NotContains(t, body, upstream.URL)
+	})
+
+	t.Run("leaves inline scripts untouched by default", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/scripts/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		body := getBody(t, proxy.JoinURL(proxyUrl, target.Prefix))
+		require.Contains(t, body, fmt.Sprintf(`fetch("%s/api")`, upstream.URL))
+	})
+
+	t.Run("base URL with a path", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL + "/app", Prefix: "/scripts/", RewriteInlineScripts: true}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		body := getBody(t, proxy.JoinURL(proxyUrl, target.Prefix))
+		expected, err := proxy.ToProxyURL(target, proxyUrl, upstream.URL+"/api")
+		require.NoError(t, err)
+		require.Contains(t, body, fmt.Sprintf(`fetch("%s")`, expected))
+	})
+}
+
+func TestRelaxedCookies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/; Secure; HttpOnly; SameSite=None")
+		w.Header().Add("Set-Cookie", "theme=dark; SameSite=Strict; Secure")
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/cookies/"}
+
+	t.Run("relaxes cookies over plain HTTP", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRelaxedCookies())
+
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, []string{
+			"session=abc; Path=/; HttpOnly; SameSite=Lax",
+			"theme=dark; SameSite=Strict",
+		}, res.Header.Values("Set-Cookie"))
+	})
+
+	t.Run("keeps cookies untouched over HTTPS", func(t *testing.T) {
+		cert, err := proxy.GenerateSslCerts("Test")
+		require.NoError(t, err)
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRelaxedCookies(), proxy.WithSsl(cert))
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		res, err := client.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, []string{
+			"session=abc; Path=/; Secure; HttpOnly; SameSite=None",
+			"theme=dark; SameSite=Strict; Secure",
+		}, res.Header.Values("Set-Cookie"))
+	})
+
+	t.Run("keeps cookies untouched behind a TLS terminating proxy", func(t *testing.T) {
+		secure := []string{
+			"session=abc; Path=/; Secure; HttpOnly; SameSite=None",
+			"theme=dark; SameSite=Strict; Secure",
+		}
+		get := func(proxyUrl string) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix), nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			res.Body.Close()
+			return res
+		}
+
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithRelaxedCookies(), proxy.WithTrustedProxies("127.0.0.1", "::1"))
+		require.Equal(t, secure, get(proxyUrl).Header.Values("Set-Cookie"))
+
+		_, proxyUrl = newLocalProxy(t, []proxy.Target{target}, proxy.WithRelaxedCookies(), proxy.WithPublicURL("https://example.com"))
+		require.Equal(t, secure, get(proxyUrl).Header.Values("Set-Cookie"))
+
+		// the header of an untrusted client does not count
+		_, proxyUrl = newLocalProxy(t, []proxy.Target{target}, proxy.WithRelaxedCookies(), proxy.WithTrustedProxies("10.0.0.1"))
+		require.Contains(t, get(proxyUrl).Header.Values("Set-Cookie"), "session=abc; Path=/; HttpOnly; SameSite=Lax")
+	})
+
+	t.Run("keeps cookies untouched by default", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Contains(t, res.Header.Values("Set-Cookie"), "session=abc; Path=/; Secure; HttpOnly; SameSite=None")
+	})
+}
+
+func TestArchive(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docs/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><link rel="stylesheet" href="/style.css"><link rel="stylesheet" href="/css/site.css"></head><body>`+
+			`<img src="/img/a.png"><img src="b.png"><img src="/img/missing.png"><img src="https://example.com/x.png">`+
+			`<img src="/img.php?id=1"><img src="/img.php?id=2">`+
+			`</body></html>`)
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "body { color: red; }") })
+	mux.HandleFunc("/css/site.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, `@font-face { src: url("/fonts/a.woff2"); } body { background: url(../img/a.png), url('missing-bg.png'); }`)
+	})
+	mux.HandleFunc("/fonts/a.woff2", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "font a") })
+	mux.HandleFunc("/img/a.png", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "image a") })
+	mux.HandleFunc("/docs/b.png", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "image b") })
+	mux.HandleFunc("/img.php", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "image "+r.URL.Query().Get("id")) })
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/site/"}
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(target))
+
+	dir := t.TempDir()
+	manifest, err := p.Archive(context.Background(), target.Prefix, "/docs/page", proxy.ArchiveOptions{Dir: dir})
+	require.NoError(t, err)
+
+	// the page links to the saved assets
+	page, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(page), `href="style.css"`)
+	require.Contains(t, string(page), `src="img/a.png"`)
+	require.Contains(t, string(page), `src="docs/b.png"`)
+	require.Contains(t, string(page), fmt.Sprintf(`src="%s/img/missing.png"`, upstream.URL))
+	require.Contains(t, string(page), `src="https://example.com/x.png"`)
+
+	for file, content := range map[string]string{"style.css": "body { color: red; }", "img/a.png": "image a", "docs/b.png": "image b"} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		require.NoError(t, err)
+		require.Equal(t, content, string(data))
+	}
+
+	// assets that differ by their query only are saved to files of their own
+	document, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	require.NoError(t, err)
+	files := document.Find(`img[src^="img."]`).Map(func(_ int, element *goquery.Selection) string { return element.AttrOr("src", "") })
+	require.Len(t, files, 2)
+	require.NotEqual(t, files[0], files[1])
+	for i, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("image %d", i+1), string(data))
+	}
+
+	// the references of the stylesheets point at the saved assets relative to the stylesheet
+	css, err := os.ReadFile(filepath.Join(dir, "css", "site.css"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(`@font-face { src: url("../fonts/a.woff2"); } body { background: url(../img/a.png), url('%s/css/missing-bg.png'); }`, upstream.URL), string(css))
+	font, err := os.ReadFile(filepath.Join(dir, "fonts", "a.woff2"))
+	require.NoError(t, err)
+	require.Equal(t, "font a", string(font))
+
+	// the manifest records the failed assets
+	require.Len(t, manifest.Assets, 9)
+	for _, asset := range manifest.Assets {
+		if strings.HasSuffix(asset.Url, "/img/missing.png") || strings.HasSuffix(asset.Url, "/css/missing-bg.png") {
+			require.NotEmpty(t, asset.Error)
+			require.Empty(t, asset.File)
+		} else {
+			require.Empty(t, asset.Error)
+		}
+	}
+	_, err = os.Stat(filepath.Join(dir, "manifest.json"))
+	require.NoError(t, err)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	registry := prometheus.NewRegistry()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/metrics-target/"}
+	p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithPrometheusMetrics(registry))
+
+	for i := 0; i < 3; i++ {
+		getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "found"))
+	}
+	getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "missing"))
+	res, err := http.Post(proxy.JoinURL(proxyUrl, target.Prefix, "found"), "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	expected := `
+# HELP proxy_requests_total Total number of proxied requests.
+# TYPE proxy_requests_total counter
+proxy_requests_total{method="GET",status="200",target="/metrics-target/"} 3
+proxy_requests_total{method="GET",status="404",target="/metrics-target/"} 1
+proxy_requests_total{method="POST",status="200",target="/metrics-target/"} 1
+# HELP proxy_active_requests Number of requests currently being proxied.
+# TYPE proxy_active_requests gauge
+proxy_active_requests{target="/metrics-target/"} 0
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "proxy_requests_total", "proxy_active_requests"))
+	count, err := testutil.GatherAndCount(registry, "proxy_request_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// the metrics handler serves the registry
+	recorder := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "proxy_requests_total")
+}
+
+func TestGzipLevel(t *testing.T) {
+	// a compressible payload that still leaves room between the compression levels
+	random := rand.New(rand.NewSource(1))
+	words := []string{"proxy", "target", "request", "response", "header", "body", "cookie", "stealth"}
+	var payload strings.Builder
+	for i := 0; i < 20000; i++ {
+		payload.WriteString(words[random.Intn(len(words))])
+		payload.WriteString(" ")
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := internal.CompressBody([]byte(payload.String()), internal.Gzip, gzip.DefaultCompression)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "text/css")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/gzip/"}
+
+	compressedSize := func(level int) int {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithGzipLevel(level))
+
+		req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix), nil)
+		require.NoError(t, err)
+		// setting the header ourselves stops the client from decompressing transparently
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		decompressed, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, payload.String(), string(decompressed))
+		return len(body)
+	}
+
+	bestSpeed := compressedSize(gzip.BestSpeed)
+	bestCompression := compressedSize(gzip.BestCompression)
+	require.Less(t, bestCompression, bestSpeed)
+
+	_, err := proxy.NewProxy(proxy.WithGzipLevel(42))
+	require.Error(t, err)
+}
+
+func TestTracing(t *testing.T) {
+	upstreamTraceparent := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdkTrace.NewTracerProvider(sdkTrace.WithSyncer(exporter))
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/traced/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithTracing(provider))
+
+	incomingTraceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	incomingSpanId := "00f067aa0ba902b7"
+	req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix, "path"), nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", incomingTraceId, incomingSpanId))
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusTeapot, res.StatusCode)
+
+	require.Eventually(t, func() bool { return len(exporter.GetSpans()) == 1 }, time.Second, 10*time.Millisecond)
+	span := exporter.GetSpans()[0]
+
+	// the span continues the incoming trace
+	require.Equal(t, incomingTraceId, span.SpanContext.TraceID().String())
+	require.Equal(t, incomingSpanId, span.Parent.SpanID().String())
+
+	// the span is propagated to the upstream
+	forwarded := <-upstreamTraceparent
+	require.Equal(t, fmt.Sprintf("00-%s-%s-01", incomingTraceId, span.SpanContext.SpanID()), forwarded)
+
+	attributes := make(map[string]string)
+	for _, attr := range span.Attributes {
+		attributes[string(attr.Key)] = attr.Value.Emit()
+	}
+	upstreamUrl, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodGet, attributes["http.method"])
+	require.Equal(t, upstream.URL+"/path", attributes["http.url"])
+	require.Equal(t, "418", attributes["http.status_code"])
+	require.Equal(t, upstreamUrl.Hostname(), attributes["net.peer.name"])
+	require.Equal(t, target.Prefix, attributes["proxy.target"])
+}
+
+func TestStripSetCookie(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "tracking=123; Path=/")
+		w.Header().Set("X-Custom", "kept")
+	}))
+	defer upstream.Close()
+
+	setCookies := func(t *testing.T, target proxy.Target, path string) []string {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix, path))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, "kept", res.Header.Get("X-Custom"))
+		return res.Header.Values("Set-Cookie")
+	}
+
+	t.Run("strips all cookies", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/cookies/", StripSetCookie: true}
+		require.Empty(t, setCookies(t, target, "any"))
+	})
+
+	t.Run("strips cookies on matching paths only", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/cookies/", StripSetCookiePaths: []string{"/track"}}
+		require.Empty(t, setCookies(t, target, "track/pixel"))
+		require.Equal(t, []string{"tracking=123; Path=/"}, setCookies(t, target, "page"))
+	})
+
+	t.Run("keeps cookies by default", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/cookies/"}
+		require.Equal(t, []string{"tracking=123; Path=/"}, setCookies(t, target, "any"))
+	})
+}
+
+func TestCssRewriting(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		fmt.Fprintf(w, `@import "/fonts.css";
+@import url(/print.css) print;
+body { background: url(/assets/bg.png); }
+.quoted { background: url("/assets/a.png"), url( '%s/assets/b.png' ); }
+.data { background: url(data:image/png;base64,AAAA); }
+.relative { background: url(img/relative.png); }
+.foreign { background: url("https://other.example/x.png"); }`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/css/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	body := getBody(t, proxied("style.css"))
+	require.Equal(t, fmt.Sprintf(`@import "%s";
+@import url(%s) print;
+body { background: url(%s); }
+.quoted { background: url("%s"), url( '%s' ); }
+.data { background: url(data:image/png;base64,AAAA); }
+.relative { background: url(img/relative.png); }
+.foreign { background: url("https://other.example/x.png"); }`,
+		proxied("fonts.css"), proxied("print.css"), proxied("assets/bg.png"), proxied("assets/a.png"), proxied("assets/b.png")), body)
+}
+
+func TestValidationErrors(t *testing.T) {
+	t.Run("invalid proxy options", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithGzipLevel(42))
+		require.Equal(t, []*proxy.ValidationError{{Field: "GzipLevel", Value: "42", Rule: "range", Message: "must be between -2 and 9"}}, proxy.ValidationErrors(err))
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{BaseUrl: "://missing-scheme", Prefix: "/bad/"})
+
+		var validationErr *proxy.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, "Target.BaseUrl", validationErr.Field)
+		require.Equal(t, "url", validationErr.Rule)
+		require.Len(t, proxy.ValidationErrors(err), 1)
+	})
+
+	t.Run("no validation errors", func(t *testing.T) {
+		require.Empty(t, proxy.ValidationErrors(nil))
+		require.Empty(t, proxy.ValidationErrors(fmt.Errorf("other error")))
+	})
+}
+
+func TestReadyzCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	readyz := func(t *testing.T, targets ...proxy.Target) (int, map[string]bool) {
+		_, proxyUrl := newLocalProxy(t, targets, proxy.WithReadyzCheck(time.Second))
+		res, err := http.Get(proxy.JoinURL(proxyUrl, "readyz"))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+		var body struct {
+			Targets map[string]bool `json:"targets"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return res.StatusCode, body.Targets
+	}
+
+	t.Run("all upstreams healthy", func(t *testing.T) {
+		status, targets := readyz(t, proxy.Target{BaseUrl: healthy.URL, Prefix: "/healthy/"})
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, map[string]bool{"/healthy/": true}, targets)
+	})
+
+	t.Run("one upstream down", func(t *testing.T) {
+		status, targets := readyz(t, proxy.Target{BaseUrl: healthy.URL, Prefix: "/healthy/"}, proxy.Target{BaseUrl: down.URL, Prefix: "/down/"})
+		require.Equal(t, http.StatusServiceUnavailable, status)
+		require.Equal(t, map[string]bool{"/healthy/": true, "/down/": false}, targets)
+	})
+
+	t.Run("targets at the built-in routes are rejected", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithReadyzCheck(time.Second), proxy.WithInfoEndpoint("secret"))
+		require.NoError(t, err)
+		for _, prefix := range []string{"/readyz", "/readyz/", "/_proxy/info"} {
+			err := p.AddTarget(proxy.Target{BaseUrl: healthy.URL, Prefix: prefix})
+			errs := proxy.ValidationErrors(err)
+			require.Len(t, errs, 1, prefix)
+			require.Equal(t, "Target.Prefix", errs[0].Field)
+		}
+		// the paths belong to the targets without the options
+		p, err = proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: healthy.URL, Prefix: "/readyz"}))
+	})
+}
+
+func TestInlineStyleRewriting(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><style>.hero { background: url("/img/hero.png"), url('%s/img/overlay.png'); }</style></head><body>`+
+			`<div id="multi" style="background: url(/img/a.png), url(&quot;/img/b.png&quot;), url(https://other.example/c.png)"></div>`+
+			`<div id="escaped" style="background: url(&quot;/img/a\&quot;b.png&quot;)"></div>`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/styles/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+
+	require.Equal(t, fmt.Sprintf(`.hero { background: url("%s"), url('%s'); }`, proxied("img/hero.png"), proxied("img/overlay.png")), document.Find("style").Text())
+	multi, _ := document.Find("#multi").Attr("style")
+	require.Equal(t, fmt.Sprintf(`background: url(%s), url("%s"), url(https://other.example/c.png)`, proxied("img/a.png"), proxied("img/b.png")), multi)
+	escaped, _ := document.Find("#escaped").Attr("style")
+	// the escaped quote does not end the url, it ends up percent-encoded in the proxy URL
+	require.Equal(t, fmt.Sprintf(`background: url("%s")`, proxied(`img/a%5C%22b.png`)), escaped)
+}
+
+func TestRequestLogging(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	t.Run("logs start and completion with request id", func(t *testing.T) {
+		handler := newRecordingHandler()
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/logged/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithLogger(slog.New(handler)), proxy.WithLogLevel(slog.LevelDebug))
+
+		req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix, "path"), nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Request-ID", "my-request")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+
+		require.Eventually(t, func() bool { return len(handler.RequestRecords()) == 2 }, time.Second, 10*time.Millisecond)
+		records := handler.RequestRecords()
+		require.Equal(t, slog.LevelDebug, records[0].Level)
+		require.Equal(t, map[string]string{"request_id": "my-request", "method": "GET", "path": "/logged/path", "target": "/logged/"}, records[0].attrs)
+		require.Equal(t, slog.LevelInfo, records[1].Level)
+		require.Equal(t, "my-request", records[1].attrs["request_id"])
+		require.Equal(t, "200", records[1].attrs["status"])
+		require.Equal(t, "5", records[1].attrs["bytes"])
+		require.Contains(t, records[1].attrs, "latency")
+
+		startup := handler.Records()[0]
+		require.Equal(t, "Proxy listening", startup.Message)
+		require.Equal(t, proxy.Version(), startup.attrs["version"])
+		require.Equal(t, "1", startup.attrs["targets"])
+	})
+
+	t.Run("generates request ids and respects the log level", func(t *testing.T) {
+		handler := newRecordingHandler()
+		target := proxy.Target{BaseUrl: down.URL, Prefix: "/down/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithLogger(slog.New(handler)), proxy.WithLogLevel(slog.LevelWarn))
+
+		res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+		require.Eventually(t, func() bool { return len(handler.Records()) == 1 }, time.Second, 10*time.Millisecond)
+		record := handler.Records()[0]
+		require.Equal(t, slog.LevelWarn, record.Level)
+		require.Len(t, record.attrs["request_id"], 36)
+		require.Contains(t, record.attrs, "err")
+	})
+
+	t.Run("completion is a debug record of the default logger", func(t *testing.T) {
+		handler := newRecordingHandler()
+		defer slog.SetDefault(slog.Default())
+		slog.SetDefault(slog.New(handler))
+
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/quiet/"}))
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/quiet/path", nil))
+
+		records := handler.RequestRecords()
+		require.Len(t, records, 2)
+		require.Equal(t, "Request completed", records[1].Message)
+		require.Equal(t, slog.LevelDebug, records[1].Level)
+	})
+}
+
+// recordingHandler is a slog.Handler keeping all records with their attributes in memory
+type recordingHandler struct {
+	mu      *sync.Mutex
+	records *[]recordedLog
+	attrs   []slog.Attr
+}
+
+type recordedLog struct {
+	slog.Record
+	attrs map[string]string
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{mu: &sync.Mutex{}, records: &[]recordedLog{}}
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	attrs := make(map[string]string)
+	for _, attr := range h.attrs {
+		attrs[attr.Key] = attr.Value.String()
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value.String()
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.records = append(*h.records, recordedLog{Record: record, attrs: attrs})
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordingHandler{mu: h.mu, records: h.records, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+func (h *recordingHandler) Records() []recordedLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]recordedLog{}, *h.records...)
+}
+
+// RequestRecords returns the records logged for a request, without startup and shutdown messages
+func (h *recordingHandler) RequestRecords() []recordedLog {
+	records := make([]recordedLog, 0)
+	for _, record := range h.Records() {
+		if _, ok := record.attrs["request_id"]; ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestInlineAssets(t *testing.T) {
+	smallImage := strings.Repeat("s", 40)
+	otherSmallImage := strings.Repeat("o", 40)
+	largeImage := strings.Repeat("l", 500)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><link rel="stylesheet" href="/style.css"></head><body>`+
+			`<img id="small" src="/img/small.png"><img id="large" src="/img/large.png"><img id="other" src="/img/other.png">`+
+			`</body></html>`)
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, `body { background: url(img/small.png); } .large { background: url(/img/large.png); }`)
+	})
+	image := func(content string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, content)
+		}
+	}
+	mux.HandleFunc("/nested/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><link rel="stylesheet" href="/nested/style.css"></head><body>`+
+			`<img id="small" src="/img/small.png"><img id="other" src="/img/other.png"></body></html>`)
+	})
+	mux.HandleFunc("/nested/style.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, `body { background: url(/img/small.png); }`)
+	})
+	mux.HandleFunc("/img/small.png", image(smallImage))
+	mux.HandleFunc("/img/other.png", image(otherSmallImage))
+	mux.HandleFunc("/img/large.png", image(largeImage))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	dataUri := func(mediaType, content string) string {
+		return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString([]byte(content))
+	}
+	fetchPage := func(t *testing.T, inline proxy.InlineAssets) (*goquery.Document, func(string) string) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/inline/", InlineAssets: &inline}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "page"))))
+		require.NoError(t, err)
+		return document, func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+	}
+	attr := func(document *goquery.Document, selector, attr string) string {
+		val, _ := document.Find(selector).Attr(attr)
+		return val
+	}
+
+	t.Run("inlines small assets only", func(t *testing.T) {
+		document, proxied := fetchPage(t, proxy.InlineAssets{MaxAssetSize: 200, MaxTotalSize: 1000, MaxDepth: 1})
+
+		require.Equal(t, dataUri("image/png", smallImage), attr(document, "#small", "src"))
+		require.Equal(t, dataUri("image/png", otherSmallImage), attr(document, "#other", "src"))
+		require.Equal(t, proxied("img/large.png"), attr(document, "#large", "src"))
+
+		// the references of the stylesheet are inlined as well or point at the proxy
+		expectedCss := fmt.Sprintf(`body { background: url(%s); } .large { background: url(%s); }`, dataUri("image/png", smallImage), proxied("img/large.png"))
+		require.Equal(t, dataUri("text/css", expectedCss), attr(document, "link", "href"))
+	})
+
+	t.Run("respects the total budget", func(t *testing.T) {
+		document, proxied := fetchPage(t, proxy.InlineAssets{MaxAssetSize: 200, MaxTotalSize: 60})
+
+		// the stylesheet comes first and is too big for the budget after it, the first image still fits
+		require.Equal(t, proxied("style.css"), attr(document, "link", "href"))
+		require.Equal(t, dataUri("image/png", smallImage), attr(document, "#small", "src"))
+		require.Equal(t, proxied("img/other.png"), attr(document, "#other", "src"))
+	})
+
+	nestedCss := fmt.Sprintf(`body { background: url(%s); }`, dataUri("image/png", smallImage))
+	fetchNested := func(t *testing.T, inline proxy.InlineAssets) *goquery.Document {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/inline/", InlineAssets: &inline}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "nested/page"))))
+		require.NoError(t, err)
+		return document
+	}
+
+	t.Run("charges nested assets with their stylesheet only", func(t *testing.T) {
+		document := fetchNested(t, proxy.InlineAssets{MaxAssetSize: 200, MaxTotalSize: len(nestedCss) + len(smallImage), MaxDepth: 1})
+
+		require.Equal(t, dataUri("text/css", nestedCss), attr(document, "link", "href"))
+		require.Equal(t, dataUri("image/png", smallImage), attr(document, "#small", "src"))
+		require.NotContains(t, attr(document, "#other", "src"), "data:")
+	})
+
+	t.Run("refunds the nested assets of rejected stylesheets", func(t *testing.T) {
+		// the rewritten stylesheet exceeds the maximum size, so only the images are inlined
+		budget := len(smallImage) + len(otherSmallImage)
+		document := fetchNested(t, proxy.InlineAssets{MaxAssetSize: len(nestedCss) - 1, MaxTotalSize: budget, MaxDepth: 1})
+
+		require.NotContains(t, attr(document, "link", "href"), "data:")
+		require.Equal(t, dataUri("image/png", smallImage), attr(document, "#small", "src"))
+		require.Equal(t, dataUri("image/png", otherSmallImage), attr(document, "#other", "src"))
+	})
+}
+
+func TestConfigFile(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	t.Run("yaml with hot reload", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "proxy.yaml")
+		writeConfig := func(config string, modified time.Time) {
+			require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+			require.NoError(t, os.Chtimes(configPath, modified, modified))
+		}
+		writeConfig(fmt.Sprintf("targets:\n  - baseUrl: %s\n    prefix: /a/\n", upstream.URL), time.Now().Add(-time.Minute))
+
+		port := freePort(t)
+		p, err := proxy.NewProxyFromFile(configPath, proxy.WithPort(port), proxy.WithConfigWatcher(20*time.Millisecond))
+		require.NoError(t, err)
+		proxyUrl := serveLocalProxy(t, p)
+
+		require.Equal(t, "upstream /x", getBody(t, proxyUrl+"/a/x"))
+		resp, err := http.Get(proxyUrl + "/b/x")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		writeConfig(fmt.Sprintf("targets:\n  - baseUrl: %s\n    prefix: /a/\n  - baseUrl: %s\n    prefix: /b/\n", upstream.URL, upstream.URL), time.Now())
+		require.Eventually(t, func() bool {
+			resp, err := http.Get(proxyUrl + "/b/x")
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, 5*time.Second, 20*time.Millisecond)
+		require.Equal(t, "upstream /x", getBody(t, proxyUrl+"/a/x"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "proxy.json")
+		config := fmt.Sprintf(`{"targets": [{"baseUrl": %q, "prefix": "/c/", "inlineAssets": {"maxAssetSize": 1024}}]}`, upstream.URL)
+		require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+
+		port := freePort(t)
+		p, err := proxy.NewProxyFromFile(configPath, proxy.WithPort(port))
+		require.NoError(t, err)
+		proxyUrl := serveLocalProxy(t, p)
+		require.Equal(t, "upstream /x", getBody(t, proxyUrl+"/c/x"))
+	})
+
+	t.Run("invalid reload keeps targets", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "proxy.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf("targets:\n  - baseUrl: %s\n    prefix: /d/\n", upstream.URL)), 0o644))
+
+		port := freePort(t)
+		p, err := proxy.NewProxyFromFile(configPath, proxy.WithPort(port))
+		require.NoError(t, err)
+		proxyUrl := serveLocalProxy(t, p)
+
+		require.NoError(t, os.WriteFile(configPath, []byte("targets:\n  - baseUrl: \"://broken\"\n    prefix: /e/\n"), 0o644))
+		require.Error(t, p.ReloadConfig(configPath))
+		require.Equal(t, "upstream /x", getBody(t, proxyUrl+"/d/x"))
+	})
+}
+
+func TestMaxResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 200; i++ {
+			w.Header().Set(fmt.Sprintf("X-Flood-%d", i), "1")
+		}
+		fmt.Fprint(w, "flooded")
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/flood/"}
+
+	t.Run("limit exceeded", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithMaxResponseHeaders(100))
+		resp, err := http.Get(proxyUrl + "/flood/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("X-Flood-0"))
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		resp, err := http.Get(proxyUrl + "/flood/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "1", resp.Header.Get("X-Flood-199"))
+	})
+}
+
+func TestSrcsetRewriting(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body>`+
+			`<img id="density" src="/img/hero.png" srcset="/img/hero.png 1x, %s/img/hero@2x.png 2x, https://cdn.example/hero@3x.png 3x">`+
+			`<picture><source id="width" srcset="/img/small.jpg 640w,/img/large.jpg 1280w" media="(min-width: 600px)"></picture>`+
+			`<img id="bare" srcset="/img/only.png">`+
+			`<img id="lazy" data-src="/img/lazy.png" data-srcset="/img/lazy.png 1x, /img/lazy@2x.png 2x" data-original="/img/orig.png">`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	attr := func(document *goquery.Document, selector, name string) string {
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	t.Run("default attributes", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/srcset/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+		require.NoError(t, err)
+
+		require.Equal(t, fmt.Sprintf("%s 1x, %s 2x, https://cdn.example/hero@3x.png 3x", proxied("img/hero.png"), proxied("img/hero@2x.png")), attr(document, "#density", "srcset"))
+		require.Equal(t, fmt.Sprintf("%s 640w,%s 1280w", proxied("img/small.jpg"), proxied("img/large.jpg")), attr(document, "#width", "srcset"))
+		require.Equal(t, proxied("img/only.png"), attr(document, "#bare", "srcset"))
+		require.Equal(t, proxied("img/lazy.png"), attr(document, "#lazy", "data-src"))
+		require.Equal(t, fmt.Sprintf("%s 1x, %s 2x", proxied("img/lazy.png"), proxied("img/lazy@2x.png")), attr(document, "#lazy", "data-srcset"))
+		require.Equal(t, "/img/orig.png", attr(document, "#lazy", "data-original"))
+	})
+
+	t.Run("custom attributes", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/srcset/", LazyLoadAttributes: []string{"data-original"}}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+		require.NoError(t, err)
+
+		require.Equal(t, proxied("img/orig.png"), attr(document, "#lazy", "data-original"))
+		require.Equal(t, "/img/lazy.png", attr(document, "#lazy", "data-src"))
+	})
+}
+
+func TestLoginCompat(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login" && r.Method == http.MethodGet:
+			http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "token-123", Domain: "127.0.0.1", Path: "/", HttpOnly: true})
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><form method="post" action="/login"><input type="hidden" name="csrf" value="token-123"><input name="user"></form></body></html>`)
+		case r.URL.Path == "/login" && r.Method == http.MethodPost:
+			csrfCookie, err := r.Cookie("csrf")
+			if err != nil || csrfCookie.Value != r.FormValue("csrf") {
+				http.Error(w, "csrf token mismatch", http.StatusForbidden)
+				return
+			}
+			if r.Header.Get("Origin") != upstreamUrl || !strings.HasPrefix(r.Header.Get("Referer"), upstreamUrl+"/login") {
+				http.Error(w, "cross origin request", http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: r.FormValue("user"), Domain: "127.0.0.1", Path: "/", HttpOnly: true})
+			http.Redirect(w, r, upstreamUrl+"/dashboard", http.StatusSeeOther)
+		case r.URL.Path == "/dashboard":
+			session, err := r.Cookie("session")
+			if err != nil {
+				http.Error(w, "not logged in", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, "<html><body>welcome %s</body></html>", session.Value)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	login := func(t *testing.T, target proxy.Target) *http.Response {
+		// the upstream cookies are bound to 127.0.0.1, the proxy is reached at [::]
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{Jar: jar}
+
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBodyWithClient(t, client, proxyUrl+"/app/login")))
+		require.NoError(t, err)
+		csrf, _ := document.Find("input[name=csrf]").Attr("value")
+
+		form := url.Values{"csrf": {csrf}, "user": {"alice"}}
+		req, err := http.NewRequest(http.MethodPost, proxyUrl+"/app/login", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", proxyUrl)
+		req.Header.Set("Referer", proxyUrl+"/app/login")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("login through the proxy", func(t *testing.T) {
+		resp := login(t, proxy.Target{BaseUrl: upstream.URL, Prefix: "/app/", StripSetCookie: true, LoginCompat: &proxy.LoginCompat{Paths: []string{"/login"}}})
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, string(body), "welcome alice")
+		// the redirect was followed by the client, not by the proxy
+		require.Equal(t, "/app/dashboard", resp.Request.URL.Path)
+	})
+
+	t.Run("without login compat", func(t *testing.T) {
+		resp := login(t, proxy.Target{BaseUrl: upstream.URL, Prefix: "/app/"})
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestShutdownDrain(t *testing.T) {
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow response")
+	}))
+	defer upstream.Close()
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/slow/"}
+	p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithDrainTimeout(500*time.Millisecond))
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(proxyUrl + "/slow/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{status: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-received
+
+	// the shutdown context expires long before the upstream answers, the drain timeout does not
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, p.Shutdown(ctx))
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	select {
+	case res := <-results:
+		require.NoError(t, res.err)
+		require.Equal(t, http.StatusOK, res.status)
+		require.Equal(t, "slow response", res.body)
+	case <-time.After(time.Second):
+		t.Fatal("response was not completed")
+	}
+}
+
+func TestFormActionRewriting(t *testing.T) {
+	var upstreamUrl string
+	posted := make(chan url.Values, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/session" {
+			require.NoError(t, r.ParseForm())
+			posted <- r.PostForm
+			fmt.Fprint(w, "logged in")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body>`+
+			`<form id="login" method="post" action="/session"><input name="user" value="alice"><button id="alt" formaction="%s/session/alt">alt</button></form>`+
+			`<form id="self" action=""></form>`+
+			`<form id="external" action="https://other.example/search"></form>`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/forms/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+	action, _ := document.Find("#login").Attr("action")
+	require.Equal(t, proxied("session"), action)
+	formAction, _ := document.Find("#alt").Attr("formaction")
+	require.Equal(t, proxied("session/alt"), formAction)
+	selfAction, _ := document.Find("#self").Attr("action")
+	require.Equal(t, "", selfAction)
+	externalAction, _ := document.Find("#external").Attr("action")
+	require.Equal(t, "https://other.example/search", externalAction)
+
+	// submit the rewritten form
+	user, _ := document.Find("#login input[name=user]").Attr("value")
+	resp, err := http.PostForm(action, url.Values{"user": {user}})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "alice", (<-posted).Get("user"))
+}
+
+func TestBaseAndMetaRefreshRewriting(t *testing.T) {
+	var upstreamUrl string
+	var head string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head>%s</head><body></body></html>`, strings.ReplaceAll(head, "UPSTREAM", upstreamUrl))
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/meta/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+	attr := func(selector, name string) string {
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+		require.NoError(t, err)
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	tests := []struct {
+		name     string
+		head     string
+		selector string
+		attr     string
+		expected string
+	}{
+		{"base with trailing slash", `<base href="UPSTREAM/">`, "base", "href", proxied("")},
+		{"base with path", `<base href="UPSTREAM/docs/">`, "base", "href", proxied("docs/")},
+		{"base without trailing slash", `<base href="UPSTREAM">`, "base", "href", proxied("")},
+		{"external base", `<base href="https://other.example/">`, "base", "href", "https://other.example/"},
+		{"meta refresh", `<meta http-equiv="refresh" content="0;url=/next">`, "meta", "content", "0;url=" + proxied("next")},
+		{"meta refresh with delay and quotes", `<meta http-equiv="Refresh" content="5; URL='UPSTREAM/next'">`, "meta", "content", "5; URL='" + proxied("next") + "'"},
+		{"meta refresh without url", `<meta http-equiv="refresh" content="30">`, "meta", "content", "30"},
+		{"external meta refresh", `<meta http-equiv="refresh" content="0; url=https://other.example/">`, "meta", "content", "0; url=https://other.example/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head = tt.head
+			require.Equal(t, tt.expected, attr(tt.selector, tt.attr))
+		})
+	}
+}
+
+func TestPreflightCache(t *testing.T) {
+	var forwarded atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			forwarded.Add(1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/cors/"}
+	p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithPreflightCache(time.Minute))
+
+	preflight := func(origin, method string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, proxyUrl+"/cors/api", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := preflight("https://app.example", http.MethodPost)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+	}
+	require.EqualValues(t, 1, forwarded.Load())
+
+	// a different tuple is forwarded again
+	preflight("https://app.example", http.MethodPut)
+	preflight("https://other.example", http.MethodPost)
+	require.EqualValues(t, 3, forwarded.Load())
+
+	// the cache is bounded, its occupancy is exported
+	require.Equal(t, map[string]proxy.MapStats{"preflightCache": {Entries: 3, MaxEntries: 10000}}, p.MapStats())
+}
+
+func TestECDSACerts(t *testing.T) {
+	cert, err := proxy.GenerateECDSACerts("Test", "proxy.example", "localhost", "127.0.0.1", "::1")
+	require.NoError(t, err)
+	require.IsType(t, &ecdsa.PrivateKey{}, cert.PrivateKey)
+
+	// the certificate survives a PEM round trip
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, x509.ECDSA, leaf.PublicKeyAlgorithm)
+	require.Equal(t, []string{"proxy.example", "localhost"}, leaf.DNSNames)
+	require.Len(t, leaf.IPAddresses, 2)
+	require.True(t, leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	require.True(t, leaf.IPAddresses[1].Equal(net.ParseIP("::1")))
+
+	// and can be served by the proxy
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/tls/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithSsl(cert))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	require.Equal(t, "hello", getBodyWithClient(t, client, proxyUrl+"/tls/"))
+}
+
+func TestEmbeddedMediaRewriting(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body>`+
+			`<iframe id="iframe" src="/embed/player"></iframe>`+
+			`<video id="video" src="%s/media/clip.mp4"><track id="track" src="/media/clip.vtt"></video>`+
+			`<audio id="audio" src="/media/sound.mp3"><source id="source" src="/media/sound.ogg"></audio>`+
+			`<embed id="embed" src="/media/anim.swf">`+
+			`<object id="object" data="/media/doc.pdf"></object>`+
+			`<iframe id="external-iframe" src="https://other.example/widget"></iframe>`+
+			`<video id="external-video" src="https://cdn.example/clip.mp4"></video>`+
+			`<object id="external-object" data="https://cdn.example/doc.pdf"></object>`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/media/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+	attr := func(selector, name string) string {
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	require.Equal(t, proxied("embed/player"), attr("#iframe", "src"))
+	require.Equal(t, proxied("media/clip.mp4"), attr("#video", "src"))
+	require.Equal(t, proxied("media/clip.vtt"), attr("#track", "src"))
+	require.Equal(t, proxied("media/sound.mp3"), attr("#audio", "src"))
+	require.Equal(t, proxied("media/sound.ogg"), attr("#source", "src"))
+	require.Equal(t, proxied("media/anim.swf"), attr("#embed", "src"))
+	require.Equal(t, proxied("media/doc.pdf"), attr("#object", "data"))
+
+	require.Equal(t, "https://other.example/widget", attr("#external-iframe", "src"))
+	require.Equal(t, "https://cdn.example/clip.mp4", attr("#external-video", "src"))
+	require.Equal(t, "https://cdn.example/doc.pdf", attr("#external-object", "data"))
+}
+
+func TestCertOptions(t *testing.T) {
+	t.Run("generate", func(t *testing.T) {
+		cert, err := proxy.GenerateSslCerts("Test",
+			proxy.WithValidFor(30*24*time.Hour),
+			proxy.WithDNSNames("proxy.example", "localhost"),
+			proxy.WithIPAddresses(net.ParseIP("127.0.0.1")),
+			proxy.WithKeyBits(3072),
+		)
+		require.NoError(t, err)
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		require.Equal(t, []string{"proxy.example", "localhost"}, leaf.DNSNames)
+		require.Len(t, leaf.IPAddresses, 1)
+		require.True(t, leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+		require.WithinDuration(t, time.Now().Add(30*24*time.Hour), leaf.NotAfter, time.Minute)
+		require.Equal(t, 3072, cert.PrivateKey.(*rsa.PrivateKey).N.BitLen())
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		cert, err := proxy.GenerateSslCerts("Test")
+		require.NoError(t, err)
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		require.Empty(t, leaf.DNSNames)
+		require.WithinDuration(t, time.Now().Add(365*24*time.Hour), leaf.NotAfter, time.Minute)
+		require.Equal(t, 2048, cert.PrivateKey.(*rsa.PrivateKey).N.BitLen())
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "hello")
+		}))
+		defer upstream.Close()
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/tls/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithGeneratedSsl("Test", proxy.WithDNSNames("proxy.example")))
+		require.True(t, strings.HasPrefix(proxyUrl, "https://"))
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		resp, err := client.Get(proxyUrl + "/tls/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, []string{"proxy.example"}, resp.TLS.PeerCertificates[0].DNSNames)
+	})
+}
+
+func TestProtocolRelativeUrls(t *testing.T) {
+	var upstreamHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><link id="css" href="//%s/css/site.css"><script id="cdn" src="//cdn.example/x.js"></script></head><body>`+
+			`<a id="same" href="//%s/x">same</a><a id="other" href="//other.example/x">other</a><a id="root" href="/x">root</a>`+
+			`<div id="style" style="background: url(//%s/img/bg.png), url(//cdn.example/bg.png)"></div>`+
+			`</body></html>`, upstreamHost, upstreamHost, upstreamHost)
+	}))
+	defer upstream.Close()
+	upstreamHost = strings.TrimPrefix(upstream.URL, "http://")
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/relative/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+	attr := func(selector, name string) string {
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	require.Equal(t, proxied("x"), attr("#same", "href"))
+	require.Equal(t, proxied("css/site.css"), attr("#css", "href"))
+	require.Equal(t, "//other.example/x", attr("#other", "href"))
+	require.Equal(t, "//cdn.example/x.js", attr("#cdn", "src"))
+	require.Equal(t, proxied("x"), attr("#root", "href"))
+	require.Equal(t, fmt.Sprintf("background: url(%s), url(//cdn.example/bg.png)", proxied("img/bg.png")), attr("#style", "style"))
+}
+
+func TestURLHelpers(t *testing.T) {
+	target := proxy.Target{BaseUrl: "https://example.com", Prefix: "/ex/"}
+	publicBase := "http://proxy.local:8080"
+
+	t.Run("JoinURL", func(t *testing.T) {
+		tests := []struct {
+			elements []string
+			expected string
+		}{
+			{[]string{"/a/", "/b/"}, "/a/b/"},
+			{[]string{"http://host:1", "/ex/", "x"}, "http://host:1/ex/x"},
+			{[]string{"http://host:1/", "ex", ""}, "http://host:1/ex/"},
+			{[]string{"/ex/", "/"}, "/ex/"},
+			{[]string{"a"}, "a"},
+		}
+		for _, tt := range tests {
+			require.Equal(t, tt.expected, proxy.JoinURL(tt.elements...), "%v", tt.elements)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		rawURL  string
+		matches bool
+		proxied string
+	}{
+		{"root relative", "/x", true, "http://proxy.local:8080/ex/x"},
+		{"root", "/", true, "http://proxy.local:8080/ex/"},
+		{"absolute", "https://example.com/a/b", true, "http://proxy.local:8080/ex/a/b"},
+		{"base URL", "https://example.com", true, "http://proxy.local:8080/ex/"},
+		{"query and fragment", "/search?q=a+b&page=2#results", true, "http://proxy.local:8080/ex/search?q=a+b&page=2#results"},
+		{"escaped path", "/a%20b/c%2Fd", true, "http://proxy.local:8080/ex/a%20b/c%2Fd"},
+		{"protocol relative", "//example.com/x.js", true, "http://proxy.local:8080/ex/x.js"},
+		{"host case", "https://EXAMPLE.com/x", true, "http://proxy.local:8080/ex/x"},
+		{"absolute URL in query", "/redirect?to=https://other.example/", true, "http://proxy.local:8080/ex/redirect?to=https://other.example/"},
+		{"other host", "https://other.example/x", false, ""},
+		{"host prefix", "https://example.com.evil/x", false, ""},
+		{"other scheme", "http://example.com/x", false, ""},
+		{"protocol relative other host", "//cdn.example/x.js", false, ""},
+		{"relative", "img/a.png", false, ""},
+		{"fragment only", "#top", false, ""},
+		{"mailto", "mailto:someone@example.com", false, ""},
+		{"data", "data:image/png;base64,AAAA", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.matches, proxy.TargetMatches(target, tt.rawURL))
+			proxied, err := proxy.ToProxyURL(target, publicBase, tt.rawURL)
+			if !tt.matches {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.proxied, proxied)
+
+			// and back again
+			origin, err := proxy.ToOriginURL(target, proxied)
+			require.NoError(t, err)
+			originUrl, err := url.Parse(origin)
+			require.NoError(t, err)
+			require.Equal(t, "https", originUrl.Scheme)
+			require.Equal(t, "example.com", originUrl.Host)
+		})
+	}
+
+	t.Run("ToOriginURL", func(t *testing.T) {
+		tests := []struct {
+			proxyURL string
+			expected string
+		}{
+			{"http://proxy.local:8080/ex/a/b?c=d#e", "https://example.com/a/b?c=d#e"},
+			{"/ex/a", "https://example.com/a"},
+			{"/ex/", "https://example.com/"},
+			{"/ex", "https://example.com/"},
+		}
+		for _, tt := range tests {
+			origin, err := proxy.ToOriginURL(target, tt.proxyURL)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, origin)
+		}
+
+		_, err := proxy.ToOriginURL(target, "/other/a")
+		require.Error(t, err)
+		_, err = proxy.ToOriginURL(target, "/example/a")
+		require.Error(t, err)
+	})
+
+	t.Run("public base with path", func(t *testing.T) {
+		proxied, err := proxy.ToProxyURL(target, "https://proxy.local/mount/", "/x")
+		require.NoError(t, err)
+		require.Equal(t, "https://proxy.local/mount/ex/x", proxied)
+	})
+}
+
+func TestSslFromFiles(t *testing.T) {
+	for _, generate := range []func() (tls.Certificate, error){
+		func() (tls.Certificate, error) { return proxy.GenerateSslCerts("Test") },
+		func() (tls.Certificate, error) { return proxy.GenerateECDSACerts("Test") },
+	} {
+		cert, err := generate()
+		require.NoError(t, err)
+		certFile, err := proxy.SaveCertificateToFile(cert.Certificate[0], "cert*.pem")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(certFile) })
+		keyFile, err := proxy.SavePrivateKeyToFile(cert.PrivateKey, "key*.pem")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(keyFile) })
+
+		certPEM, err := os.ReadFile(certFile)
+		require.NoError(t, err)
+		keyPEM, err := os.ReadFile(keyFile)
+		require.NoError(t, err)
+		loaded, err := proxy.LoadCertFromPEM(certPEM, keyPEM)
+		require.NoError(t, err)
+		require.Equal(t, cert.Certificate, loaded.Certificate)
+
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "hello")
+		}))
+		t.Cleanup(upstream.Close)
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/tls/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithSslFromFiles(certFile, keyFile))
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		require.Equal(t, "hello", getBodyWithClient(t, client, proxyUrl+"/tls/"))
+	}
+
+	_, err := proxy.NewProxy(proxy.WithSslFromFiles("missing-cert.pem", "missing-key.pem"))
+	require.Error(t, err)
+	_, err = proxy.LoadCertFromPEM([]byte("no pem"), []byte("no pem"))
+	require.Error(t, err)
+}
+
+func TestCrossTargetRewrite(t *testing.T) {
+	var githubUrl, wikiUrl string
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a id="wiki" href="%s/wiki/Foo">wiki</a><a id="talk" href="%s/talk/Foo">talk</a><a id="self" href="%s/repo">repo</a><a id="root" href="/root">root</a></body></html>`, wikiUrl, wikiUrl, githubUrl)
+	}))
+	defer github.Close()
+	wiki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a id="github" href="%s/FrauElster">github</a></body></html>`, githubUrl)
+	}))
+	defer wiki.Close()
+	githubUrl, wikiUrl = github.URL, wiki.URL
+
+	targets := []proxy.Target{
+		{BaseUrl: github.URL, Prefix: "/github/"},
+		{BaseUrl: wiki.URL, Prefix: "/wikipedia/"},
+		// a more specific target on the same host
+		{BaseUrl: wiki.URL + "/wiki", Prefix: "/articles/"},
+	}
+	attr := func(url, selector string) string {
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, url)))
+		require.NoError(t, err)
+		val, _ := document.Find(selector).Attr("href")
+		return val
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, targets, proxy.WithCrossTargetRewrite())
+
+		require.Equal(t, proxyUrl+"/articles/wiki/Foo", attr(proxyUrl+"/github/", "#wiki"))
+		require.Equal(t, proxyUrl+"/wikipedia/talk/Foo", attr(proxyUrl+"/github/", "#talk"))
+		require.Equal(t, proxyUrl+"/github/repo", attr(proxyUrl+"/github/", "#self"))
+		require.Equal(t, proxyUrl+"/github/root", attr(proxyUrl+"/github/", "#root"))
+		require.Equal(t, proxyUrl+"/github/FrauElster", attr(proxyUrl+"/wikipedia/", "#github"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, targets)
+
+		require.Equal(t, wiki.URL+"/wiki/Foo", attr(proxyUrl+"/github/", "#wiki"))
+		require.Equal(t, github.URL+"/FrauElster", attr(proxyUrl+"/wikipedia/", "#github"))
+	})
+}
+
+func TestRewriteRules(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><script type="application/ld+json">{"url": "%s/about"}</script></head><body>`+
+			`<div id="api" data-endpoint="/api/items"></div>`+
+			`<div id="widget" data-config="/widget/config.json"></div>`+
+			`<div id="keep" data-config="/keep/config.json"></div>`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{
+		BaseUrl: upstream.URL,
+		Prefix:  "/rules/",
+		RewriteRules: []proxy.RewriteRule{
+			{Selector: "[data-endpoint]", Attr: "data-endpoint"},
+			{Selector: `script[type="application/ld+json"]`, Text: true},
+			{
+				Selector: "[data-config]",
+				Attr:     "data-config",
+				Rewrite: func(original string, proxyURL *url.URL) (string, bool) {
+					if strings.HasPrefix(original, "/keep/") {
+						return "", false
+					}
+					return proxy.JoinURL(proxyURL.String(), original) + "?proxied=1", true
+				},
+			},
+		},
+	}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+	attr := func(selector, name string) string {
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	require.Equal(t, proxied("api/items"), attr("#api", "data-endpoint"))
+	require.Equal(t, proxied("widget/config.json")+"?proxied=1", attr("#widget", "data-config"))
+	require.Equal(t, "/keep/config.json", attr("#keep", "data-config"))
+	require.Equal(t, fmt.Sprintf(`{"url": "%s"}`, proxied("about")), document.Find("script").Text())
+}
+
+func TestBackendClientCert(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello ", r.TLS.PeerCertificates[0].Subject.Organization[0])
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	// trusts the certificate of the test server
+	transport := upstream.Client().Transport.(*http.Transport)
+
+	proxyCert, err := proxy.GenerateECDSACerts("Proxy")
+	require.NoError(t, err)
+	targetCert, err := proxy.GenerateECDSACerts("Target")
+	require.NoError(t, err)
+
+	get := func(t *testing.T, target proxy.Target, opts ...proxy.ProxyOption) (int, string) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, append(opts, proxy.WithTransport(transport))...)
+		resp, err := http.Get(proxyUrl + target.Prefix)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("without client certificate", func(t *testing.T) {
+		status, _ := get(t, proxy.Target{BaseUrl: upstream.URL, Prefix: "/mtls/"})
+		require.Equal(t, http.StatusBadGateway, status)
+	})
+
+	t.Run("proxy client certificate", func(t *testing.T) {
+		status, body := get(t, proxy.Target{BaseUrl: upstream.URL, Prefix: "/mtls/"}, proxy.WithBackendClientCert(proxyCert))
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "hello Proxy", body)
+	})
+
+	t.Run("target client certificate takes precedence", func(t *testing.T) {
+		status, body := get(t, proxy.Target{BaseUrl: upstream.URL, Prefix: "/mtls/", ClientCert: &targetCert}, proxy.WithBackendClientCert(proxyCert))
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "hello Target", body)
+	})
+
+	// the configured transport is not modified
+	require.Empty(t, transport.TLSClientConfig.Certificates)
+
+	t.Run("requires an http.Transport", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithTransport(stealth.NewStealthTransport()), proxy.WithBackendClientCert(proxyCert))
+		require.Error(t, err)
+	})
+}
+
+func TestRewriteCookies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=api.example.com; Path=/; Secure; HttpOnly")
+		w.Header().Add("Set-Cookie", "prefs=dark; domain=.api.example.com; path=/settings")
+		w.Header().Add("Set-Cookie", "plain=1")
+	}))
+	defer upstream.Close()
+
+	cookies := func(t *testing.T, target proxy.Target, host string) []string {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		req, err := http.NewRequest(http.MethodGet, proxyUrl+target.Prefix, nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.Header.Values("Set-Cookie")
+	}
+
+	t.Run("rewrites domain and path", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/", RewriteCookies: true}
+		require.Equal(t, []string{
+			"session=abc; Domain=proxy.example; Path=/api/; Secure; HttpOnly",
+			"prefs=dark; Domain=proxy.example; Path=/api/settings",
+			"plain=1",
+		}, cookies(t, target, "proxy.example:8080"))
+	})
+
+	t.Run("drops domain for IP hosts", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/", RewriteCookies: true}
+		require.Equal(t, []string{
+			"session=abc; Path=/api/; Secure; HttpOnly",
+			"prefs=dark; Path=/api/settings",
+			"plain=1",
+		}, cookies(t, target, "127.0.0.1:8080"))
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}
+		require.Contains(t, cookies(t, target, "proxy.example:8080"), "session=abc; Domain=api.example.com; Path=/; Secure; HttpOnly")
+	})
+}
+
+func TestRewriteExclusions(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><style>.a { background: url(/downloads/bg.png) } .b { background: url(/img/bg.png) }</style></head><body>`+
+			`<a id="download" href="/downloads/setup.exe">download</a>`+
+			`<a id="relative" href="downloads/readme.txt">readme</a>`+
+			`<a id="oauth" href="%s/oauth/authorize?client_id=1" rel="nofollow">login</a>`+
+			`<a id="external" class="external" href="/partner">partner</a>`+
+			`<a id="page" href="/page">page</a>`+
+			`<img id="image" src="/img/logo.png">`+
+			`</body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{
+		BaseUrl: upstream.URL,
+		Prefix:  "/excl/",
+		RewriteExclusions: &proxy.RewriteExclusions{
+			Patterns:   []string{upstream.URL + "/downloads/*", "regexp:/oauth/authorize\\b"},
+			Selectors:  []string{"a.external"},
+			NoReferrer: true,
+		},
+	}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, proxied(""))))
+	require.NoError(t, err)
+	attr := func(selector, name string) string {
+		val, _ := document.Find(selector).Attr(name)
+		return val
+	}
+
+	t.Run("patterns", func(t *testing.T) {
+		require.Equal(t, "/downloads/setup.exe", attr("#download", "href"))
+		require.Equal(t, "downloads/readme.txt", attr("#relative", "href"))
+		require.Equal(t, upstream.URL+"/oauth/authorize?client_id=1", attr("#oauth", "href"))
+		require.Contains(t, document.Find("style").Text(), "url(/downloads/bg.png)")
+		require.Contains(t, document.Find("style").Text(), "url("+proxied("img/bg.png")+")")
+	})
+
+	t.Run("selectors", func(t *testing.T) {
+		require.Equal(t, "/partner", attr("#external", "href"))
+	})
+
+	t.Run("siblings are rewritten", func(t *testing.T) {
+		require.Equal(t, proxied("page"), attr("#page", "href"))
+		require.Equal(t, proxied("img/logo.png"), attr("#image", "src"))
+	})
+
+	t.Run("no referrer", func(t *testing.T) {
+		require.Equal(t, "noreferrer", attr("#download", "rel"))
+		require.Equal(t, "noreferrer", attr("#relative", "rel"))
+		require.Equal(t, "nofollow noreferrer", attr("#oauth", "rel"))
+		require.Equal(t, "noreferrer", attr("#external", "rel"))
+		_, exists := document.Find("#page").Attr("rel")
+		require.False(t, exists)
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/invalid/", RewriteExclusions: &proxy.RewriteExclusions{Patterns: []string{"regexp:("}}})
+		require.Len(t, proxy.ValidationErrors(err), 1)
+	})
+}
+
+func TestDisableRewrite(t *testing.T) {
+	var page bytes.Buffer
+	writer := gzip.NewWriter(&page)
+	_, err := writer.Write([]byte(`<html><body><a href="/page" class=x>a &amp; b</a></body></html>`))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(page.Bytes())
+	}))
+	defer upstream.Close()
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/raw/", DisableRewrite: true}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+	req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix, "page"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	// keep the client from decompressing the body, the compressed bytes are compared
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, int64(page.Len()), resp.ContentLength)
+	require.Equal(t, sha256.Sum256(page.Bytes()), sha256.Sum256(body))
+}
+
+func TestContentLength(t *testing.T) {
+	download := bytes.Repeat([]byte("0123456789"), 5*1024*1024)
+	var archive bytes.Buffer
+	writer := gzip.NewWriter(&archive)
+	_, err := writer.Write(download[:1024*1024])
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/download.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "download.bin", time.Time{}, bytes.NewReader(download))
+		case "/archive.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(archive.Len()))
+			w.Write(archive.Bytes())
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			writer := gzip.NewWriter(w)
+			writer.Write([]byte(`<html><body><a href="/other.html">other</a></body></html>`))
+			writer.Close()
+		case "/empty.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNoContent)
+		case "/cached.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+	defer upstream.Close()
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/length/"}
+	p, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	// keep the client from decompressing the bodies, the lengths refer to the encoded bytes
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(t *testing.T, path string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix, path), nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	t.Run("identity download", func(t *testing.T) {
+		resp, body := get(t, "download.bin")
+		require.Equal(t, int64(len(download)), resp.ContentLength)
+		require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		require.Empty(t, resp.TransferEncoding)
+		require.Equal(t, len(download), len(body))
+	})
+
+	t.Run("gzip passthrough", func(t *testing.T) {
+		resp, body := get(t, "archive.bin")
+		require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		require.Equal(t, int64(archive.Len()), resp.ContentLength)
+		require.Equal(t, archive.Bytes(), body)
+	})
+
+	t.Run("recompressed html", func(t *testing.T) {
+		resp, body := get(t, "page.html")
+		require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		require.Equal(t, int64(len(body)), resp.ContentLength)
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		html, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Contains(t, string(html), proxy.JoinURL(proxyUrl, target.Prefix, "other.html"))
+	})
+
+	t.Run("no length for statuses without body", func(t *testing.T) {
+		for path, status := range map[string]int{"empty.html": http.StatusNoContent, "cached.html": http.StatusNotModified} {
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, proxy.JoinURL(target.Prefix, path), nil))
+			require.Equal(t, status, recorder.Code)
+			require.Empty(t, recorder.Header().Values("Content-Length"), path)
+		}
+	})
+}
+
+func TestRewriteRedirects(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, upstreamUrl+"/new?from=old", http.StatusFound)
+		case "/moved":
+			http.Redirect(w, r, "/new", http.StatusPermanentRedirect)
+		case "/new":
+			fmt.Fprint(w, "new page")
+		}
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/redirects/", RewriteRedirects: true}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	location := func(t *testing.T, path string) (int, string) {
+		resp, err := noFollow.Get(proxied(path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	t.Run("absolute location", func(t *testing.T) {
+		status, loc := location(t, "old")
+		require.Equal(t, http.StatusFound, status)
+		require.Equal(t, proxied("new")+"?from=old", loc)
+	})
+
+	t.Run("root relative location", func(t *testing.T) {
+		status, loc := location(t, "moved")
+		require.Equal(t, http.StatusPermanentRedirect, status)
+		require.Equal(t, proxied("new"), loc)
+	})
+
+	t.Run("followed through the proxy", func(t *testing.T) {
+		resp, err := http.Get(proxied("old"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, proxied("new")+"?from=old", resp.Request.URL.String())
+		require.Equal(t, "new page", getBody(t, proxied("old")))
+	})
+}
+
+func TestRewriteJSON(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{
+  "total_count": 2,
+  "next": "%[1]s/repos?page=2",
+  "items": [
+    {"id": "1234", "url": "%[1]s/repos/octo/hello", "issues_url": "%[1]s/repos/octo/hello/issues{/number}", "html_url": "https://github.example/octo/hello"},
+    {"id": 5678, "url": "%[1]s/repos/octo/world", "description": "mirror of %[1]s/repos/octo/hello <fork>", "homepage": "%[1]s.evil.example/"}
+  ],
+  "_links": {"self": {"href": "%[1]s/repos?page=1"}},
+  "%[1]s/key": null
+}`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/json/", RewriteJSON: true}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	body := getBody(t, proxied("repos"))
+	var payload struct {
+		TotalCount json.Number `json:"total_count"`
+		Next       string      `json:"next"`
+		Items      []struct {
+			ID          json.Number `json:"id"`
+			Url         string      `json:"url"`
+			IssuesUrl   string      `json:"issues_url"`
+			HtmlUrl     string      `json:"html_url"`
+			Description string      `json:"description"`
+			Homepage    string      `json:"homepage"`
+		} `json:"items"`
+		Links struct {
+			Self struct {
+				Href string `json:"href"`
+			} `json:"self"`
+		} `json:"_links"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &payload))
+
+	require.Equal(t, proxied("repos")+"?page=2", payload.Next)
+	require.Equal(t, proxied("repos")+"?page=1", payload.Links.Self.Href)
+	require.Len(t, payload.Items, 2)
+	require.Equal(t, proxied("repos/octo/hello"), payload.Items[0].Url)
+	require.Equal(t, proxied("repos/octo/hello/issues")+"{/number}", payload.Items[0].IssuesUrl)
+	require.Equal(t, "https://github.example/octo/hello", payload.Items[0].HtmlUrl)
+	require.Equal(t, "mirror of "+proxied("repos/octo/hello")+" <fork>", payload.Items[1].Description)
+	require.Equal(t, upstream.URL+".evil.example/", payload.Items[1].Homepage)
+
+	// numbers, numbers as strings, keys and the formatting are untouched
+	require.Equal(t, json.Number("1234"), payload.Items[0].ID)
+	require.Equal(t, json.Number("5678"), payload.Items[1].ID)
+	require.Contains(t, body, `"total_count": 2,`+"\n")
+	require.Contains(t, body, fmt.Sprintf(`"%s/key": null`, upstream.URL))
+
+	t.Run("disabled by default", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/raw-json/"}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		require.Contains(t, getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "repos")), upstream.URL+"/repos?page=2")
+	})
+
+	t.Run("base URL with a path", func(t *testing.T) {
+		var upstreamUrl string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/users" {
+				fmt.Fprint(w, "users")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"users": "%s/v1/users"}`, upstreamUrl)
+		}))
+		defer upstream.Close()
+		upstreamUrl = upstream.URL
+
+		target := proxy.Target{BaseUrl: upstream.URL + "/v1", Prefix: "/versioned/", RewriteJSON: true}
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		var payload struct {
+			Users string `json:"users"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(getBody(t, proxy.JoinURL(proxyUrl, target.Prefix))), &payload))
+
+		// the link maps like the attributes of HTML, so following it reaches the same upstream URL
+		expected, err := proxy.ToProxyURL(target, proxyUrl, upstream.URL+"/v1/users")
+		require.NoError(t, err)
+		require.Equal(t, expected, payload.Users)
+		require.Equal(t, "users", getBody(t, payload.Users))
+	})
+}
+
+func TestConcurrentRewriting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a href="%s/next">next</a></body></html>`, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	targets := []proxy.Target{
+		{BaseUrl: upstream.URL, Prefix: "/github/"},
+		{BaseUrl: upstream.URL, Prefix: "/gitlab/"},
+	}
+	p, proxyUrl := newLocalProxy(t, targets)
+
+	// run with -race to detect the requests sharing state
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		target := targets[i%len(targets)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				body := getBody(t, proxy.JoinURL(proxyUrl, target.Prefix, "page"))
+				require.Contains(t, body, proxy.JoinURL(proxyUrl, target.Prefix, "page/next"))
+				require.Equal(t, proxyUrl, p.Addr())
+			}
+		}()
+	}
+	wg.Wait()
+
+	addr, err := url.Parse(p.Addr())
+	require.NoError(t, err)
+	require.Empty(t, addr.Path)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/fwd/"}
+
+	forwarded := func(t *testing.T, proxyUrl string, header http.Header) (string, string) {
+		// connect over IPv4, the proxy listens on all interfaces
+		u, err := url.Parse(proxyUrl)
+		require.NoError(t, err)
+		u.Host = net.JoinHostPort("127.0.0.1", u.Port())
+		req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(u.String(), target.Prefix), nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		xff, realIp, _ := strings.Cut(string(body), "|")
+		return xff, realIp
+	}
+
+	t.Run("single proxy", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		xff, realIp := forwarded(t, proxyUrl, http.Header{})
+		require.Equal(t, "127.0.0.1", xff)
+		require.Equal(t, "127.0.0.1", realIp)
+	})
+
+	t.Run("chained proxies", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		xff, realIp := forwarded(t, proxyUrl, http.Header{"X-Forwarded-For": {"203.0.113.7, 10.0.0.1"}})
+		require.Equal(t, "203.0.113.7, 10.0.0.1, 127.0.0.1", xff)
+		require.Equal(t, "127.0.0.1", realIp)
+
+		_, realIp = forwarded(t, proxyUrl, http.Header{"X-Real-Ip": {"203.0.113.7"}})
+		require.Equal(t, "203.0.113.7", realIp)
+	})
+
+	t.Run("trusted proxies", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithTrustedProxies("127.0.0.1", "10.0.0.0/8"))
+		xff, realIp := forwarded(t, proxyUrl, http.Header{"X-Forwarded-For": {"203.0.113.7, 10.0.0.1"}})
+		require.Equal(t, "203.0.113.7, 10.0.0.1, 127.0.0.1", xff)
+		require.Equal(t, "203.0.113.7", realIp)
+	})
+
+	t.Run("untrusted client", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithTrustedProxies("10.0.0.0/8"))
+		xff, realIp := forwarded(t, proxyUrl, http.Header{"X-Forwarded-For": {"203.0.113.7"}, "X-Real-Ip": {"203.0.113.7"}})
+		require.Equal(t, "127.0.0.1", xff)
+		require.Equal(t, "127.0.0.1", realIp)
+	})
+
+	t.Run("invalid cidr", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithTrustedProxies("10.0.0.0/33"))
+		errs := proxy.ValidationErrors(err)
+		require.Len(t, errs, 1)
+		require.Equal(t, "TrustedProxies", errs[0].Field)
+	})
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"Connection", "X-Connection-Listed"},
+		{"Keep-Alive", "timeout=5"},
+		{"Proxy-Authenticate", "Basic"},
+		{"Proxy-Authorization", "Basic dXNlcjpwYXNz"},
+		{"Te", "trailers"},
+		{"Trailer", "X-Checksum"},
+		{"Transfer-Encoding", "gzip"},
+		{"Upgrade", "websocket"},
+		{"X-Connection-Listed", "secret"},
+	}
+
+	upstreamHeaders := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header.Clone()
+		// write the response by hand, the server would replace the Connection header
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\n")
+		for _, test := range tests {
+			if test.name != "Transfer-Encoding" {
+				fmt.Fprintf(buf, "%s: %s\r\n", test.name, test.value)
+			}
+		}
+		buf.WriteString("Transfer-Encoding: chunked\r\nX-End-To-End: kept\r\n\r\n0\r\n\r\n")
+		require.NoError(t, buf.Flush())
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hop/"}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+	req, err := http.NewRequest(http.MethodGet, proxy.JoinURL(proxyUrl, target.Prefix), nil)
+	require.NoError(t, err)
+	for _, test := range tests {
+		req.Header.Set(test.name, test.value)
+	}
+	req.Header.Set("X-End-To-End", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	received := <-upstreamHeaders
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the proxy may set its own connection headers, e.g. Connection: close
+			require.NotContains(t, received.Values(test.name), test.value, "should not be forwarded to the upstream")
+			require.NotContains(t, resp.Header.Values(test.name), test.value, "should not be forwarded to the client")
+		})
+	}
+	require.Equal(t, "kept", received.Get("X-End-To-End"))
+	require.Equal(t, "kept", resp.Header.Get("X-End-To-End"))
+}
+
+func TestHeaderProfiles(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Server", "nginx/1.25.3")
+		w.Header().Set("X-Powered-By", "PHP/8.3")
+		w.Header().Set("Via", "1.1 varnish")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	upstreamHeaders := http.Header{
+		"Content-Type":            {"text/plain"},
+		"Content-Length":          {"2"},
+		"Content-Security-Policy": {"default-src 'self'; frame-ancestors 'none'"},
+		"X-Frame-Options":         {"DENY"},
+		"Set-Cookie":              {"session=abc"},
+		"Etag":                    {`"v1"`},
+		"Server":                  {"nginx/1.25.3"},
+		"X-Powered-By":            {"PHP/8.3"},
+		"Via":                     {"1.1 varnish"},
+		"Cache-Control":           {"no-cache"},
+	}
+	proxyCorsHeaders := http.Header{
+		"Access-Control-Allow-Origin":  {"*"},
+		"Access-Control-Allow-Methods": {"GET, POST, PUT, DELETE, OPTIONS"},
+		"Access-Control-Allow-Headers": {"Content-Type, Authorization"},
+	}
+	// with returns the upstream headers with the changes, nil values remove a header
+	with := func(changes ...http.Header) http.Header {
+		header := upstreamHeaders.Clone()
+		for _, change := range changes {
+			for name, values := range change {
+				if values == nil {
+					delete(header, name)
+					continue
+				}
+				header[name] = values
+			}
+		}
+		return header
+	}
+
+	tests := []struct {
+		profile string
+		rules   []proxy.HeaderRule
+		want    http.Header
+	}{
+		{profile: "", want: with(proxyCorsHeaders)},
+		{profile: proxy.HeaderProfileIframeEmbed, want: with(proxyCorsHeaders, http.Header{
+			"X-Frame-Options":         nil,
+			"Content-Security-Policy": {"default-src 'self'"},
+		})},
+		{profile: proxy.HeaderProfileApiCorsOpen, want: with(http.Header{
+			"Access-Control-Allow-Origin":   {"*"},
+			"Access-Control-Allow-Methods":  {"GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+			"Access-Control-Allow-Headers":  {"*"},
+			"Access-Control-Expose-Headers": {"*"},
+			"Access-Control-Max-Age":        {"86400"},
+		})},
+		{profile: proxy.HeaderProfilePrivacy, want: with(proxyCorsHeaders, http.Header{
+			"Set-Cookie":   nil,
+			"Etag":         nil,
+			"Server":       nil,
+			"X-Powered-By": nil,
+			"Via":          nil,
+		})},
+		{profile: proxy.HeaderProfilePassthroughStrict, want: with()},
+		{
+			profile: proxy.HeaderProfilePrivacy,
+			rules:   []proxy.HeaderRule{{Name: "Server", Value: "proxy"}, {Name: "Cache-Control", Remove: true}},
+			want: with(proxyCorsHeaders, http.Header{
+				"Set-Cookie":    nil,
+				"Etag":          nil,
+				"Server":        {"proxy"},
+				"X-Powered-By":  nil,
+				"Via":           nil,
+				"Cache-Control": nil,
+			}),
+		},
+	}
+	for _, test := range tests {
+		name := test.profile
+		if name == "" {
+			name = "default"
+		}
+		if test.rules != nil {
+			name += " with explicit rules"
+		}
+		t.Run(name, func(t *testing.T) {
+			target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/headers/", HeaderProfile: test.profile, ResponseHeaderRules: test.rules}
+			_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+			resp, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			header := resp.Header.Clone()
+			header.Del("Date")
+			require.Equal(t, test.want, header)
+		})
+	}
+
+	t.Run("unknown profile", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/headers/", HeaderProfile: "iframe"})
+		errs := proxy.ValidationErrors(err)
+		require.Len(t, errs, 1)
+		require.Equal(t, "Target.HeaderProfile", errs[0].Field)
+	})
+}
+
+func TestPublicURL(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Set-Cookie", "session=abc; Domain=upstream.example; Path=/")
+		fmt.Fprint(w, `<html><body><a href="/page">page</a></body></html>`)
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/pub/", RewriteRedirects: true, RewriteCookies: true}
+
+	fetch := func(t *testing.T, rawUrl string) (*http.Response, string) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(rawUrl)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		document, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		href, _ := document.Find("a").Attr("href")
+		return resp, href
+	}
+
+	t.Run("request host", func(t *testing.T) {
+		p, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+		u, err := url.Parse(proxyUrl)
+		require.NoError(t, err)
+		localUrl := "http://" + net.JoinHostPort("127.0.0.1", u.Port())
+
+		resp, href := fetch(t, proxy.JoinURL(localUrl, target.Prefix))
+		require.Equal(t, proxy.JoinURL(localUrl, target.Prefix, "page"), href)
+		require.Equal(t, "session=abc; Path=/pub/", resp.Header.Get("Set-Cookie"))
+		require.Equal(t, proxyUrl, p.Addr())
+	})
+
+	t.Run("public url with base path", func(t *testing.T) {
+		p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithPublicURL("https://example.com/proxy"))
+
+		resp, href := fetch(t, proxy.JoinURL(proxyUrl, target.Prefix))
+		require.Equal(t, "https://example.com/proxy/pub/page", href)
+		require.Equal(t, "session=abc; Domain=example.com; Path=/proxy/pub/", resp.Header.Get("Set-Cookie"))
+
+		resp, _ = fetch(t, proxy.JoinURL(proxyUrl, target.Prefix, "old"))
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		require.Equal(t, "https://example.com/proxy/pub/page", resp.Header.Get("Location"))
+
+		// the bind address is still reported
+		require.Equal(t, proxyUrl, p.Addr())
+		require.NotContains(t, p.Addr(), "example.com")
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithPublicURL("example.com/proxy"))
+		errs := proxy.ValidationErrors(err)
+		require.Len(t, errs, 1)
+		require.Equal(t, "PublicURL", errs[0].Field)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a href="/page">%s</a></body></html>`, r.URL.Path)
+	}))
+	defer upstream.Close()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/embedded/"}
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(target))
+
+	link := func(t *testing.T, rawUrl string) (string, string) {
+		document, err := goquery.NewDocumentFromReader(strings.NewReader(getBody(t, rawUrl)))
+		require.NoError(t, err)
+		href, _ := document.Find("a").Attr("href")
+		return document.Find("a").Text(), href
+	}
+
+	t.Run("ServeHTTP", func(t *testing.T) {
+		server := httptest.NewServer(p)
+		defer server.Close()
+
+		path, href := link(t, server.URL+"/embedded/index")
+		require.Equal(t, "/index", path)
+		require.Equal(t, server.URL+"/embedded/page", href)
+	})
+
+	t.Run("mounted in a mux", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/proxy/", http.StripPrefix("/proxy", p.Handler()))
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		path, _ := link(t, server.URL+"/proxy/embedded/index")
+		require.Equal(t, "/index", path)
+		require.Equal(t, "ok", getBody(t, server.URL+"/health"))
+	})
+
+	t.Run("targets added later", func(t *testing.T) {
+		server := httptest.NewServer(p)
+		defer server.Close()
+
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/later/"}))
+		path, _ := link(t, server.URL+"/later/index")
+		require.Equal(t, "/index", path)
+	})
+}
+
+func TestOpenAPI(t *testing.T) {
+	var upstreamUrl string
+	specs := map[string]string{
+		"/v3.json": `{
+  "openapi": "3.0.3",
+  "info": {"title": "Pets \u00e9", "version": "1.0"},
+  "servers": [{"url": "UPSTREAM/v1", "description": "production"}, {"url": "https://other.example/v1"}],
+  "paths": {
+    "/pets": {
+      "servers": [{"url": "/v2"}],
+      "get": {"summary": "List pets", "servers": [{"url": "UPSTREAM/v3"}], "responses": {"200": {"description": "ok"}}}
+    }
+  }
+}`,
+		"/v3.yaml": `openapi: 3.0.3
+info:
+  title: Pets
+  version: "1.0"
+servers:
+  - url: UPSTREAM/v1
+paths:
+  /pets:
+    get:
+      summary: List pets
+      operationId: listPets
+      responses:
+        "200":
+          description: ok
+`,
+		"/v2.json": `{"swagger": "2.0", "host": "UPSTREAM_HOST", "basePath": "/api", "schemes": ["http"],
+ "paths": {"/pets": {"get": {"summary": "List pets"}}}}`,
+		"/v2.yaml": `swagger: "2.0"
+info:
+  title: Pets
+paths:
+  /pets:
+    get:
+      summary: List pets
+`,
+		"/other.json": `{"url": "UPSTREAM/v1"}`,
+		"/spec.txt":   `{"openapi": "3.1.0", "servers": [{"url": "UPSTREAM/v1"}]}`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec, ok := specs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch filepath.Ext(r.URL.Path) {
+		case ".json":
+			w.Header().Set("Content-Type", "application/json")
+		case ".yaml":
+			w.Header().Set("Content-Type", "application/yaml")
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		fmt.Fprint(w, strings.NewReplacer("UPSTREAM_HOST", strings.TrimPrefix(upstreamUrl, "http://"), "UPSTREAM", upstreamUrl).Replace(spec))
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/spec/", OpenAPI: &proxy.OpenAPI{SpecPaths: []string{"/spec.txt"}}}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+	proxyHost := strings.TrimPrefix(proxyUrl, "http://")
+
+	t.Run("v3 json", func(t *testing.T) {
+		want := strings.NewReplacer(
+			`"UPSTREAM/v1"`, `"`+proxied("v1")+`"`,
+			`"/v2"`, `"`+proxied("v2")+`"`,
+			`"UPSTREAM/v3"`, `"`+proxied("v3")+`"`,
+		).Replace(specs["/v3.json"])
+		require.Equal(t, want, getBody(t, proxied("v3.json")))
+	})
+
+	t.Run("v3 yaml", func(t *testing.T) {
+		var spec struct {
+			Servers []struct {
+				Url string `yaml:"url"`
+			} `yaml:"servers"`
+			Paths map[string]map[string]map[string]any `yaml:"paths"`
+		}
+		require.NoError(t, yaml.Unmarshal([]byte(getBody(t, proxied("v3.yaml"))), &spec))
+		require.Len(t, spec.Servers, 1)
+		require.Equal(t, proxied("v1"), spec.Servers[0].Url)
+		require.Equal(t, map[string]any{
+			"summary":     "List pets",
+			"operationId": "listPets",
+			"responses":   map[string]any{"200": map[string]any{"description": "ok"}},
+		}, spec.Paths["/pets"]["get"])
+	})
+
+	t.Run("v2 json", func(t *testing.T) {
+		want := strings.NewReplacer(
+			`"UPSTREAM_HOST"`, `"`+proxyHost+`"`,
+			`"/api"`, `"/spec/api"`,
+		).Replace(specs["/v2.json"])
+		require.Equal(t, want, getBody(t, proxied("v2.json")))
+	})
+
+	t.Run("v2 yaml without basePath", func(t *testing.T) {
+		var spec map[string]any
+		require.NoError(t, yaml.Unmarshal([]byte(getBody(t, proxied("v2.yaml"))), &spec))
+		require.Equal(t, "/spec/", spec["basePath"])
+		require.Equal(t, map[string]any{"get": map[string]any{"summary": "List pets"}}, spec["paths"].(map[string]any)["/pets"])
+	})
+
+	t.Run("configured spec path", func(t *testing.T) {
+		require.Equal(t, `{"openapi": "3.1.0", "servers": [{"url": "`+proxied("v1")+`"}]}`, getBody(t, proxied("spec.txt")))
+	})
+
+	t.Run("other documents", func(t *testing.T) {
+		require.Equal(t, `{"url": "`+upstream.URL+`/v1"}`, getBody(t, proxied("other.json")))
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	config := fmt.Sprintf(`targets:
+  - baseUrl: %s
+    prefix: /good/
+  - baseUrl: http://upstream.invalid
+    prefix: /unresolvable/
+  - baseUrl: %s
+    prefix: /bad-regexp/
+    rewriteExclusions:
+      patterns: ["regexp:("]
+`, upstream.URL, upstream.URL)
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	checks := func(findings []proxy.Finding) map[string]proxy.Severity {
+		result := make(map[string]proxy.Severity)
+		for _, finding := range findings {
+			result[finding.Check] = finding.Severity
+		}
+		return result
+	}
+
+	t.Run("config file", func(t *testing.T) {
+		report, err := proxy.DryRunFile(context.Background(), path, nil, proxy.WithProbeTimeout(2*time.Second))
+		require.ErrorIs(t, err, proxy.ErrDryRunFailed)
+		require.True(t, report.HasErrors())
+
+		require.Equal(t, map[string]proxy.Severity{"http": proxy.SeverityInfo}, checks(report.ForTarget("/good/")))
+		require.Equal(t, map[string]proxy.Severity{"dns": proxy.SeverityError}, checks(report.ForTarget("/unresolvable/")))
+		require.Equal(t, map[string]proxy.Severity{"config": proxy.SeverityError}, checks(report.ForTarget("/bad-regexp/")))
+		require.Empty(t, report.ForTarget(""))
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/good/"}))
+
+		report, err := p.DryRun(context.Background())
+		require.NoError(t, err)
+		require.False(t, report.HasErrors())
+		require.Len(t, report.Findings, 1)
+
+		report, err = p.DryRun(context.Background(), proxy.WithoutProbes())
+		require.NoError(t, err)
+		require.Empty(t, report.Findings)
+	})
+
+	t.Run("listen address in use", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "0.0.0.0:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		p, err := proxy.NewProxy(proxy.WithPort(listener.Addr().(*net.TCPAddr).Port))
+		require.NoError(t, err)
+		report, err := p.DryRun(context.Background(), proxy.WithoutProbes())
+		require.ErrorIs(t, err, proxy.ErrDryRunFailed)
+		require.Equal(t, map[string]proxy.Severity{"listen": proxy.SeverityError}, checks(report.ForTarget("")))
+	})
+}
+
+func TestRuntimeTargets(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/first/"}))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	status := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a request to /first/ is in flight while the targets change
+	slow := make(chan int)
+	go func() {
+		resp, err := http.Get(server.URL + "/first/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := http.Get(server.URL + "/first/fast")
+				if err == nil {
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		prefix := fmt.Sprintf("/added-%d/", i)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: prefix}))
+		require.Equal(t, http.StatusOK, status(prefix+"fast"))
+		require.NoError(t, p.RemoveTarget(prefix))
+	}
+	wg.Wait()
+
+	require.NoError(t, p.RemoveTarget("first/"))
+	require.Equal(t, http.StatusNotFound, status("/first/fast"))
+	require.Equal(t, http.StatusNotFound, status("/added-0/fast"))
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-slow)
+
+	err = p.RemoveTarget("/first/")
+	require.ErrorIs(t, err, proxy.ErrUnknownTarget)
+}
+
+func TestHooks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Order", strings.Join(r.Header.Values("X-Order"), ","))
+	}))
+	defer upstream.Close()
+
+	var mu sync.Mutex
+	calls := make([]string, 0)
+	pre := func(name string) func(*http.Request) *http.Request {
+		return func(r *http.Request) *http.Request {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, "pre "+name)
+			r.Header.Add("X-Order", name)
+			return r
+		}
+	}
+	post := func(name string) func(*http.Response) *http.Response {
+		return func(r *http.Response) *http.Response {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, "post "+name)
+			return r
+		}
+	}
+	run := func(t *testing.T, target proxy.Target, path string) []string {
+		calls = calls[:0]
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(target))
+		server := httptest.NewServer(p)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return append([]string{resp.Header.Get("X-Order")}, calls...)
+	}
+
+	t.Run("registration order", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hooks/"}
+		target.AddPreRequest(pre("first"))
+		target.AddPostRequest(post("first"))
+		target.AddPreRequest(pre("second"))
+		target.AddPostRequest(post("second"))
+
+		require.Equal(t, []string{"first,second", "pre first", "pre second", "post second", "post first"}, run(t, target, "/hooks/"))
+	})
+
+	t.Run("priorities", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hooks/"}
+		target.AddPreRequest(pre("user"))
+		target.AddPostRequest(post("user"))
+		target.AddPreRequest(pre("late"), proxy.WithHookPriority(10))
+		target.AddPostRequest(post("late"), proxy.WithHookPriority(10))
+		target.AddPreRequest(pre("auth"), proxy.WithHookPriority(proxy.HookPriorityAuth))
+		target.AddPreRequest(pre("stats"), proxy.WithHookPriority(proxy.HookPriorityInstrumentation))
+		target.AddPostRequest(post("stats"), proxy.WithHookPriority(proxy.HookPriorityInstrumentation))
+
+		require.Equal(t, []string{
+			"stats,auth,user,late",
+			"pre stats", "pre auth", "pre user", "pre late",
+			"post late", "post user", "post stats",
+		}, run(t, target, "/hooks/"))
+	})
+
+	t.Run("legacy fields", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hooks/", PreRequest: pre("field"), PostRequest: post("field")}
+		target.AddPreRequest(pre("added"))
+		target.AddPostRequest(post("added"))
+		target.AddPreRequest(pre("stats"), proxy.WithHookPriority(proxy.HookPriorityInstrumentation))
+
+		require.Equal(t, []string{"stats,added,field", "pre stats", "pre added", "pre field", "post field", "post added"}, run(t, target, "/hooks/"))
+	})
+
+	t.Run("nil returns", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hooks/"}
+		target.AddPreRequest(func(*http.Request) *http.Request { return nil })
+		target.AddPreRequest(pre("after nil"))
+		target.AddPostRequest(post("after nil"))
+		target.AddPostRequest(func(*http.Response) *http.Response { return nil })
+
+		require.Equal(t, []string{"after nil", "pre after nil", "post after nil"}, run(t, target, "/hooks/"))
+	})
+
+	t.Run("failed request", func(t *testing.T) {
+		responses := make([]*http.Response, 0)
+		target := proxy.Target{BaseUrl: "http://127.0.0.1:1", Prefix: "/hooks/"}
+		for i := 0; i < 2; i++ {
+			target.AddPostRequest(func(r *http.Response) *http.Response {
+				responses = append(responses, r)
+				return &http.Response{StatusCode: http.StatusOK}
+			})
+		}
+
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(target))
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/hooks/", nil))
+		require.Equal(t, http.StatusBadGateway, recorder.Code)
+		require.Equal(t, []*http.Response{nil, nil}, responses)
+	})
+
+	t.Run("copies do not share hooks", func(t *testing.T) {
+		base := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hooks/"}
+		base.AddPreRequest(pre("base"))
+		first, second := base, base
+		first.AddPreRequest(pre("first"))
+		second.AddPreRequest(pre("second"))
+
+		require.Equal(t, "base,first", run(t, first, "/hooks/")[0])
+		require.Equal(t, "base,second", run(t, second, "/hooks/")[0])
+	})
+}
+
+func TestHostRouting(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		var upstream *httptest.Server
+		upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<html><body><p>%s %s</p><a id="root" href="/root"></a><a id="abs" href="%s/abs"></a></body></html>`, name, r.URL.Path, upstream.URL)
+		}))
+		return upstream
+	}
+	github, wiki, fallback := newUpstream("github"), newUpstream("wiki"), newUpstream("fallback")
+	defer github.Close()
+	defer wiki.Close()
+	defer fallback.Close()
+
+	p, err := proxy.NewProxy(proxy.WithCrossTargetRewrite())
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: github.URL, Host: "GitHub.localhost"}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: wiki.URL, Host: "*.wiki.localhost"}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: fallback.URL, Prefix: "/fallback/"}))
+
+	get := func(rawUrl string) (int, *goquery.Document) {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, rawUrl, nil))
+		doc, err := goquery.NewDocumentFromReader(recorder.Body)
+		require.NoError(t, err)
+		return recorder.Code, doc
+	}
+	href := func(doc *goquery.Document, id string) string {
+		value, _ := doc.Find("#" + id).Attr("href")
+		return value
+	}
+
+	t.Run("exact host", func(t *testing.T) {
+		status, doc := get("http://github.localhost:8080/page")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "github /page", doc.Find("p").Text())
+		require.Equal(t, "/root", href(doc, "root"))
+		require.Equal(t, "http://github.localhost:8080/abs", href(doc, "abs"))
+	})
+
+	t.Run("wildcard host", func(t *testing.T) {
+		status, doc := get("http://en.wiki.localhost/page")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "wiki /page", doc.Find("p").Text())
+		require.Equal(t, "http://en.wiki.localhost/abs", href(doc, "abs"))
+
+		status, _ = get("http://wiki.localhost/page")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("prefix fallback", func(t *testing.T) {
+		status, doc := get("http://github.localhost:8080/fallback/page")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "github /fallback/page", doc.Find("p").Text(), "the host target serves all of its paths")
+
+		status, doc = get("http://localhost:8080/fallback/page")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "fallback /page", doc.Find("p").Text())
+		require.Equal(t, "http://localhost:8080/fallback/root", href(doc, "root"))
+		require.Equal(t, "http://localhost:8080/fallback/abs", href(doc, "abs"))
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		status, _ := get("http://localhost:8080/page")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("cross target links", func(t *testing.T) {
+		page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<a id="github" href="%s/x"></a><a id="wiki" href="%s/x"></a>`, github.URL, wiki.URL)
+		}))
+		defer page.Close()
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: page.URL, Prefix: "/page/"}))
+
+		_, doc := get("http://localhost:8080/page/")
+		require.Equal(t, "http://github.localhost:8080/x", href(doc, "github"))
+		require.Equal(t, wiki.URL+"/x", href(doc, "wiki"), "wildcard hosts cannot be linked to")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, p.RemoveTarget("github.localhost/"))
+		status, _ := get("http://github.localhost:8080/other")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("invalid host", func(t *testing.T) {
+		err := p.AddTarget(proxy.Target{BaseUrl: github.URL, Host: "github.localhost:8080"})
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "hostname", validationErrs[0].Rule)
+	})
+}
+
+func TestPathRewriting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	forwardedPath := func(t *testing.T, target proxy.Target, path string) string {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(target))
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.String()
+	}
+
+	t.Run("strip prefix", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}
+		require.Equal(t, "/users?page=2", forwardedPath(t, target, "/api/users?page=2"))
+		require.Equal(t, "/", forwardedPath(t, target, "/api/"))
+	})
+
+	t.Run("rewrite prefix", func(t *testing.T) {
+		target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/", RewritePrefix: "/v2"}
+		require.Equal(t, "/v2/users?page=2", forwardedPath(t, target, "/api/users?page=2"))
+		require.Equal(t, "/v2/", forwardedPath(t, target, "/api/"))
+	})
+
+	t.Run("path transform", func(t *testing.T) {
+		target := proxy.Target{
+			BaseUrl:       upstream.URL,
+			Prefix:        "/api/",
+			RewritePrefix: "/v2/",
+			PathTransform: func(path string) string { return strings.ToLower(path) + ".json" },
+		}
+		require.Equal(t, "/v2/users.json?page=2", forwardedPath(t, target, "/api/Users?page=2"))
+	})
+}
+
+func TestDefaultTarget(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	api, app := newUpstream("api"), newUpstream("app")
+	defer api.Close()
+	defer app.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: api.URL, Prefix: "/api/"}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: app.URL, Prefix: "/app/", Default: true}))
+
+	get := func(path string) string {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.String()
+	}
+	require.Equal(t, "app /totally/unknown", get("/totally/unknown"))
+	require.Equal(t, "app /page", get("/app/page"))
+	require.Equal(t, "api /users", get("/api/users"))
+
+	t.Run("conflicts", func(t *testing.T) {
+		err := p.AddTarget(proxy.Target{BaseUrl: api.URL, Prefix: "/other/", Default: true})
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "unique", validationErrs[0].Rule)
+
+		err = p.AddTarget(proxy.Target{BaseUrl: api.URL, Prefix: "/"})
+		validationErrs = proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "unique", validationErrs[0].Rule)
+
+		// replacing the default target requires removing it first
+		require.NoError(t, p.RemoveTarget("/app/"))
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: api.URL, Prefix: "/app/", Default: true}))
+		require.Equal(t, "api /totally/unknown", get("/totally/unknown"))
+	})
+
+	t.Run("config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.yaml")
+		config := fmt.Sprintf("targets:\n  - {baseUrl: %s, prefix: /a/, default: true}\n  - {baseUrl: %s, prefix: /b/, default: true}\n", api.URL, app.URL)
+		require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+		_, err := proxy.NewProxyFromFile(path)
+		require.Error(t, err)
+	})
+}
+
+func TestQueryParams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(r.URL.Query())
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl:          upstream.URL,
+		Prefix:           "/api/",
+		AddQueryParams:   map[string]string{"api_key": "secret", "version": "2"},
+		StripQueryParams: []string{"session", "tracking"},
+	}))
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/users?page=3&session=abc&version=1&version=3&tracking", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var query url.Values
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &query))
+	require.Equal(t, url.Values{
+		"page":    {"3"},
+		"api_key": {"secret"},
+		"version": {"2"},
+	}, query)
+}
+
+func TestRequestHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer upstream.Close()
+
+	var hookHeader string
+	target := proxy.Target{
+		BaseUrl:              upstream.URL,
+		Prefix:               "/api/",
+		RemoveRequestHeaders: []string{"Cookie", "X-Forwarded-For"},
+		AddRequestHeaders:    map[string]string{"Authorization": "Bearer token", "X-Api-Version": "2"},
+		PreRequest: func(r *http.Request) *http.Request {
+			hookHeader = r.Header.Get("Authorization")
+			return r
+		},
+	}
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(target))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/", nil)
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("Authorization", "Basic client")
+	req.Header.Set("Accept", "application/json")
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var header http.Header
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &header))
+	require.Empty(t, header.Values("Cookie"))
+	require.Empty(t, header.Values("X-Forwarded-For"))
+	require.Equal(t, []string{"Bearer token"}, header.Values("Authorization"))
+	require.Equal(t, "2", header.Get("X-Api-Version"))
+	require.Equal(t, "application/json", header.Get("Accept"))
+	require.Equal(t, "Bearer token", hookHeader, "PreRequest runs after the headers are changed")
+
+	// the request of the client is not modified
+	require.Equal(t, "session=abc", req.Header.Get("Cookie"))
+	require.Equal(t, "Basic client", req.Header.Get("Authorization"))
+	require.Empty(t, req.Header.Get("X-Api-Version"))
+}
+
+func TestMutationAudit(t *testing.T) {
+	var upstreamUrl, page string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Upstream", "secret")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(page))
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+	page = fmt.Sprintf(`<html><head></head><body>
+<a href="%[1]s/one">one</a><a href="%[1]s/two">two</a><a href="https://other.example/">other</a>
+<img src="/logo.png"/><div data-api="%[1]s/api"></div>
+</body></html>`, upstreamUrl)
+
+	target := proxy.Target{
+		BaseUrl:             upstreamUrl,
+		Prefix:              "/audit/",
+		RewriteRules:        []proxy.RewriteRule{{Selector: "[data-api]", Attr: "data-api"}},
+		ResponseHeaderRules: []proxy.HeaderRule{{Name: "X-Upstream", Remove: true}, {Name: "Cache-Control", Value: "max-age=60"}},
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithMutationAudit())
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(target))
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost:8080/audit/", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var report proxy.MutationReport
+		require.NoError(t, json.Unmarshal([]byte(recorder.Header().Get("X-Proxy-Mutations")), &report))
+		require.Equal(t, 2, report.Rewrites["a[href]"].Count)
+		require.Equal(t, upstreamUrl+"/one -> http://localhost:8080/audit/one", report.Rewrites["a[href]"].Sample)
+		require.Equal(t, 1, report.Rewrites["img[src]"].Count)
+		require.Equal(t, map[string]int{"[data-api]": 1}, report.Rules)
+		require.Contains(t, report.HeadersRemoved, "X-Upstream")
+		require.Contains(t, report.HeadersChanged, "Cache-Control")
+		require.Contains(t, report.HeadersAdded, "Access-Control-Allow-Origin")
+		require.Equal(t, len(page), report.UpstreamBytes)
+		require.Equal(t, recorder.Body.Len(), report.RewrittenBytes)
+		require.Zero(t, report.CompressedBytes)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(target))
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost:8080/audit/", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Empty(t, recorder.Header().Values("X-Proxy-Mutations"))
+	})
+}
+
+func TestListenerHandoff(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Generation")))
+	}))
+	defer upstream.Close()
+
+	target := func(generation string) proxy.Target {
+		return proxy.Target{BaseUrl: upstream.URL, Prefix: "/", AddRequestHeaders: map[string]string{"X-Generation": generation}}
+	}
+	old, proxyUrl := newLocalProxy(t, []proxy.Target{target("old")})
+
+	// clients keep sending requests on new connections throughout the handoff
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	errs := make([]error, 0)
+	generations := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Get(proxyUrl + "/")
+				var body []byte
+				if err == nil {
+					body, err = io.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					generations[string(body)]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	file, err := old.ListenerFile()
+	require.NoError(t, err)
+	next, err := proxy.NewProxy(proxy.WithListenerFile(file))
+	require.NoError(t, err)
+	require.NoError(t, next.AddTarget(target("next")))
+	startProxy(t, next)
+	t.Cleanup(func() { stopServer(t, next) })
+	require.Equal(t, proxyUrl, next.Addr())
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, old.Handoff(context.Background()))
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	require.Empty(t, errs)
+	require.NotZero(t, generations["old"])
+	require.NotZero(t, generations["next"])
+
+	body := getBody(t, proxyUrl+"/")
+	require.Equal(t, "next", body)
+}
+
+func TestTargets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Api-Key")))
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.Empty(t, p.Targets())
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "web/"}))
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl:           upstream.URL,
+		Prefix:            "/api/",
+		AddRequestHeaders: map[string]string{"X-Api-Key": "secret"},
+		LoginCompat:       &proxy.LoginCompat{Paths: []string{"/login"}},
+	}))
+
+	targets := p.Targets()
+	require.Len(t, targets, 2)
+	require.Equal(t, "/api/", targets[0].Prefix)
+	require.Equal(t, "/web/", targets[1].Prefix)
+
+	target, ok := p.Target("api/")
+	require.True(t, ok)
+	require.Equal(t, "secret", target.AddRequestHeaders["X-Api-Key"])
+	_, ok = p.Target("/unknown/")
+	require.False(t, ok)
+
+	// changing the copies does not change the routing
+	targets[0].AddRequestHeaders["X-Api-Key"] = "changed"
+	target.LoginCompat.Paths[0] = "/changed"
+	target.Prefix = "/changed/"
+	server := httptest.NewServer(p)
+	defer server.Close()
+	require.Equal(t, "secret", getBody(t, server.URL+"/api/"))
+	target, _ = p.Target("/api/")
+	require.Equal(t, "secret", target.AddRequestHeaders["X-Api-Key"])
+	require.Equal(t, []string{"/login"}, target.LoginCompat.Paths)
+
+	require.NoError(t, p.RemoveTarget("/web/"))
+	targets = p.Targets()
+	require.Len(t, targets, 1)
+	require.Equal(t, "/api/", targets[0].Prefix)
+}
+
+func TestResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-Backend-Ip", "10.0.0.12")
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	var hookSaw string
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl:               upstream.URL,
+		Prefix:                "/api/",
+		RemoveResponseHeaders: []string{"X-Powered-By", "X-Backend-Ip"},
+		AddResponseHeaders:    map[string]string{"X-Proxy-Target": "api", "Access-Control-Allow-Origin": "https://added.example"},
+		PostRequest: func(resp *http.Response) *http.Response {
+			if resp != nil {
+				hookSaw = resp.Header.Get("X-Powered-By")
+				resp.Header.Set("X-Backend-Ip", "10.0.0.13")
+			}
+			return resp
+		},
+	}))
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "PHP/5.6", hookSaw, "PostRequest sees the upstream headers")
+	require.Empty(t, recorder.Header().Values("X-Powered-By"))
+	require.Empty(t, recorder.Header().Values("X-Backend-Ip"), "headers set by PostRequest are removed as well")
+	require.Equal(t, "api", recorder.Header().Get("X-Proxy-Target"))
+	require.Equal(t, "*", recorder.Header().Get("Access-Control-Allow-Origin"), "the CORS headers of the proxy win")
+}
+
+func TestRedaction(t *testing.T) {
+	fixtures := map[string]struct{ contentType, body string }{
+		"/users.json": {"application/json", `{"users": [{"name": "Ann", "email": "ann@example.com", "token": {"value": "abc", "expires": 1700000000}},
+  {"name": "Bob \u0026 \"Co\"", "email": "bob@example.com", "token": null}], "total": 2, "note": "contact ann@example.com"}`},
+		"/page.html": {"text/html", `<html><head><title>Users</title></head><body>` +
+			`<p class="user">Ann &lt;ann@example.com&gt;</p><a href="mailto:ann@example.com" title="ann@example.com">mail</a>` +
+			`</body></html>`},
+		"/log.txt":    {"text/plain", "login by ann@example.com\nlogin by bob@example.com\n"},
+		"/other.json": {"application/json", `{"items": [1, 2.50, true]}`},
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture := fixtures[r.URL.Path]
+		w.Header().Set("Content-Type", fixture.contentType)
+		w.Write([]byte(fixture.body))
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy(proxy.WithMutationAudit())
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl: upstream.URL,
+		Prefix:  "/admin/",
+		Redactions: []proxy.RedactionRule{
+			{ContentTypes: []string{"application/json"}, JSONPaths: []string{"users.*.email", "users.*.token"}},
+			{Patterns: []string{`[\w.]+@example\.com`}, Mask: "***"},
+		},
+	}))
+
+	get := func(path string) (string, proxy.MutationReport) {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin"+path, nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var report proxy.MutationReport
+		require.NoError(t, json.Unmarshal([]byte(recorder.Header().Get("X-Proxy-Mutations")), &report))
+		return recorder.Body.String(), report
+	}
+
+	t.Run("json", func(t *testing.T) {
+		body, report := get("/users.json")
+		require.JSONEq(t, `{"users": [{"name": "Ann", "email": "[REDACTED]", "token": "[REDACTED]"},
+  {"name": "Bob & \"Co\"", "email": "[REDACTED]", "token": "[REDACTED]"}], "total": 2, "note": "contact ann@example.com"}`, body)
+		require.Less(t, strings.Index(body, `"users"`), strings.Index(body, `"total"`), "the order of the keys is kept")
+		require.Equal(t, 4, report.Redactions)
+	})
+
+	t.Run("html", func(t *testing.T) {
+		body, report := get("/page.html")
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, "Ann <***>", doc.Find("p.user").Text())
+		href, _ := doc.Find("a").Attr("href")
+		require.Equal(t, "mailto:ann@example.com", href)
+		title, _ := doc.Find("a").Attr("title")
+		require.Equal(t, "ann@example.com", title)
+		require.Equal(t, "Users", doc.Find("title").Text())
+		require.Equal(t, 1, report.Redactions)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		body, report := get("/log.txt")
+		require.Equal(t, "login by ***\nlogin by ***\n", body)
+		require.Equal(t, 2, report.Redactions)
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		body, report := get("/other.json")
+		require.Equal(t, fixtures["/other.json"].body, body)
+		require.Zero(t, report.Redactions)
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		err := p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/bad/", Redactions: []proxy.RedactionRule{{Patterns: []string{"("}}}})
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "Target.Redactions.Patterns", validationErrs[0].Field)
+	})
+}
+
+func TestEventStream(t *testing.T) {
+	disconnected := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "id: %d\ndata: event %d\n\n", i, i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		// the stream stays open until the client is gone
+		<-r.Context().Done()
+		close(disconnected)
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/events/"}))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events/stream", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 3 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	require.Equal(t, []string{"event 1", "event 2", "event 3"}, events)
+
+	// disconnecting the client ends the upstream stream
+	cancel()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream stream was not closed after the client disconnected")
+	}
+}
+
+func TestTargetValidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v2 " + r.URL.Path))
+	}))
+	defer v2.Close()
+
+	t.Run("rejected", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			target proxy.Target
+			field  string
+			rule   string
+		}{
+			{"empty prefix", proxy.Target{BaseUrl: upstream.URL, Prefix: ""}, "Target.Prefix", "required"},
+			{"whitespace prefix", proxy.Target{BaseUrl: upstream.URL, Prefix: "  "}, "Target.Prefix", "required"},
+			{"prefix with whitespace", proxy.Target{BaseUrl: upstream.URL, Prefix: "/my api/"}, "Target.Prefix", "prefix"},
+			{"duplicate prefix", proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}, "Target.Prefix", "unique"},
+			{"duplicate prefix without slashes", proxy.Target{BaseUrl: upstream.URL, Prefix: "api"}, "Target.Prefix", "unique"},
+			{"base url without scheme", proxy.Target{BaseUrl: "example.com", Prefix: "/a/"}, "Target.BaseUrl", "url"},
+			{"base url without host", proxy.Target{BaseUrl: "http://", Prefix: "/b/"}, "Target.BaseUrl", "url"},
+			{"relative base url", proxy.Target{BaseUrl: "/upstream", Prefix: "/c/"}, "Target.BaseUrl", "url"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				p, err := proxy.NewProxy()
+				require.NoError(t, err)
+				require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}))
+
+				validationErrs := proxy.ValidationErrors(p.AddTarget(tt.target))
+				require.Len(t, validationErrs, 1)
+				require.Equal(t, tt.field, validationErrs[0].Field)
+				require.Equal(t, tt.rule, validationErrs[0].Rule)
+			})
+		}
+	})
+
+	t.Run("duplicate prefix in config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.yaml")
+		config := fmt.Sprintf("targets:\n  - {baseUrl: %s, prefix: /api/}\n  - {baseUrl: %s, prefix: /api}\n", upstream.URL, v2.URL)
+		require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+		_, err := proxy.NewProxyFromFile(path)
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "unique", validationErrs[0].Rule)
+	})
+
+	t.Run("longest prefix wins", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/api"}))
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: v2.URL, Prefix: "api/v2"}))
+		require.Equal(t, []string{"/api/", "/api/v2/"}, targetPrefixes(p))
+
+		get := func(path string) string {
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+			return recorder.Body.String()
+		}
+		require.Equal(t, "/users", get("/api/users"))
+		require.Equal(t, "v2 /users", get("/api/v2/users"))
+		require.Equal(t, "/v3/users", get("/api/v3/users"))
+
+		// the prefix can be given the way it was added
+		require.NoError(t, p.RemoveTarget("api/v2"))
+		require.Equal(t, "/v2/users", get("/api/v2/users"))
+	})
+}
+
+func targetPrefixes(p *proxy.Proxy) []string {
+	prefixes := make([]string, 0)
+	for _, target := range p.Targets() {
+		prefixes = append(prefixes, target.Prefix)
+	}
+	return prefixes
+}
+
+func TestStreamingResponse(t *testing.T) {
+	const chunkSize = 32 * 1024 // the buffer size of io.Copy
+	var large []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/large.html":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write(large)
+		case "/chunked.html":
+			w.Write([]byte(`<a href="/first">first</a>`))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(`<a href="/second">second</a>`))
+		default:
+			w.Write([]byte(`<a href="/small">small</a>`))
+		}
+	}))
+	defer upstream.Close()
+	large = bytes.Repeat([]byte(fmt.Sprintf(`<a href="%s/page">link</a>`+"\n", upstream.URL)), 10*1024*1024/(len(upstream.URL)+27))
+
+	p, err := proxy.NewProxy(proxy.WithStreamingResponse(1024 * 1024))
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/up/"}))
+
+	t.Run("large response is streamed", func(t *testing.T) {
+		w := &countingResponseWriter{header: make(http.Header)}
+		req := httptest.NewRequest(http.MethodGet, "/up/large.html", nil)
+		// warm up the connection to the upstream, so only the copying is measured
+		p.ServeHTTP(&countingResponseWriter{header: make(http.Header)}, req)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		p.ServeHTTP(w, req)
+		runtime.ReadMemStats(&after)
+
+		require.Equal(t, len(large), w.n, "the body is passed on untouched")
+		require.Equal(t, strconv.Itoa(len(large)), w.header.Get("Content-Length"))
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(2*chunkSize))
+	})
+
+	t.Run("chunked response is streamed", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/up/chunked.html", nil))
+		require.Equal(t, `<a href="/first">first</a><a href="/second">second</a>`, recorder.Body.String())
+	})
+
+	t.Run("small response is rewritten", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/up/small.html", nil))
+		require.Contains(t, recorder.Body.String(), `/up/small`)
+	})
+
+	t.Run("negative size", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithStreamingResponse(-1))
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "StreamingResponse", validationErrs[0].Field)
+	})
+}
+
+// countingResponseWriter discards the body and counts its bytes
+type countingResponseWriter struct {
+	header http.Header
+	status int
+	n      int
+}
+
+func (w *countingResponseWriter) Header() http.Header { return w.header }
+
+func (w *countingResponseWriter) WriteHeader(status int) { w.status = status }
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
+
+func TestPrefixWithoutTrailingSlash(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	for _, prefix := range []string{"/p", "/p/"} {
+		t.Run(prefix, func(t *testing.T) {
+			p, err := proxy.NewProxy()
+			require.NoError(t, err)
+			require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: prefix}))
+
+			get := func(path string) (int, string) {
+				recorder := httptest.NewRecorder()
+				p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+				return recorder.Code, recorder.Body.String()
+			}
+			for path, upstreamPath := range map[string]string{
+				"/p":            "/",
+				"/p?q=1":        "/?q=1",
+				"/p/":           "/",
+				"/p/deep/path":  "/deep/path",
+				"/p/deep/path/": "/deep/path/",
+			} {
+				status, body := get(path)
+				require.Equal(t, http.StatusOK, status, path)
+				require.Equal(t, upstreamPath, body, path)
+			}
+
+			status, _ := get("/pp")
+			require.Equal(t, http.StatusNotFound, status, "only the prefix itself and its subtree belong to the target")
+		})
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other host"))
+	}))
+	defer other.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/status/"):
+			status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+			http.Redirect(w, r, "/final", status)
+		case r.URL.Path == "/chain/1":
+			http.Redirect(w, r, "/chain/2", http.StatusFound)
+		case r.URL.Path == "/chain/2":
+			http.Redirect(w, r, "/final?from=chain", http.StatusMovedPermanently)
+		case r.URL.Path == "/loop/a":
+			http.Redirect(w, r, "/loop/b", http.StatusFound)
+		case r.URL.Path == "/loop/b":
+			http.Redirect(w, r, "/loop/a", http.StatusFound)
+		case r.URL.Path == "/cross":
+			http.Redirect(w, r, other.URL+"/page", http.StatusFound)
+		case r.URL.Path == "/final":
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s", r.Method, body)
+		}
+	}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/follow/", FollowRedirects: &proxy.RedirectPolicy{}}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/short/", FollowRedirects: &proxy.RedirectPolicy{MaxHops: 1}}))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	t.Run("status codes", func(t *testing.T) {
+		for status, expected := range map[int]string{
+			http.StatusMovedPermanently:  "GET ",
+			http.StatusFound:             "GET ",
+			http.StatusSeeOther:          "GET ",
+			http.StatusTemporaryRedirect: "POST payload",
+			http.StatusPermanentRedirect: "POST payload",
+		} {
+			res := do(http.MethodPost, fmt.Sprintf("/follow/status/%d", status), "payload")
+			require.Equal(t, http.StatusOK, res.Code, status)
+			require.Equal(t, expected, res.Body.String(), status)
+			require.Equal(t, fmt.Sprintf("%d /final", status), res.Header().Get("X-Proxy-Redirects"))
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		res := do(http.MethodGet, "/follow/chain/1", "")
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, "302 /chain/2, 301 /final?from=chain", res.Header().Get("X-Proxy-Redirects"))
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		res := do(http.MethodGet, "/follow/loop/a", "")
+		require.Equal(t, http.StatusLoopDetected, res.Code)
+	})
+
+	t.Run("hop limit", func(t *testing.T) {
+		require.Equal(t, http.StatusLoopDetected, do(http.MethodGet, "/short/chain/1", "").Code)
+		require.Equal(t, http.StatusOK, do(http.MethodGet, "/short/chain/2", "").Code)
+	})
+
+	t.Run("cross host", func(t *testing.T) {
+		res := do(http.MethodGet, "/follow/cross", "")
+		require.Equal(t, http.StatusFound, res.Code)
+		require.Equal(t, other.URL+"/page", res.Header().Get("Location"))
+		require.Empty(t, res.Header().Get("X-Proxy-Redirects"))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		err := p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/both/", FollowRedirects: &proxy.RedirectPolicy{}, RewriteRedirects: true})
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "excluded_with", validationErrs[0].Rule)
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	get := func(t *testing.T, opts ...proxy.ProxyOption) *httptest.ResponseRecorder {
+		p, err := proxy.NewProxy(opts...)
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/b/"}))
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/a/"}))
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Host: "app.localhost"}))
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown/path", nil))
+		return recorder
+	}
+
+	t.Run("json", func(t *testing.T) {
+		res := get(t)
+		require.Equal(t, http.StatusNotFound, res.Code)
+		require.Equal(t, "application/json", res.Header().Get("Content-Type"))
+		require.JSONEq(t, `{"error": "no target matches the path", "path": "/unknown/path", "prefixes": ["/a/", "/b/", "app.localhost/"]}`, res.Body.String())
+	})
+
+	t.Run("without prefix listing", func(t *testing.T) {
+		res := get(t, proxy.WithoutPrefixListing())
+		require.Equal(t, http.StatusNotFound, res.Code)
+		require.JSONEq(t, `{"error": "no target matches the path", "path": "/unknown/path"}`, res.Body.String())
+	})
+
+	t.Run("custom handler", func(t *testing.T) {
+		res := get(t, proxy.WithNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nothing at "+r.URL.Path, http.StatusGone)
+		})))
+		require.Equal(t, http.StatusGone, res.Code)
+		require.Equal(t, "nothing at /unknown/path\n", res.Body.String())
+	})
+}
+
+func TestIndexPage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p, err := proxy.NewProxy(proxy.WithIndexPage(), proxy.WithPublicURL("https://proxy.example.com"))
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/github/"}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: "https://example.com/docs", Prefix: "/docs/"}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Host: "*.wiki.localhost"}))
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("html", func(t *testing.T) {
+		res := get("/", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, "text/html; charset=utf-8", res.Header().Get("Content-Type"))
+
+		doc, err := goquery.NewDocumentFromReader(res.Body)
+		require.NoError(t, err)
+		links := make(map[string]string)
+		doc.Find("a").Each(func(_ int, a *goquery.Selection) {
+			links[a.Text()], _ = a.Attr("href")
+		})
+		require.Equal(t, map[string]string{
+			"/docs/":   "https://proxy.example.com/docs/",
+			"/github/": "https://proxy.example.com/github/",
+		}, links, "wildcard hosts cannot be linked")
+		require.Contains(t, doc.Text(), "*.wiki.localhost/")
+		require.Contains(t, doc.Text(), "https://example.com/docs")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		res := get("/", "application/json")
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, "application/json", res.Header().Get("Content-Type"))
+		require.JSONEq(t, fmt.Sprintf(`{"targets": [
+			{"prefix": "/", "host": "*.wiki.localhost", "baseUrl": %[1]q},
+			{"prefix": "/docs/", "baseUrl": "https://example.com/docs", "url": "https://proxy.example.com/docs/"},
+			{"prefix": "/github/", "baseUrl": %[1]q, "url": "https://proxy.example.com/github/"}
+		]}`, upstream.URL), res.Body.String())
+	})
+
+	t.Run("other paths are not found", func(t *testing.T) {
+		res := get("/unknown", "application/json")
+		require.Equal(t, http.StatusNotFound, res.Code)
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		for _, target := range []proxy.Target{
+			{BaseUrl: upstream.URL, Prefix: "/"},
+			{BaseUrl: upstream.URL, Prefix: "/app/", Default: true},
+		} {
+			validationErrs := proxy.ValidationErrors(p.AddTarget(target))
+			require.Len(t, validationErrs, 1)
+			require.Equal(t, "excluded_with", validationErrs[0].Rule)
+		}
+		// a host target at / does not shadow the index page
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Host: "app.localhost", Prefix: "/"}))
+	})
+}
+
+func TestInfoEndpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	info := func(t *testing.T, p *proxy.Proxy, token string) (int, proxy.Info) {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/_proxy/info", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		p.ServeHTTP(recorder, req)
+		var result proxy.Info
+		if recorder.Code == http.StatusOK {
+			require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+		}
+		return recorder.Code, result
+	}
+
+	t.Run("without optional features", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithInfoEndpoint("secret"))
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/"}))
+
+		status, result := info(t, p, "secret")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, proxy.Version(), result.Version)
+		require.NotEmpty(t, result.Version)
+		require.Equal(t, runtime.Version(), result.GoVersion)
+		require.Equal(t, runtime.GOOS, result.GOOS)
+		require.Equal(t, runtime.GOARCH, result.GOARCH)
+		require.Equal(t, 1, result.Targets)
+		require.Equal(t, []string{"http://0.0.0.0:0"}, result.ListenAddresses)
+		for name, enabled := range result.Features {
+			require.Equal(t, name == "infoEndpoint", enabled, name)
+		}
+	})
+
+	t.Run("with optional features", func(t *testing.T) {
+		cert, err := proxy.GenerateSslCerts("Test")
+		require.NoError(t, err)
+		p, err := proxy.NewProxy(proxy.WithInfoEndpoint("secret"), proxy.WithSsl(cert), proxy.WithMutationAudit(),
+			proxy.WithRateLimitGovernor(time.Second), proxy.WithStreamingResponse(1024), proxy.WithPort(8443))
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/a/"}))
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/b/"}))
+
+		status, result := info(t, p, "secret")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, 2, result.Targets)
+		require.Equal(t, []string{"https://0.0.0.0:8443"}, result.ListenAddresses)
+		for _, name := range []string{"ssl", "mutationAudit", "rateLimitGovernor", "streamingResponse", "infoEndpoint"} {
+			require.True(t, result.Features[name], name)
+		}
+		require.False(t, result.Features["tracing"])
+	})
+
+	t.Run("admin token", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithInfoEndpoint("secret"))
+		require.NoError(t, err)
+		status, _ := info(t, p, "")
+		require.Equal(t, http.StatusUnauthorized, status)
+		status, _ = info(t, p, "wrong")
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		_, err = proxy.NewProxy(proxy.WithInfoEndpoint(""))
+		require.Len(t, proxy.ValidationErrors(err), 1)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/"}))
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/_proxy/info", nil))
+		require.Equal(t, "upstream /_proxy/info", recorder.Body.String(), "without the option the path belongs to the targets")
+	})
+}
+
+func TestMountedHandler(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<a href="/page">root relative</a><a href="%s/other">absolute</a>`, upstreamUrl)
+		}
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/app/", RewriteRedirects: true, RewriteCookies: true}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/own", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("own route")) })
+	mux.Handle("/proxy/", http.StripPrefix("/proxy", p))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	t.Run("links", func(t *testing.T) {
+		res, err := client.Get(server.URL + "/proxy/app/")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		doc, err := goquery.NewDocumentFromReader(res.Body)
+		require.NoError(t, err)
+		hrefs := doc.Find("a").Map(func(_ int, a *goquery.Selection) string { return a.AttrOr("href", "") })
+		require.Equal(t, []string{server.URL + "/proxy/app/page", server.URL + "/proxy/app/other"}, hrefs)
+	})
+
+	t.Run("redirects and cookies", func(t *testing.T) {
+		res, err := client.Get(server.URL + "/proxy/app/login")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusFound, res.StatusCode)
+		require.Equal(t, server.URL+"/proxy/app/home", res.Header.Get("Location"))
+		require.Len(t, res.Cookies(), 1)
+		require.Equal(t, "/proxy/app/", res.Cookies()[0].Path)
+	})
+
+	t.Run("own routes", func(t *testing.T) {
+		res, err := client.Get(server.URL + "/own")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, "own route", string(body))
+	})
+}
+
+func TestServeListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	serve := func(t *testing.T, serve func(p *proxy.Proxy, listener net.Listener) error) (*proxy.Proxy, net.Listener) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/up/"}))
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		served := make(chan error, 1)
+		go func() { served <- serve(p, listener) }()
+		waitReady(t, p, served)
+		t.Cleanup(func() {
+			require.NoError(t, p.Shutdown(context.Background()))
+			require.ErrorIs(t, <-served, http.ErrServerClosed)
+		})
+		return p, listener
+	}
+	get := func(t *testing.T, client *http.Client, url string) string {
+		res, err := client.Get(url)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		p, listener := serve(t, (*proxy.Proxy).Serve)
+		require.Equal(t, "http://"+listener.Addr().String(), p.Addr())
+		require.Equal(t, "upstream", get(t, http.DefaultClient, p.Addr()+"/up/"))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		cert, err := proxy.GenerateSslCerts("Test")
+		require.NoError(t, err)
+		certFile, err := proxy.SaveCertificateToFile(cert.Certificate[0], "cert*.pem")
+		require.NoError(t, err)
+		defer os.Remove(certFile)
+		keyFile, err := proxy.SavePrivateKeyToFile(cert.PrivateKey, "key*.pem")
+		require.NoError(t, err)
+		defer os.Remove(keyFile)
+
+		p, listener := serve(t, func(p *proxy.Proxy, listener net.Listener) error {
+			return p.ServeTLS(listener, certFile, keyFile)
+		})
+		require.Equal(t, "https://"+listener.Addr().String(), p.Addr())
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		require.Equal(t, "upstream", get(t, client, p.Addr()+"/up/"))
+	})
+}
+
+func TestUpstreamErrorClassification(t *testing.T) {
+	// a freed port could be taken by another test meanwhile, so the dialer refuses the connection itself
+	refusing := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}}
+	untrusted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer untrusted.Close()
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer reachable.Close()
+
+	socksServer, err := socks5.New(&socks5.Config{Credentials: socks5.StaticCredentials{"user": "secret"}})
+	require.NoError(t, err)
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socksListener.Close()
+	go socksServer.Serve(socksListener)
+	socksDialer, err := goProxy.SOCKS5("tcp", socksListener.Addr().String(), &goProxy.Auth{User: "user", Password: "wrong"}, goProxy.Direct)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		baseUrl   string
+		transport http.RoundTripper
+		class     proxy.ErrorClass
+	}{
+		{name: "DNS failure", baseUrl: "http://upstream.invalid", class: proxy.DNSFailure},
+		{name: "connection refused", baseUrl: reachable.URL, transport: refusing, class: proxy.ConnectionRefused},
+		{name: "TLS verification", baseUrl: untrusted.URL, class: proxy.TLSVerification},
+		{name: "proxy auth", baseUrl: reachable.URL, transport: &http.Transport{Dial: socksDialer.Dial}, class: proxy.ProxyAuth},
+		{name: "timeout", baseUrl: hanging.URL, transport: &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}, class: proxy.Timeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newRecordingHandler()
+			registry := prometheus.NewRegistry()
+			var reported []proxy.ErrorClass
+			target := proxy.Target{BaseUrl: tt.baseUrl, Prefix: "/failing/"}
+			target.AddPreRequest(func(r *http.Request) *http.Request {
+				return proxy.OnUpstreamError(r, func(class proxy.ErrorClass) { reported = append(reported, class) })
+			})
+			opts := []proxy.ProxyOption{proxy.WithLogger(slog.New(handler)), proxy.WithPrometheusMetrics(registry)}
+			if tt.transport != nil {
+				opts = append(opts, proxy.WithTransport(tt.transport))
+			}
+			_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, opts...)
+
+			res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix, "path"))
+			require.NoError(t, err)
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusBadGateway, res.StatusCode)
+			require.True(t, strings.HasPrefix(string(body), "Error forwarding request"))
+			require.Equal(t, []proxy.ErrorClass{tt.class}, reported)
+
+			// the warning and the completion of the request carry the class
+			require.Eventually(t, func() bool { return len(handler.RequestRecords()) == 3 }, time.Second, 10*time.Millisecond)
+			for _, record := range handler.RequestRecords()[1:] {
+				require.Equal(t, string(tt.class), record.attrs["error_class"])
+			}
+
+			expected := fmt.Sprintf(`
+# HELP proxy_upstream_errors_total Total number of requests that could not be forwarded, by the class of the error.
+# TYPE proxy_upstream_errors_total counter
+proxy_upstream_errors_total{class="%s",target="/failing/"} 1
+`, tt.class)
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "proxy_upstream_errors_total"))
+		})
+	}
+
+	t.Run("wrapped errors of custom transports", func(t *testing.T) {
+		opErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		require.Equal(t, proxy.ConnectionRefused, proxy.ClassifyError(fmt.Errorf("custom transport: %w", opErr)))
+		require.Equal(t, proxy.Timeout, proxy.ClassifyError(fmt.Errorf("custom transport: %w", context.DeadlineExceeded)))
+		require.Equal(t, proxy.ProxyAuth, proxy.ClassifyError(&proxy.UpstreamError{Class: proxy.ProxyAuth, Err: errors.New("denied")}))
+		require.Equal(t, proxy.Other, proxy.ClassifyError(errors.New("something else")))
+	})
+}
+
+func TestRun(t *testing.T) {
+	t.Run("cancel completes the requests in flight", func(t *testing.T) {
+		arrived := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(arrived)
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("slow"))
+		}))
+		defer upstream.Close()
+
+		port := freePort(t)
+		p, err := proxy.NewProxy(proxy.WithPort(port))
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/slow/"}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ran := make(chan error, 1)
+		go func() { ran <- p.Run(ctx) }()
+		waitReady(t, p, ran)
+
+		type result struct {
+			body string
+			err  error
+		}
+		requested := make(chan result, 1)
+		go func() {
+			res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow/", port))
+			if err != nil {
+				requested <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			requested <- result{body: string(body), err: err}
+		}()
+
+		<-arrived
+		cancel()
+		res := <-requested
+		require.NoError(t, res.err)
+		require.Equal(t, "slow", res.body)
+		require.NoError(t, <-ran)
+	})
+
+	t.Run("returns the error of the server", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		p, err := proxy.NewProxy(proxy.WithPort(listener.Addr().(*net.TCPAddr).Port))
+		require.NoError(t, err)
+		err = p.Run(context.Background())
+		require.Error(t, err)
+		require.NotErrorIs(t, err, http.ErrServerClosed)
+	})
+
+	t.Run("grace period", func(t *testing.T) {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer upstream.Close()
+		defer close(release)
+
+		port := freePort(t)
+		p, err := proxy.NewProxy(proxy.WithPort(port), proxy.WithGracePeriod(50*time.Millisecond))
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/hanging/"}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ran := make(chan error, 1)
+		go func() { ran <- p.Run(ctx) }()
+		waitReady(t, p, ran)
+
+		client := &http.Client{Timeout: 2 * time.Second}
+		go client.Get(fmt.Sprintf("http://127.0.0.1:%d/hanging/", port))
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-ran:
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(time.Second):
+			t.Fatal("Run did not return after the grace period")
+		}
+	})
+
+	t.Run("negative grace period", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithGracePeriod(-time.Second))
+		var validationErr *proxy.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, "GracePeriod", validationErr.Field)
+	})
+}
+
+// unwrappingWriter wraps a ResponseWriter like logging middleware does, counting the bytes written through it
+type unwrappingWriter struct {
+	http.ResponseWriter
+	bytes *atomic.Int64
+}
+
+func (w unwrappingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes.Add(int64(n))
+	return n, err
+}
+
+func (w unwrappingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestMiddleware(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 1; i <= 2; i++ {
+				fmt.Fprintf(w, "data: event %d\n\n", i)
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("upstream " + r.Header.Get("X-Middleware")))
+	}))
+	defer upstream.Close()
+
+	order := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Order", name)
+				_, hasInfo := proxy.RequestInfoFromContext(r.Context())
+				w.Header().Set("X-Info-"+name, strconv.FormatBool(hasInfo))
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	var infos []proxy.RequestInfo
+	requestInfo := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, _ := proxy.RequestInfoFromContext(r.Context())
+			infos = append(infos, info)
+			r.Header.Set("X-Middleware", info.RequestID)
+			next.ServeHTTP(w, r)
+		})
+	}
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	var written atomic.Int64
+	wrap := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(unwrappingWriter{ResponseWriter: w, bytes: &written}, r)
+		})
+	}
+
+	p, err := proxy.NewProxy(proxy.WithMiddleware(order("global1"), order("global2"), wrap))
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl:    upstream.URL,
+		Prefix:     "/mw/",
+		Middleware: []func(http.Handler) http.Handler{order("target"), requestInfo},
+	}))
+	require.NoError(t, p.AddTarget(proxy.Target{
+		BaseUrl:    upstream.URL,
+		Prefix:     "/protected/",
+		Middleware: []func(http.Handler) http.Handler{deny, wrap},
+	}))
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/plain/"}))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	get := func(t *testing.T, path string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		maps.Copy(req.Header, header)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(body)
+	}
+
+	t.Run("global and per-target order", func(t *testing.T) {
+		res, body := get(t, "/mw/page", http.Header{"X-Request-Id": {"mw-request"}})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, []string{"global1", "global2", "target"}, res.Header.Values("X-Order"))
+		require.Equal(t, "false", res.Header.Get("X-Info-global1"))
+		require.Equal(t, "true", res.Header.Get("X-Info-target"))
+		require.Equal(t, "upstream mw-request", body)
+		require.Equal(t, proxy.RequestInfo{RequestID: "mw-request", Target: "/mw/"}, infos[len(infos)-1])
+	})
+
+	t.Run("generated request id", func(t *testing.T) {
+		_, body := get(t, "/mw/page", nil)
+		id := infos[len(infos)-1].RequestID
+		require.NotEmpty(t, id)
+		require.Equal(t, "upstream "+id, body)
+	})
+
+	t.Run("per-target middleware only wraps its target", func(t *testing.T) {
+		res, body := get(t, "/plain/page", nil)
+		require.Equal(t, []string{"global1", "global2"}, res.Header.Values("X-Order"))
+		require.Equal(t, "upstream ", body)
+	})
+
+	t.Run("short-circuit", func(t *testing.T) {
+		before := upstreamRequests.Load()
+		res, _ := get(t, "/protected/page", nil)
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		require.Equal(t, before, upstreamRequests.Load())
+
+		res, body := get(t, "/protected/page", http.Header{"Authorization": {"Bearer token"}})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "upstream ", body)
+	})
+
+	t.Run("wrapped writers pass flushing through", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/protected/events", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		// the events arrive while the upstream keeps the stream open
+		var events []string
+		scanner := bufio.NewScanner(res.Body)
+		for len(events) < 2 && scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				events = append(events, data)
+			}
+		}
+		require.Equal(t, []string{"event 1", "event 2"}, events)
+		require.Positive(t, written.Load())
+	})
+
+	t.Run("hijacking through the proxy's writer", func(t *testing.T) {
+		hijacked := make(chan error, 1)
+		hijack := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err == nil {
+					conn.Write([]byte("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n"))
+					conn.Close()
+				}
+				hijacked <- err
+			})
+		}
+		p, err := proxy.NewProxy(proxy.WithMiddleware(wrap))
+		require.NoError(t, err)
+		require.NoError(t, p.AddTarget(proxy.Target{
+			BaseUrl:    upstream.URL,
+			Prefix:     "/hijack/",
+			Middleware: []func(http.Handler) http.Handler{wrap, hijack},
+		}))
+		server := httptest.NewServer(p)
+		defer server.Close()
+
+		res, err := http.Get(server.URL + "/hijack/")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.NoError(t, <-hijacked)
+		require.Equal(t, http.StatusNoContent, res.StatusCode)
+	})
+}
+
+func TestReady(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		opts   []proxy.ProxyOption
+		scheme string
+	}{
+		{name: "plain", scheme: "http://"},
+		{name: "tls", opts: []proxy.ProxyOption{proxy.WithGeneratedSsl("Test")}, scheme: "https://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without WithPort the OS chooses the port
+			p, err := proxy.NewProxy(tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/up/"}))
+			select {
+			case <-p.Ready():
+				t.Fatal("ready before listening")
+			default:
+			}
+
+			startProxy(t, p)
+			defer stopServer(t, p)
+			require.True(t, strings.HasPrefix(p.Addr(), tt.scheme), p.Addr())
+			require.False(t, strings.HasSuffix(p.Addr(), ":0"), p.Addr())
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+			res, err := client.Get(proxy.JoinURL(p.Addr(), "/up/"))
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, "upstream", string(body))
+		})
+	}
+}
+
+func TestDialPolicy(t *testing.T) {
+	lookup := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("192.0.2.2")}, nil
+	}
+	v4Only := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	}
+
+	tests := []struct {
+		policy proxy.DialPolicy
+		dialed []string
+	}{
+		{policy: proxy.Auto, dialed: []string{"[2001:db8::1]:80", "192.0.2.1:80", "[2001:db8::2]:80", "192.0.2.2:80"}},
+		{policy: proxy.IPv4Only, dialed: []string{"192.0.2.1:80", "192.0.2.2:80"}},
+		{policy: proxy.IPv6Only, dialed: []string{"[2001:db8::1]:80", "[2001:db8::2]:80"}},
+		{policy: proxy.PreferIPv4, dialed: []string{"192.0.2.1:80", "192.0.2.2:80", "[2001:db8::1]:80", "[2001:db8::2]:80"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("policy %q", tt.policy), func(t *testing.T) {
+			var dialed []string
+			dialer := &proxy.PolicyDialer{Policy: tt.policy, LookupNetIP: lookup,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					dialed = append(dialed, addr)
+					return nil, os.NewSyscallError("connect", syscall.ECONNREFUSED)
+				}}
+			_, err := dialer.Dial(context.Background(), "tcp", "upstream.test:80")
+			require.Equal(t, proxy.ConnectionRefused, proxy.ClassifyError(err))
+			require.Equal(t, tt.dialed, dialed)
+		})
+	}
+
+	t.Run("stops at the first connection", func(t *testing.T) {
+		var dialed []string
+		dialer := &proxy.PolicyDialer{Policy: proxy.PreferIPv4, LookupNetIP: lookup,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			}}
+		conn, err := dialer.Dial(context.Background(), "tcp", "upstream.test:80")
+		require.NoError(t, err)
+		conn.Close()
+		require.Equal(t, []string{"192.0.2.1:80"}, dialed)
+	})
+
+	t.Run("no address of the allowed families is a DNS failure", func(t *testing.T) {
+		dialer := &proxy.PolicyDialer{Policy: proxy.IPv6Only, LookupNetIP: v4Only,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				t.Fatalf("dialed %s", addr)
+				return nil, nil
+			}}
+		_, err := dialer.Dial(context.Background(), "tcp", "upstream.test:80")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		require.Equal(t, "upstream.test", dnsErr.Name)
+		require.Equal(t, proxy.DNSFailure, proxy.ClassifyError(err))
+	})
+
+	t.Run("IP addresses are dialed as they are", func(t *testing.T) {
+		var dialed []string
+		dialer := &proxy.PolicyDialer{Policy: proxy.IPv6Only, LookupNetIP: func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			t.Fatalf("resolved %s", host)
+			return nil, nil
+		}, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, os.NewSyscallError("connect", syscall.ECONNREFUSED)
+		}}
+		_, err := dialer.Dial(context.Background(), "tcp", "192.0.2.1:80")
+		require.Error(t, err)
+		require.Equal(t, []string{"192.0.2.1:80"}, dialed)
+	})
+
+	t.Run("proxy and target policies", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer upstream.Close()
+		port := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+		var mu sync.Mutex
+		var dialed []string
+		base := &http.Transport{DisableKeepAlives: true, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, upstream.Listener.Addr().String())
+		}}
+		targets := []proxy.Target{
+			{BaseUrl: fmt.Sprintf("http://localhost:%d", port), Prefix: "/proxy/"},
+			{BaseUrl: fmt.Sprintf("http://localhost:%d", port), Prefix: "/target/", DialPolicy: proxy.PreferIPv4},
+		}
+		p, proxyUrl := newLocalProxy(t, targets, proxy.WithTransport(base), proxy.WithDialPolicy(proxy.IPv4Only))
+		require.True(t, p.Info().Features["dialPolicy"])
+
+		for _, target := range targets {
+			res, err := http.Get(proxy.JoinURL(proxyUrl, target.Prefix))
+			require.NoError(t, err)
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, "ok", string(body))
+		}
+		// localhost is resolved by the policy dialers, the transport dials its IPv4 address
+		expected := fmt.Sprintf("127.0.0.1:%d", port)
+		require.Equal(t, []string{expected, expected}, dialed)
+	})
+
+	t.Run("invalid policies", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithDialPolicy("ipv5-only"))
+		require.Equal(t, []*proxy.ValidationError{{Field: "DialPolicy", Value: "ipv5-only", Rule: "oneof",
+			Message: "must be one of ipv4-only, ipv6-only and prefer-ipv4 or empty"}}, proxy.ValidationErrors(err))
+
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{BaseUrl: "http://localhost", Prefix: "/", DialPolicy: "ipv5-only"})
+		require.Equal(t, "Target.DialPolicy", proxy.ValidationErrors(err)[0].Field)
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("before the proxy listens", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithPort(freePort(t)))
+		require.NoError(t, err)
+		require.ErrorIs(t, p.Shutdown(context.Background()), proxy.ErrNotListening)
+
+		// the proxy can still be started and shut down
+		served := make(chan error, 1)
+		go func() { served <- p.ListenAndServe() }()
+		waitReady(t, p, served)
+		require.NoError(t, p.Shutdown(context.Background()))
+		require.ErrorIs(t, <-served, http.ErrServerClosed)
+	})
+
+	t.Run("repeated calls", func(t *testing.T) {
+		p, err := proxy.NewProxy(proxy.WithPort(freePort(t)))
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- p.ListenAndServe() }()
+		waitReady(t, p, served)
+
+		require.NoError(t, p.Shutdown(context.Background()))
+		require.NoError(t, p.Shutdown(context.Background()))
+		require.ErrorIs(t, <-served, http.ErrServerClosed)
+	})
+
+	t.Run("concurrent start and stop", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			p, err := proxy.NewProxy(proxy.WithPort(freePort(t)))
+			require.NoError(t, err)
+			served := make(chan error, 1)
+			go func() { served <- p.ListenAndServe() }()
+			shutdowns := make(chan error, 2)
+			for j := 0; j < 2; j++ {
+				go func() { shutdowns <- p.Shutdown(context.Background()) }()
+			}
+			for j := 0; j < 2; j++ {
+				err := <-shutdowns
+				if err != nil {
+					require.ErrorIs(t, err, proxy.ErrNotListening)
+				}
+			}
+
+			// the shutdowns might have been too early, the proxy stops at the latest with this one
+			<-p.Ready()
+			require.NoError(t, p.Shutdown(context.Background()))
+			require.ErrorIs(t, <-served, http.ErrServerClosed)
+		}
+	})
+}
+
+func TestDrainDeadline(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	var draining atomic.Bool
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/hanging/"}
+	p, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithDrainTimeout(100*time.Millisecond),
+		proxy.WithDrainHook(func() { draining.Store(true) }))
+	require.Zero(t, p.InFlight())
+
+	type result struct {
+		status int
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(proxyUrl + "/hanging/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		results <- result{status: resp.StatusCode}
+	}()
+	<-received
+	require.Equal(t, 1, p.InFlight())
+	require.False(t, draining.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := p.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, draining.Load())
+
+	// the upstream request is cancelled instead of hanging until the upstream answers
+	select {
+	case res := <-results:
+		if res.err == nil {
+			require.Equal(t, http.StatusBadGateway, res.status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request still hangs after the drain deadline")
+	}
+	require.Eventually(t, func() bool { return p.InFlight() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFanOut(t *testing.T) {
+	type received struct {
+		body   string
+		header http.Header
+	}
+	newDestination := func(t *testing.T, status int) (*httptest.Server, chan received) {
+		requests := make(chan received, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- received{body: string(body), header: r.Header}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "answer of %d", status)
+		}))
+		t.Cleanup(server.Close)
+		return server, requests
+	}
+	newTarget := func(destinations ...proxy.FanOutDestination) (proxy.Target, chan proxy.FanOutDelivery) {
+		deliveries := make(chan proxy.FanOutDelivery, 10)
+		return proxy.Target{
+			Prefix:            "/webhooks/",
+			AddRequestHeaders: map[string]string{"X-Webhook": "vendor"},
+			FanOut:            destinations,
+			OnDelivery:        func(delivery proxy.FanOutDelivery) { deliveries <- delivery },
+		}, deliveries
+	}
+	post := func(t *testing.T, url string) (int, string) {
+		res, err := http.Post(url, "application/json", strings.NewReader(`{"event":"created"}`))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+	collect := func(t *testing.T, deliveries chan proxy.FanOutDelivery, n int) map[string]proxy.FanOutDelivery {
+		byDestination := make(map[string]proxy.FanOutDelivery)
+		for i := 0; i < n; i++ {
+			select {
+			case delivery := <-deliveries:
+				byDestination[delivery.Destination] = delivery
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only %d of %d deliveries reported", i, n)
+			}
+		}
+		return byDestination
+	}
+
+	t.Run("all succeed", func(t *testing.T) {
+		billing, billingRequests := newDestination(t, http.StatusOK)
+		crm, crmRequests := newDestination(t, http.StatusCreated)
+		audit, auditRequests := newDestination(t, http.StatusNoContent)
+		target, deliveries := newTarget(
+			proxy.FanOutDestination{Name: "billing", BaseUrl: billing.URL, Policy: proxy.MustSucceed},
+			proxy.FanOutDestination{Name: "crm", BaseUrl: crm.URL, Policy: proxy.MustSucceed, Primary: true,
+				AddRequestHeaders: map[string]string{"Authorization": "Bearer crm"}},
+			proxy.FanOutDestination{Name: "audit", BaseUrl: audit.URL, RemoveRequestHeaders: []string{"X-Webhook"}},
+		)
+		registry := prometheus.NewRegistry()
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target}, proxy.WithPrometheusMetrics(registry))
+
+		status, body := post(t, proxyUrl+"/webhooks/events")
+		require.Equal(t, http.StatusCreated, status)
+		require.Equal(t, "answer of 201", body)
+
+		for name, requests := range map[string]chan received{"billing": billingRequests, "crm": crmRequests, "audit": auditRequests} {
+			request := <-requests
+			require.Equal(t, `{"event":"created"}`, request.body, name)
+			require.Equal(t, name == "crm", request.header.Get("Authorization") == "Bearer crm", name)
+			require.Equal(t, name != "audit", request.header.Get("X-Webhook") == "vendor", name)
+		}
+		for name, delivery := range collect(t, deliveries, 3) {
+			require.True(t, delivery.Succeeded(), name)
+			require.Equal(t, 1, delivery.Attempts, name)
+			require.Equal(t, "/webhooks/", delivery.Target)
+		}
+
+		expected := `
+# HELP proxy_fanout_deliveries_total Total number of deliveries to the destinations of fan-out targets, by their outcome.
+# TYPE proxy_fanout_deliveries_total counter
+proxy_fanout_deliveries_total{destination="audit",outcome="delivered",target="/webhooks/"} 1
+proxy_fanout_deliveries_total{destination="billing",outcome="delivered",target="/webhooks/"} 1
+proxy_fanout_deliveries_total{destination="crm",outcome="delivered",target="/webhooks/"} 1
+`
+		require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "proxy_fanout_deliveries_total"))
+	})
+
+	t.Run("best-effort failure", func(t *testing.T) {
+		billing, _ := newDestination(t, http.StatusOK)
+		audit, auditRequests := newDestination(t, http.StatusInternalServerError)
+		target, deliveries := newTarget(
+			proxy.FanOutDestination{Name: "billing", BaseUrl: billing.URL, Policy: proxy.MustSucceed},
+			proxy.FanOutDestination{Name: "audit", BaseUrl: audit.URL, Policy: proxy.BestEffort, Retries: 2},
+		)
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		status, body := post(t, proxyUrl+"/webhooks/events")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "answer of 200", body)
+
+		byDestination := collect(t, deliveries, 2)
+		require.True(t, byDestination["billing"].Succeeded())
+		require.False(t, byDestination["audit"].Succeeded())
+		require.Equal(t, http.StatusInternalServerError, byDestination["audit"].Status)
+		require.Equal(t, 3, byDestination["audit"].Attempts)
+		require.Len(t, auditRequests, 3)
+	})
+
+	t.Run("must-succeed failure", func(t *testing.T) {
+		billing, _ := newDestination(t, http.StatusOK)
+		crm, _ := newDestination(t, http.StatusServiceUnavailable)
+		audit, _ := newDestination(t, http.StatusOK)
+		target, deliveries := newTarget(
+			proxy.FanOutDestination{Name: "billing", BaseUrl: billing.URL, Policy: proxy.MustSucceed},
+			proxy.FanOutDestination{Name: "crm", BaseUrl: crm.URL, Policy: proxy.MustSucceed},
+			proxy.FanOutDestination{Name: "audit", BaseUrl: audit.URL},
+		)
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		status, body := post(t, proxyUrl+"/webhooks/events")
+		require.Equal(t, http.StatusBadGateway, status)
+		require.Equal(t, "Error forwarding request: delivery to crm failed\n", body)
+		require.False(t, collect(t, deliveries, 3)["crm"].Succeeded())
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		billing, _ := newDestination(t, http.StatusOK)
+		audit, _ := newDestination(t, http.StatusOK)
+		target, deliveries := newTarget(
+			proxy.FanOutDestination{Name: "billing", BaseUrl: billing.URL},
+			proxy.FanOutDestination{Name: "audit", BaseUrl: audit.URL},
+		)
+		target.FanOutResponse = proxy.RespondAccepted
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		status, _ := post(t, proxyUrl+"/webhooks/events")
+		require.Equal(t, http.StatusAccepted, status)
+		require.Len(t, collect(t, deliveries, 2), 2)
+	})
+
+	t.Run("unreachable primary", func(t *testing.T) {
+		target, deliveries := newTarget(proxy.FanOutDestination{Name: "billing", BaseUrl: fmt.Sprintf("http://127.0.0.1:%d", freePort(t))})
+		_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+
+		status, body := post(t, proxyUrl+"/webhooks/events")
+		require.Equal(t, http.StatusBadGateway, status)
+		require.Equal(t, "Error forwarding request: upstream refused the connection\n", body)
+		require.Equal(t, proxy.ConnectionRefused, proxy.ClassifyError(collect(t, deliveries, 1)["billing"].Err))
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{Prefix: "/webhooks/", FanOutResponse: "all", FanOut: []proxy.FanOutDestination{
+			{BaseUrl: "billing", Policy: "sometimes", Retries: -1, Primary: true},
+			{BaseUrl: "http://crm", Primary: true},
+		}})
+		fields := make([]string, 0)
+		for _, validationErr := range proxy.ValidationErrors(err) {
+			fields = append(fields, validationErr.Field)
+		}
+		require.ElementsMatch(t, []string{"Target.FanOutResponse", "Target.FanOut.BaseUrl", "Target.FanOut.Policy",
+			"Target.FanOut.Retries", "Target.FanOut.Primary"}, fields)
+	})
+}
+
+func TestHtmlFragments(t *testing.T) {
+	var upstreamUrl string
+	fragments := map[string]string{
+		"/card":  `<div class="card" hx-get="/more" hx-swap="outerHTML"><a href="UPSTREAM/users/2">Bob</a><img src="UPSTREAM/bob.png"></div>` + "\n" + `<p>Secret 1234</p>`,
+		"/rows":  `<tr><td><a href="UPSTREAM/users/1">Alice</a></td></tr><tr><td style="background: url(UPSTREAM/bg.png)">x</td></tr>`,
+		"/items": `<!-- list items --><li><a href="UPSTREAM/items/1">One</a></li><li>Two</li>`,
+		"/page":  `<!DOCTYPE html><title>Page</title><a href="UPSTREAM/users/3">Carol</a>`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, strings.ReplaceAll(fragments[r.URL.Path], "UPSTREAM", upstreamUrl))
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/htmx/", Redactions: []proxy.RedactionRule{{Patterns: []string{`\d{4}`}}}}
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	proxied := func(path string) string { return proxy.JoinURL(proxyUrl, target.Prefix, path) }
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/card", fmt.Sprintf(`<div class="card" hx-get="/more" hx-swap="outerHTML"><a href="%s">Bob</a><img src="%s"/></div>`+"\n"+`<p>Secret [REDACTED]</p>`,
+			proxied("users/2"), proxied("bob.png"))},
+		{"/rows", fmt.Sprintf(`<tr><td><a href="%s">Alice</a></td></tr><tr><td style="background: url(%s)">x</td></tr>`,
+			proxied("users/1"), proxied("bg.png"))},
+		{"/items", fmt.Sprintf(`<!-- list items --><li><a href="%s">One</a></li><li>Two</li>`, proxied("items/1"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			body := getBody(t, proxied(tt.path))
+			require.Equal(t, tt.expected, body)
+		})
+	}
+
+	t.Run("documents keep their wrapper elements", func(t *testing.T) {
+		body := getBody(t, proxied("/page"))
+		require.Equal(t, fmt.Sprintf(`<!DOCTYPE html><html><head><title>Page</title></head><body><a href="%s">Carol</a></body></html>`, proxied("users/3")), body)
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	t.Run("clients stalling on headers are disconnected", func(t *testing.T) {
+		_, proxyUrl := newLocalProxy(t, nil, proxy.WithTimeouts(proxy.ServerTimeouts{ReadHeaderTimeout: 100 * time.Millisecond}))
+		u, err := url.Parse(proxyUrl)
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", u.Port()))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		start := time.Now()
+		_, err = io.ReadAll(conn)
+		require.NoError(t, err, "the proxy closes the connection instead of letting the client wait")
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("write timeout", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/events" {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+			}
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprint(w, "data: done\n\n")
+		}))
+		defer upstream.Close()
+
+		targets := []proxy.Target{
+			{BaseUrl: upstream.URL, Prefix: "/slow/"},
+			{BaseUrl: upstream.URL, Prefix: "/download/", DisableWriteTimeout: true},
+		}
+		_, proxyUrl := newLocalProxy(t, targets, proxy.WithTimeouts(proxy.ServerTimeouts{WriteTimeout: 100 * time.Millisecond}))
+
+		_, err := http.Get(proxyUrl + "/slow/")
+		require.Error(t, err, "the response is cut off after the write timeout")
+		require.Equal(t, "data: done\n\n", getBody(t, proxyUrl+"/download/"))
+		require.Equal(t, "data: done\n\n", getBody(t, proxyUrl+"/slow/events"))
+	})
+
+	t.Run("bodies passed through outlast the write timeout", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, "first")
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprint(w, "second")
+		}))
+		defer upstream.Close()
+
+		targets := []proxy.Target{{BaseUrl: upstream.URL, Prefix: "/download/"}}
+		_, proxyUrl := newLocalProxy(t, targets, proxy.WithTimeouts(proxy.ServerTimeouts{WriteTimeout: 100 * time.Millisecond}))
+		require.Equal(t, "firstsecond", getBody(t, proxyUrl+"/download/file.bin"))
+	})
+}
+
+func TestOSAssignedPort(t *testing.T) {
+	var upstreamUrl string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, upstreamUrl+"/landing", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a id="about" href="%s/about">about</a></body></html>`, upstreamUrl)
+	}))
+	defer upstream.Close()
+	upstreamUrl = upstream.URL
+
+	p, err := proxy.NewProxy(proxy.WithPort(0))
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/app/", RewriteRedirects: true}))
+	startProxy(t, p)
+	defer stopServer(t, p)
+
+	addr, err := url.Parse(p.Addr())
+	require.NoError(t, err)
+	port := addr.Port()
+	require.NotEqual(t, "0", port)
+	require.Equal(t, []string{p.Addr()}, p.Info().ListenAddresses)
+	proxyUrl := "http://127.0.0.1:" + port
+
+	t.Run("redirects", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		res, err := client.Get(proxyUrl + "/app/redirect")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, proxyUrl+"/app/landing", res.Header.Get("Location"))
+	})
+
+	t.Run("rewritten URLs", func(t *testing.T) {
+		require.Contains(t, getBody(t, proxyUrl+"/app/page"), fmt.Sprintf(`href="%s/app/about"`, proxyUrl))
+
+		// without a Host the URLs point at the address the proxy listens on
+		req := httptest.NewRequest(http.MethodGet, "/app/page", nil)
+		req.Host = ""
+		res := httptest.NewRecorder()
+		p.ServeHTTP(res, req)
+		require.Contains(t, res.Body.String(), fmt.Sprintf(`href="%s/app/about"`, p.Addr()))
+	})
+
+	t.Run("public URL with port 0", func(t *testing.T) {
+		_, err := proxy.NewProxy(proxy.WithPort(0), proxy.WithPublicURL("http://localhost:0/proxy"))
+		validationErrs := proxy.ValidationErrors(err)
+		require.Len(t, validationErrs, 1)
+		require.Equal(t, "PublicURL", validationErrs[0].Field)
+		require.Equal(t, "port", validationErrs[0].Rule)
+	})
+}
+
+func TestTargetTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slow := func() {
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-release:
+			}
+		}
+		switch r.URL.Path {
+		case "/slow-headers":
+			slow()
+		case "/slow-body":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<p>first</p>")
+			w.(http.Flusher).Flush()
+			slow()
+			fmt.Fprint(w, "<p>second</p>")
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: first\n\n")
+			w.(http.Flusher).Flush()
+			slow()
+			fmt.Fprint(w, "data: second\n\n")
+		case "/download":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, "first")
+			w.(http.Flusher).Flush()
+			slow()
+			fmt.Fprint(w, "second")
+		default:
+			fmt.Fprint(w, "fast")
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	var mu sync.Mutex
+	var reported []proxy.ErrorClass
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/timeout/", Timeout: 100 * time.Millisecond}
+	target.AddPreRequest(func(r *http.Request) *http.Request {
+		return proxy.OnUpstreamError(r, func(class proxy.ErrorClass) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, class)
+		})
+	})
+	_, proxyUrl := newLocalProxy(t, []proxy.Target{target})
+	get := func(path string) (int, string) {
+		res, err := http.Get(proxyUrl + "/timeout" + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get("/fast")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "fast", body)
+
+	status, body = get("/slow-headers")
+	require.Equal(t, http.StatusGatewayTimeout, status)
+	require.Equal(t, "Error forwarding request: upstream timed out\n", body)
+	mu.Lock()
+	require.Equal(t, []proxy.ErrorClass{proxy.Timeout}, reported)
+	mu.Unlock()
+
+	// the rewritten body is buffered, so reading it counts
+	status, _ = get("/slow-body")
+	require.Equal(t, http.StatusGatewayTimeout, status)
+
+	// streams are not cut off
+	status, body = get("/events")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "data: first\n\ndata: second\n\n", body)
+	status, body = get("/download")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "firstsecond", body)
+
+	t.Run("validation", func(t *testing.T) {
+		p, err := proxy.NewProxy()
+		require.NoError(t, err)
+		err = p.AddTarget(proxy.Target{BaseUrl: upstream.URL, Prefix: "/", Timeout: -time.Second})
+		require.Equal(t, "Target.Timeout", proxy.ValidationErrors(err)[0].Field)
+	})
+}
+
 func isLengthApproximatelyEqual(a, b string, marginPercent float64) bool {
 	if len(a) == 0 || len(b) == 0 {
 		return false // Handle empty strings
@@ -74,9 +5060,13 @@ func isLengthApproximatelyEqual(a, b string, marginPercent float64) bool {
 }
 
 func getBody(t *testing.T, url string) string {
+	return getBodyWithClient(t, http.DefaultClient, url)
+}
+
+func getBodyWithClient(t *testing.T, client *http.Client, url string) string {
 	req, err := http.NewRequest("GET", url, nil)
 	require.NoError(t, err)
-	res, err := http.DefaultClient.Do(req)
+	res, err := client.Do(req)
 	require.NoError(t, err, "Error requesting %s", url)
 	defer res.Body.Close()
 
@@ -85,13 +5075,55 @@ func getBody(t *testing.T, url string) string {
 	return string(body)
 }
 
+// newLocalProxy creates a proxy for the given targets on a free local port, starts it and waits until it accepts connections
+// it returns the proxy and the URL it can be reached at
+func newLocalProxy(t *testing.T, targets []proxy.Target, opts ...proxy.ProxyOption) (*proxy.Proxy, string) {
+	port := freePort(t)
+	p, err := proxy.NewProxy(append(opts, proxy.WithPort(port))...)
+	require.NoError(t, err)
+	for _, target := range targets {
+		require.NoError(t, p.AddTarget(target))
+	}
+	return p, serveLocalProxy(t, p)
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveLocalProxy starts p and waits until it listens, it returns the URL the proxy can be reached at
+func serveLocalProxy(t *testing.T, p *proxy.Proxy) string {
+	startProxy(t, p)
+	t.Cleanup(func() { stopServer(t, p) })
+
+	return p.Addr()
+}
+
+// startProxy serves the proxy in the background and waits until it listens
 func startProxy(t *testing.T, proxy *proxy.Proxy) {
+	served := make(chan error, 1)
 	go func() {
 		err := proxy.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
 			t.Error(err)
 		}
+		served <- err
 	}()
+	waitReady(t, proxy, served)
+}
+
+// waitReady waits until the proxy listens, it fails the test if served, the error of serving it, arrives first
+func waitReady(t *testing.T, proxy *proxy.Proxy, served <-chan error) {
+	select {
+	case <-proxy.Ready():
+	case err := <-served:
+		t.Fatalf("proxy stopped before it was ready: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy was not ready after 5 seconds")
+	}
 }
 
 func stopServer(t *testing.T, proxy *proxy.Proxy) {
@@ -117,14 +5149,15 @@ func mustSocksTransport(t *testing.T) *stealth.StealthTransport {
 
 func XTestRun(t *testing.T) {
 	stats := stats.NewStatServer()
-	stats.RegisterTarget(GithubTarget)
-	stats.RegisterTarget(WikipediaTarget)
+	github, wikipedia := GithubTarget, WikipediaTarget
+	stats.RegisterTarget(&github)
+	stats.RegisterTarget(&wikipedia)
 
 	proxy, err := proxy.NewProxy(proxy.WithTransport(mustSocksTransport(t)), proxy.WithPort(8080))
 	require.NoError(t, err)
-	err = proxy.AddTarget(GithubTarget)
+	err = proxy.AddTarget(github)
 	require.NoError(t, err)
-	err = proxy.AddTarget(WikipediaTarget)
+	err = proxy.AddTarget(wikipedia)
 	require.NoError(t, err)
 
 	go func() {
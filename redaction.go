@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// defaultRedactionMask replaces redacted content if RedactionRule.Mask is not set
+const defaultRedactionMask = "[REDACTED]"
+
+// RedactionRule masks sensitive content of the responses of a target, e.g. emails or tokens.
+// It applies to JSON, HTML and other text responses, even if DisableRewrite is set.
+type RedactionRule struct {
+	// ContentTypes limits the rule to responses whose media type starts with one of them, e.g. "application/json"
+	ContentTypes []string `json:"contentTypes" yaml:"contentTypes"`
+	// JSONPaths are the values of JSON responses replaced with Mask, as keys separated by dots.
+	// A * matches any key or array index, e.g. "users.*.email". The document is parsed, so the escaping stays valid,
+	// and re-encoded without indentation if a value matched.
+	JSONPaths []string `json:"jsonPaths" yaml:"jsonPaths"`
+	// Patterns are regular expressions whose matches are replaced with Mask in the text nodes of HTML responses
+	// and in other text responses. Attributes and markup of HTML are never touched.
+	Patterns []string `json:"patterns" yaml:"patterns"`
+	// Mask replaces the redacted content, defaults to "[REDACTED]"
+	Mask string `json:"mask" yaml:"mask"`
+}
+
+func (r RedactionRule) mask() string {
+	if r.Mask == "" {
+		return defaultRedactionMask
+	}
+	return r.Mask
+}
+
+// appliesTo reports whether the rule is scoped to the content type
+func (r RedactionRule) appliesTo(contentType string) bool {
+	if len(r.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, scope := range r.ContentTypes {
+		if strings.HasPrefix(mediaType, strings.ToLower(scope)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRedactions compiles the patterns of the rules, nil if there are none
+func compileRedactions(rules []RedactionRule) ([][]*regexp.Regexp, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := make([][]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		for _, pattern := range rule.Patterns {
+			expr, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			compiled[i] = append(compiled[i], expr)
+		}
+	}
+	return compiled, nil
+}
+
+// redacts reports whether one of the redaction rules applies to responses with the content type
+func (t Target) redacts(contentType string) bool {
+	for _, rule := range t.Redactions {
+		if !rule.appliesTo(contentType) {
+			continue
+		}
+		if isJsonContentType(contentType) && len(rule.JSONPaths) > 0 {
+			return true
+		}
+		if strings.HasPrefix(strings.TrimSpace(strings.ToLower(contentType)), "text/") && len(rule.Patterns) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// redact applies the redaction rules of the target to the decompressed body and returns the number of redactions
+func (t Target) redact(contentType string, body []byte) ([]byte, int) {
+	total := 0
+	for i, rule := range t.Redactions {
+		if !rule.appliesTo(contentType) {
+			continue
+		}
+
+		var count int
+		switch {
+		case isJsonContentType(contentType):
+			body, count = redactJson(body, rule.JSONPaths, rule.mask())
+		case strings.Contains(contentType, "text/html"):
+			body, count = redactHtml(body, t.redactionPatterns[i], rule.mask())
+		case strings.HasPrefix(strings.TrimSpace(strings.ToLower(contentType)), "text/"):
+			text, n := redactText(string(body), t.redactionPatterns[i], rule.mask())
+			body, count = []byte(text), n
+		}
+		total += count
+	}
+	return body, total
+}
+
+// redactText replaces the matches of the patterns with mask
+func redactText(text string, patterns []*regexp.Regexp, mask string) (string, int) {
+	count := 0
+	for _, pattern := range patterns {
+		text = pattern.ReplaceAllStringFunc(text, func(string) string {
+			count++
+			return mask
+		})
+	}
+	return text, count
+}
+
+// redactHtml replaces the matches of the patterns in the text nodes of the document, the document is kept as it is if nothing matches
+func redactHtml(document []byte, patterns []*regexp.Regexp, mask string) ([]byte, int) {
+	if len(patterns) == 0 {
+		return document, 0
+	}
+	root, err := parseHtml(document)
+	if err != nil {
+		return document, 0
+	}
+
+	count := 0
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			var n int
+			node.Data, n = redactText(node.Data, patterns, mask)
+			count += n
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+	if count == 0 {
+		return document, 0
+	}
+
+	var result bytes.Buffer
+	if err := html.Render(&result, root); err != nil {
+		return document, 0
+	}
+	return result.Bytes(), count
+}
+
+// redactJson replaces the values at the paths with mask, keeping the order of the keys
+// the document is kept as it is if nothing matches or it is invalid
+func redactJson(document []byte, paths []string, mask string) ([]byte, int) {
+	if len(paths) == 0 {
+		return document, 0
+	}
+	patterns := make([][]string, len(paths))
+	for i, path := range paths {
+		patterns[i] = strings.Split(path, ".")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	redactor := jsonRedactor{decoder: decoder, patterns: patterns, mask: mask, out: &bytes.Buffer{}}
+	if err := redactor.value(nil); err != nil {
+		return document, 0
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return document, 0
+	}
+	if redactor.count == 0 {
+		return document, 0
+	}
+	return redactor.out.Bytes(), redactor.count
+}
+
+// jsonRedactor re-encodes a JSON document token by token, replacing the values matching its patterns
+type jsonRedactor struct {
+	decoder  *json.Decoder
+	patterns [][]string
+	mask     string
+	out      *bytes.Buffer
+	count    int
+}
+
+// value copies the next value of the document at path to the result
+func (r *jsonRedactor) value(path []string) error {
+	token, err := r.decoder.Token()
+	if err != nil {
+		return err
+	}
+	redacted := r.matches(path)
+	if redacted {
+		r.count++
+		if err := r.writeString(r.mask); err != nil {
+			return err
+		}
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		if redacted {
+			return nil
+		}
+		return r.writePrimitive(token)
+	}
+
+	// nested values are copied to a discarded buffer if the whole value is redacted
+	if redacted {
+		out := r.out
+		r.out = &bytes.Buffer{}
+		defer func() { r.out = out }()
+	}
+
+	switch delim {
+	case '{':
+		r.out.WriteByte('{')
+		for i := 0; r.decoder.More(); i++ {
+			key, err := r.decoder.Token()
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				r.out.WriteByte(',')
+			}
+			if err := r.writeString(key.(string)); err != nil {
+				return err
+			}
+			r.out.WriteByte(':')
+			if err := r.value(append(path[:len(path):len(path)], key.(string))); err != nil {
+				return err
+			}
+		}
+		r.out.WriteByte('}')
+	case '[':
+		r.out.WriteByte('[')
+		for i := 0; r.decoder.More(); i++ {
+			if i > 0 {
+				r.out.WriteByte(',')
+			}
+			if err := r.value(append(path[:len(path):len(path)], strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		r.out.WriteByte(']')
+	default:
+		return fmt.Errorf("unexpected delimiter %s", delim)
+	}
+	// the closing delimiter
+	_, err = r.decoder.Token()
+	return err
+}
+
+// matches reports whether the path matches one of the patterns
+func (r *jsonRedactor) matches(path []string) bool {
+	for _, pattern := range r.patterns {
+		if len(pattern) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range pattern {
+			if pattern[i] != "*" && pattern[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *jsonRedactor) writeString(val string) error {
+	encoded, err := marshalJsonString(val)
+	if err != nil {
+		return err
+	}
+	r.out.Write(encoded)
+	return nil
+}
+
+func (r *jsonRedactor) writePrimitive(token json.Token) error {
+	switch val := token.(type) {
+	case string:
+		return r.writeString(val)
+	case json.Number:
+		r.out.WriteString(val.String())
+	case bool:
+		r.out.WriteString(strconv.FormatBool(val))
+	case nil:
+		r.out.WriteString("null")
+	default:
+		return fmt.Errorf("unexpected token %v", token)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// redirectsHeader lists the redirects the proxy followed for the response, see RedirectPolicy
+const redirectsHeader = "X-Proxy-Redirects"
+
+// defaultMaxRedirectHops is the number of redirects followed if RedirectPolicy.MaxHops is not set, like net/http does
+const defaultMaxRedirectHops = 10
+
+var (
+	errRedirectLoop     = errors.New("redirect loop")
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// RedirectPolicy makes the proxy follow the redirects of the upstream itself and return only the final response,
+// for clients that cannot follow redirects. Only redirects to the host of the target are followed, the method and
+// body are kept for 307 and 308 and changed to GET without body for 301, 302 and 303 like browsers do.
+// A redirect to another host is passed on to the client with its Location rewritten like RewriteRedirects does.
+// The followed redirects are listed in the X-Proxy-Redirects response header, e.g. "302 /login, 303 /home".
+// Loops and chains longer than MaxHops are answered with 508 Loop Detected.
+type RedirectPolicy struct {
+	// MaxHops is the maximum number of redirects followed for a request, defaults to 10
+	MaxHops int `json:"maxHops" yaml:"maxHops"`
+}
+
+func (r RedirectPolicy) maxHops() int {
+	if r.MaxHops == 0 {
+		return defaultMaxRedirectHops
+	}
+	return r.MaxHops
+}
+
+// redirectFollower records the redirects followed for a single request
+type redirectFollower struct {
+	policy RedirectPolicy
+	hops   []string
+}
+
+// checkRedirect is the http.Client.CheckRedirect of the follower, via holds the requests sent so far, oldest first
+func (f *redirectFollower) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return http.ErrUseLastResponse
+	}
+	for _, previous := range via {
+		if previous.Method == req.Method && previous.URL.String() == req.URL.String() {
+			return fmt.Errorf("%w at %s", errRedirectLoop, req.URL.RequestURI())
+		}
+	}
+	if len(via) > f.policy.maxHops() {
+		return fmt.Errorf("%w: more than %d", errTooManyRedirects, f.policy.maxHops())
+	}
+
+	status := 0
+	if req.Response != nil {
+		status = req.Response.StatusCode
+	}
+	f.hops = append(f.hops, fmt.Sprintf("%d %s", status, req.URL.RequestURI()))
+	return nil
+}
+
+// header returns the value of the X-Proxy-Redirects header, empty if no redirect was followed
+func (f *redirectFollower) header() string {
+	return strings.Join(f.hops, ", ")
+}
+
+// isRedirectLimit reports whether the upstream request failed because of a redirect loop or too many redirects
+func isRedirectLimit(err error) bool {
+	return errors.Is(err, errRedirectLoop) || errors.Is(err, errTooManyRedirects)
+}
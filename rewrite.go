@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// rewriteUrl translates a URL found in a response of the target to its proxy equivalent at publicBase
+// it returns false if the URL does not point at the target and has to stay untouched
+func (p *Proxy) rewriteUrl(val string, target Target, publicBase string) (string, bool) {
+	if target.servesRoot() && strings.HasPrefix(val, "/") && !strings.HasPrefix(val, "//") {
+		return val, false
+	}
+	proxyUrl, err := ToProxyURL(target, publicBase, val)
+	if err == nil {
+		return proxyUrl, true
+	}
+	if !p.crossTargetRewrite {
+		return val, false
+	}
+
+	other, ok := p.crossTarget(val)
+	if !ok {
+		return val, false
+	}
+	if other.Host != "" {
+		// the other target is reachable at its own host only
+		if publicBase, ok = hostBase(publicBase, other); !ok {
+			return val, false
+		}
+	}
+	proxyUrl, err = ToProxyURL(other, publicBase, val)
+	if err != nil {
+		return val, false
+	}
+	return proxyUrl, true
+}
+
+// crossTarget returns the registered target an absolute URL points at
+// if multiple targets share the host, the one whose BaseUrl path is the longest prefix of the URL path wins
+func (p *Proxy) crossTarget(val string) (Target, bool) {
+	// root relative URLs always belong to the target they are found on
+	if strings.HasPrefix(val, "/") && !strings.HasPrefix(val, "//") {
+		return Target{}, false
+	}
+	valUrl, err := url.Parse(val)
+	if err != nil {
+		return Target{}, false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var best Target
+	bestLength := -1
+	for _, target := range p.targets {
+		if !TargetMatches(target, val) {
+			continue
+		}
+		targetUrl, err := url.Parse(target.BaseUrl)
+		if err != nil {
+			continue
+		}
+		basePath := strings.TrimSuffix(targetUrl.Path, "/")
+		if valUrl.Path != basePath && !strings.HasPrefix(valUrl.Path, basePath+"/") {
+			continue
+		}
+		if len(basePath) > bestLength {
+			best, bestLength = target, len(basePath)
+		}
+	}
+	return best, bestLength >= 0
+}
+
+// urlAttributes are the elements and their attribute holding a URL that is rewritten in HTML responses
+// the base URL is rewritten as well, so relative links keep resolving to the proxy
+var urlAttributes = []struct{ element, attr string }{
+	{"a", "href"},
+	{"link", "href"},
+	{"base", "href"},
+	{"img", "src"},
+	{"script", "src"},
+	{"iframe", "src"},
+	{"video", "src"},
+	{"audio", "src"},
+	{"source", "src"},
+	{"track", "src"},
+	{"embed", "src"},
+	{"object", "data"},
+	{"form", "action"},
+	{"button", "formaction"},
+}
+
+// RewriteRule rewrites the URLs in the elements of HTML responses matching Selector
+type RewriteRule struct {
+	// Selector is the goquery selector of the elements the rule applies to
+	Selector string
+	// Attr is the attribute holding the URL, ignored if Text is set
+	Attr string
+	// Text rewrites the text content of the elements instead of an attribute
+	// by default the absolute URLs of the target are replaced, like RewriteInlineScripts does
+	Text bool
+	// Rewrite replaces the default rewriting, proxyURL is the URL of the target's prefix on the proxy
+	// if it returns false, the original value is kept
+	Rewrite func(original string, proxyURL *url.URL) (string, bool)
+}
+
+// apply rewrites the elements matching the rule and returns the number of changed values
+func (r RewriteRule) apply(find func(selector string) *goquery.Selection, proxyBase *url.URL, rewriteUrl func(string) (string, bool), replaceUrls func(string) string) int {
+	changed := 0
+	rewrite := func(original string) (string, bool) {
+		if r.Rewrite != nil {
+			// the function gets a copy, so it cannot break the following rewrites
+			proxyUrl := *proxyBase
+			return r.Rewrite(original, &proxyUrl)
+		}
+		if r.Text {
+			return replaceUrls(original), true
+		}
+		return rewriteUrl(original)
+	}
+
+	selection := find(r.Selector)
+	if r.Text {
+		replaceText(selection, func(text string) string {
+			if newText, ok := rewrite(text); ok {
+				if newText != text {
+					changed++
+				}
+				return newText
+			}
+			return text
+		})
+		return changed
+	}
+	selection.Each(func(index int, element *goquery.Selection) {
+		val, exists := element.Attr(r.Attr)
+		if !exists {
+			return
+		}
+		if newVal, ok := rewrite(val); ok {
+			if newVal != val {
+				changed++
+			}
+			element.SetAttr(r.Attr, newVal)
+		}
+	})
+	return changed
+}
+
+// cssUrlPattern matches url(...) in its quoted and unquoted forms and the string form of @import
+// the url(...) form of @import is covered by the first alternative
+var cssUrlPattern = regexp.MustCompile(`url\(\s*(?:"((?:[^"\\]|\\.)*)"|'((?:[^'\\]|\\.)*)'|([^)'"\s]*))\s*\)|@import\s+(?:"((?:[^"\\]|\\.)*)"|'((?:[^'\\]|\\.)*)')`)
+
+// rewriteCssUrls calls rewrite for every url(...) and @import reference in the given CSS
+// and replaces the reference with the result if rewrite returns true. data: URIs are skipped.
+func rewriteCssUrls(css string, rewrite func(string) (string, bool)) string {
+	var result strings.Builder
+	last := 0
+	for _, match := range cssUrlPattern.FindAllStringSubmatchIndex(css, -1) {
+		for group := 1; group < len(match)/2; group++ {
+			start, end := match[2*group], match[2*group+1]
+			if start < 0 {
+				continue
+			}
+
+			val := css[start:end]
+			if strings.HasPrefix(val, "data:") {
+				break
+			}
+			if newVal, ok := rewrite(val); ok {
+				result.WriteString(css[last:start])
+				result.WriteString(newVal)
+				last = end
+			}
+			break
+		}
+	}
+	result.WriteString(css[last:])
+	return result.String()
+}
+
+// rewriteSrcset calls rewrite for every candidate URL of a srcset attribute value like "a.png 1x, b.png 2x"
+// and replaces the URL with the result if rewrite returns true, descriptors and separators are kept as they are
+func rewriteSrcset(srcset string, rewrite func(string) (string, bool)) string {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+
+	var result strings.Builder
+	last := 0
+	for i := 0; i < len(srcset); {
+		// skip separators before the URL
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		// a comma directly after the URL ends the candidate without descriptors
+		end := i
+		for end > start && srcset[end-1] == ',' {
+			end--
+		}
+		if end > start && !strings.HasPrefix(srcset[start:end], "data:") {
+			if newVal, ok := rewrite(srcset[start:end]); ok {
+				result.WriteString(srcset[last:start])
+				result.WriteString(newVal)
+				last = end
+			}
+		}
+		if end < i {
+			continue
+		}
+
+		// skip the descriptors, they may contain commas inside parentheses
+		depth := 0
+		for i < len(srcset) && (srcset[i] != ',' || depth > 0) {
+			switch srcset[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			i++
+		}
+	}
+	result.WriteString(srcset[last:])
+	return result.String()
+}
+
+// metaRefreshPattern matches the content of a meta refresh like "5; url='/next'", the URL is the third group
+var metaRefreshPattern = regexp.MustCompile(`(?i)^(\s*[\d.]+\s*[;,]?\s*(?:url\s*=\s*)?)(["']?)([^"']*)`)
+
+// rewriteMetaRefresh calls rewrite for the URL of a meta refresh content value
+// and replaces the URL with the result if rewrite returns true, delay and quotes are kept as they are
+func rewriteMetaRefresh(content string, rewrite func(string) (string, bool)) string {
+	match := metaRefreshPattern.FindStringSubmatchIndex(content)
+	if match == nil {
+		return content
+	}
+	start, end := match[6], match[7]
+	val := strings.TrimSpace(content[start:end])
+	if val == "" {
+		return content
+	}
+	newVal, ok := rewrite(val)
+	if !ok {
+		return content
+	}
+	return content[:start] + newVal + content[end:]
+}
+
+// isJsonContentType reports whether the content type is application/json or a +json type like application/hal+json
+func isJsonContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// urlEnd are the characters ending a URL in text, like the quotes of a string in a script
+const urlEnd = " \t\r\n\"'`<>{}|\\^"
+
+// replaceTargetUrls calls rewrite for every absolute URL on the host of the target in text
+// and replaces the URL with the result if rewrite returns true, so the URLs map like the ones of attributes.
+// Occurrences that continue the host of the target, like host+".evil.com", are kept.
+func replaceTargetUrls(text string, target Target, rewrite func(string) (string, bool)) string {
+	targetUrl, err := url.Parse(target.BaseUrl)
+	if err != nil || targetUrl.Host == "" {
+		return text
+	}
+	origin := targetUrl.Scheme + "://" + targetUrl.Host
+
+	var result strings.Builder
+	for {
+		idx := strings.Index(text, origin)
+		if idx < 0 {
+			result.WriteString(text)
+			return result.String()
+		}
+		end := idx + len(origin)
+		if end < len(text) && !strings.ContainsRune("/?#"+urlEnd, rune(text[end])) {
+			result.WriteString(text[:end])
+			text = text[end:]
+			continue
+		}
+		if length := strings.IndexAny(text[end:], urlEnd); length >= 0 {
+			end += length
+		} else {
+			end = len(text)
+		}
+
+		result.WriteString(text[:idx])
+		val := text[idx:end]
+		newVal, ok := rewrite(val)
+		if !ok {
+			newVal = val
+		} else if val == origin {
+			// the text may continue the bare origin with a path, like the template "https://host{/path}"
+			newVal = strings.TrimSuffix(newVal, "/")
+		}
+		result.WriteString(newVal)
+		text = text[end:]
+	}
+}
+
+// rewriteJsonStrings calls replace for every string value of the JSON document and replaces the value with the result
+// object keys, numbers and the formatting are kept, invalid JSON is returned as it is
+func rewriteJsonStrings(document []byte, replace func(string) string) []byte {
+	if !json.Valid(document) {
+		return document
+	}
+
+	var result bytes.Buffer
+	last := 0
+	for i := 0; i < len(document); i++ {
+		if document[i] != '"' {
+			continue
+		}
+		start := i
+		for i++; document[i] != '"'; i++ {
+			if document[i] == '\\' {
+				i++
+			}
+		}
+		end := i + 1
+
+		// a string followed by a colon is an object key
+		next := end
+		for next < len(document) && strings.ContainsRune(" \t\r\n", rune(document[next])) {
+			next++
+		}
+		if next < len(document) && document[next] == ':' {
+			continue
+		}
+
+		var val string
+		if err := json.Unmarshal(document[start:end], &val); err != nil {
+			continue
+		}
+		newVal := replace(val)
+		if newVal == val {
+			continue
+		}
+		encoded, err := marshalJsonString(newVal)
+		if err != nil {
+			continue
+		}
+		result.Write(document[last:start])
+		result.Write(encoded)
+		last = end
+	}
+	result.Write(document[last:])
+	return result.Bytes()
+}
+
+// marshalJsonString encodes the string as JSON without escaping HTML characters like json.Marshal does
+func marshalJsonString(val string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(val); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// replaceText replaces the text content of the selected elements with the result of replace
+// the text nodes are modified directly, goquery's SetText would HTML escape raw text like scripts and styles
+func replaceText(selection *goquery.Selection, replace func(string) string) {
+	for _, node := range selection.Nodes {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.TextNode {
+				child.Data = replace(child.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultGracePeriod is how long Run waits for the requests in flight when its context is cancelled
+const defaultGracePeriod = 30 * time.Second
+
+// WithGracePeriod sets how long Run waits for the requests in flight after its context is cancelled, defaults to 30s
+func WithGracePeriod(gracePeriod time.Duration) ProxyOption {
+	return func(p *Proxy) { p.gracePeriod = gracePeriod }
+}
+
+// Run serves the proxy like ListenAndServe until ctx is cancelled, then shuts it down gracefully.
+// It returns nil after a clean shutdown and the error of the server or of Shutdown otherwise,
+// http.ErrServerClosed is never returned.
+func (p *Proxy) Run(ctx context.Context) error {
+	listener, err := p.listen()
+	if err != nil {
+		return fmt.Errorf("error starting listener: %w", err)
+	}
+	// the server is created before serving, so a cancellation right away shuts it down as well
+	server := p.newServer(listener)
+	served := make(chan error, 1)
+	go func() { served <- p.serve(server, listener) }()
+
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	gracePeriod := p.gracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultGracePeriod
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	shutdownErr := p.Shutdown(shutdownCtx)
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return shutdownErr
+}
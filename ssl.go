@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -10,20 +13,101 @@ import (
 	"fmt"
 	"log/slog"
 	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"time"
 )
 
-func GenerateSslCerts(caOrganisation string) (tls.Certificate, error) {
+// CertOptions configures the certificates generated by GenerateSslCerts
+type CertOptions struct {
+	// ValidFor is how long the certificates are valid, defaults to one year
+	ValidFor time.Duration
+	// DNSNames and IPAddresses are the subject alternative names of the server certificate
+	DNSNames    []string
+	IPAddresses []net.IP
+	// KeyBits is the size of the RSA keys, defaults to 2048
+	KeyBits int
+}
+
+type CertOption func(*CertOptions)
+
+// WithValidFor sets how long the generated certificates are valid
+func WithValidFor(validFor time.Duration) CertOption {
+	return func(o *CertOptions) { o.ValidFor = validFor }
+}
+
+// WithDNSNames adds DNS names to the subject alternative names of the server certificate
+func WithDNSNames(names ...string) CertOption {
+	return func(o *CertOptions) { o.DNSNames = append(o.DNSNames, names...) }
+}
+
+// WithIPAddresses adds IP addresses to the subject alternative names of the server certificate
+func WithIPAddresses(ips ...net.IP) CertOption {
+	return func(o *CertOptions) { o.IPAddresses = append(o.IPAddresses, ips...) }
+}
+
+// WithKeyBits sets the size of the generated RSA keys
+func WithKeyBits(bits int) CertOption {
+	return func(o *CertOptions) { o.KeyBits = bits }
+}
+
+func newCertOptions(opts ...CertOption) CertOptions {
+	options := CertOptions{
+		ValidFor: 365 * 24 * time.Hour,
+		KeyBits:  2048,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func GenerateSslCerts(caOrganisation string, opts ...CertOption) (tls.Certificate, error) {
+	options := newCertOptions(opts...)
+	return certBuilder{organisation: caOrganisation, options: options, generateKey: generateRsaKey(options.KeyBits)}.build()
+}
+
+// GenerateECDSACerts works like GenerateSslCerts, but uses ECDSA P-256 keys, which are faster in handshakes than RSA
+// The sans are added to the server certificate as IP addresses if they parse as one and as DNS names otherwise.
+func GenerateECDSACerts(caOrganisation string, sans ...string) (tls.Certificate, error) {
+	options := newCertOptions()
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			options.IPAddresses = append(options.IPAddresses, ip)
+			continue
+		}
+		options.DNSNames = append(options.DNSNames, san)
+	}
+	return certBuilder{organisation: caOrganisation, options: options, generateKey: generateEcdsaKey}.build()
+}
+
+func generateRsaKey(bits int) func() (crypto.Signer, error) {
+	return func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, bits) }
+}
+
+func generateEcdsaKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// certBuilder generates a self signed root certificate and a server certificate signed by it
+// the key type of both is determined by generateKey
+type certBuilder struct {
+	organisation string
+	options      CertOptions
+	generateKey  func() (crypto.Signer, error)
+}
+
+func (b certBuilder) build() (tls.Certificate, error) {
 	// Generate the root certificate and key
-	rootCertTemplate, rootKey, err := generateSelfSignedRootCertificate(caOrganisation)
+	rootCertTemplate, rootKey, err := b.rootCertificate()
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("error generating root certificate: %w", err)
 	}
 	slog.Info("Root certificate and private key generated successfully.")
 
 	// Generate the server certificate signed by the root
-	serverCertDER, serverKey, err := generateServerCertificate(rootCertTemplate, rootKey, caOrganisation)
+	serverCertDER, serverKey, err := b.serverCertificate(rootCertTemplate, rootKey)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("error generating server certificate: %w", err)
 	}
@@ -36,58 +120,63 @@ func GenerateSslCerts(caOrganisation string) (tls.Certificate, error) {
 	}, nil
 }
 
-func generateSelfSignedRootCertificate(caOrganisation string) (*x509.Certificate, *rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
+// template returns a certificate template valid for options.ValidFor with a random serial number
+func (b certBuilder) template(key crypto.Signer) (x509.Certificate, error) {
 	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour) // Valid for one year
+	notAfter := notBefore.Add(b.options.ValidFor)
 
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, nil, err
+		return x509.Certificate{}, err
 	}
 
-	template := x509.Certificate{
+	keyUsage := x509.KeyUsageDigitalSignature
+	// key encipherment is only defined for RSA keys
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	return x509.Certificate{
 		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{Organization: []string{caOrganisation}},
+		Subject:               pkix.Name{Organization: []string{b.organisation}},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              keyUsage,
 		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-
-	return &template, priv, nil
+	}, nil
 }
 
-func generateServerCertificate(rootCert *x509.Certificate, rootKey *rsa.PrivateKey, caOrganisation string) ([]byte, *rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+func (b certBuilder) rootCertificate() (*x509.Certificate, crypto.Signer, error) {
+	priv, err := b.generateKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour) // Valid for one year
+	template, err := b.template(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage |= x509.KeyUsageCertSign
+	template.IsCA = true
 
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return &template, priv, nil
+}
+
+func (b certBuilder) serverCertificate(rootCert *x509.Certificate, rootKey crypto.Signer) ([]byte, crypto.Signer, error) {
+	priv, err := b.generateKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	template := x509.Certificate{
-		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{Organization: []string{caOrganisation}},
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+	template, err := b.template(priv)
+	if err != nil {
+		return nil, nil, err
 	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.DNSNames = b.options.DNSNames
+	template.IPAddresses = b.options.IPAddresses
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, rootCert, &priv.PublicKey, rootKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, rootCert, priv.Public(), rootKey)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -95,7 +184,34 @@ func generateServerCertificate(rootCert *x509.Certificate, rootKey *rsa.PrivateK
 	return certDER, priv, nil
 }
 
-func saveCertificateToFile(certBytes []byte, filename string) (filepath string, err error) {
+// withClientCert returns a copy of the transport that presents the client certificate to the upstream
+func withClientCert(transport http.RoundTripper, cert tls.Certificate) (http.RoundTripper, error) {
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("client certificates require an *http.Transport, got %T", transport)
+	}
+
+	// Clone clones the TLS config as well, so the original transport keeps its certificates
+	clone := httpTransport.Clone()
+	if clone.TLSClientConfig == nil {
+		clone.TLSClientConfig = &tls.Config{}
+	}
+	clone.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return clone, nil
+}
+
+// LoadCertFromPEM parses a PEM encoded certificate (chain) and its private key, e.g. read from a Let's Encrypt bundle
+func LoadCertFromPEM(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error parsing PEM certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// SaveCertificateToFile writes the DER encoded certificate PEM encoded to a new temporary file
+// filename is the pattern of the file name as in os.CreateTemp, the path of the created file is returned
+func SaveCertificateToFile(certBytes []byte, filename string) (filepath string, err error) {
 	tempFile, err := os.CreateTemp("", filename)
 	if err != nil {
 		return "", err
@@ -110,15 +226,30 @@ func saveCertificateToFile(certBytes []byte, filename string) (filepath string,
 	return tempFile.Name(), nil
 }
 
-func savePrivateKeyToFile(key *rsa.PrivateKey, filename string) (filepath string, err error) {
+// SavePrivateKeyToFile writes the RSA or ECDSA private key PEM encoded to a new temporary file
+// filename is the pattern of the file name as in os.CreateTemp, the path of the created file is returned
+func SavePrivateKeyToFile(key crypto.PrivateKey, filename string) (filepath string, err error) {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", key)
+	}
+
 	tempFile, err := os.CreateTemp("", filename)
 	if err != nil {
 		return "", err
 	}
 	defer tempFile.Close()
 
-	keyBytes := x509.MarshalPKCS1PrivateKey(key)
-	err = pem.Encode(tempFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyBytes})
+	err = pem.Encode(tempFile, block)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// WithPrometheusExport serves the stats of the targets in the Prometheus format at /metrics
+func WithPrometheusExport(enabled bool) StatServerOption {
+	return func(s *StatServer) { s.prometheusExport = enabled }
+}
+
+var (
+	// the count restarts when the target is registered again, so it is a gauge like the stats of the window
+	requestsDesc = prometheus.NewDesc("proxy_stats_requests",
+		"Number of requests to the target since it was registered.", []string{"target"}, nil)
+	avgResponseTimeDesc = prometheus.NewDesc("proxy_stats_avg_response_time_seconds",
+		"Average response time of the target in the capture window.", []string{"target"}, nil)
+	errorRateDesc = prometheus.NewDesc("proxy_stats_error_rate",
+		"Ratio of failed requests to the target in the capture window.", []string{"target"}, nil)
+	requestRateDesc = prometheus.NewDesc("proxy_stats_request_rate",
+		"Requests per second to the target in the capture window.", []string{"target"}, nil)
+)
+
+// statCollector exports the TargetStats of the registered targets, they are computed on each scrape
+type statCollector struct {
+	server *StatServer
+}
+
+func (c statCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsDesc
+	ch <- avgResponseTimeDesc
+	ch <- errorRateDesc
+	ch <- requestRateDesc
+}
+
+func (c statCollector) Collect(ch chan<- prometheus.Metric) {
+	for prefix, rec := range c.server.targetRecorders {
+		stat := rec.GetStat()
+		ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.GaugeValue, float64(stat.TotalRequestCount), prefix)
+		ch <- prometheus.MustNewConstMetric(avgResponseTimeDesc, prometheus.GaugeValue, stat.AvgResponseTime.Seconds(), prefix)
+		ch <- prometheus.MustNewConstMetric(errorRateDesc, prometheus.GaugeValue, stat.ErrorRate, prefix)
+		ch <- prometheus.MustNewConstMetric(requestRateDesc, prometheus.GaugeValue, stat.RequestRate, prefix)
+	}
+}
+
+// metricsHandler serves the stats of the targets from a registry of their own,
+// so they do not mix with the metrics of the proxy, see proxy.WithPrometheusMetrics
+func (s *StatServer) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statCollector{server: s})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -1,15 +1,16 @@
 package stats
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/FrauElster/proxy"
-	"github.com/FrauElster/proxy/internal"
 )
 
 //go:embed static/*
@@ -17,13 +18,26 @@ var staticFiles embed.FS
 
 type enhancedRec struct {
 	StatRecorder
-	resStarted time.Time
 }
 
+// pendingRequest is passed from PreRequest to PostRequest in the context of the request,
+// the X-Request-ID is not unique as clients may send it
+type pendingRequest struct {
+	method  string
+	started time.Time
+	// recorded is set once the response or the error of the request is recorded
+	recorded atomic.Bool
+}
+
+// pendingKey is the context key of the pendingRequest, one per recorder so several StatServers can record a target
+type pendingKey struct{ rec *enhancedRec }
+
 type StatServer struct {
 	captureWindow   time.Duration
 	targetRecorders map[string]*enhancedRec
 	port            int
+	// prometheusExport serves the stats at /metrics as well, see WithPrometheusExport
+	prometheusExport bool
 }
 
 type StatServerOption func(*StatServer)
@@ -50,10 +64,21 @@ func NewStatServer(opts ...StatServerOption) *StatServer {
 	return s
 }
 
-func (s *StatServer) RegisterTarget(target proxy.Target) {
-	s.targetRecorders[target.Prefix] = &enhancedRec{StatRecorder: *newStatRecorder(s.captureWindow)}
-	target.PreRequest = s.PreRequest(target.Prefix)
-	target.PostRequest = s.PostRequest(target.Prefix)
+// RegisterTarget adds hooks recording the responses of the target, the hooks of the target are kept
+// The deliveries of fan-out targets are recorded with Target.OnDelivery, which still calls the previous one.
+// The target has to be added to the proxy afterwards.
+func (s *StatServer) RegisterTarget(target *proxy.Target) {
+	rec := &enhancedRec{StatRecorder: *newStatRecorder(s.captureWindow)}
+	s.targetRecorders[target.Prefix] = rec
+	onDelivery := target.OnDelivery
+	target.OnDelivery = func(delivery proxy.FanOutDelivery) {
+		rec.AddDelivery(delivery)
+		if onDelivery != nil {
+			onDelivery(delivery)
+		}
+	}
+	target.AddPreRequest(s.PreRequest(target.Prefix), proxy.WithHookPriority(proxy.HookPriorityInstrumentation))
+	target.AddPostRequest(s.PostRequest(target.Prefix), proxy.WithHookPriority(proxy.HookPriorityInstrumentation))
 }
 
 func (s *StatServer) PreRequest(targetPrefix string) func(*http.Request) *http.Request {
@@ -63,8 +88,15 @@ func (s *StatServer) PreRequest(targetPrefix string) func(*http.Request) *http.R
 	}
 
 	return func(r *http.Request) *http.Request {
-		rec.resStarted = time.Now()
-		return r
+		pending := &pendingRequest{method: r.Method, started: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), pendingKey{rec}, pending))
+		// a failed request reaches PostRequest without a response, so it is recorded here
+		return proxy.OnUpstreamError(r, func(class proxy.ErrorClass) {
+			rec.AddError(class)
+			if pending.recorded.CompareAndSwap(false, true) {
+				rec.AddResponse(time.Since(pending.started), http.StatusBadGateway, pending.method)
+			}
+		})
 	}
 }
 
@@ -75,11 +107,13 @@ func (s *StatServer) PostRequest(targetPrefix string) func(*http.Response) *http
 	}
 
 	return func(r *http.Response) *http.Response {
-		status := http.StatusBadGateway
-		if r != nil {
-			status = r.StatusCode
+		if r == nil || r.Request == nil {
+			return r
+		}
+		pending, ok := r.Request.Context().Value(pendingKey{rec}).(*pendingRequest)
+		if ok && pending.recorded.CompareAndSwap(false, true) {
+			rec.AddResponse(time.Since(pending.started), r.StatusCode, pending.method)
 		}
-		rec.AddResponse(time.Since(rec.resStarted), status)
 		return r
 	}
 }
@@ -91,14 +125,17 @@ func (s *StatServer) ListenAndServe() error {
 
 	// serve targets data
 	apiPrefix := "/api"
-	http.HandleFunc(internal.JoinUrl(apiPrefix, "targets"), func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc(proxy.JoinURL(apiPrefix, "targets"), func(w http.ResponseWriter, r *http.Request) {
 		data := struct {
 			Targets []string `json:"targets"`
 		}{Targets: mapKeys(s.targetRecorders)}
 		sendJson(w, data)
 	})
 	for name, target := range s.targetRecorders {
-		http.HandleFunc(internal.JoinUrl(apiPrefix, "targets", name), handleTargetRequest(&target.StatRecorder))
+		http.HandleFunc(proxy.JoinURL(apiPrefix, "targets", name), handleTargetRequest(&target.StatRecorder))
+	}
+	if s.prometheusExport {
+		http.Handle("/metrics", s.metricsHandler())
 	}
 
 	server := &http.Server{Addr: fmt.Sprintf(":%d", s.port)}
@@ -1,16 +1,32 @@
 package stats
 
 import (
+	"maps"
+	"slices"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/FrauElster/proxy"
 )
 
 type responseState struct {
 	responseTime time.Duration
 	statusCode   int
+	method       string
 	timeStamp    time.Time
 }
 
+// MethodStats are the stats of the requests of one HTTP method in the window duration
+type MethodStats struct {
+	// the number of requests
+	Count int `json:"count"`
+	// the average response time
+	AvgResponseTime time.Duration `json:"avgResponseTime"`
+	// the share of the requests that failed (Status >= 400)
+	ErrorRate float64 `json:"errorRate"`
+}
+
 type TargetStats struct {
 	StatStartDate time.Time `json:"statStartDate"`
 	// the total number of requests
@@ -24,6 +40,10 @@ type TargetStats struct {
 
 	// the average response time in the window duration
 	AvgResponseTime time.Duration `json:"avgResponseTime"`
+	// the response times in the window duration that 50, 95 and 99 percent of the requests did not exceed
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
 	// the number of requests in the window duration
 	RequestCount int `json:"requestCount"`
 	// the number of requests per second in the window duration
@@ -31,6 +51,25 @@ type TargetStats struct {
 
 	// the number of requests that failed (Status >= 400) in the window duration
 	ErrorRate float64 `json:"errorRate"`
+	// the number of responses by status code in the window duration
+	StatusCodeCounts map[int]int `json:"statusCodeCounts"`
+	// the number of responses by the class of their status code in the window duration
+	Status2xx int `json:"status2xx"`
+	Status3xx int `json:"status3xx"`
+	Status4xx int `json:"status4xx"`
+	Status5xx int `json:"status5xx"`
+	// the stats of the window duration by the HTTP method of the requests
+	ByMethod map[string]MethodStats `json:"byMethod"`
+	// the total number of requests that could not be forwarded by the class of the error
+	ErrorsByClass map[proxy.ErrorClass]int `json:"errorsByClass"`
+	// the total number of deliveries by the destination of a fan-out target
+	Deliveries map[string]DeliveryStats `json:"deliveries"`
+}
+
+// DeliveryStats counts the deliveries to a destination of a fan-out target
+type DeliveryStats struct {
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
 }
 
 type StatRecorder struct {
@@ -39,21 +78,29 @@ type StatRecorder struct {
 	windowSize   time.Duration
 	// the responses to base the stats on
 	responseWindow []responseState
+	// the response times of responseWindow in ascending order for the percentiles
+	sortedResponseTimes []time.Duration
 
 	// the total number of requests
 	requestCount int
 	// average response time
 	avgResponseTime time.Duration
+	// the number of requests that could not be forwarded by the class of the error
+	errorsByClass map[proxy.ErrorClass]int
+	// the number of deliveries by the destination of a fan-out target
+	deliveries map[string]DeliveryStats
 }
 
 func newStatRecorder(windowSize time.Duration) *StatRecorder {
 	return &StatRecorder{
 		windowSize:     windowSize,
 		responseWindow: make([]responseState, 0),
+		errorsByClass:  make(map[proxy.ErrorClass]int),
+		deliveries:     make(map[string]DeliveryStats),
 	}
 }
 
-func (t *StatRecorder) AddResponse(responseTime time.Duration, statusCode int) {
+func (t *StatRecorder) AddResponse(responseTime time.Duration, statusCode int, method string) {
 	t.Lock()
 	defer t.Unlock()
 
@@ -64,28 +111,53 @@ func (t *StatRecorder) AddResponse(responseTime time.Duration, statusCode int) {
 	t.requestCount++
 	t.avgResponseTime = (t.avgResponseTime*time.Duration(t.requestCount-1) + responseTime) / time.Duration(t.requestCount)
 
+	t.updateWindow()
+	t.responseWindow = append(t.responseWindow, responseState{responseTime: responseTime, statusCode: statusCode, method: method, timeStamp: time.Now()})
+	i := sort.Search(len(t.sortedResponseTimes), func(i int) bool { return t.sortedResponseTimes[i] >= responseTime })
+	t.sortedResponseTimes = slices.Insert(t.sortedResponseTimes, i, responseTime)
+}
+
+// updateWindow removes the responses that are older than the window, t has to be locked
+func (t *StatRecorder) updateWindow() {
 	newWindow := make([]responseState, 0, len(t.responseWindow)+1)
 	for _, state := range t.responseWindow {
 		if time.Since(state.timeStamp) < t.windowSize {
 			newWindow = append(newWindow, state)
+			continue
 		}
+		i := sort.Search(len(t.sortedResponseTimes), func(i int) bool { return t.sortedResponseTimes[i] >= state.responseTime })
+		t.sortedResponseTimes = slices.Delete(t.sortedResponseTimes, i, i+1)
 	}
-	newWindow = append(newWindow, responseState{responseTime: responseTime, statusCode: statusCode, timeStamp: time.Now()})
 	t.responseWindow = newWindow
 }
 
-func (t *StatRecorder) GetStat() TargetStats {
+// AddError counts a request that could not be forwarded, its response is added with AddResponse as well
+func (t *StatRecorder) AddError(class proxy.ErrorClass) {
 	t.Lock()
 	defer t.Unlock()
+	t.errorsByClass[class]++
+}
 
-	// update window
-	newWindow := make([]responseState, 0, len(t.responseWindow)+1)
-	for _, state := range t.responseWindow {
-		if time.Since(state.timeStamp) < t.windowSize {
-			newWindow = append(newWindow, state)
-		}
+// AddDelivery counts a delivery to a destination of a fan-out target
+func (t *StatRecorder) AddDelivery(delivery proxy.FanOutDelivery) {
+	t.Lock()
+	defer t.Unlock()
+	stats := t.deliveries[delivery.Destination]
+	if delivery.Succeeded() {
+		stats.Delivered++
+	} else {
+		stats.Failed++
 	}
-	t.responseWindow = newWindow
+	t.deliveries[delivery.Destination] = stats
+}
+
+func (t *StatRecorder) GetStat() TargetStats {
+	t.Lock()
+	defer t.Unlock()
+
+	t.updateWindow()
+	newWindow := t.responseWindow
+	statusCodeCounts := getStatusCodeCounts(newWindow)
 
 	// calculate stats
 	return TargetStats{
@@ -93,10 +165,21 @@ func (t *StatRecorder) GetStat() TargetStats {
 		TotalAvgResponseTime: t.avgResponseTime,
 		WindowDuration:       t.windowSize,
 		AvgResponseTime:      getAvgResponseTime(newWindow),
+		P50:                  getPercentile(t.sortedResponseTimes, 50),
+		P95:                  getPercentile(t.sortedResponseTimes, 95),
+		P99:                  getPercentile(t.sortedResponseTimes, 99),
 		RequestCount:         len(newWindow),
 		RequestRate:          getRequestRate(newWindow),
 		ErrorRate:            getErrorRate(newWindow),
+		StatusCodeCounts:     statusCodeCounts,
+		Status2xx:            countStatusClass(statusCodeCounts, 2),
+		Status3xx:            countStatusClass(statusCodeCounts, 3),
+		Status4xx:            countStatusClass(statusCodeCounts, 4),
+		Status5xx:            countStatusClass(statusCodeCounts, 5),
+		ByMethod:             getMethodStats(newWindow),
 		StatStartDate:        t.firstRequest,
+		ErrorsByClass:        maps.Clone(t.errorsByClass),
+		Deliveries:           maps.Clone(t.deliveries),
 	}
 }
 
@@ -111,6 +194,15 @@ func getAvgResponseTime(stats []responseState) time.Duration {
 	return totalResponseTime / time.Duration(len(stats))
 }
 
+// getPercentile returns the nearest-rank percentile of the response times, which have to be sorted
+func getPercentile(sorted []time.Duration, percentile int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (percentile*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
 func getRequestRate(stats []responseState) float64 {
 	if len(stats) == 0 {
 		return 0
@@ -135,3 +227,39 @@ func getErrorRate(stats []responseState) float64 {
 
 	return float64(errorCount) / float64(len(stats))
 }
+
+func getStatusCodeCounts(stats []responseState) map[int]int {
+	counts := make(map[int]int)
+	for _, state := range stats {
+		counts[state.statusCode]++
+	}
+	return counts
+}
+
+// countStatusClass sums the counts of the status codes of a class, e.g. 4 for 4xx
+func countStatusClass(counts map[int]int, class int) int {
+	var count int
+	for statusCode, n := range counts {
+		if statusCode/100 == class {
+			count += n
+		}
+	}
+	return count
+}
+
+func getMethodStats(stats []responseState) map[string]MethodStats {
+	byMethod := make(map[string][]responseState)
+	for _, state := range stats {
+		byMethod[state.method] = append(byMethod[state.method], state)
+	}
+
+	methodStats := make(map[string]MethodStats, len(byMethod))
+	for method, states := range byMethod {
+		methodStats[method] = MethodStats{
+			Count:           len(states),
+			AvgResponseTime: getAvgResponseTime(states),
+			ErrorRate:       getErrorRate(states),
+		}
+	}
+	return methodStats
+}
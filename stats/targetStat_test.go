@@ -0,0 +1,256 @@
+package stats
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FrauElster/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentiles(t *testing.T) {
+	recorder := newStatRecorder(time.Minute)
+	for _, i := range rand.Perm(100) {
+		recorder.AddResponse(time.Duration(i+1)*time.Millisecond, http.StatusOK, http.MethodGet)
+	}
+
+	stat := recorder.GetStat()
+	require.Equal(t, 100, stat.RequestCount)
+	require.InEpsilon(t, 50*time.Millisecond, stat.P50, 0.05)
+	require.InEpsilon(t, 95*time.Millisecond, stat.P95, 0.05)
+	require.InEpsilon(t, 99*time.Millisecond, stat.P99, 0.05)
+
+	data, err := json.Marshal(stat)
+	require.NoError(t, err)
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.Contains(t, fields, "p50")
+	require.Contains(t, fields, "p95")
+	require.Contains(t, fields, "p99")
+
+	t.Run("responses leaving the window", func(t *testing.T) {
+		recorder := newStatRecorder(50 * time.Millisecond)
+		recorder.AddResponse(time.Second, http.StatusOK, http.MethodGet)
+		time.Sleep(60 * time.Millisecond)
+		recorder.AddResponse(10*time.Millisecond, http.StatusOK, http.MethodGet)
+
+		stat := recorder.GetStat()
+		require.Equal(t, 1, stat.RequestCount)
+		require.Equal(t, 10*time.Millisecond, stat.P99)
+	})
+
+	t.Run("no responses", func(t *testing.T) {
+		stat := newStatRecorder(time.Minute).GetStat()
+		require.Zero(t, stat.P50)
+		require.Zero(t, stat.P99)
+	})
+}
+
+func TestMethodStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer upstream.Close()
+
+	statServer := NewStatServer()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}
+	statServer.RegisterTarget(&target)
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(target))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			method := http.MethodGet
+			if i%3 == 0 {
+				method = http.MethodPost
+			}
+			req, err := http.NewRequest(method, server.URL+"/api/items", nil)
+			require.NoError(t, err)
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			res.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	stat := statServer.targetRecorders[target.Prefix].GetStat()
+	require.Equal(t, 6, stat.RequestCount)
+	require.Len(t, stat.ByMethod, 2)
+	require.Equal(t, 4, stat.ByMethod[http.MethodGet].Count)
+	require.Zero(t, stat.ByMethod[http.MethodGet].ErrorRate)
+	require.Equal(t, 2, stat.ByMethod[http.MethodPost].Count)
+	require.Equal(t, 1.0, stat.ByMethod[http.MethodPost].ErrorRate)
+
+	t.Run("requests that could not be forwarded", func(t *testing.T) {
+		statServer := NewStatServer()
+		target := proxy.Target{BaseUrl: "http://upstream.invalid", Prefix: "/failing/"}
+		statServer.RegisterTarget(&target)
+		require.NoError(t, p.AddTarget(target))
+
+		res, err := http.Post(server.URL+"/failing/", "text/plain", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+
+		stat := statServer.targetRecorders[target.Prefix].GetStat()
+		require.Equal(t, MethodStats{Count: 1, AvgResponseTime: stat.AvgResponseTime, ErrorRate: 1}, stat.ByMethod[http.MethodPost])
+		require.Equal(t, 1, stat.ErrorsByClass[proxy.DNSFailure])
+	})
+}
+
+func TestDuplicateRequestIDs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	statServer := NewStatServer()
+	target := proxy.Target{BaseUrl: upstream.URL, Prefix: "/api/"}
+	statServer.RegisterTarget(&target)
+	p, err := proxy.NewProxy()
+	require.NoError(t, err)
+	require.NoError(t, p.AddTarget(target))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// clients choose the X-Request-ID, so concurrent requests may share it
+	var wg sync.WaitGroup
+	for _, path := range []string{"/api/slow", "/api/fast"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Request-ID", "duplicate")
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			res.Body.Close()
+		}(path)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	stat := statServer.targetRecorders[target.Prefix].GetStat()
+	require.Equal(t, 2, stat.RequestCount)
+	require.GreaterOrEqual(t, stat.P99, 100*time.Millisecond)
+	require.Less(t, stat.P50, 100*time.Millisecond)
+}
+
+func TestDeliveries(t *testing.T) {
+	var forwarded []proxy.FanOutDelivery
+	target := proxy.Target{Prefix: "/webhooks/", OnDelivery: func(delivery proxy.FanOutDelivery) {
+		forwarded = append(forwarded, delivery)
+	}}
+	statServer := NewStatServer()
+	statServer.RegisterTarget(&target)
+
+	target.OnDelivery(proxy.FanOutDelivery{Destination: "billing", Status: http.StatusOK})
+	target.OnDelivery(proxy.FanOutDelivery{Destination: "billing", Status: http.StatusInternalServerError})
+	target.OnDelivery(proxy.FanOutDelivery{Destination: "audit", Status: http.StatusAccepted})
+
+	stat := statServer.targetRecorders[target.Prefix].GetStat()
+	require.Equal(t, map[string]DeliveryStats{"billing": {Delivered: 1, Failed: 1}, "audit": {Delivered: 1}}, stat.Deliveries)
+	require.Len(t, forwarded, 3)
+}
+
+func TestStatusCodeCounts(t *testing.T) {
+	recorder := newStatRecorder(time.Minute)
+	for statusCode, n := range map[int]int{200: 5, 204: 1, 301: 2, 404: 3, 500: 4} {
+		for i := 0; i < n; i++ {
+			recorder.AddResponse(time.Millisecond, statusCode, http.MethodGet)
+		}
+	}
+
+	stat := recorder.GetStat()
+	require.Equal(t, map[int]int{200: 5, 204: 1, 301: 2, 404: 3, 500: 4}, stat.StatusCodeCounts)
+	require.Equal(t, 6, stat.Status2xx)
+	require.Equal(t, 2, stat.Status3xx)
+	require.Equal(t, 3, stat.Status4xx)
+	require.Equal(t, 4, stat.Status5xx)
+
+	// the stats of the API of the StatServer include the counts
+	res := httptest.NewRecorder()
+	handleTargetRequest(recorder)(res, httptest.NewRequest(http.MethodGet, "/api/targets/test", nil))
+	var fields struct {
+		StatusCodeCounts map[string]int `json:"statusCodeCounts"`
+		Status5xx        int            `json:"status5xx"`
+	}
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &fields))
+	require.Equal(t, map[string]int{"200": 5, "204": 1, "301": 2, "404": 3, "500": 4}, fields.StatusCodeCounts)
+	require.Equal(t, 4, fields.Status5xx)
+}
+
+func TestPrometheusExport(t *testing.T) {
+	statServer := NewStatServer(WithPrometheusExport(true))
+	api := proxy.Target{Prefix: "/api/"}
+	web := proxy.Target{Prefix: "/web/"}
+	statServer.RegisterTarget(&api)
+	statServer.RegisterTarget(&web)
+	// the responses are spread over a fixed span, so the request rate is exact
+	addResponses := func(prefix string, span time.Duration, responses ...responseState) {
+		rec := statServer.targetRecorders[prefix]
+		for _, response := range responses {
+			rec.AddResponse(response.responseTime, response.statusCode, http.MethodGet)
+		}
+		start := time.Now().Add(-span)
+		for i := range rec.responseWindow {
+			rec.responseWindow[i].timeStamp = start.Add(span * time.Duration(i) / time.Duration(len(rec.responseWindow)-1))
+		}
+	}
+	addResponses(api.Prefix, time.Second,
+		responseState{responseTime: 100 * time.Millisecond, statusCode: http.StatusOK},
+		responseState{responseTime: 300 * time.Millisecond, statusCode: http.StatusInternalServerError})
+	addResponses(web.Prefix, 4*time.Second,
+		responseState{responseTime: 50 * time.Millisecond, statusCode: http.StatusOK},
+		responseState{responseTime: 50 * time.Millisecond, statusCode: http.StatusOK},
+		responseState{responseTime: 50 * time.Millisecond, statusCode: http.StatusNotFound})
+
+	server := httptest.NewServer(statServer.metricsHandler())
+	defer server.Close()
+
+	expected := `
+# HELP proxy_stats_avg_response_time_seconds Average response time of the target in the capture window.
+# TYPE proxy_stats_avg_response_time_seconds gauge
+proxy_stats_avg_response_time_seconds{target="/api/"} 0.2
+proxy_stats_avg_response_time_seconds{target="/web/"} 0.05
+# HELP proxy_stats_error_rate Ratio of failed requests to the target in the capture window.
+# TYPE proxy_stats_error_rate gauge
+proxy_stats_error_rate{target="/api/"} 0.5
+proxy_stats_error_rate{target="/web/"} 0.3333333333333333
+# HELP proxy_stats_request_rate Requests per second to the target in the capture window.
+# TYPE proxy_stats_request_rate gauge
+proxy_stats_request_rate{target="/api/"} 2
+proxy_stats_request_rate{target="/web/"} 0.75
+# HELP proxy_stats_requests Number of requests to the target since it was registered.
+# TYPE proxy_stats_requests gauge
+proxy_stats_requests{target="/api/"} 2
+proxy_stats_requests{target="/web/"} 3
+`
+	require.NoError(t, testutil.ScrapeAndCompare(server.URL, strings.NewReader(expected)))
+
+	// the samples follow the recorded responses
+	statServer.targetRecorders[api.Prefix].AddResponse(200*time.Millisecond, http.StatusOK, http.MethodGet)
+	expected = `
+# HELP proxy_stats_requests Number of requests to the target since it was registered.
+# TYPE proxy_stats_requests gauge
+proxy_stats_requests{target="/api/"} 3
+proxy_stats_requests{target="/web/"} 3
+`
+	require.NoError(t, testutil.ScrapeAndCompare(server.URL, strings.NewReader(expected), "proxy_stats_requests"))
+}
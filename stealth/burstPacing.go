@@ -0,0 +1,92 @@
+package stealth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPacingConflict is returned by RoundTrip if both WithDelay and WithBurstPacing are used
+var ErrPacingConflict = errors.New("WithDelay and WithBurstPacing are mutually exclusive")
+
+// WithBurstPacing paces the requests with a token bucket instead of a delay between every request.
+// Up to burst requests are sent immediately, e.g. a page and its XHRs, afterwards requests are held back
+// so the sustained rate converges to ratePerMinute. Waiting requests give up once their context is done.
+// It cannot be combined with WithDelay.
+func WithBurstPacing(ratePerMinute float64, burst int) StealthOption {
+	return func(s *StealthTransport) {
+		s.pacing = newTokenBucket(ratePerMinute/60, burst)
+	}
+}
+
+// PacingTokens returns the number of requests that can currently be sent without waiting
+// it is negative if requests are waiting, the second return value is false if WithBurstPacing is not used
+func (t *StealthTransport) PacingTokens() (float64, bool) {
+	if t.pacing == nil {
+		return 0, false
+	}
+	return t.pacing.available(), true
+}
+
+// tokenBucket hands out a token per request, tokens refill at rate per second up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func newTokenBucket(ratePerSecond float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   ratePerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+		after:  time.After,
+	}
+}
+
+// refill adds the tokens accumulated since the last refill, b.mu has to be held
+func (b *tokenBucket) refill() {
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+// wait takes a token, if there is none left it waits until its token is refilled or ctx is done
+// tokens are reserved in order, so waiting requests do not overtake each other
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.refill()
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-b.after(delay):
+		return nil
+	case <-ctx.Done():
+		// hand the reserved token back to the requests behind
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
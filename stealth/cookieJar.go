@@ -0,0 +1,43 @@
+package stealth
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+)
+
+// WithCookieJar keeps the cookies set by the responses in the jar and sends them with the following requests,
+// like an http.Client with a Jar does. Cookies already set on a request take precedence over the jar.
+func WithCookieJar(jar http.CookieJar) StealthOption {
+	return func(s *StealthTransport) {
+		s.jar = jar
+	}
+}
+
+// NewCookieJar returns an in-memory cookie jar for WithCookieJar
+func NewCookieJar() http.CookieJar {
+	// cookiejar.New never fails without options
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// addJarCookies adds the cookies of the jar for the request URL that are not set on the request yet
+func (t *StealthTransport) addJarCookies(req *http.Request) {
+	if t.jar == nil {
+		return
+	}
+	for _, cookie := range t.jar.Cookies(req.URL) {
+		if _, err := req.Cookie(cookie.Name); err == http.ErrNoCookie {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// storeJarCookies stores the cookies set by the response in the jar
+func (t *StealthTransport) storeJarCookies(req *http.Request, res *http.Response) {
+	if t.jar == nil {
+		return
+	}
+	if cookies := res.Cookies(); len(cookies) > 0 {
+		t.jar.SetCookies(req.URL, cookies)
+	}
+}
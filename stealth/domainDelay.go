@@ -0,0 +1,53 @@
+package stealth
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/FrauElster/proxy/internal"
+)
+
+// WithPerDomainDelay sets the minimum and maximum delay between requests to the same host, requests to other hosts
+// are not held back. The actual delay is a random value between min and max. It replaces the delay of WithDelay.
+func WithPerDomainDelay(min, max time.Duration) StealthOption {
+	return func(s *StealthTransport) {
+		s.domainDelay = &domainDelay{min: min, max: max, lastRequest: newHostMap[time.Time](s)}
+	}
+}
+
+// domainDelay spaces the requests to each host by a random delay between min and max
+type domainDelay struct {
+	min, max time.Duration
+	// lastRequest is the time the last request to the host was or is scheduled to be sent
+	lastRequest *internal.BoundedMap[string, time.Time]
+}
+
+// wait schedules the request to the host after the last one and waits until it is due or ctx is done
+// the slot is reserved before waiting, so concurrent requests to the same host are spaced as well
+func (d *domainDelay) wait(ctx context.Context, host string) error {
+	delay := d.min
+	if d.max > d.min {
+		delay += time.Duration(rand.Int63n(int64(d.max - d.min)))
+	}
+
+	now := time.Now()
+	due := d.lastRequest.Update(host, func(last time.Time, ok bool) time.Time {
+		if ok && last.Add(delay).After(now) {
+			return last.Add(delay)
+		}
+		return now
+	})
+
+	if !due.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(due.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,190 @@
+package stealth
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithAcceptLanguages sends a randomly chosen one of the given Accept-Language values with every request
+// instead of always the same one
+func WithAcceptLanguages(langs ...string) StealthOption {
+	return func(s *StealthTransport) {
+		s.acceptLanguages = langs
+	}
+}
+
+// WithHeaderOrderShuffle sends the headers of every request in a random order.
+// net/http writes the headers sorted by name, which is a fingerprint of its own, so the order is shuffled on the wire
+// by the connections of the transport. It only applies to HTTP/1.1, HTTPS connections are limited to HTTP/1.1.
+func WithHeaderOrderShuffle(enabled bool) StealthOption {
+	return func(s *StealthTransport) {
+		s.shuffleHeaders = enabled
+		if transport, ok := s.Transport.(*http.Transport); ok {
+			s.configureHeaderShuffle(transport)
+		}
+	}
+}
+
+// configureHeaderShuffle makes the connections of the transport shuffle the headers if WithHeaderOrderShuffle is used
+// the connections are dialed with the Dial of the transport at the time of dialing, so a SOCKS5 proxy set later applies
+func (t *StealthTransport) configureHeaderShuffle(transport *http.Transport) {
+	if !t.shuffleHeaders {
+		return
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if transport.Dial != nil {
+			return transport.Dial(network, addr)
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &headerShuffleConn{Conn: conn}, nil
+	}
+	// the TLS connection is established here, so the headers are shuffled before they are encrypted
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &headerShuffleConn{Conn: tlsConn}, nil
+	}
+}
+
+// writeState is the part of an HTTP/1.1 request a headerShuffleConn is writing
+type writeState int
+
+const (
+	writingHeaders writeState = iota
+	writingBody
+	writingChunkSize
+	writingChunkData
+	writingTrailers
+)
+
+// headerShuffleConn shuffles the header lines of the HTTP/1.1 requests written to it
+// the header block is held back until it is complete, bodies are passed through and parsed only to find the next request
+type headerShuffleConn struct {
+	net.Conn
+	state writeState
+	// pending is the incomplete header block or the incomplete line of a chunked body
+	pending []byte
+	// remaining are the bytes left of the body or the current chunk
+	remaining int64
+}
+
+func (c *headerShuffleConn) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		switch c.state {
+		case writingHeaders:
+			c.pending = append(c.pending, p...)
+			end := bytes.Index(c.pending, []byte("\r\n\r\n"))
+			if end < 0 {
+				return n, nil
+			}
+			head, rest := c.pending[:end+4], bytes.Clone(c.pending[end+4:])
+			c.pending = nil
+			if _, err := c.Conn.Write(shuffleHeaderLines(head)); err != nil {
+				return 0, err
+			}
+			c.state, c.remaining = bodyState(head)
+			p = rest
+		case writingBody, writingChunkData:
+			k := int64(len(p))
+			if k > c.remaining {
+				k = c.remaining
+			}
+			if _, err := c.Conn.Write(p[:k]); err != nil {
+				return 0, err
+			}
+			p, c.remaining = p[k:], c.remaining-k
+			if c.remaining == 0 && c.state == writingBody {
+				c.state = writingHeaders
+			} else if c.remaining == 0 {
+				c.state = writingChunkSize
+			}
+		case writingChunkSize, writingTrailers:
+			end := bytes.IndexByte(p, '\n')
+			if end < 0 {
+				c.pending = append(c.pending, p...)
+				_, err := c.Conn.Write(p)
+				return n, err
+			}
+			if _, err := c.Conn.Write(p[:end+1]); err != nil {
+				return 0, err
+			}
+			line := strings.TrimSpace(string(append(c.pending, p[:end+1]...)))
+			c.pending, p = nil, p[end+1:]
+			if c.state == writingTrailers {
+				if line == "" {
+					c.state = writingHeaders
+				}
+				continue
+			}
+			size, _, _ := strings.Cut(line, ";")
+			chunkSize, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+			if err != nil || chunkSize == 0 {
+				c.state = writingTrailers
+				continue
+			}
+			// the chunk data is followed by a CRLF
+			c.state, c.remaining = writingChunkData, chunkSize+2
+		}
+	}
+	return n, nil
+}
+
+// bodyState returns the state following the header block and the length of the body
+func bodyState(head []byte) (writeState, int64) {
+	for _, line := range strings.Split(string(head), "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "transfer-encoding":
+			if strings.Contains(strings.ToLower(value), "chunked") {
+				return writingChunkSize, 0
+			}
+		case "content-length":
+			if length, err := strconv.ParseInt(value, 10, 64); err == nil && length > 0 {
+				return writingBody, length
+			}
+		}
+	}
+	return writingHeaders, 0
+}
+
+// shuffleHeaderLines returns the header block with its header lines in random order, the request line stays first
+func shuffleHeaderLines(head []byte) []byte {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	headers := lines[1:]
+	rand.Shuffle(len(headers), func(i, j int) { headers[i], headers[j] = headers[j], headers[i] })
+	return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n")
+}
@@ -0,0 +1,55 @@
+package stealth
+
+import (
+	"time"
+
+	"github.com/FrauElster/proxy/internal"
+)
+
+const (
+	// defaultMaxHosts and defaultHostTTL bound the state kept per host unless WithHostStateLimits is used
+	defaultMaxHosts = 10000
+	defaultHostTTL  = time.Hour
+)
+
+// MapStats are the occupancy and evictions of a bounded in-memory map of the transport
+type MapStats = internal.MapStats
+
+// WithHostStateLimits bounds the state the transport keeps per host, e.g. the queues of WithDomainRateLimitQueue
+// and the last requests of WithPerDomainDelay. Each map keeps up to maxHosts hosts and forgets hosts that were
+// not requested for ttl, hosts with requests in flight are kept. Defaults to 10000 hosts and an hour,
+// 0 disables a limit.
+func WithHostStateLimits(maxHosts int, ttl time.Duration) StealthOption {
+	return func(s *StealthTransport) {
+		s.maxHosts = maxHosts
+		s.hostTTL = ttl
+	}
+}
+
+// newHostMap returns a map of state per host bounded by the limits of the transport
+func newHostMap[V any](s *StealthTransport) *internal.BoundedMap[string, V] {
+	return internal.NewBoundedMap[string, V](s.maxHosts, s.hostTTL)
+}
+
+// applyHostStateLimits recreates the maps created by the options with the final limits, they are still empty
+func (t *StealthTransport) applyHostStateLimits() {
+	if t.queues != nil {
+		t.queues = newHostMap[*domainQueue](t)
+	}
+	if t.domainDelay != nil {
+		t.domainDelay.lastRequest = newHostMap[time.Time](t)
+	}
+}
+
+// MapStats returns the stats of the maps of state per host by name, "rateLimitQueues" and "domainDelays"
+// Maps of options that are not used are missing.
+func (t *StealthTransport) MapStats() map[string]MapStats {
+	stats := make(map[string]MapStats)
+	if t.queues != nil {
+		stats["rateLimitQueues"] = t.queues.Stats()
+	}
+	if t.domainDelay != nil {
+		stats["domainDelays"] = t.domainDelay.lastRequest.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,125 @@
+package stealth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimitQueueFull is returned if a request would have to wait for a rate limited domain,
+// but the queue of that domain is already full
+var ErrRateLimitQueueFull = errors.New("rate limit queue of the domain is full")
+
+// defaultRetryAfter is the backoff used if a 429 response has no (valid) Retry-After header
+const defaultRetryAfter = time.Second
+
+// WithDomainRateLimitQueue makes the stealth transport back off from a domain that answered with 429 Too Many Requests.
+// Until the Retry-After of that response elapsed, all requests to the domain wait in a queue of the given capacity,
+// afterwards they are released one by one, each waiting for the response of the previous one.
+// Requests that do not fit into the queue fail with ErrRateLimitQueueFull.
+func WithDomainRateLimitQueue(capacity int) StealthOption {
+	return func(s *StealthTransport) {
+		s.queueCapacity = capacity
+		s.queues = newHostMap[*domainQueue](s)
+	}
+}
+
+// domainQueue holds back the requests to a single rate limited domain
+type domainQueue struct {
+	mu           sync.Mutex
+	blockedUntil time.Time
+
+	// waiting has a slot for every request in the queue
+	waiting chan struct{}
+	// turn is held by the request that was released from the queue until its response arrived
+	turn chan struct{}
+}
+
+func newDomainQueue(capacity int) *domainQueue {
+	return &domainQueue{
+		waiting: make(chan struct{}, capacity),
+		turn:    make(chan struct{}, 1),
+	}
+}
+
+// domainQueue returns the queue of the given host, nil if WithDomainRateLimitQueue is not used
+// the queue is kept until release is called, so requests waiting in it do not lose it to an eviction
+func (t *StealthTransport) domainQueue(host string) (queue *domainQueue, release func()) {
+	if t.queues == nil {
+		return nil, func() {}
+	}
+	return t.queues.Acquire(host, func() *domainQueue { return newDomainQueue(t.queueCapacity) })
+}
+
+// acquire waits until the request may be sent, the returned function has to be called once the response arrived
+func (q *domainQueue) acquire(ctx context.Context) (func(), error) {
+	q.mu.Lock()
+	blocked := time.Now().Before(q.blockedUntil)
+	q.mu.Unlock()
+	// keep the order, new requests do not overtake the ones still queued
+	if !blocked && len(q.waiting) == 0 {
+		return func() {}, nil
+	}
+
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		return nil, ErrRateLimitQueueFull
+	}
+	defer func() { <-q.waiting }()
+
+	select {
+	case q.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-q.turn }
+
+	for {
+		q.mu.Lock()
+		delay := time.Until(q.blockedUntil)
+		q.mu.Unlock()
+		if delay <= 0 {
+			return release, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// observe blocks the domain if the response is a 429 Too Many Requests
+func (q *domainQueue) observe(res *http.Response) {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	retryAfter := parseRetryAfter(res.Header.Get("Retry-After"))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if until := time.Now().Add(retryAfter); until.After(q.blockedUntil) {
+		q.blockedUntil = until
+	}
+}
+
+// parseRetryAfter parses the Retry-After header which is either delta seconds or a HTTP date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return defaultRetryAfter
+}
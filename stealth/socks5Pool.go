@@ -0,0 +1,82 @@
+package stealth
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	goProxy "golang.org/x/net/proxy"
+)
+
+// PoolStrategy decides which SOCKS5 proxy of a pool a request is sent through
+type PoolStrategy int
+
+const (
+	// RoundRobin sends the requests through the proxies of the pool in turn
+	RoundRobin PoolStrategy = iota
+	// Random sends every request through a randomly chosen proxy of the pool
+	Random
+)
+
+// WithSocks5Pool rotates the requests across the given SOCKS5 proxies, auths[i] is the auth of addrs[i] and may be nil.
+// Every proxy of the pool has a transport of its own, created when the proxy is picked for the first time,
+// so connections are reused per proxy. It replaces WithSocks5.
+func WithSocks5Pool(addrs []string, auths []*goProxy.Auth, strategy PoolStrategy) StealthOption {
+	return func(s *StealthTransport) {
+		if len(addrs) == 0 {
+			return
+		}
+		pool := &socks5Pool{strategy: strategy, slots: make([]*poolSlot, len(addrs))}
+		for i, addr := range addrs {
+			pool.slots[i] = &poolSlot{addr: addr}
+			if i < len(auths) {
+				pool.slots[i].auth = auths[i]
+			}
+		}
+		s.pool = pool
+	}
+}
+
+// socks5Pool holds the SOCKS5 proxies of WithSocks5Pool
+type socks5Pool struct {
+	strategy PoolStrategy
+	slots    []*poolSlot
+	next     atomic.Uint64
+}
+
+// poolSlot is a SOCKS5 proxy of the pool with its transport, which is initialized on first use
+type poolSlot struct {
+	addr string
+	auth *goProxy.Auth
+
+	once      sync.Once
+	transport *http.Transport
+	err       error
+}
+
+// pick returns the slot the next request is sent through
+func (p *socks5Pool) pick() *poolSlot {
+	if p.strategy == Random {
+		return p.slots[rand.Intn(len(p.slots))]
+	}
+	return p.slots[(p.next.Add(1)-1)%uint64(len(p.slots))]
+}
+
+// roundTripper returns the transport of the slot, configure is applied to it when it is created
+func (s *poolSlot) roundTripper(configure func(*http.Transport)) (http.RoundTripper, error) {
+	s.once.Do(func() {
+		dialer, err := goProxy.SOCKS5("tcp", s.addr, s.auth, goProxy.Direct)
+		if err != nil {
+			s.err = fmt.Errorf("failed to initialize SOCKS5 proxy %s: %w", s.addr, err)
+			return
+		}
+		s.transport = &http.Transport{Dial: dialer.Dial}
+		configure(s.transport)
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.transport, nil
+}
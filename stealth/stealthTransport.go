@@ -1,13 +1,16 @@
 package stealth
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/FrauElster/proxy/internal"
+	"golang.org/x/net/http2"
 	goProxy "golang.org/x/net/proxy"
 )
 
@@ -24,6 +27,8 @@ type StealthTransport struct {
 	minDelay    time.Duration
 	maxDelay    time.Duration
 	lastRequest time.Time
+	// lastRequestMu guards lastRequest, the transport is used by concurrent requests
+	lastRequestMu sync.Mutex
 
 	// socks5Proxy is the SOCKS5 proxy used by the stealth transport
 	// if socks5Proxy is empty, the stealth transport will not use a SOCKS5 proxy
@@ -34,6 +39,29 @@ type StealthTransport struct {
 	// compression is true if the stealth transport will compress requests and decompress responses
 	// if the request is already compressed, the stealth transport will not compress it again, and will not decompress the response
 	compression bool
+
+	// queues hold back the requests to rate limited domains, nil if WithDomainRateLimitQueue is not used
+	queues        *internal.BoundedMap[string, *domainQueue]
+	queueCapacity int
+	// maxHosts and hostTTL bound the state kept per host, see WithHostStateLimits
+	maxHosts int
+	hostTTL  time.Duration
+
+	// pacing is the token bucket of WithBurstPacing, nil to use minDelay and maxDelay
+	pacing *tokenBucket
+	// domainDelay spaces the requests per host if WithPerDomainDelay is used, minDelay and maxDelay are ignored then
+	domainDelay *domainDelay
+
+	// pool are the SOCKS5 proxies of WithSocks5Pool, nil to send all requests through Transport
+	pool *socks5Pool
+	// http2 is the setting of WithHTTP2, nil to keep the default of net/http
+	http2 *bool
+	// jar holds the cookies of WithCookieJar, nil if the transport does not keep cookies
+	jar http.CookieJar
+	// acceptLanguages are the Accept-Language values of WithAcceptLanguages, empty to always send the default one
+	acceptLanguages []string
+	// shuffleHeaders is true if WithHeaderOrderShuffle is enabled
+	shuffleHeaders bool
 }
 
 type StealthOption func(*StealthTransport)
@@ -68,22 +96,61 @@ func WithDelay(min, max time.Duration) StealthOption {
 	}
 }
 
+// WithHTTP2 negotiates HTTP/2 with HTTPS servers via ALPN like browsers do, or forces HTTP/1.1 if enabled is false
+// The HTTP/2 connections are dialed by the underlying transport, so they go through the SOCKS5 proxy as well.
+func WithHTTP2(enabled bool) StealthOption {
+	return func(s *StealthTransport) {
+		s.http2 = &enabled
+		if transport, ok := s.Transport.(*http.Transport); ok {
+			s.configureHTTP2(transport)
+		}
+	}
+}
+
+// configureHTTP2 applies the setting of WithHTTP2 to the transport
+func (t *StealthTransport) configureHTTP2(transport *http.Transport) {
+	if t.http2 == nil {
+		return
+	}
+	if !*t.http2 {
+		// a non-nil empty map disables the HTTP/2 support of net/http
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		slog.Warn("failed to configure HTTP/2", "err", err)
+	}
+}
+
+// configureTransport applies the settings of WithHTTP2 and WithHeaderOrderShuffle to a transport of the pool
+func (t *StealthTransport) configureTransport(transport *http.Transport) {
+	t.configureHTTP2(transport)
+	t.configureHeaderShuffle(transport)
+}
+
 func NewStealthTransport(opts ...StealthOption) *StealthTransport {
 	t := &StealthTransport{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 		},
+		maxHosts: defaultMaxHosts,
+		hostTTL:  defaultHostTTL,
 	}
 
 	for _, opt := range opts {
 		opt(t)
 	}
+	t.applyHostStateLimits()
 
 	return t
 }
 
 // RoundTrip implements the http.RoundTripper interface
 func (t *StealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.pacing != nil && (t.minDelay > 0 || t.maxDelay > 0) {
+		return nil, ErrPacingConflict
+	}
+
 	// set a random user agent if one is not already set
 	if len(t.userAgents) > 0 {
 		randomUserAgent := t.userAgents[rand.Intn(len(t.userAgents))]
@@ -91,13 +158,20 @@ func (t *StealthTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	}
 
 	// add basic headers if they are not already set
-	addHeaderIfNotExists(req, "Accept-Language", "de-DE,de;q=0.9,en-US;q=0.8,en;q=0.7")
+	acceptLanguage := "de-DE,de;q=0.9,en-US;q=0.8,en;q=0.7"
+	if len(t.acceptLanguages) > 0 {
+		acceptLanguage = t.acceptLanguages[rand.Intn(len(t.acceptLanguages))]
+	}
+	addHeaderIfNotExists(req, "Accept-Language", acceptLanguage)
 	addHeaderIfNotExists(req, "Accept", "*/*")
 	addHeaderIfNotExists(req, "Connection", "keep-alive")
 	addHeaderIfNotExists(req, "Cache-Control", "no-cache")
 	addHeaderIfNotExists(req, "Pragma", "no-cache")
 	addHeaderIfNotExists(req, "DNT", "1")
 
+	// send the cookies of the session
+	t.addJarCookies(req)
+
 	// add compression header
 	hadCompression := req.Header.Get("Accept-Encoding") != ""
 	if t.compression && !hadCompression {
@@ -105,8 +179,15 @@ func (t *StealthTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
 	}
 
-	// initialize the SOCKS5 proxy if one is set
-	if t.socks5Proxy != "" && !t.socks5Initialized {
+	// pick a SOCKS5 proxy of the pool or initialize the SOCKS5 proxy if one is set
+	transport := t.Transport
+	if t.pool != nil {
+		var err error
+		transport, err = t.pool.pick().roundTripper(t.configureTransport)
+		if err != nil {
+			return nil, err
+		}
+	} else if t.socks5Proxy != "" && !t.socks5Initialized {
 		dialer, err := goProxy.SOCKS5("tcp", t.socks5Proxy, t.socksAuth, goProxy.Direct)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize SOCKS5 proxy: %w", err)
@@ -118,19 +199,51 @@ func (t *StealthTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	}
 
 	// delay the request if necessary
-	if t.minDelay > 0 && t.maxDelay > 0 {
+	if t.domainDelay != nil {
+		if err := t.domainDelay.wait(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	} else if t.minDelay > 0 && t.maxDelay > 0 {
+		t.lastRequestMu.Lock()
 		actualDelay := time.Since(t.lastRequest)
+		t.lastRequestMu.Unlock()
 		wantDelay := rand.Int63n(int64(t.maxDelay-t.minDelay)) + int64(t.minDelay)
 		if actualDelay < time.Duration(wantDelay) {
 			time.Sleep(time.Duration(wantDelay) - actualDelay)
 		}
 	}
 
-	t.lastRequest = time.Now()
-	res, resErr := t.Transport.RoundTrip(req)
+	if t.pacing != nil {
+		err := t.pacing.wait(req.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// wait if the domain told us to slow down
+	queue, releaseQueue := t.domainQueue(req.URL.Host)
+	defer releaseQueue()
+	if queue != nil {
+		release, err := queue.acquire(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	if t.domainDelay == nil {
+		t.lastRequestMu.Lock()
+		t.lastRequest = time.Now()
+		t.lastRequestMu.Unlock()
+	}
+	res, resErr := transport.RoundTrip(req)
 	if resErr != nil {
 		return nil, resErr
 	}
+	if queue != nil {
+		queue.observe(res)
+	}
+	t.storeJarCookies(req, res)
 
 	// decompress
 	if t.compression && !hadCompression && res.Header.Get("Content-Encoding") != "" {
@@ -1,12 +1,19 @@
 package stealth
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -101,6 +108,83 @@ func TestStealthClient(t *testing.T) {
 	})
 }
 
+func TestDomainRateLimitQueue(t *testing.T) {
+	var mu sync.Mutex
+	var limited bool
+	var active, maxActive int
+	arrivals := make([]time.Time, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if !limited {
+			limited = true
+			mu.Unlock()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		arrivals = append(arrivals, time.Now())
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := NewStealthTransport(WithDomainRateLimitQueue(10))
+	c := &http.Client{Transport: transport}
+
+	resp, err := c.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	limitedAt := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Get(server.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, arrivals, 5)
+	require.Equal(t, 1, maxActive, "requests should be released one by one")
+	for _, arrival := range arrivals {
+		require.GreaterOrEqual(t, arrival.Sub(limitedAt), 900*time.Millisecond, "requests should wait for the Retry-After")
+	}
+	for i := 1; i < len(arrivals); i++ {
+		require.GreaterOrEqual(t, arrivals[i].Sub(arrivals[i-1]), 20*time.Millisecond)
+	}
+}
+
+func TestDomainRateLimitQueueFull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	transport := NewStealthTransport(WithDomainRateLimitQueue(0))
+	c := &http.Client{Transport: transport}
+
+	resp, err := c.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	_, err = c.Get(server.URL)
+	require.ErrorIs(t, err, ErrRateLimitQueueFull)
+}
+
 func mustSocksTransport(t *testing.T) *StealthTransport {
 	err := godotenv.Load("../.env")
 	require.NoError(t, err)
@@ -114,3 +198,566 @@ func mustSocksTransport(t *testing.T) *StealthTransport {
 	}))
 	return transport
 }
+
+// fakeClock lets the token bucket run without sleeping, waits advance the clock immediately
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) install(b *tokenBucket) {
+	b.now = func() time.Time { return c.now }
+	b.after = func(d time.Duration) <-chan time.Time {
+		c.waits = append(c.waits, d)
+		c.now = c.now.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- c.now
+		return ch
+	}
+}
+
+func TestBurstPacing(t *testing.T) {
+	t.Run("burst admission", func(t *testing.T) {
+		bucket := newTokenBucket(1, 3)
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		clock.install(bucket)
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, bucket.wait(context.Background()))
+		}
+		require.Empty(t, clock.waits, "the burst should pass immediately")
+
+		require.NoError(t, bucket.wait(context.Background()))
+		require.Equal(t, []time.Duration{time.Second}, clock.waits)
+
+		// an idle period refills the bucket up to the burst size
+		clock.now = clock.now.Add(time.Hour)
+		require.Equal(t, float64(3), bucket.available())
+	})
+
+	t.Run("sustained rate", func(t *testing.T) {
+		bucket := newTokenBucket(120.0/60, 5)
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		clock.install(bucket)
+		start := clock.now
+
+		for i := 0; i < 205; i++ {
+			require.NoError(t, bucket.wait(context.Background()))
+		}
+		// the 5 requests of the burst are free, the remaining 200 are sent at 2 per second
+		require.InDelta(t, 100*time.Second, clock.now.Sub(start), float64(time.Millisecond))
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		bucket := newTokenBucket(1, 1)
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		clock.install(bucket)
+		bucket.after = func(time.Duration) <-chan time.Time { return nil }
+
+		require.NoError(t, bucket.wait(context.Background()))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, bucket.wait(ctx), context.Canceled)
+		require.Equal(t, float64(0), bucket.available(), "the cancelled request should hand its token back")
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		transport := NewStealthTransport(WithBurstPacing(60, 2))
+		c := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			resp, err := c.Get(server.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		tokens, ok := transport.PacingTokens()
+		require.True(t, ok)
+		require.Less(t, tokens, 0.5)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		_, err = c.Do(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("conflicts with delay", func(t *testing.T) {
+		transport := NewStealthTransport(WithDelay(time.Millisecond, 2*time.Millisecond), WithBurstPacing(60, 2))
+		req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(req)
+		require.ErrorIs(t, err, ErrPacingConflict)
+	})
+}
+
+func TestHTTP2(t *testing.T) {
+	// the server answers HTTP/2 requests only
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	newTransport := func(opts ...StealthOption) *StealthTransport {
+		transport := NewStealthTransport(opts...)
+		tlsConfig := transport.Transport.(*http.Transport).TLSClientConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+			transport.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+		}
+		tlsConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		return transport
+	}
+	get := func(t *testing.T, transport *StealthTransport) *http.Response {
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		resp := get(t, newTransport(WithHTTP2(true)))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "HTTP/2.0", resp.Proto)
+		require.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		resp := get(t, newTransport(WithHTTP2(false)))
+		require.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode)
+		require.Equal(t, "HTTP/1.1", resp.Proto)
+	})
+
+	t.Run("with SOCKS5", func(t *testing.T) {
+		var dials atomic.Int32
+		socksServer, err := socks5.New(&socks5.Config{
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				return net.Dial(network, addr)
+			},
+		})
+		require.NoError(t, err)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go socksServer.Serve(listener)
+
+		resp := get(t, newTransport(WithHTTP2(true), WithSocks5(listener.Addr().String(), nil)))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+		require.Equal(t, int32(1), dials.Load(), "the connection should be dialed through the SOCKS5 server")
+	})
+}
+
+func TestSocks5Pool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// newSocksServers starts SOCKS5 servers counting the connections dialed through them
+	newSocksServers := func(t *testing.T, n int) ([]string, []*atomic.Int32) {
+		addrs := make([]string, n)
+		dials := make([]*atomic.Int32, n)
+		for i := range addrs {
+			count := &atomic.Int32{}
+			socksServer, err := socks5.New(&socks5.Config{
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					count.Add(1)
+					return net.Dial(network, addr)
+				},
+			})
+			require.NoError(t, err)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { listener.Close() })
+			go socksServer.Serve(listener)
+			addrs[i], dials[i] = listener.Addr().String(), count
+		}
+		return addrs, dials
+	}
+	send := func(t *testing.T, transport *StealthTransport, n int) {
+		c := &http.Client{Transport: transport}
+		for i := 0; i < n; i++ {
+			resp, err := c.Get(server.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		addrs, dials := newSocksServers(t, 3)
+		send(t, NewStealthTransport(WithSocks5Pool(addrs, nil, RoundRobin)), 6)
+		// every proxy has a transport of its own that keeps its connection alive
+		for i, count := range dials {
+			require.Equal(t, int32(1), count.Load(), addrs[i])
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		addrs, dials := newSocksServers(t, 3)
+		send(t, NewStealthTransport(WithSocks5Pool(addrs, []*goProxy.Auth{nil, nil, nil}, Random)), 50)
+
+		used := 0
+		for _, count := range dials {
+			if count.Load() > 0 {
+				used++
+			}
+		}
+		require.Greater(t, used, 1, "requests should be spread across the pool")
+	})
+
+	t.Run("lazy initialization", func(t *testing.T) {
+		addrs, dials := newSocksServers(t, 1)
+		transport := NewStealthTransport(WithSocks5Pool(append(addrs, "127.0.0.1:1"), nil, RoundRobin))
+		send(t, transport, 1)
+		require.Equal(t, int32(1), dials[0].Load())
+		require.Nil(t, transport.pool.slots[1].transport, "the second proxy was not used yet")
+	})
+}
+
+func TestCookieJar(t *testing.T) {
+	var sessions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil {
+			sessions = append(sessions, "")
+		} else {
+			sessions = append(sessions, cookie.Value)
+		}
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		}
+	}))
+	defer server.Close()
+
+	transport := NewStealthTransport(WithCookieJar(NewCookieJar()))
+	send := func(path string, cookies ...*http.Cookie) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	send("/login")
+	send("/page")
+	send("/page", &http.Cookie{Name: "session", Value: "explicit"})
+	require.Equal(t, []string{"", "abc", "explicit"}, sessions)
+}
+
+func TestAcceptLanguages(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Header.Get("Accept-Language")] = true
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	transport := NewStealthTransport(WithAcceptLanguages("en-US,en;q=0.9", "fr-FR,fr;q=0.9"))
+	for i := 0; i < 50; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	require.Equal(t, map[string]bool{"en-US,en;q=0.9": true, "fr-FR,fr;q=0.9": true}, seen)
+}
+
+func TestHeaderOrderShuffle(t *testing.T) {
+	// headerOrders sends requests through the transport to a raw server and returns the header names in wire order
+	headerOrders := func(t *testing.T, transport http.RoundTripper, requests int) []string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		orders := make(chan string, requests)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				var names []string
+				if _, err := reader.ReadString('\n'); err != nil {
+					return
+				}
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+					name, _, _ := strings.Cut(line, ":")
+					names = append(names, name)
+				}
+				orders <- strings.Join(names, ",")
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			}
+		}()
+
+		var result []string
+		for i := 0; i < requests; i++ {
+			req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String(), nil)
+			require.NoError(t, err)
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			result = append(result, <-orders)
+		}
+		return result
+	}
+	distinct := func(orders []string) int {
+		set := map[string]bool{}
+		for _, order := range orders {
+			set[order] = true
+		}
+		return len(set)
+	}
+
+	t.Run("shuffled", func(t *testing.T) {
+		orders := headerOrders(t, NewStealthTransport(WithHeaderOrderShuffle(true)), 10)
+		require.Greater(t, distinct(orders), 1)
+	})
+
+	t.Run("not shuffled", func(t *testing.T) {
+		orders := headerOrders(t, NewStealthTransport(), 10)
+		require.Equal(t, 1, distinct(orders))
+	})
+
+	t.Run("bodies on a kept alive connection", func(t *testing.T) {
+		var connections atomic.Int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		}))
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections.Add(1)
+			}
+		}
+		server.Start()
+		defer server.Close()
+
+		transport := NewStealthTransport(WithHeaderOrderShuffle(true))
+		for _, body := range []string{"sized body", "chunked body", "", "another sized body"} {
+			var reader io.Reader = strings.NewReader(body)
+			if body == "chunked body" {
+				// an unknown length is sent chunked
+				reader = io.MultiReader(reader)
+			}
+			req, err := http.NewRequest(http.MethodPost, server.URL, reader)
+			require.NoError(t, err)
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, body, string(got))
+		}
+		require.Equal(t, int32(1), connections.Load())
+	})
+
+	t.Run("HTTPS", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		defer server.Close()
+
+		transport := NewStealthTransport(WithHeaderOrderShuffle(true))
+		transport.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "HTTP/1.1", string(got))
+	})
+}
+
+func TestPerDomainDelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	// both hosts reach the same server, but are different domains to the transport
+	domainA := "http://127.0.0.1:" + port
+	domainB := "http://localhost:" + port
+
+	const delay = 500 * time.Millisecond
+	// sendConcurrently sends a request to each url at once and returns how long each took
+	sendConcurrently := func(t *testing.T, transport *StealthTransport, urls ...string) []time.Duration {
+		durations := make([]time.Duration, len(urls))
+		var wg sync.WaitGroup
+		for i, url := range urls {
+			wg.Add(1)
+			go func(i int, url string) {
+				defer wg.Done()
+				start := time.Now()
+				req, err := http.NewRequest(http.MethodGet, url, nil)
+				require.NoError(t, err)
+				resp, err := transport.RoundTrip(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				durations[i] = time.Since(start)
+			}(i, url)
+		}
+		wg.Wait()
+		return durations
+	}
+
+	t.Run("different domains do not delay each other", func(t *testing.T) {
+		transport := NewStealthTransport(WithPerDomainDelay(delay, delay))
+		for _, duration := range sendConcurrently(t, transport, domainA, domainB) {
+			require.Less(t, duration, delay/2)
+		}
+		// the second request to each domain waits for its own delay only
+		start := time.Now()
+		durations := sendConcurrently(t, transport, domainA, domainB)
+		for _, duration := range durations {
+			require.Less(t, duration, delay+delay/2)
+		}
+		require.Less(t, time.Since(start), 2*delay)
+	})
+
+	t.Run("requests to the same domain are spaced", func(t *testing.T) {
+		transport := NewStealthTransport(WithPerDomainDelay(delay, delay))
+		durations := sendConcurrently(t, transport, domainA, domainA)
+		slices.Sort(durations)
+		require.Less(t, durations[0], delay/2)
+		require.GreaterOrEqual(t, durations[1], delay-50*time.Millisecond)
+	})
+
+	t.Run("waiting gives up with the context", func(t *testing.T) {
+		transport := NewStealthTransport(WithPerDomainDelay(delay, delay))
+		sendConcurrently(t, transport, domainA)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, domainA, nil)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestHostStateLimits(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer releaseOnce.Do(func() { close(release) })
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	// the hosts are different to the transport, but all of them are dialed at the server
+	host := func(i int) string { return fmt.Sprintf("http://127.0.0.%d:%s", i, port) }
+	newTransport := func(opts ...StealthOption) *StealthTransport {
+		transport := NewStealthTransport(opts...)
+		transport.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+		}
+		return transport
+	}
+	send := func(t *testing.T, transport *StealthTransport, url string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	t.Run("least recently used hosts are evicted", func(t *testing.T) {
+		transport := newTransport(WithDomainRateLimitQueue(1), WithPerDomainDelay(0, 0), WithHostStateLimits(2, 0))
+		for i := 1; i <= 3; i++ {
+			send(t, transport, host(i))
+		}
+		send(t, transport, host(2))
+		send(t, transport, host(4))
+
+		stats := transport.MapStats()
+		require.Equal(t, MapStats{Entries: 2, MaxEntries: 2, Evictions: 2}, stats["rateLimitQueues"])
+		require.Equal(t, MapStats{Entries: 2, MaxEntries: 2, Evictions: 2}, stats["domainDelays"])
+		// host 2 was used more recently than host 3
+		_, ok := transport.queues.Get(fmt.Sprintf("127.0.0.2:%s", port))
+		require.True(t, ok)
+		_, ok = transport.queues.Get(fmt.Sprintf("127.0.0.3:%s", port))
+		require.False(t, ok)
+	})
+
+	t.Run("hosts expire after the ttl", func(t *testing.T) {
+		transport := newTransport(WithHostStateLimits(0, time.Minute), WithDomainRateLimitQueue(1))
+		now := time.Now()
+		transport.queues.Now = func() time.Time { return now }
+		send(t, transport, host(1))
+		now = now.Add(30 * time.Second)
+		send(t, transport, host(2))
+		require.Equal(t, MapStats{Entries: 2}, transport.MapStats()["rateLimitQueues"])
+
+		now = now.Add(45 * time.Second)
+		require.Equal(t, MapStats{Entries: 1, Evictions: 1}, transport.MapStats()["rateLimitQueues"])
+		now = now.Add(time.Minute)
+		require.Equal(t, MapStats{Entries: 0, Evictions: 2}, transport.MapStats()["rateLimitQueues"])
+	})
+
+	t.Run("hosts with requests in flight are pinned", func(t *testing.T) {
+		transport := newTransport(WithDomainRateLimitQueue(1), WithHostStateLimits(1, 0))
+		done := make(chan error, 1)
+		go func() {
+			req, err := http.NewRequest(http.MethodGet, host(1)+"/slow", nil)
+			if err == nil {
+				var resp *http.Response
+				if resp, err = transport.RoundTrip(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+			done <- err
+		}()
+		// the upstream holds the request until it is released, so it is in flight from here on
+		select {
+		case <-arrived:
+		case err := <-done:
+			t.Fatalf("request ended before reaching the upstream: %v", err)
+		}
+		slowHost := fmt.Sprintf("127.0.0.1:%s", port)
+		queue, ok := transport.queues.Get(slowHost)
+		require.True(t, ok)
+
+		// the other hosts exceed the limit, but do not replace the queue of the request in flight
+		send(t, transport, host(2))
+		send(t, transport, host(3))
+		pinned, ok := transport.queues.Get(slowHost)
+		require.True(t, ok)
+		require.Same(t, queue, pinned)
+
+		// once released, the limit applies again
+		releaseOnce.Do(func() { close(release) })
+		require.NoError(t, <-done)
+		require.Equal(t, 1, transport.MapStats()["rateLimitQueues"].Entries)
+	})
+}
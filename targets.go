@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"maps"
+	"slices"
+	"sort"
+)
+
+// Targets returns copies of the registered targets sorted by prefix, with their prefix as it is stored
+// Changing the copies does not affect the proxy, use AddTarget and RemoveTarget for that.
+func (p *Proxy) Targets() []Target {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	targets := make([]Target, 0, len(p.targets))
+	for _, target := range p.targets {
+		targets = append(targets, target.clone())
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].route() < targets[j].route() })
+	return targets
+}
+
+// Target returns a copy of the target with the given prefix, for targets with a Host its Host followed by its prefix
+func (p *Proxy) Target(prefix string) (Target, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	target, ok := p.targets[p.routeKey(prefix)]
+	if !ok {
+		return Target{}, false
+	}
+	return target.clone(), true
+}
+
+// clone returns a copy of the target that shares no slices, maps or configuration structs with it
+// functions and the client certificate are shared, they are not modified by the proxy
+func (t Target) clone() Target {
+	t.AddQueryParams = maps.Clone(t.AddQueryParams)
+	t.StripQueryParams = slices.Clone(t.StripQueryParams)
+	t.RemoveRequestHeaders = slices.Clone(t.RemoveRequestHeaders)
+	t.AddRequestHeaders = maps.Clone(t.AddRequestHeaders)
+	t.StripSetCookiePaths = slices.Clone(t.StripSetCookiePaths)
+	t.LazyLoadAttributes = slices.Clone(t.LazyLoadAttributes)
+	t.RewriteRules = slices.Clone(t.RewriteRules)
+	t.RemoveResponseHeaders = slices.Clone(t.RemoveResponseHeaders)
+	t.AddResponseHeaders = maps.Clone(t.AddResponseHeaders)
+	t.ResponseHeaderRules = slices.Clone(t.ResponseHeaderRules)
+	t.exclusionPatterns = slices.Clone(t.exclusionPatterns)
+	t.redactionPatterns = slices.Clone(t.redactionPatterns)
+	t.preHooks = slices.Clone(t.preHooks)
+	t.postHooks = slices.Clone(t.postHooks)
+	t.Middleware = slices.Clone(t.Middleware)
+	t.FanOut = slices.Clone(t.FanOut)
+	for i, destination := range t.FanOut {
+		t.FanOut[i].RemoveRequestHeaders = slices.Clone(destination.RemoveRequestHeaders)
+		t.FanOut[i].AddRequestHeaders = maps.Clone(destination.AddRequestHeaders)
+	}
+	t.Redactions = slices.Clone(t.Redactions)
+	for i, rule := range t.Redactions {
+		t.Redactions[i].ContentTypes = slices.Clone(rule.ContentTypes)
+		t.Redactions[i].JSONPaths = slices.Clone(rule.JSONPaths)
+		t.Redactions[i].Patterns = slices.Clone(rule.Patterns)
+	}
+	if t.InlineAssets != nil {
+		inlineAssets := *t.InlineAssets
+		t.InlineAssets = &inlineAssets
+	}
+	if t.LoginCompat != nil {
+		loginCompat := LoginCompat{Paths: slices.Clone(t.LoginCompat.Paths)}
+		t.LoginCompat = &loginCompat
+	}
+	if t.RewriteExclusions != nil {
+		exclusions := RewriteExclusions{
+			Patterns:   slices.Clone(t.RewriteExclusions.Patterns),
+			Selectors:  slices.Clone(t.RewriteExclusions.Selectors),
+			NoReferrer: t.RewriteExclusions.NoReferrer,
+		}
+		t.RewriteExclusions = &exclusions
+	}
+	if t.FollowRedirects != nil {
+		followRedirects := *t.FollowRedirects
+		t.FollowRedirects = &followRedirects
+	}
+	if t.OpenAPI != nil {
+		openAPI := OpenAPI{SpecPaths: slices.Clone(t.OpenAPI.SpecPaths)}
+		t.OpenAPI = &openAPI
+	}
+	return t
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errTargetTimeout is the cause of the cancellation of upstream requests which exceed Target.Timeout
+var errTargetTimeout = errors.New("target timeout exceeded")
+
+// ServerTimeouts are the timeouts of the connections of clients, see WithTimeouts
+// A zero value uses the default of the field, a negative one disables the timeout.
+type ServerTimeouts struct {
+	// ReadHeaderTimeout limits reading the request headers, so slow-loris clients are disconnected, defaults to 10 seconds
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout limits reading the whole request including its body, defaults to 1 minute
+	ReadTimeout time.Duration
+	// WriteTimeout limits forwarding a request and writing its response headers and rewritten bodies, defaults to 2 minutes.
+	// It is a deadline of each request instead of the server, so bodies passed through as they are, event streams
+	// and the targets with Target.DisableWriteTimeout are not cut off.
+	WriteTimeout time.Duration
+	// IdleTimeout limits how long a keep-alive connection waits for the next request, defaults to 2 minutes
+	IdleTimeout time.Duration
+}
+
+// defaultServerTimeouts are used for the fields of ServerTimeouts which are not set
+var defaultServerTimeouts = ServerTimeouts{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       time.Minute,
+	WriteTimeout:      2 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+}
+
+// WithTimeouts sets the timeouts of the connections of clients, the fields which are not set keep their defaults
+func WithTimeouts(timeouts ServerTimeouts) ProxyOption {
+	return func(p *Proxy) { p.timeouts = timeouts }
+}
+
+// withDefaults returns the timeouts with the defaults for the fields which are not set, disabled ones are 0
+func (t ServerTimeouts) withDefaults() ServerTimeouts {
+	resolve := func(timeout, fallback time.Duration) time.Duration {
+		switch {
+		case timeout < 0:
+			return 0
+		case timeout == 0:
+			return fallback
+		}
+		return timeout
+	}
+	return ServerTimeouts{
+		ReadHeaderTimeout: resolve(t.ReadHeaderTimeout, defaultServerTimeouts.ReadHeaderTimeout),
+		ReadTimeout:       resolve(t.ReadTimeout, defaultServerTimeouts.ReadTimeout),
+		WriteTimeout:      resolve(t.WriteTimeout, defaultServerTimeouts.WriteTimeout),
+		IdleTimeout:       resolve(t.IdleTimeout, defaultServerTimeouts.IdleTimeout),
+	}
+}
+
+// setWriteDeadline applies the WriteTimeout to the response of a request to the target
+// writers which do not support deadlines, e.g. of ServeHTTP in tests, are left alone
+func (p *Proxy) setWriteDeadline(w http.ResponseWriter, target *Target) {
+	timeout := p.timeouts.withDefaults().WriteTimeout
+	if timeout == 0 || target.DisableWriteTimeout {
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// clearWriteDeadline lifts the WriteTimeout for a response that is streamed as long as it lasts
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// liftWriteDeadline sends the response headers under the WriteTimeout and lifts it for the body,
+// which is passed through as long as the upstream takes
+func (p *Proxy) liftWriteDeadline(w http.ResponseWriter, target Target) error {
+	if p.timeouts.withDefaults().WriteTimeout == 0 || target.DisableWriteTimeout {
+		return nil
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	clearWriteDeadline(w)
+	return nil
+}
+
+// withTimeout returns a copy of the upstream request that is cancelled after Target.Timeout,
+// unless the returned function is called before, e.g. once the response turns out to be streamed
+func (t Target) withTimeout(req *http.Request) (*http.Request, func()) {
+	if t.Timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.Timeout, func() { cancel(errTargetTimeout) })
+	return req.WithContext(ctx), func() { timer.Stop() }
+}
+
+// timedOut reports whether the upstream request was cancelled because it exceeded Target.Timeout
+func timedOut(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), errTargetTimeout)
+}
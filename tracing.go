@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/FrauElster/proxy"
+
+// WithTracing creates a span for every proxied request using the given tracer provider
+// The span continues the trace of the incoming W3C traceparent/tracestate headers and is propagated to the upstream
+func WithTracing(tp trace.TracerProvider) ProxyOption {
+	return func(p *Proxy) { p.tracer = tp.Tracer(tracerName) }
+}
+
+var tracePropagator = propagation.TraceContext{}
+
+// startSpan starts the span of an incoming request
+// it returns the request to continue with and a function ending the span once the response is written
+func (p *Proxy) startSpan(target *Target, recorder *statusRecorder, r *http.Request) (*http.Request, func()) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := p.tracer.Start(ctx, "proxy "+target.Prefix,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			attribute.String("proxy.target", target.Prefix),
+		),
+	)
+	return r.WithContext(ctx), func() {
+		span.SetAttributes(semconv.HTTPStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		span.End()
+	}
+}
+
+// injectSpan adds the upstream request to the span of the context and propagates it to the upstream
+func (p *Proxy) injectSpan(ctx context.Context, upstreamReq *http.Request) {
+	if p.tracer == nil {
+		return
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.HTTPURL(upstreamReq.URL.String()),
+		semconv.NetPeerName(upstreamReq.URL.Hostname()),
+	)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(upstreamReq.Header))
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// JoinURL joins the given URL parts with exactly one slash between each of them
+// leading and trailing slashes of the first and last part are kept, e.g. JoinURL("/a/", "/b/") is "/a/b/"
+func JoinURL(elements ...string) string {
+	parts := make([]string, 0, len(elements))
+	for idx, element := range elements {
+		if idx > 0 {
+			element = strings.TrimPrefix(element, "/")
+		}
+		if idx < len(elements)-1 {
+			element = strings.TrimSuffix(element, "/")
+		}
+		// empty parts in between, e.g. the prefix "/", would add a second slash
+		if element == "" && idx > 0 && idx < len(elements)-1 {
+			continue
+		}
+		parts = append(parts, element)
+	}
+	return strings.Join(parts, "/")
+}
+
+// TargetMatches reports whether the URL, as found in a response of the target, points at the target.
+// That is the case for root relative paths ("/x") and for absolute and protocol relative URLs ("//host/x")
+// on the host of the target's BaseUrl. Relative paths ("x") and other hosts do not match.
+func TargetMatches(target Target, rawURL string) bool {
+	_, ok := originPath(target, rawURL)
+	return ok
+}
+
+// ToProxyURL translates a URL of the target to the URL it is reachable at through the proxy at publicBase
+// The prefix of the target replaces the root of the target host, query and fragment are kept.
+// It returns an error if the URL does not match the target, see TargetMatches.
+func ToProxyURL(target Target, publicBase, rawURL string) (string, error) {
+	path, ok := originPath(target, rawURL)
+	if !ok {
+		return "", fmt.Errorf("%s does not point at target %s", rawURL, target.Prefix)
+	}
+	proxyUrl, err := url.Parse(publicBase)
+	if err != nil {
+		return "", fmt.Errorf("error parsing public base URL: %w", err)
+	}
+
+	setEscapedPath(proxyUrl, JoinURL(proxyUrl.EscapedPath(), target.Prefix, path.EscapedPath()))
+	proxyUrl.RawQuery = path.RawQuery
+	proxyUrl.Fragment = path.Fragment
+	return proxyUrl.String(), nil
+}
+
+// ToOriginURL translates a URL of the proxy back to the URL of the target it is forwarded to
+// proxyURL is either absolute or a path, its path has to start with the prefix of the target.
+func ToOriginURL(target Target, proxyURL string) (string, error) {
+	proxyUrl, err := url.Parse(proxyURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing proxy URL: %w", err)
+	}
+	prefix := strings.TrimSuffix(target.Prefix, "/")
+	if proxyUrl.Path != prefix && !strings.HasPrefix(proxyUrl.Path, prefix+"/") {
+		return "", fmt.Errorf("%s is not below target prefix %s", proxyURL, target.Prefix)
+	}
+	originUrl, err := url.Parse(target.BaseUrl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing target URL: %w", err)
+	}
+
+	setEscapedPath(originUrl, "/"+strings.TrimPrefix(strings.TrimPrefix(proxyUrl.EscapedPath(), prefix), "/"))
+	originUrl.RawQuery = proxyUrl.RawQuery
+	originUrl.Fragment = proxyUrl.Fragment
+	return originUrl.String(), nil
+}
+
+// originPath returns the path, query and fragment of a URL pointing at the target
+func originPath(target Target, rawURL string) (*url.URL, bool) {
+	isRootRelative := strings.HasPrefix(rawURL, "/") && !strings.HasPrefix(rawURL, "//")
+	isAbsolute := !isRootRelative && (strings.HasPrefix(rawURL, "//") || strings.Contains(rawURL, "://"))
+	if !isRootRelative && !isAbsolute {
+		return nil, false
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, false
+	}
+	if isAbsolute {
+		targetUrl, err := url.Parse(target.BaseUrl)
+		if err != nil || !strings.EqualFold(u.Host, targetUrl.Host) {
+			return nil, false
+		}
+		// protocol relative URLs take the scheme of the page they are found on
+		if u.Scheme != "" && !strings.EqualFold(u.Scheme, targetUrl.Scheme) {
+			return nil, false
+		}
+	}
+	return &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery, Fragment: u.Fragment}, true
+}
+
+// setEscapedPath sets the path of u from its escaped form, so escaped slashes and the like are kept
+func setEscapedPath(u *url.URL, escapedPath string) {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		u.Path, u.RawPath = escapedPath, ""
+		return
+	}
+	u.Path, u.RawPath = path, escapedPath
+}
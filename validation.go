@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ValidationError describes a single invalid configuration value
+// Several ValidationErrors are combined with errors.Join, use ValidationErrors to get all of them
+type ValidationError struct {
+	// Field is the name of the invalid field, e.g. "Target.BaseUrl"
+	Field string `json:"field"`
+	// Value is the rejected value
+	Value string `json:"value"`
+	// Rule is a short machine-readable name of the violated rule, e.g. "url"
+	Rule string `json:"rule"`
+	// Message is a human-readable description of the violation
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Message)
+}
+
+// ValidationErrors returns all ValidationErrors contained in err, including joined and wrapped ones
+func ValidationErrors(err error) []*ValidationError {
+	if err == nil {
+		return nil
+	}
+
+	if validationErr, ok := err.(*ValidationError); ok {
+		return []*ValidationError{validationErr}
+	}
+
+	result := make([]*ValidationError, 0)
+	switch unwrapped := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, e := range unwrapped.Unwrap() {
+			result = append(result, ValidationErrors(e)...)
+		}
+	case interface{ Unwrap() error }:
+		result = append(result, ValidationErrors(unwrapped.Unwrap())...)
+	}
+	return result
+}
+
+// validateProxy checks the options of a proxy
+func validateProxy(p *Proxy) error {
+	errs := make([]error, 0)
+	if p.gzipLevel < gzip.HuffmanOnly || p.gzipLevel > gzip.BestCompression {
+		errs = append(errs, &ValidationError{
+			Field:   "GzipLevel",
+			Value:   strconv.Itoa(p.gzipLevel),
+			Rule:    "range",
+			Message: fmt.Sprintf("must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression),
+		})
+	}
+	if p.maxResponseHeaders < 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "MaxResponseHeaders",
+			Value:   strconv.Itoa(p.maxResponseHeaders),
+			Rule:    "min",
+			Message: "must not be negative",
+		})
+	}
+	if p.streamingMinSize < 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "StreamingResponse",
+			Value:   strconv.FormatInt(p.streamingMinSize, 10),
+			Rule:    "min",
+			Message: "must not be negative",
+		})
+	}
+	if p.gracePeriod < 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "GracePeriod",
+			Value:   p.gracePeriod.String(),
+			Rule:    "min",
+			Message: "must not be negative",
+		})
+	}
+	if !p.dialPolicy.valid() {
+		errs = append(errs, &ValidationError{
+			Field:   "DialPolicy",
+			Value:   string(p.dialPolicy),
+			Rule:    "oneof",
+			Message: "must be one of ipv4-only, ipv6-only and prefer-ipv4 or empty",
+		})
+	}
+	if p.infoEndpoint && p.adminToken == "" {
+		errs = append(errs, &ValidationError{
+			Field:   "InfoEndpoint",
+			Value:   p.adminToken,
+			Rule:    "required",
+			Message: "the admin token must not be empty",
+		})
+	}
+	if p.publicUrl != "" {
+		if u, err := url.Parse(p.publicUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, &ValidationError{
+				Field:   "PublicURL",
+				Value:   p.publicUrl,
+				Rule:    "url",
+				Message: "must be an absolute http or https URL",
+			})
+		} else if u.Port() == "0" {
+			errs = append(errs, &ValidationError{
+				Field:   "PublicURL",
+				Value:   p.publicUrl,
+				Rule:    "port",
+				Message: "must not use port 0, the port the OS chooses is not known when the URL is set, leave the public URL unset to use it",
+			})
+		}
+	}
+	for _, cidr := range p.trustedProxyCidrs {
+		if _, err := parseTrustedProxy(cidr); err != nil {
+			errs = append(errs, &ValidationError{
+				Field:   "TrustedProxies",
+				Value:   cidr,
+				Rule:    "cidr",
+				Message: "must be a CIDR or an IP address",
+			})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateTarget checks a target before it is added to a proxy
+func validateTarget(target Target) error {
+	errs := make([]error, 0)
+	if u, err := url.Parse(target.BaseUrl); len(target.FanOut) == 0 && (err != nil || u.Scheme == "" || u.Host == "") {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.BaseUrl",
+			Value:   target.BaseUrl,
+			Rule:    "url",
+			Message: "must be an absolute URL with scheme and host",
+		})
+	}
+	if strings.TrimSpace(target.Prefix) == "" {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.Prefix",
+			Value:   target.Prefix,
+			Rule:    "required",
+			Message: "must not be empty",
+		})
+	} else if strings.IndexFunc(target.Prefix, unicode.IsSpace) >= 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.Prefix",
+			Value:   target.Prefix,
+			Rule:    "prefix",
+			Message: "must not contain whitespace",
+		})
+	}
+	if target.Host != "" && !isValidHostPattern(target.Host) {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.Host",
+			Value:   target.Host,
+			Rule:    "hostname",
+			Message: `must be a hostname without port, optionally starting with "*."`,
+		})
+	}
+	if target.Default && target.Host != "" {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.Default",
+			Value:   target.route(),
+			Rule:    "excluded_with",
+			Message: "a target with Host cannot be the default",
+		})
+	}
+	if target.FollowRedirects != nil && target.FollowRedirects.MaxHops < 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.FollowRedirects.MaxHops",
+			Value:   strconv.Itoa(target.FollowRedirects.MaxHops),
+			Rule:    "min",
+			Message: "must not be negative",
+		})
+	}
+	if target.FollowRedirects != nil && target.RewriteRedirects {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.FollowRedirects",
+			Value:   target.route(),
+			Rule:    "excluded_with",
+			Message: "a target cannot follow redirects and pass them on with RewriteRedirects",
+		})
+	}
+	if _, ok := headerProfiles[target.HeaderProfile]; target.HeaderProfile != "" && !ok {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.HeaderProfile",
+			Value:   target.HeaderProfile,
+			Rule:    "oneof",
+			Message: "must be the name of a built-in header profile",
+		})
+	}
+	if !target.DialPolicy.valid() {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.DialPolicy",
+			Value:   string(target.DialPolicy),
+			Rule:    "oneof",
+			Message: "must be one of ipv4-only, ipv6-only and prefer-ipv4 or empty",
+		})
+	}
+	if target.Timeout < 0 {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.Timeout",
+			Value:   target.Timeout.String(),
+			Rule:    "min",
+			Message: "must not be negative",
+		})
+	}
+	errs = append(errs, validateFanOut(target)...)
+	if target.RewriteExclusions != nil {
+		for _, pattern := range target.RewriteExclusions.Patterns {
+			if _, err := compilePattern(pattern); err != nil {
+				errs = append(errs, &ValidationError{
+					Field:   "Target.RewriteExclusions.Patterns",
+					Value:   pattern,
+					Rule:    "pattern",
+					Message: "must be a glob or a valid regular expression",
+				})
+			}
+		}
+	}
+	for _, rule := range target.Redactions {
+		for _, pattern := range rule.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, &ValidationError{
+					Field:   "Target.Redactions.Patterns",
+					Value:   pattern,
+					Rule:    "pattern",
+					Message: "must be a valid regular expression",
+				})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateFanOut checks the destinations of a fan-out target
+func validateFanOut(target Target) []error {
+	errs := make([]error, 0)
+	if target.FanOutResponse != "" && target.FanOutResponse != RespondPrimary && target.FanOutResponse != RespondAccepted {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.FanOutResponse",
+			Value:   string(target.FanOutResponse),
+			Rule:    "oneof",
+			Message: "must be one of primary and accepted or empty",
+		})
+	}
+	primaries := 0
+	for _, destination := range target.FanOut {
+		if u, err := url.Parse(destination.BaseUrl); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, &ValidationError{
+				Field:   "Target.FanOut.BaseUrl",
+				Value:   destination.BaseUrl,
+				Rule:    "url",
+				Message: "must be an absolute URL with scheme and host",
+			})
+		}
+		if destination.Policy != "" && destination.Policy != BestEffort && destination.Policy != MustSucceed {
+			errs = append(errs, &ValidationError{
+				Field:   "Target.FanOut.Policy",
+				Value:   string(destination.Policy),
+				Rule:    "oneof",
+				Message: "must be one of best-effort and must-succeed or empty",
+			})
+		}
+		if destination.Timeout < 0 {
+			errs = append(errs, &ValidationError{
+				Field:   "Target.FanOut.Timeout",
+				Value:   destination.Timeout.String(),
+				Rule:    "min",
+				Message: "must not be negative",
+			})
+		}
+		if destination.Retries < 0 {
+			errs = append(errs, &ValidationError{
+				Field:   "Target.FanOut.Retries",
+				Value:   strconv.Itoa(destination.Retries),
+				Rule:    "min",
+				Message: "must not be negative",
+			})
+		}
+		if destination.Primary {
+			primaries++
+		}
+	}
+	if primaries > 1 {
+		errs = append(errs, &ValidationError{
+			Field:   "Target.FanOut.Primary",
+			Value:   target.route(),
+			Rule:    "unique",
+			Message: "only one destination can be the primary one",
+		})
+	}
+	return errs
+}
+
+// validateBuiltinRoutes rejects targets whose prefix is the path of /readyz or the info endpoint,
+// the mux would panic on the second registration of the path
+func (p *Proxy) validateBuiltinRoutes(target Target) error {
+	if target.Host != "" {
+		return nil
+	}
+	path := strings.TrimSuffix(target.Prefix, "/")
+	if (p.readyzTimeout > 0 && path == "/readyz") || (p.infoEndpoint && path == infoPath) {
+		return &ValidationError{
+			Field:   "Target.Prefix",
+			Value:   target.Prefix,
+			Rule:    "excluded_with",
+			Message: fmt.Sprintf("%s is served by the proxy itself", path),
+		}
+	}
+	return nil
+}
+
+// validateRoute checks that the target can be registered next to the given targets
+// every route is unique, there is only one default target and it conflicts with a target at the prefix "/",
+// which catches everything as well
+func validateRoute(targets map[string]Target, target Target) error {
+	if _, ok := targets[target.route()]; ok {
+		return &ValidationError{
+			Field:   "Target.Prefix",
+			Value:   target.route(),
+			Rule:    "unique",
+			Message: "another target is registered at the prefix already",
+		}
+	}
+	for _, other := range targets {
+		if other.Host != "" || target.Host != "" {
+			continue
+		}
+		if target.Default && other.Default {
+			return &ValidationError{
+				Field:   "Target.Default",
+				Value:   target.Prefix,
+				Rule:    "unique",
+				Message: fmt.Sprintf("%s is the default target already", other.Prefix),
+			}
+		}
+		if (target.Default && other.Prefix == "/") || (other.Default && target.Prefix == "/") {
+			return &ValidationError{
+				Field:   "Target.Default",
+				Value:   target.Prefix,
+				Rule:    "unique",
+				Message: "a default target conflicts with a target at the prefix /",
+			}
+		}
+	}
+	return nil
+}